@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,12 +10,16 @@ import (
 	"time"
 
 	"github.com/logpulse/backend/internal/api"
+	"github.com/logpulse/backend/internal/clock"
 	"github.com/logpulse/backend/internal/config"
 	"github.com/logpulse/backend/internal/index"
 	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/logging"
 	"github.com/logpulse/backend/internal/plugin"
 	"github.com/logpulse/backend/internal/query"
+	"github.com/logpulse/backend/internal/ratelimiter"
 	"github.com/logpulse/backend/internal/storage"
+	"github.com/logpulse/backend/internal/wal"
 	gootel "go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -24,44 +28,122 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	// Load configuration, then log as it asks
+	const configPath = "configs/config.yaml"
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fatal("Failed to load config", "error", err)
+	}
+	if err := logging.Setup(cfg.Logging.Format, cfg.Logging.Level); err != nil {
+		fatal("Invalid logging config", "error", err)
+	}
+	logger := logging.Component("Server")
+	alertLog := logging.Component("Alerting")
+	storageLog := logging.Component("Storage")
+	indexLog := logging.Component("Index")
+	queryLog := logging.Component("Query")
+
 	// Create root context for graceful shutdown
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 	defer rootCancel()
 
 	// Load alert rules
 	var webhookNotifier *plugin.WebhookNotifier
-	webhookCfgs, err := config.LoadWebhooks("configs/webhooks.yaml")
-	if err == nil && len(webhookCfgs) > 0 {
+	var notifierCfgs []plugin.NotifierConfig
+	webhookSettings, err := config.LoadWebhookSettings("configs/webhooks.yaml")
+	if err != nil {
+		webhookSettings = &config.WebhookSettings{}
+	}
+	for _, n := range webhookSettings.Notifiers {
+		notifierCfgs = append(notifierCfgs, plugin.NotifierConfig{Name: n.Name, Type: n.Type, Settings: n.Settings})
+	}
+	if webhookCfgs := webhookSettings.Webhooks; len(webhookCfgs) > 0 {
 		pluginCfgs := make([]plugin.WebhookConfig, len(webhookCfgs))
 		for i, w := range webhookCfgs {
-			pluginCfgs[i] = plugin.WebhookConfig{URL: w.URL, Events: w.Events}
+			pluginCfgs[i] = plugin.WebhookConfig{URL: w.URL, Events: w.Events, Match: w.Match}
 		}
 		webhookNotifier = plugin.NewWebhookNotifier(pluginCfgs)
-		log.Printf("Loaded %d webhook(s)", len(pluginCfgs))
+		alertLog.Info("Loaded webhooks", "count", len(pluginCfgs))
 	}
 
-	alertRules, _ := config.LoadAlerts("configs/alerts.yaml")
 	alertManager := plugin.NewAlertManager(webhookNotifier)
-	for _, rule := range alertRules {
-		alertManager.AddRule(plugin.AlertRule{
-			Name:      rule.Name,
-			Expr:      rule.Expr,
-			Threshold: rule.Threshold,
-			Window:    5 * time.Minute,
-			Channels:  rule.Channels,
-			Labels:    rule.Labels,
-		})
+	if alertSettings, err := config.LoadAlertSettings("configs/alerts.yaml"); err == nil {
+		if alertSettings.RepeatInterval != "" {
+			if d, err := time.ParseDuration(alertSettings.RepeatInterval); err == nil {
+				alertManager.RepeatInterval = d
+			} else {
+				alertLog.Warn("Invalid alert repeat_interval", "value", alertSettings.RepeatInterval, "error", err)
+			}
+		}
+		for _, n := range alertSettings.Notifiers {
+			notifierCfgs = append(notifierCfgs, plugin.NotifierConfig{Name: n.Name, Type: n.Type, Settings: n.Settings})
+		}
+		if qh := alertSettings.QuietHours; qh != nil {
+			windows := make([]plugin.QuietWindow, len(qh.Windows))
+			for i, w := range qh.Windows {
+				windows[i] = plugin.QuietWindow{Days: w.Days, Start: w.Start, End: w.End}
+			}
+			quiet, err := plugin.NewQuietHours(qh.Timezone, windows, qh.Severities, qh.Exempt)
+			if err != nil {
+				fatal("Invalid alert quiet_hours", "error", err)
+			}
+			alertManager.QuietHours = quiet
+		}
+		for _, rule := range alertSettings.Alerts {
+			var repeat time.Duration
+			if rule.RepeatInterval != "" {
+				if d, err := time.ParseDuration(rule.RepeatInterval); err == nil {
+					repeat = d
+				} else {
+					alertLog.Warn("Invalid repeat_interval", "alert", rule.Name, "value", rule.RepeatInterval, "error", err)
+				}
+			}
+			var pending time.Duration
+			if rule.Duration != "" {
+				if d, err := time.ParseDuration(rule.Duration); err == nil {
+					pending = d
+				} else {
+					alertLog.Warn("Invalid duration", "alert", rule.Name, "value", rule.Duration, "error", err)
+				}
+			}
+			alertManager.AddRule(plugin.AlertRule{
+				Name:           rule.Name,
+				Expr:           rule.Expr,
+				Threshold:      rule.Threshold,
+				Window:         5 * time.Minute,
+				Channels:       rule.Channels,
+				Labels:         rule.Labels,
+				Severity:       rule.Severity,
+				Duration:       pending,
+				Annotations:    rule.Annotations,
+				RepeatInterval: repeat,
+			})
+		}
+	}
+	if err := alertManager.ConfigureNotifiers(notifierCfgs); err != nil {
+		fatal("Failed to configure alert notifiers", "error", err)
+	}
+	if len(notifierCfgs) > 0 {
+		alertLog.Info("Loaded alert notifiers", "count", len(notifierCfgs))
 	}
 
-	// Proper query function for alert evaluation
+	// Proper query function for alert evaluation, bounded by a deadline so a
+	// slow rule cannot overrun the evaluation tick
 	var executor *query.Executor
+	alertQueryTimeout := config.DefaultAlertQueryTimeout
 	queryFunc := func(expr string) (float64, error) {
 		if executor == nil {
 			return 0, nil
 		}
 		endTime := time.Now()
 		startTime := endTime.Add(-5 * time.Minute)
-		result, err := executor.Execute(expr, startTime, endTime, 0)
+		ctx, cancel := context.WithTimeout(rootCtx, alertQueryTimeout)
+		defer cancel()
+		result, err := executor.ExecuteContext(ctx, expr, startTime, endTime, 0, query.ExecuteOptions{})
 		if err != nil {
 			return 0, err
 		}
@@ -71,26 +153,10 @@ func main() {
 		return float64(result.Stats.MatchedLines), nil
 	}
 
-	// Alert evaluation with context cancellation
-	go func() {
-		ticker := time.NewTicker(60 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-rootCtx.Done():
-				log.Println("[AlertEvaluator] Shutting down")
-				return
-			case <-ticker.C:
-				alertManager.EvaluateRules(queryFunc)
-			}
-		}
-	}()
-
 	// --- OpenTelemetry Tracing Setup ---
 	exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
 	if err != nil {
-		log.Fatalf("Failed to create OTel exporter: %v", err)
+		fatal("Failed to create OTel exporter", "error", err)
 	}
 	tp := trace.NewTracerProvider(
 		trace.WithBatcher(exp),
@@ -102,47 +168,316 @@ func main() {
 	gootel.SetTracerProvider(tp)
 	defer func() { _ = tp.Shutdown(context.Background()) }()
 
-	// Load configuration
-	cfg, err := config.Load("configs/config.yaml")
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
+	// Alert evaluation with context cancellation; a config reload can change
+	// the interval
+	alertInterval := make(chan time.Duration)
+	go func() {
+		ticker := time.NewTicker(cfg.Alerting.EvaluationInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-rootCtx.Done():
+				logging.Component("AlertEvaluator").Info("Shutting down")
+				return
+			case d := <-alertInterval:
+				ticker.Reset(d)
+			case <-ticker.C:
+				alertManager.EvaluateRules(queryFunc)
+			}
+		}
+	}()
 
-	log.Printf("Starting LokiLite server on port %s", cfg.Server.Port)
+	logger.Info("Starting LokiLite server", "port", cfg.Server.Port)
+	if cfg.ReadOnly() {
+		logger.Info("Running as a read-only replica", "storage_path", cfg.Storage.Path)
+	}
 
 	// Initialize components
 	labelIndex := index.NewIndex()
-	storageWriter := storage.NewWriter(cfg.Storage.Path, cfg.Storage.ChunkSizeBytes)
-	storageReader := storage.NewReader(cfg.Storage.Path)
+	labelIndex.SetMaxLabelNames(cfg.Index.MaxLabelNames)
+	labelIndex.SetMaxLabelValues(cfg.Index.MaxLabelValuesPerName)
+	var storageWriter *storage.Writer
+	var storageReader *storage.Reader
+	if cfg.Storage.Backend == config.StorageBackendS3 {
+		s3 := cfg.Storage.S3
+		backend, err := storage.NewS3Backend(storage.S3Config{
+			Endpoint:        s3.Endpoint,
+			Region:          s3.Region,
+			Bucket:          s3.Bucket,
+			Prefix:          s3.Prefix,
+			AccessKeyID:     s3.AccessKeyID,
+			SecretAccessKey: s3.SecretAccessKey,
+			Timeout:         s3.Timeout,
+		})
+		if err != nil {
+			fatal("Invalid storage.s3 config", "error", err)
+		}
+		storageLog.Info("Keeping chunks in S3", "bucket", s3.Bucket)
+		storageWriter = storage.NewWriterWithBackend(backend, cfg.Storage.ChunkSizeBytes)
+		storageReader = storage.NewReaderWithBackend(backend)
+	} else {
+		storageWriter = storage.NewWriter(cfg.Storage.Path, cfg.Storage.ChunkSizeBytes)
+		storageReader = storage.NewReader(cfg.Storage.Path)
+	}
+	if cfg.Storage.Encoding != "" {
+		if err := storageWriter.SetEncoding(cfg.Storage.Encoding); err != nil {
+			fatal("Invalid storage config", "error", err)
+		}
+	}
+	storageWriter.SetCompression(cfg.Storage.CompressionEnabled)
+	// Object stores are written at the current schema from the start
+	if cfg.Storage.Backend == config.StorageBackendLocal {
+		schemaVersion := storage.ReadSchemaVersion(cfg.Storage.Path)
+		if !cfg.ReadOnly() {
+			if schemaVersion, err = storage.EnsureSchema(cfg.Storage.Path); err != nil {
+				storageLog.Warn("Failed to record the storage schema version", "error", err)
+			}
+		}
+		if schemaVersion < storage.SchemaVersion {
+			storageLog.Warn("Chunk metadata is at an old schema version; run `server migrate` or POST /admin/migrate to upgrade it",
+				"schema_version", schemaVersion, "current", storage.SchemaVersion)
+		}
+	}
+	storageReader.SetPrefetchBytes(cfg.Query.PrefetchBytes)
+
+	// Rebuild the index from the snapshot and the chunk metadata on disk
+	recovered, err := labelIndex.Recover(cfg.Index.SnapshotPath, storageReader)
+	if err != nil {
+		fatal("Failed to rebuild index", "error", err)
+	}
+	indexLog.Info("Rebuilt index", "duration", recovered.Duration, "chunks", recovered.Chunks,
+		"rescanned", recovered.Rescanned, "streams", recovered.Streams, "from_snapshot", recovered.FromSnapshot)
+	if cfg.ReadOnly() {
+		// The writer owns the snapshot; follow its chunks instead
+		go func() {
+			ticker := time.NewTicker(cfg.Index.RefreshInterval)
+			defer ticker.Stop()
+			last := time.Now()
+			for {
+				select {
+				case <-rootCtx.Done():
+					return
+				case <-ticker.C:
+					started := time.Now()
+					if _, err := labelIndex.Refresh(storageReader, last); err != nil {
+						indexLog.Warn("Refresh failed", "error", err)
+						continue
+					}
+					last = started
+				}
+			}
+		}()
+	} else if cfg.Index.SnapshotPath != "" {
+		go func() {
+			ticker := time.NewTicker(cfg.Index.SnapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-rootCtx.Done():
+					return
+				case <-ticker.C:
+					if err := labelIndex.PersistIndex(cfg.Index.SnapshotPath); err != nil {
+						indexLog.Warn("Periodic snapshot failed", "error", err)
+					}
+				}
+			}
+		}()
+	}
 
 	// Initialize executor for alerts
 	executor = query.NewExecutor(labelIndex, storageReader)
+	alertQueryTimeout = cfg.Alerting.QueryTimeout
+	if wq := cfg.Alerting.WebhookQueue; webhookNotifier != nil && wq.Path != "" {
+		queue, err := plugin.NewWebhookQueue(plugin.WebhookQueueConfig{
+			Path:        wq.Path,
+			MaxSize:     wq.MaxSize,
+			Workers:     wq.Workers,
+			MinBackoff:  wq.MinBackoff,
+			MaxBackoff:  wq.MaxBackoff,
+			MaxAttempts: wq.MaxAttempts,
+		})
+		if err != nil {
+			fatal("Failed to open webhook queue", "error", err)
+		}
+		webhookNotifier.SetQueue(queue)
+		queue.Start(rootCtx)
+	}
+	executor.SetStrictConsistency(cfg.Query.StrictConsistency)
+	if err := executor.SetStreamWarningThreshold(cfg.Query.StreamWarningThreshold); err != nil {
+		fatal("Invalid stream warning threshold", "error", err)
+	}
+	for name, path := range cfg.Query.NamedSets {
+		values, err := query.LoadNamedSetFile(path)
+		if err != nil {
+			fatal("Failed to load named set", "name", name, "path", path, "error", err)
+		}
+		query.SetNamedSet(name, values)
+		queryLog.Info("Loaded named set", "name", name, "values", len(values))
+	}
+	for name, body := range cfg.Query.Macros {
+		if err := query.SetMacro(name, body); err != nil {
+			fatal("Invalid query macro", "error", err)
+		}
+	}
+	if len(cfg.Query.Macros) > 0 {
+		queryLog.Info("Loaded query macros", "count", len(cfg.Query.Macros))
+	}
 
 	// Initialize streaming hub with context
-	streamHub := api.NewStreamHub()
-	go streamHub.Run(rootCtx)
+	streamHub := api.NewStreamHubWithBuffer(cfg.Streaming.BroadcastBufferSize, cfg.Streaming.DropPolicy)
+	streamHub.SetClientBufferSize(cfg.Streaming.ClientBufferSize)
+	if err := streamHub.SetMaxClientOverflows(cfg.Streaming.MaxClientOverflows); err != nil {
+		fatal("Invalid streaming.max_client_overflows", "error", err)
+	}
+	if err := streamHub.SetClientRate(cfg.Streaming.MaxClientRate); err != nil {
+		fatal("Invalid streaming.max_client_rate", "error", err)
+	}
+	if !cfg.ReadOnly() {
+		go streamHub.Run(rootCtx)
+	}
 
 	// Initialize ingestor with stream hub for live broadcasting
 	ingestor := ingest.NewIngestor(labelIndex, storageWriter, cfg.Ingest.BufferSize, streamHub)
+	ingestor.SetChunkRotation(
+		time.Duration(cfg.Ingest.FlushInterval)*time.Millisecond,
+		cfg.Storage.ChunkSizeBytes,
+		cfg.Ingest.MaxChunkAge,
+	)
+	overrides := make([]ingest.ChunkSizeOverride, len(cfg.Storage.ChunkSizeOverrides))
+	for i, o := range cfg.Storage.ChunkSizeOverrides {
+		overrides[i] = ingest.ChunkSizeOverride{Selector: o.Selector, Bytes: o.ChunkSizeBytes}
+	}
+	if err := ingestor.SetChunkSizeOverrides(overrides); err != nil {
+		fatal("Invalid storage config", "error", err)
+	}
+	if err := ingestor.SetMissingTimestamp(cfg.Ingest.MissingTimestamp); err != nil {
+		fatal("Invalid ingest.missing_timestamp", "error", err)
+	}
+	if err := ingestor.SetLateWindow(cfg.Ingest.LateWindow, cfg.Ingest.LateLogs); err != nil {
+		fatal("Invalid ingest.late_window", "error", err)
+	}
+	if err := ingestor.SetMaxLineLength(cfg.Ingest.MaxLineBytes, cfg.Ingest.LongLines); err != nil {
+		fatal("Invalid ingest.max_line_bytes", "error", err)
+	}
+	if err := ingestor.SetStripANSI(cfg.Ingest.StripANSI); err != nil {
+		fatal("Invalid ingest config", "error", err)
+	}
+	if err := ingestor.SetStreamMetricLabels(cfg.Ingest.MetricLabels); err != nil {
+		fatal("Invalid ingest.metric_labels", "error", err)
+	}
+	if err := ingestor.SetBufferHighWater(cfg.Ingest.BufferHighWater); err != nil {
+		fatal("Invalid ingest.buffer_high_water", "error", err)
+	}
+	schemas := make([]ingest.LabelSchema, len(cfg.Ingest.LabelSchemas))
+	for i, s := range cfg.Ingest.LabelSchemas {
+		schemas[i] = ingest.LabelSchema{Selector: s.Selector, Required: s.Required, Allowed: s.Allowed}
+	}
+	if err := ingestor.SetLabelSchemas(schemas, cfg.Ingest.LabelSchemaAction); err != nil {
+		fatal("Invalid ingest.label_schemas", "error", err)
+	}
+	detections := make([]ingest.LevelDetection, len(cfg.Ingest.LevelDetection))
+	for i, d := range cfg.Ingest.LevelDetection {
+		detections[i] = ingest.LevelDetection{Selector: d.Selector}
+		for _, r := range d.Rules {
+			detections[i].Rules = append(detections[i].Rules, ingest.LevelRule{Level: r.Level, Pattern: r.Pattern, Keywords: r.Keywords})
+		}
+	}
+	if err := ingestor.SetLevelDetection(detections); err != nil {
+		fatal("Invalid ingest.level_detection", "error", err)
+	}
+	jsonLabels := make([]ingest.JSONLabels, len(cfg.Ingest.JSONLabels))
+	for i, j := range cfg.Ingest.JSONLabels {
+		jsonLabels[i] = ingest.JSONLabels{Selector: j.Selector, Fields: j.Fields, Prefix: j.Prefix, MaxValues: j.MaxValues}
+	}
+	if err := ingestor.SetJSONLabels(jsonLabels); err != nil {
+		fatal("Invalid ingest.json_labels", "error", err)
+	}
 
-	// Start background workers with context
-	go ingestor.Start()
-	go storage.StartRetentionWorker(rootCtx, cfg.Storage.Path, cfg.Storage.RetentionDays)
+	// Replay what the WAL holds beyond the stored chunks, as left by a
+	// crash, before accepting new entries
+	var walLog *wal.WAL
+	if wc := cfg.Ingest.WAL; wc.Enabled && !cfg.ReadOnly() {
+		walLog, err = wal.Open(wal.Options{Dir: wc.Dir, SegmentSize: wc.SegmentSizeBytes, Sync: wc.Sync, Compress: wc.Compress})
+		if err != nil {
+			fatal("Failed to open the WAL", "dir", wc.Dir, "error", err)
+		}
+		ingestor.SetWAL(walLog)
+		restored, err := ingestor.ReplayWAL()
+		if err != nil {
+			fatal("Failed to replay the WAL", "dir", wc.Dir, "error", err)
+		}
+		logging.Component("WAL").Info("Replayed unflushed entries", "entries", restored, "dir", wc.Dir)
+	}
 
-	// Setup HTTP server
-	router := api.NewRouterWithWebhooks(ingestor, storageReader, labelIndex, cfg, streamHub, webhookNotifier)
+	// Start background workers with context. A read-only replica keeps the
+	// ingestor unstarted, so nothing it serves writes to storage.
+	if !cfg.ReadOnly() {
+		go ingestor.Start()
+	}
+	retentionExclude := make([]storage.LabelMatcher, 0, len(cfg.Storage.RetentionExclude))
+	for _, selector := range cfg.Storage.RetentionExclude {
+		parsed, err := query.ParseAdvancedQuery(selector)
+		if err != nil {
+			fatal("Invalid storage.retention_exclude selector", "selector", selector, "error", err)
+		}
+		retentionExclude = append(retentionExclude, parsed)
+	}
+	var retentionWorker *storage.RetentionWorker
+	if !cfg.ReadOnly() {
+		limit := storage.StorageLimit{
+			MaxBytes:      cfg.Storage.MaxStorageBytes,
+			LowWaterBytes: cfg.Storage.MaxStorageBytes * int64(cfg.Storage.LowWaterPercent) / 100,
+		}
+		retentionWorker = storage.NewRetentionWorker(storageWriter, labelIndex, cfg.Storage.RetentionDays, limit, clock.Real{}, retentionExclude...)
+		go retentionWorker.Run(rootCtx)
+	}
+	if cc := cfg.Storage.Compaction; cc.Interval > 0 && !cfg.ReadOnly() {
+		window, err := storage.ParseCompactionWindow(cc.WindowStart, cc.WindowEnd, cc.WindowTimezone)
+		if err != nil {
+			fatal("Invalid storage.compaction window", "error", err)
+		}
+		opts := storage.CompactionOptions{
+			Interval:      cc.Interval,
+			TargetBytes:   int64(cfg.Storage.ChunkSizeBytes),
+			MaxMergeBytes: cc.MaxMergeBytes,
+			Workers:       cc.Workers,
+			Window:        window,
+		}
+		if cc.PauseBufferedBytes > 0 {
+			opts.Paused = func() bool { return ingestor.BufferedBytes() > cc.PauseBufferedBytes }
+		}
+		go storage.StartCompactionWorker(rootCtx, storageWriter, labelIndex, opts, clock.Real{})
+	}
 
-	// Create health handler and set up streaming metrics
+	// Create health handler, which serves /health and /metrics
 	healthHandler := api.NewHealthHandler(ingestor, storageReader, labelIndex)
 	healthHandler.SetWriter(storageWriter)
 	healthHandler.SetStreamHub(streamHub)
+	if cfg.Health.ReadProbeInterval > 0 {
+		healthHandler.StartReadProbe(cfg.Health.ReadProbeInterval)
+	}
+
+	// Setup HTTP server
+	limiter := ratelimiter.New(cfg.RateLimit)
+	router := api.NewRouterWithWebhooks(ingestor, storageReader, labelIndex, cfg, streamHub, webhookNotifier, alertManager, limiter, healthHandler)
+
+	// Reload rate limits, retention and the alert interval on SIGHUP
+	reloads := &reloader{
+		path:          configPath,
+		current:       cfg,
+		limiter:       limiter,
+		retention:     retentionWorker,
+		alertInterval: alertInterval,
+	}
+	reloads.start(rootCtx)
 
 	server := &http.Server{
 		Addr:         ":" + cfg.Server.Port,
 		Handler:      router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
 	// Proper graceful shutdown with context and synchronization
@@ -153,87 +488,110 @@ func main() {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 
-		log.Println("Graceful shutdown initiated...")
+		logger.Info("Graceful shutdown initiated")
 
 		// Step 1: Shutdown HTTP server first to drain in-flight requests
 		httpTimeout := time.Duration(cfg.Shutdown.HTTPTimeout) * time.Second
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), httpTimeout)
 		defer shutdownCancel()
 
-		log.Printf("Draining in-flight HTTP requests (timeout: %v)...", httpTimeout)
+		logger.Info("Draining in-flight HTTP requests", "timeout", httpTimeout)
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			log.Printf("Server shutdown error: %v", err)
+			logger.Error("Server shutdown failed", "error", err)
 		} else {
-			log.Println("HTTP server shutdown complete - all requests drained")
+			logger.Info("HTTP server shutdown complete, all requests drained")
 		}
 
-		// Step 2: Flush ingestor buffers with progress monitoring
-		ingestorTimeout := time.Duration(cfg.Shutdown.IngestorTimeout) * time.Second
-		progressInterval := time.Duration(cfg.Shutdown.ProgressLog) * time.Second
-
-		flushDone := make(chan *ingest.FlushProgress, 1) // Buffered to prevent goroutine leak
-		go func() {
-			log.Println("Flushing ingestor buffers...")
-			progress := ingestor.StopWithProgress()
-			flushDone <- progress
-		}()
-
-		// Progress monitoring ticker
-		progressTicker := time.NewTicker(progressInterval)
-		defer progressTicker.Stop()
-
-		timeoutTimer := time.NewTimer(ingestorTimeout)
-		defer timeoutTimer.Stop()
-
-		for {
-			select {
-			case progress := <-flushDone:
-				elapsed := time.Since(progress.StartTime)
-				log.Printf("Ingestor flushed successfully: buffers=%d/%d, entries=%d/%d, duration=%v",
-					progress.FlushedBuffers, progress.TotalBuffers,
-					progress.FlushedEntries, progress.TotalEntries,
-					elapsed)
-				goto shutdownComplete
-
-			case <-progressTicker.C:
-				if progress := ingestor.GetFlushProgress(); progress != nil {
+		// Steps 2 and 3 only apply to a node that writes
+		if !cfg.ReadOnly() {
+			// Step 2: Flush ingestor buffers with progress monitoring
+			ingestorTimeout := time.Duration(cfg.Shutdown.IngestorTimeout) * time.Second
+			progressInterval := time.Duration(cfg.Shutdown.ProgressLog) * time.Second
+
+			flushDone := make(chan *ingest.FlushProgress, 1) // Buffered to prevent goroutine leak
+			go func() {
+				logger.Info("Flushing ingestor buffers")
+				progress := ingestor.StopWithProgress()
+				flushDone <- progress
+			}()
+
+			// Progress monitoring ticker
+			progressTicker := time.NewTicker(progressInterval)
+			defer progressTicker.Stop()
+
+			timeoutTimer := time.NewTimer(ingestorTimeout)
+			defer timeoutTimer.Stop()
+
+			for {
+				select {
+				case progress := <-flushDone:
 					elapsed := time.Since(progress.StartTime)
-					log.Printf("Flush progress: buffers=%d/%d, entries=%d/%d, elapsed=%v",
-						progress.FlushedBuffers, progress.TotalBuffers,
-						progress.FlushedEntries, progress.TotalEntries,
-						elapsed)
+					logger.Info("Ingestor flushed successfully",
+						"buffers", progress.FlushedBuffers, "total_buffers", progress.TotalBuffers,
+						"entries", progress.FlushedEntries, "total_entries", progress.TotalEntries,
+						"duration", elapsed)
+					goto shutdownComplete
+
+				case <-progressTicker.C:
+					if progress := ingestor.GetFlushProgress(); progress != nil {
+						elapsed := time.Since(progress.StartTime)
+						logger.Info("Flush progress",
+							"buffers", progress.FlushedBuffers, "total_buffers", progress.TotalBuffers,
+							"entries", progress.FlushedEntries, "total_entries", progress.TotalEntries,
+							"elapsed", elapsed)
+					}
+
+				case <-timeoutTimer.C:
+					if progress := ingestor.GetFlushProgress(); progress != nil {
+						logger.Warn("Ingestor flush timed out", "timeout", ingestorTimeout,
+							"buffers", progress.FlushedBuffers, "total_buffers", progress.TotalBuffers,
+							"entries", progress.FlushedEntries, "total_entries", progress.TotalEntries)
+					} else {
+						logger.Warn("Ingestor flush timed out", "timeout", ingestorTimeout)
+					}
+					goto shutdownComplete
+				}
+			}
+
+		shutdownComplete:
+			if walLog != nil {
+				if err := walLog.Close(); err != nil {
+					logger.Warn("Closing the WAL failed", "error", err)
 				}
+			}
 
-			case <-timeoutTimer.C:
-				if progress := ingestor.GetFlushProgress(); progress != nil {
-					log.Printf("WARNING: Ingestor flush timeout after %v - buffers=%d/%d, entries=%d/%d",
-						ingestorTimeout,
-						progress.FlushedBuffers, progress.TotalBuffers,
-						progress.FlushedEntries, progress.TotalEntries)
+			// Step 3: Snapshot the index now that every buffer is flushed
+			if cfg.Index.SnapshotPath != "" {
+				if err := labelIndex.PersistIndex(cfg.Index.SnapshotPath); err != nil {
+					logger.Warn("Index snapshot failed", "error", err)
 				} else {
-					log.Printf("WARNING: Ingestor flush timeout after %v", ingestorTimeout)
+					logger.Info("Index snapshot written", "path", cfg.Index.SnapshotPath)
 				}
-				goto shutdownComplete
 			}
 		}
 
-	shutdownComplete:
-		// Step 3: Cancel context to stop background workers (alerts, retention, etc.)
-		log.Println("Stopping background workers...")
+		// Step 4: Cancel context to stop background workers (alerts, retention, etc.)
+		logger.Info("Stopping background workers")
 		rootCancel()
+		healthHandler.StopReadProbe()
 
 		close(shutdownComplete)
 	}()
 
 	// Start server
-	log.Printf("LokiLite is ready at http://localhost:%s", cfg.Server.Port)
-	log.Printf("WebSocket streaming available at ws://localhost:%s/stream", cfg.Server.Port)
+	logger.Info("LokiLite is ready", "url", "http://localhost:"+cfg.Server.Port, "stream", "ws://localhost:"+cfg.Server.Port+"/stream")
 
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+		fatal("Server error", "error", err)
 	}
 
 	// Wait for graceful shutdown to complete
 	<-shutdownComplete
-	log.Println("Server stopped cleanly")
+	logger.Info("Server stopped cleanly")
+}
+
+// fatal logs msg and its attributes at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+// runMigrate implements `server migrate`: it upgrades the metadata of every
+// stored chunk to the current schema and prints the outcome. It must not run
+// against storage a server is writing to; use POST /admin/migrate there.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := fs.String("config", "configs/config.yaml", "Path to the server config file")
+	storagePath := fs.String("storage", "", "Storage path to migrate (default: storage.path from the config)")
+	fs.Parse(args)
+
+	path := *storagePath
+	if path == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+		path = cfg.Storage.Path
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Storage path %s: %v\n", path, err)
+		return 1
+	}
+
+	// Interrupting is safe; running again resumes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	migration := storage.NewMigration(storage.NewWriter(path, 0))
+	migration.Start()
+	err := migration.Run(ctx)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(migration.Status())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration incomplete: %v\n", err)
+		return 1
+	}
+	return 0
+}
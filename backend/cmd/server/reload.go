@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/logging"
+	"github.com/logpulse/backend/internal/ratelimiter"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+// reloader re-reads the config file on SIGHUP and applies the settings that
+// can change while the server runs: rate limits, retention days and the
+// alert evaluation interval. Every other change is logged as ignored until
+// the next restart.
+type reloader struct {
+	path    string
+	current *config.Config
+
+	limiter *ratelimiter.Limiter
+	// retention is nil on a read-only replica, which runs no retention
+	retention *storage.RetentionWorker
+	// alertInterval receives a new alert evaluation interval
+	alertInterval chan<- time.Duration
+}
+
+// start reloads on every SIGHUP until ctx is cancelled. The signal is
+// handled from when start returns.
+func (r *reloader) start(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+				r.reload(ctx)
+			}
+		}
+	}()
+}
+
+// reload loads the config file and applies what changed. A file that fails
+// to load or validate changes nothing.
+func (r *reloader) reload(ctx context.Context) {
+	logger := logging.Component("Config")
+	logger.Info("Reloading", "path", r.path)
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		logger.Error("Reload failed, keeping the current settings", "error", err)
+		return
+	}
+
+	next := *r.current
+	// The preflight route is built once, so count_preflight needs a restart
+	next.RateLimit = cfg.RateLimit
+	next.RateLimit.CountPreflight = r.current.RateLimit.CountPreflight
+	if r.retention != nil {
+		next.Storage.RetentionDays = cfg.Storage.RetentionDays
+	}
+	next.Alerting.EvaluationInterval = cfg.Alerting.EvaluationInterval
+
+	if !reflect.DeepEqual(next.RateLimit, r.current.RateLimit) {
+		r.limiter.Update(next.RateLimit)
+		logger.Info("Applied rate_limit", "enabled", next.RateLimit.Enabled,
+			"requests_per_minute", next.RateLimit.RequestsPerMinute, "burst", next.RateLimit.Burst)
+	}
+	if next.Storage.RetentionDays != r.current.Storage.RetentionDays {
+		r.retention.SetRetentionDays(next.Storage.RetentionDays)
+		logger.Info("Applied storage.retention_days", "retention_days", next.Storage.RetentionDays)
+	}
+	if d := next.Alerting.EvaluationInterval; d != r.current.Alerting.EvaluationInterval && r.alertInterval != nil {
+		select {
+		case r.alertInterval <- d:
+			logger.Info("Applied alerting.evaluation_interval", "evaluation_interval", d)
+		case <-ctx.Done():
+			return
+		}
+	}
+	for _, name := range configChanges(reflect.ValueOf(next), reflect.ValueOf(*cfg), "") {
+		logger.Warn("Ignoring change on reload; restart to apply", "setting", name)
+	}
+	r.current = &next
+}
+
+// configChanges returns the yaml names of the settings that differ between
+// two configs, descending into sections
+func configChanges(old, updated reflect.Value, prefix string) []string {
+	var changed []string
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		o, u := old.Field(i), updated.Field(i)
+		if reflect.DeepEqual(o.Interface(), u.Interface()) {
+			continue
+		}
+		if o.Kind() == reflect.Struct {
+			changed = append(changed, configChanges(o, u, prefix+name+".")...)
+		} else {
+			changed = append(changed, prefix+name)
+		}
+	}
+	return changed
+}
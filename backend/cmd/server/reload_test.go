@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/ratelimiter"
+)
+
+func TestReloader_SIGHUPAppliesRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(burst int) {
+		yaml := "rate_limit:\n  enabled: true\n  requests_per_minute: 1\n  burst: " + strconv.Itoa(burst) + "\n"
+		if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(100)
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := ratelimiter.New(cfg.RateLimit)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// limited reports whether a second request from a fresh IP is refused,
+	// which only a burst of 1 does
+	clients := 0
+	limited := func() bool {
+		clients++
+		var code int
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/ingest", nil)
+			req.RemoteAddr = "10.0." + strconv.Itoa(clients/256) + "." + strconv.Itoa(clients%256) + ":1234"
+			handler.ServeHTTP(rec, req)
+			code = rec.Code
+		}
+		return code == http.StatusTooManyRequests
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	(&reloader{path: path, current: cfg, limiter: limiter}).start(ctx)
+
+	if limited() {
+		t.Fatal("expected a burst of 100 to allow 2 requests")
+	}
+
+	write(1)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !limited() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the reloaded burst of 1 to rate limit requests")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := config.DefaultConfig()
+	updated := config.DefaultConfig()
+	updated.Server.Port = "9090"
+	updated.Storage.RetentionDays++
+
+	got := configChanges(reflect.ValueOf(*old), reflect.ValueOf(*updated), "")
+	if want := []string{"server.port", "storage.retention_days"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
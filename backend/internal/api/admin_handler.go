@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+// selftestLabels identify the stream used by the self-test. The labels are
+// fixed so repeated runs do not grow label cardinality; each run is told
+// apart by a unique token in the line.
+var selftestLabels = map[string]string{"job": "logpulse_selftest"}
+
+var selftestSeq int64
+
+// AdminHandler serves operational endpoints under /admin
+type AdminHandler struct {
+	ingestor *ingest.Ingestor
+	executor *query.Executor
+
+	// Self-tests share one stream, so runs are serialized
+	selftestMu sync.Mutex
+
+	// At most one storage migration runs at a time
+	migration *storage.Migration
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(ingestor *ingest.Ingestor, executor *query.Executor) *AdminHandler {
+	return &AdminHandler{ingestor: ingestor, executor: executor, migration: ingestor.NewMigration()}
+}
+
+// SelftestResult reports the outcome and per-stage timings of a self-test
+type SelftestResult struct {
+	Pass   bool               `json:"pass"`
+	RunID  string             `json:"runId"`
+	Stages map[string]float64 `json:"stagesMs"`
+	Error  string             `json:"error,omitempty"`
+}
+
+// Selftest handles POST /admin/selftest: it ingests a uniquely tagged line,
+// flushes it to storage, queries it back, verifies the round trip and purges
+// the test stream
+func (h *AdminHandler) Selftest(w http.ResponseWriter, r *http.Request) {
+	h.selftestMu.Lock()
+	defer h.selftestMu.Unlock()
+
+	result := h.runSelftest()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Pass {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *AdminHandler) runSelftest() *SelftestResult {
+	now := time.Now().UTC()
+	runID := fmt.Sprintf("selftest-%d-%d", now.UnixNano(), atomic.AddInt64(&selftestSeq, 1))
+	line := "logpulse self-test " + runID
+	result := &SelftestResult{RunID: runID, Stages: make(map[string]float64)}
+
+	stage := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		result.Stages[name] = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			result.Error = name + ": " + err.Error()
+			return false
+		}
+		return true
+	}
+
+	ok := stage("ingest", func() error {
+		accepted, err := h.ingestor.Ingest(&models.IngestRequest{Streams: []models.Stream{{
+			Labels:  selftestLabels,
+			Entries: []models.Entry{{Ts: now.Format(time.RFC3339), Line: line}},
+		}}})
+		if err == nil && accepted == 0 {
+			err = fmt.Errorf("entry was not accepted")
+		}
+		return err
+	})
+
+	ok = ok && stage("flush", func() error {
+		h.ingestor.FlushStream(selftestLabels)
+		return nil
+	})
+
+	ok = ok && stage("query", func() error {
+		res, err := h.executor.Execute(`{job="logpulse_selftest"} |= "`+runID+`"`, now.Add(-time.Minute), now.Add(time.Minute), 10)
+		if err != nil {
+			return err
+		}
+		if len(res.Logs) != 1 || res.Logs[0].Message != line {
+			return fmt.Errorf("expected 1 line %q, got %d lines", line, len(res.Logs))
+		}
+		return nil
+	})
+
+	// Always purge, even after a failure, so test data does not linger
+	purged := stage("purge", func() error {
+		_, err := h.ingestor.PurgeStream(selftestLabels)
+		return err
+	})
+
+	result.Pass = ok && purged
+	return result
+}
+
+// legacyImportRequest is the body of POST /admin/import
+type legacyImportRequest struct {
+	Dir    string            `json:"dir"`
+	Labels map[string]string `json:"labels"`
+}
+
+// ImportLegacy handles POST /admin/import: it adopts the .log.gz NDJSON
+// chunks in a server-side directory as chunks of one stream, synthesizing
+// their .meta files and registering them in the index
+func (h *AdminHandler) ImportLegacy(w http.ResponseWriter, r *http.Request) {
+	var req legacyImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Dir == "" || len(req.Labels) == 0 {
+		http.Error(w, "dir and labels are required", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(req.Dir); err != nil || !info.IsDir() {
+		http.Error(w, "dir is not a readable directory", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.ingestor.ImportLegacyChunks(req.Dir, req.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[Admin] Imported %d legacy chunks (%d existing, %d failed) from %s as %v",
+		len(result.Imported), len(result.Existing), len(result.Errors), req.Dir, req.Labels)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Migrate handles POST /admin/migrate: it starts upgrading every chunk's
+// metadata to the current schema in the background and answers 202 with
+// the migration's status. Re-running it after an interruption skips the
+// chunks already upgraded.
+func (h *AdminHandler) Migrate(w http.ResponseWriter, r *http.Request) {
+	if err := h.migration.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	go func() {
+		if err := h.migration.Run(context.Background()); err != nil {
+			log.Printf("[Admin] Storage migration failed: %v", err)
+		}
+		status := h.migration.Status()
+		log.Printf("[Admin] Storage migration finished: %d chunks upgraded, %d already current, %d failed",
+			status.Upgraded, status.Current, len(status.Errors))
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h.migration.Status())
+}
+
+// MigrationStatus handles GET /admin/migrate, reporting the progress of the
+// current or last migration
+func (h *AdminHandler) MigrationStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.migration.Status())
+}
+
+// requireAPIKey guards admin endpoints regardless of auth.enabled. Without a
+// configured key the endpoints are refused outright.
+func requireAPIKey(apiKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKey == "" {
+			http.Error(w, "Admin API disabled: set auth.api_key", http.StatusForbidden)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = r.Header.Get("Authorization")
+		}
+		if key != apiKey {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
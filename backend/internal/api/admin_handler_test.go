@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/query"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestSelftest_RoundTripAndPurge(t *testing.T) {
+	dir := t.TempDir()
+	idx := index.NewIndex()
+	ingestor := ingest.NewIngestor(idx, storage.NewWriter(dir, 1024*1024), 100, nil)
+	h := NewAdminHandler(ingestor, query.NewExecutor(idx, storage.NewReader(dir)))
+	handler := requireAPIKey("secret", http.HandlerFunc(h.Selftest))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/admin/selftest", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without key, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/selftest", nil)
+	req.Header.Set("X-API-Key", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var result SelftestResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rec.Code != http.StatusOK || !result.Pass {
+		t.Fatalf("expected pass, got %d: %+v", rec.Code, result)
+	}
+	for _, stage := range []string{"ingest", "flush", "query", "purge"} {
+		if _, ok := result.Stages[stage]; !ok {
+			t.Errorf("missing timing for stage %s", stage)
+		}
+	}
+	if chunks, _ := idx.Stats(); chunks != 0 {
+		t.Errorf("expected self-test chunks to be purged, %d remain", chunks)
+	}
+}
@@ -5,32 +5,44 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/plugin"
 )
 
 // AlertRule represents an alert configuration
 type AlertRule struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Query     string    `json:"query"`
-	Condition string    `json:"condition"` // gt, lt, eq, gte, lte
-	Threshold int       `json:"threshold"`
-	Duration  string    `json:"duration"` // 5m, 1h, etc
-	Severity  string    `json:"severity"` // critical, warning, info
-	Enabled   bool      `json:"enabled"`
-	Webhook   string    `json:"webhook,omitempty"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Query       string            `json:"query"`
+	Condition   string            `json:"condition"` // gt, lt, eq, gte, lte
+	Threshold   int               `json:"threshold"`
+	Duration    string            `json:"duration"` // 5m, 1h, etc
+	Severity    string            `json:"severity"` // critical, warning, info
+	Enabled     bool              `json:"enabled"`
+	Webhook     string            `json:"webhook,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
 }
 
 // AlertHandler handles alert endpoints
 type AlertHandler struct {
 	mu     sync.RWMutex
 	alerts map[string]*AlertRule
+
+	// manager evaluates the rules and tracks their state (nil = no state)
+	manager *plugin.AlertManager
 }
 
 // NewAlertHandler creates a new alert handler
@@ -91,23 +103,20 @@ func (h *AlertHandler) CreateAlert(w http.ResponseWriter, r *http.Request) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	// Generate UUID
-	b := make([]byte, 16)
-	rand.Read(b)
-	id := hex.EncodeToString(b)
-
 	alert := &AlertRule{
-		ID:        id,
-		Name:      req.Name,
-		Query:     req.Query,
-		Condition: req.Condition,
-		Threshold: req.Threshold,
-		Duration:  req.Duration,
-		Severity:  req.Severity,
-		Enabled:   true,
-		Webhook:   req.Webhook,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:          newAlertID(),
+		Name:        req.Name,
+		Query:       req.Query,
+		Condition:   req.Condition,
+		Threshold:   req.Threshold,
+		Duration:    req.Duration,
+		Severity:    req.Severity,
+		Enabled:     true,
+		Webhook:     req.Webhook,
+		Labels:      req.Labels,
+		Annotations: req.Annotations,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
 	}
 
 	h.alerts[alert.ID] = alert
@@ -136,6 +145,38 @@ func (h *AlertHandler) GetAlert(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(alert)
 }
 
+// SetAlertManager reports rule states from am on GET /alerts/{id}/state
+func (h *AlertHandler) SetAlertManager(am *plugin.AlertManager) {
+	h.manager = am
+}
+
+// GetAlertState handles GET /alerts/{id}/state, returning the evaluation
+// state of the rule named by the alert with that id, or of the rule with
+// that name, as rules loaded from alerts.yaml have no id
+func (h *AlertHandler) GetAlertState(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	name := id
+	h.mu.RLock()
+	if alert, exists := h.alerts[id]; exists {
+		name = alert.Name
+	}
+	h.mu.RUnlock()
+
+	if h.manager == nil {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	status, ok := h.manager.RuleState(name)
+	if !ok {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
 // UpdateAlert updates an alert
 func (h *AlertHandler) UpdateAlert(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -178,6 +219,12 @@ func (h *AlertHandler) UpdateAlert(w http.ResponseWriter, r *http.Request) {
 	if req.Webhook != "" {
 		alert.Webhook = req.Webhook
 	}
+	if req.Labels != nil {
+		alert.Labels = req.Labels
+	}
+	if req.Annotations != nil {
+		alert.Annotations = req.Annotations
+	}
 
 	alert.UpdatedAt = time.Now()
 
@@ -232,3 +279,158 @@ func (h *AlertHandler) DeleteAlert(w http.ResponseWriter, r *http.Request) {
 	delete(h.alerts, id)
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// maxAlertImportBytes bounds the body accepted by ImportAlerts
+const maxAlertImportBytes = 1 << 20
+
+// ExportAlerts handles GET /alerts/export, returning every rule in the
+// configs/alerts.yaml format
+func (h *AlertHandler) ExportAlerts(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	rules := make([]config.AlertRule, 0, len(h.alerts))
+	for _, alert := range h.alerts {
+		enabled := alert.Enabled
+		rules = append(rules, config.AlertRule{
+			Name:        alert.Name,
+			Expr:        alert.Query,
+			Threshold:   float64(alert.Threshold),
+			Condition:   alert.Condition,
+			Duration:    alert.Duration,
+			Severity:    alert.Severity,
+			Enabled:     &enabled,
+			Labels:      alert.Labels,
+			Annotations: alert.Annotations,
+		})
+	}
+	h.mu.RUnlock()
+
+	// Stable output keeps exported files diff-friendly
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	out, err := yaml.Marshal(config.AlertSettings{Alerts: rules})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode alerts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", `attachment; filename="alerts.yaml"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// ImportAlerts handles POST /alerts/import. The body uses the
+// configs/alerts.yaml format; rules are matched by name, updating existing
+// ones and creating the rest. Nothing is applied if any rule is invalid.
+func (h *AlertHandler) ImportAlerts(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAlertImportBytes+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxAlertImportBytes {
+		http.Error(w, "Import too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var settings config.AlertSettings
+	if err := yaml.Unmarshal(body, &settings); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid YAML: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range settings.Alerts {
+		if err := validateImportedRule(rule); err != nil {
+			http.Error(w, fmt.Sprintf("alerts[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if seen[rule.Name] {
+			http.Error(w, fmt.Sprintf("alerts[%d]: duplicate rule name %q", i, rule.Name), http.StatusBadRequest)
+			return
+		}
+		seen[rule.Name] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	byName := make(map[string]*AlertRule, len(h.alerts))
+	for _, alert := range h.alerts {
+		byName[alert.Name] = alert
+	}
+
+	created, updated := 0, 0
+	now := time.Now()
+	for _, rule := range settings.Alerts {
+		alert, exists := byName[rule.Name]
+		if !exists {
+			alert = &AlertRule{ID: newAlertID(), Name: rule.Name, CreatedAt: now}
+			h.alerts[alert.ID] = alert
+			created++
+		} else {
+			updated++
+		}
+
+		alert.Query = rule.Expr
+		alert.Condition = normalizeCondition(rule.Condition)
+		alert.Threshold = int(rule.Threshold)
+		alert.Duration = rule.Duration
+		alert.Severity = rule.Severity
+		if alert.Severity == "" {
+			alert.Severity = "warning"
+		}
+		alert.Enabled = rule.Enabled == nil || *rule.Enabled
+		alert.Labels = rule.Labels
+		alert.Annotations = rule.Annotations
+		alert.UpdatedAt = now
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"created": created, "updated": updated})
+}
+
+// validateImportedRule applies CreateAlert's validation to an imported rule
+func validateImportedRule(rule config.AlertRule) error {
+	switch {
+	case rule.Name == "":
+		return fmt.Errorf("alert name is required")
+	case rule.Expr == "":
+		return fmt.Errorf("expr is required")
+	case rule.Condition == "":
+		return fmt.Errorf("condition is required")
+	case rule.Threshold < 0:
+		return fmt.Errorf("threshold must be >= 0")
+	case rule.Threshold != math.Trunc(rule.Threshold):
+		return fmt.Errorf("threshold must be a whole number")
+	case rule.Duration == "":
+		return fmt.Errorf("duration is required")
+	}
+	return nil
+}
+
+// normalizeCondition maps the comparison symbols used in alerts.yaml onto
+// the names used by the API
+func normalizeCondition(c string) string {
+	switch c {
+	case ">":
+		return "gt"
+	case "<":
+		return "lt"
+	case ">=":
+		return "gte"
+	case "<=":
+		return "lte"
+	case "==", "=":
+		return "eq"
+	}
+	return c
+}
+
+// newAlertID generates a random 128-bit hex ID
+func newAlertID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/plugin"
+)
+
+const importYAML = `
+alerts:
+  - name: "High Error Rate"
+    expr: '{level="error"}'
+    threshold: 10
+    condition: ">"
+    duration: 5m
+    severity: "warning"
+    labels:
+      service: "all"
+  - name: "Disabled"
+    expr: '{app="db"}'
+    threshold: 1
+    condition: "gt"
+    duration: 1m
+    enabled: false
+`
+
+func TestAlerts_ImportExportRoundTrip(t *testing.T) {
+	h := NewAlertHandler()
+
+	rec := httptest.NewRecorder()
+	h.ImportAlerts(rec, httptest.NewRequest("POST", "/alerts/import", strings.NewReader(importYAML)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"created":2`) {
+		t.Fatalf("unexpected import response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Re-importing updates by name instead of duplicating
+	rec = httptest.NewRecorder()
+	h.ImportAlerts(rec, httptest.NewRequest("POST", "/alerts/import", strings.NewReader(importYAML)))
+	if !strings.Contains(rec.Body.String(), `"updated":2`) || len(h.alerts) != 2 {
+		t.Fatalf("expected 2 updates and 2 rules, got %s with %d rules", rec.Body.String(), len(h.alerts))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ExportAlerts(rec, httptest.NewRequest("GET", "/alerts/export", nil))
+	var exported config.AlertSettings
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &exported); err != nil {
+		t.Fatalf("export is not valid YAML: %v", err)
+	}
+	if len(exported.Alerts) != 2 {
+		t.Fatalf("expected 2 exported rules, got %d", len(exported.Alerts))
+	}
+	disabled, high := exported.Alerts[0], exported.Alerts[1]
+	if disabled.Enabled == nil || *disabled.Enabled {
+		t.Error("expected enabled: false to survive the round trip")
+	}
+	if high.Expr != `{level="error"}` || high.Condition != "gt" || high.Labels["service"] != "all" {
+		t.Errorf("unexpected exported rule: %+v", high)
+	}
+}
+
+func TestAlerts_ImportRejectsInvalidAtomically(t *testing.T) {
+	h := NewAlertHandler()
+	body := `
+alerts:
+  - name: ok
+    expr: '{app="api"}'
+    condition: gt
+    duration: 1m
+  - name: missing-expr
+    condition: gt
+    duration: 1m
+`
+	rec := httptest.NewRecorder()
+	h.ImportAlerts(rec, httptest.NewRequest("POST", "/alerts/import", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest || len(h.alerts) != 0 {
+		t.Errorf("expected 400 and no rules created, got %d with %d rules", rec.Code, len(h.alerts))
+	}
+}
+
+func TestGetAlertState(t *testing.T) {
+	am := plugin.NewAlertManager(nil)
+	am.AddRule(plugin.AlertRule{Name: "High Error Rate", Threshold: 10})
+	am.EvaluateRules(func(string) (float64, error) { return 20, nil })
+
+	h := NewAlertHandler()
+	h.SetAlertManager(am)
+	h.alerts["abc"] = &AlertRule{ID: "abc", Name: "High Error Rate"}
+	router := mux.NewRouter()
+	router.HandleFunc("/alerts/{id}/state", h.GetAlertState)
+
+	for _, id := range []string{"abc", "High%20Error%20Rate"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/alerts/"+id+"/state", nil))
+		var status plugin.AlertStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected response %d: %s", id, rec.Code, rec.Body)
+		}
+		if status.State != plugin.StateFiring || status.Value != 20 || status.FiredAt == nil {
+			t.Errorf("%s: unexpected state %+v", id, status)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/alerts/missing/state", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown rule, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// budgetBlockSize is the granularity at which bodies of unknown length
+// reserve budget while being read
+const budgetBlockSize = 64 * 1024
+
+var (
+	errBudgetTimeout  = errors.New("ingest body budget exhausted")
+	errBudgetTooLarge = errors.New("request body exceeds ingest body budget")
+)
+
+// BodyBudget bounds the total bytes of request bodies buffered at once
+// across concurrent requests. Requests that cannot reserve budget within
+// the wait period are rejected with 503.
+type BodyBudget struct {
+	limit int64
+	wait  time.Duration
+
+	mu      sync.Mutex
+	inUse   int64
+	changed chan struct{} // closed and replaced on every release
+
+	rejected int64
+}
+
+// NewBodyBudget creates a budget of limit bytes; requests wait up to wait
+// for budget to free up before being rejected
+func NewBodyBudget(limit int64, wait time.Duration) *BodyBudget {
+	return &BodyBudget{
+		limit:   limit,
+		wait:    wait,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire reserves n bytes, waiting until the deadline for budget to free up
+func (b *BodyBudget) acquire(ctx context.Context, n int64, deadline time.Time) error {
+	if n > b.limit {
+		return errBudgetTooLarge
+	}
+	for {
+		b.mu.Lock()
+		if b.inUse+n <= b.limit {
+			b.inUse += n
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+			return errBudgetTimeout
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes to the budget and wakes waiters
+func (b *BodyBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.inUse -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// InUse returns the bytes currently reserved by in-flight request bodies
+func (b *BodyBudget) InUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inUse
+}
+
+// Limit returns the configured budget in bytes
+func (b *BodyBudget) Limit() int64 {
+	return b.limit
+}
+
+// Rejected returns the number of requests turned away for lack of budget
+func (b *BodyBudget) Rejected() int64 {
+	return atomic.LoadInt64(&b.rejected)
+}
+
+// Middleware buffers the request body against the budget before calling
+// next, and releases the reservation once next returns
+func (b *BodyBudget) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, reserved, err := b.readBody(r)
+		defer b.release(reserved)
+		if err != nil {
+			switch err {
+			case errBudgetTooLarge:
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			case errBudgetTimeout:
+				rejected := atomic.AddInt64(&b.rejected, 1)
+				if rejected == 1 || rejected%100 == 0 {
+					log.Printf("[BodyBudget] WARN: rejecting ingest request, %d/%d bytes in flight. Total rejected: %d", b.InUse(), b.limit, rejected)
+				}
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			default:
+				http.Error(w, "Failed to read request body: "+err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readBody reads the whole body, reserving budget up front when the length
+// is known and block by block otherwise. It returns the bytes reserved,
+// which the caller must release even on error.
+func (b *BodyBudget) readBody(r *http.Request) ([]byte, int64, error) {
+	defer r.Body.Close()
+	deadline := time.Now().Add(b.wait)
+
+	if r.ContentLength >= 0 {
+		if err := b.acquire(r.Context(), r.ContentLength, deadline); err != nil {
+			return nil, 0, err
+		}
+		body := make([]byte, r.ContentLength)
+		_, err := io.ReadFull(r.Body, body)
+		return body, r.ContentLength, err
+	}
+
+	var body []byte
+	var reserved int64
+	blockSize := min(int64(budgetBlockSize), b.limit)
+	block := make([]byte, blockSize)
+	for {
+		if reserved+blockSize > b.limit {
+			return nil, reserved, errBudgetTooLarge
+		}
+		if err := b.acquire(r.Context(), blockSize, deadline); err != nil {
+			return nil, reserved, err
+		}
+		reserved += blockSize
+
+		n, err := io.ReadFull(r.Body, block)
+		body = append(body, block[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Hand back the unused tail of the last block
+			unused := blockSize - int64(n)
+			b.release(unused)
+			return body, reserved - unused, nil
+		}
+		if err != nil {
+			return nil, reserved, err
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyBudget_WaitsThenRejects(t *testing.T) {
+	b := NewBodyBudget(100, 20*time.Millisecond)
+	ctx := context.Background()
+
+	if err := b.acquire(ctx, 80, time.Now().Add(b.wait)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.acquire(ctx, 30, time.Now().Add(b.wait)); err != errBudgetTimeout {
+		t.Errorf("expected timeout while budget is held, got %v", err)
+	}
+
+	// A release during the wait lets the waiter through
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		b.release(80)
+	}()
+	if err := b.acquire(ctx, 30, time.Now().Add(time.Second)); err != nil {
+		t.Errorf("expected acquire after release, got %v", err)
+	}
+	if b.InUse() != 30 {
+		t.Errorf("expected 30 bytes in use, got %d", b.InUse())
+	}
+	if err := b.acquire(ctx, 101, time.Now()); err != errBudgetTooLarge {
+		t.Errorf("expected too-large error, got %v", err)
+	}
+}
+
+func TestBodyBudget_Middleware(t *testing.T) {
+	b := NewBodyBudget(1024, 0)
+	var seen string
+	handler := b.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen = string(body)
+		if b.InUse() != int64(len(body)) {
+			t.Errorf("expected %d bytes reserved during handler, got %d", len(body), b.InUse())
+		}
+	}))
+
+	// Unknown length is read block by block
+	req := httptest.NewRequest("POST", "/ingest", io.NopCloser(strings.NewReader(`{"streams":[]}`)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if seen != `{"streams":[]}` || rec.Code != http.StatusOK {
+		t.Errorf("unexpected body %q or status %d", seen, rec.Code)
+	}
+	if b.InUse() != 0 {
+		t.Errorf("expected budget released, %d bytes still in use", b.InUse())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/ingest", strings.NewReader(strings.Repeat("x", 2048))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for body larger than the budget, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// LokiCompatVersion is the Loki release whose HTTP API LogPulse reports.
+// Grafana's Loki datasource gates features on this version, so it should
+// only be raised once the endpoints the newer Loki added are implemented.
+// Against 2.9 Grafana uses query_range, instant query, labels and label
+// values, which are all served under /loki/api/v1.
+const LokiCompatVersion = "2.9.0"
+
+// Version is the LogPulse build, set with
+// -ldflags "-X github.com/logpulse/backend/internal/api.Version=..."
+var Version = "dev"
+
+// lokiBuildInfo mirrors the response of Loki's /loki/api/v1/status/buildinfo
+type lokiBuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"buildUser"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	// LogPulseVersion identifies the real server behind the Loki version
+	LogPulseVersion string `json:"logpulseVersion"`
+}
+
+// BuildInfo handles GET /loki/api/v1/status/buildinfo, which Grafana probes
+// to detect a Loki-compatible datasource and its feature set
+func (h *LokiHandler) BuildInfo(w http.ResponseWriter, r *http.Request) {
+	info := lokiBuildInfo{
+		Version:         LokiCompatVersion,
+		Branch:          "HEAD",
+		BuildUser:       "logpulse",
+		GoVersion:       runtime.Version(),
+		LogPulseVersion: Version,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.time":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
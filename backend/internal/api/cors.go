@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/logpulse/backend/internal/config"
+)
+
+// corsMiddleware sets CORS headers for allowed origins and answers OPTIONS
+// preflights through the preflight handler. Preflights from origins outside
+// the allowlist are rejected with 403.
+func corsMiddleware(cfg config.CORSConfig, preflight http.Handler) mux.MiddlewareFunc {
+	wildcard := false
+	allowed := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			wildcard = true
+		}
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			originAllowed := wildcard || allowed[origin]
+
+			if wildcard && !cfg.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Add("Vary", "Origin")
+				if origin != "" && originAllowed {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					if cfg.AllowCredentials {
+						w.Header().Set("Access-Control-Allow-Credentials", "true")
+					}
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, Authorization, "+RequestIDHeader)
+			w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+
+			if r.Method == "OPTIONS" {
+				if origin != "" && !originAllowed {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				preflight.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// preflightOK is the terminal handler for preflights that pass every check
+func preflightOK(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// limitPath applies limit only to requests for path, so preflights for
+// rate-limited routes are charged against the same limiter
+func limitPath(path string, limit mux.MiddlewareFunc, next http.Handler) http.Handler {
+	limited := limit(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			limited.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
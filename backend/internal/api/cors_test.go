@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/logpulse/backend/internal/config"
+)
+
+func TestCORSMiddleware_Allowlist(t *testing.T) {
+	cfg := config.CORSConfig{
+		AllowedOrigins:   []string{"https://grafana.example.com"},
+		AllowCredentials: true,
+	}
+	handler := corsMiddleware(cfg, http.HandlerFunc(preflightOK))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cases := []struct {
+		method     string
+		origin     string
+		wantStatus int
+		wantOrigin string
+	}{
+		{"OPTIONS", "https://grafana.example.com", http.StatusOK, "https://grafana.example.com"},
+		{"OPTIONS", "https://evil.example.com", http.StatusForbidden, ""},
+		{"GET", "https://evil.example.com", http.StatusTeapot, ""},
+		{"GET", "", http.StatusTeapot, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/query", nil)
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != c.wantStatus {
+			t.Errorf("%s from %q: expected status %d, got %d", c.method, c.origin, c.wantStatus, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != c.wantOrigin {
+			t.Errorf("%s from %q: expected Allow-Origin %q, got %q", c.method, c.origin, c.wantOrigin, got)
+		}
+	}
+}
+
+func TestCORSMiddleware_PreflightAuth(t *testing.T) {
+	cfg := config.CORSConfig{AllowedOrigins: []string{"*"}}
+	preflight := authMiddleware(apiKeys{"secret": nil}, nil, true)(http.HandlerFunc(preflightOK))
+	handler := corsMiddleware(cfg, preflight)(http.NotFoundHandler())
+
+	req := httptest.NewRequest("OPTIONS", "/query", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for preflight without key, got %d", rec.Code)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("expected CORS headers on rejected preflight")
+	}
+
+	req.Header.Set("X-API-Key", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for preflight with key, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// DecodePool caps how many ingest requests decode and process their bodies
+// at once, so bursts of large JSON or protobuf payloads cannot take every
+// CPU from queries. Requests beyond the cap queue for a slot and are
+// rejected with 503 once the wait period passes.
+type DecodePool struct {
+	slots chan struct{}
+	wait  time.Duration
+
+	queued   int64
+	rejected int64
+}
+
+// NewDecodePool creates a pool of workers slots (GOMAXPROCS when not
+// positive); requests queue up to wait for a free slot
+func NewDecodePool(workers int, wait time.Duration) *DecodePool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &DecodePool{slots: make(chan struct{}, workers), wait: wait}
+}
+
+// Middleware runs next once a decode slot is free
+func (p *DecodePool) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			if !p.enqueue(r) {
+				rejected := atomic.AddInt64(&p.rejected, 1)
+				if rejected == 1 || rejected%100 == 0 {
+					log.Printf("[DecodePool] WARN: rejecting ingest request, %d decoding and %d queued. Total rejected: %d",
+						p.Active(), p.Queued(), rejected)
+				}
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "ingest decoders busy", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		defer func() { <-p.slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enqueue waits for a slot and reports whether one was taken
+func (p *DecodePool) enqueue(r *http.Request) bool {
+	atomic.AddInt64(&p.queued, 1)
+	defer atomic.AddInt64(&p.queued, -1)
+
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// Active returns the number of requests currently decoding
+func (p *DecodePool) Active() int {
+	return len(p.slots)
+}
+
+// Workers returns the configured number of concurrent decodes
+func (p *DecodePool) Workers() int {
+	return cap(p.slots)
+}
+
+// Queued returns the number of requests waiting for a decode slot
+func (p *DecodePool) Queued() int64 {
+	return atomic.LoadInt64(&p.queued)
+}
+
+// Rejected returns the number of requests turned away while waiting
+func (p *DecodePool) Rejected() int64 {
+	return atomic.LoadInt64(&p.rejected)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDecodePool_CapsConcurrency(t *testing.T) {
+	pool := NewDecodePool(1, 50*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := pool.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/ingest", nil))
+		done <- rec.Code
+	}()
+	<-started
+	if pool.Active() != 1 {
+		t.Errorf("expected 1 active decode, got %d", pool.Active())
+	}
+
+	// The second request queues, then gives up once the wait passes
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/ingest", nil))
+	if rec.Code != http.StatusServiceUnavailable || pool.Rejected() != 1 {
+		t.Errorf("expected a 503 after waiting, got %d (rejected %d)", rec.Code, pool.Rejected())
+	}
+
+	// A queued request proceeds once the slot frees up
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/ingest", nil))
+		done <- rec.Code
+	}()
+	for pool.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("expected 200, got %d", code)
+		}
+	}
+	if pool.Queued() != 0 || pool.Active() != 0 {
+		t.Errorf("expected an idle pool, got %d queued and %d active", pool.Queued(), pool.Active())
+	}
+}
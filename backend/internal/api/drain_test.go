@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestDrainer_RefusesThenNotReady(t *testing.T) {
+	idx := index.NewIndex()
+	ingestor := ingest.NewIngestor(idx, storage.NewWriter(t.TempDir(), 1024*1024), 100, nil)
+	ingestor.Ingest(&models.IngestRequest{Streams: []models.Stream{{
+		Labels:  map[string]string{"app": "api"},
+		Entries: []models.Entry{{Ts: time.Now().Format(time.RFC3339), Line: "buffered"}},
+	}}})
+
+	d := NewDrainer(ingestor, 50*time.Millisecond)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := d.Middleware(ok)
+	ready := d.ReadyGate(ok)
+
+	serve := func(h http.Handler, method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	if rec := serve(handler, "POST", "/ingest"); rec.Code != http.StatusOK {
+		t.Fatalf("expected ingest to pass before draining, got %d", rec.Code)
+	}
+
+	if rec := serve(http.HandlerFunc(d.Drain), "POST", "/admin/drain"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 from drain, got %d", rec.Code)
+	}
+	if chunks, _ := idx.Stats(); chunks != 1 {
+		t.Errorf("expected buffered entries flushed into a chunk, got %d chunks", chunks)
+	}
+
+	rec := serve(handler, "GET", "/query")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After while draining, got %d", rec.Code)
+	}
+	if rec := serve(handler, "GET", "/health"); rec.Code != http.StatusOK {
+		t.Errorf("expected /health to stay available, got %d", rec.Code)
+	}
+	if rec := serve(ready, "GET", "/ready"); rec.Code != http.StatusOK {
+		t.Errorf("expected ready during the grace period, got %d", rec.Code)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if rec := serve(ready, "GET", "/ready"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not-ready after the grace period, got %d", rec.Code)
+	}
+}
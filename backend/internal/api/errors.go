@@ -24,6 +24,8 @@ const (
 	// Server errors
 	ErrorCodeInternalError  ErrorCode = "INTERNAL_ERROR"
 	ErrorCodeIngestionError ErrorCode = "INGESTION_ERROR"
+	ErrorCodeStorageError   ErrorCode = "STORAGE_INCONSISTENCY"
+	ErrorCodeReadOnly       ErrorCode = "READ_ONLY"
 
 	// Connection errors
 	ErrorCodeConnectionError ErrorCode = "CONNECTION_ERROR"
@@ -34,17 +36,21 @@ type ErrorResponse struct {
 	Error   string    `json:"error"`
 	Code    ErrorCode `json:"code"`
 	Details string    `json:"details,omitempty"`
+	// RequestID correlates the error with server logs and traces
+	RequestID string `json:"request_id,omitempty"`
 }
 
-// WriteErrorResponse writes a structured error response to the HTTP response writer
+// WriteErrorResponse writes a structured error response to the HTTP response
+// writer, with the request ID requestIDMiddleware set on the response
 func WriteErrorResponse(w http.ResponseWriter, statusCode int, code ErrorCode, message string, details string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
 	errorResp := ErrorResponse{
-		Error:   message,
-		Code:    code,
-		Details: details,
+		Error:     message,
+		Code:      code,
+		Details:   details,
+		RequestID: w.Header().Get(RequestIDHeader),
 	}
 
 	json.NewEncoder(w).Encode(errorResp)
@@ -55,6 +61,7 @@ func WriteQueryError(w http.ResponseWriter, err error, details string) {
 	var code ErrorCode
 	var message string
 	var errorDetails string
+	status := http.StatusBadRequest
 
 	// Check if it's a detailed QueryError
 	if queryErr, ok := err.(*query.QueryError); ok {
@@ -67,6 +74,11 @@ func WriteQueryError(w http.ResponseWriter, err error, details string) {
 			code = ErrorCodeInvalidRegex
 			message = "Invalid regex pattern"
 			errorDetails = queryErr.Details
+		case "storage_inconsistency":
+			code = ErrorCodeStorageError
+			message = queryErr.Message
+			errorDetails = queryErr.Details
+			status = http.StatusInternalServerError
 		default:
 			code = ErrorCodeBadQuery
 			message = queryErr.Message
@@ -97,7 +109,7 @@ func WriteQueryError(w http.ResponseWriter, err error, details string) {
 		errorDetails = details
 	}
 
-	WriteErrorResponse(w, http.StatusBadRequest, code, message, errorDetails)
+	WriteErrorResponse(w, status, code, message, errorDetails)
 }
 
 // WriteValidationError writes a validation error response
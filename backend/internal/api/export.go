@@ -0,0 +1,355 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/query"
+)
+
+// exportPageSize is the number of entries each export job reads per query
+const exportPageSize = 5000
+
+// Export job states
+const (
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// ExportJob describes a background export of a log query to a file
+type ExportJob struct {
+	ID     string    `json:"id"`
+	Query  string    `json:"query"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Status string    `json:"status"`
+	// Progress is the share of the time range exported so far, 0 to 1.
+	// Entries are written newest first, so it grows from the range end.
+	Progress float64    `json:"progress"`
+	Lines    int64      `json:"lines"`
+	Bytes    int64      `json:"bytes"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// ExportManager runs export jobs independently of the requests that start
+// them, writing NDJSON files that stay downloadable until the TTL expires
+type ExportManager struct {
+	executor *query.Executor
+	dir      string
+	ttl      time.Duration
+	pageSize int
+
+	mu   sync.Mutex
+	jobs map[string]*ExportJob
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewExportManager creates a manager writing export files into dir
+func NewExportManager(executor *query.Executor, dir string, ttl time.Duration) *ExportManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ExportManager{
+		executor: executor,
+		dir:      dir,
+		ttl:      ttl,
+		pageSize: exportPageSize,
+		jobs:     make(map[string]*ExportJob),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start begins removing expired exports in the background
+func (m *ExportManager) Start() {
+	go func() {
+		interval := m.ttl / 4
+		if interval < time.Minute {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.cleanup(now)
+			}
+		}
+	}()
+}
+
+// Stop cancels running jobs and the cleanup loop
+func (m *ExportManager) Stop() {
+	m.cancel()
+}
+
+func (m *ExportManager) path(id string) string {
+	return filepath.Join(m.dir, id+".ndjson")
+}
+
+// start registers a job and runs it in the background
+func (m *ExportManager) start(queryStr string, start, end time.Time) (*ExportJob, error) {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	job := &ExportJob{
+		ID:      hex.EncodeToString(buf),
+		Query:   queryStr,
+		Start:   start,
+		End:     end,
+		Status:  ExportRunning,
+		Created: time.Now().UTC(),
+	}
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	snapshot := *job
+	m.mu.Unlock()
+
+	go m.run(job)
+	return &snapshot, nil
+}
+
+// job returns a copy of a job's current state
+func (m *ExportManager) job(id string) (ExportJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ExportJob{}, false
+	}
+	return *job, true
+}
+
+// run pages through the query with cursors, appending each page to a
+// partial file that is renamed into place once the export completes
+func (m *ExportManager) run(job *ExportJob) {
+	err := m.export(job)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	expires := now.Add(m.ttl)
+	job.Finished, job.Expires = &now, &expires
+	if err != nil {
+		job.Status = ExportFailed
+		job.Error = err.Error()
+		log.Printf("[Export] Job %s failed after %d lines: %v", job.ID, job.Lines, err)
+		return
+	}
+	job.Status = ExportDone
+	job.Progress = 1
+	log.Printf("[Export] Job %s finished: %d lines, %d bytes", job.ID, job.Lines, job.Bytes)
+}
+
+func (m *ExportManager) export(job *ExportJob) error {
+	partPath := m.path(job.ID) + ".part"
+	file, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath) // no-op once renamed
+
+	counter := &countingWriter{w: file}
+	bw := bufio.NewWriter(counter)
+	enc := json.NewEncoder(bw)
+	span := job.End.Sub(job.Start)
+
+	var opts query.ExecuteOptions
+	for {
+		result, err := m.executor.ExecuteContext(m.ctx, job.Query, job.Start, job.End, m.pageSize, opts)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		for _, l := range result.Logs {
+			if err := enc.Encode(l); err != nil {
+				file.Close()
+				return err
+			}
+		}
+
+		m.mu.Lock()
+		job.Lines += int64(len(result.Logs))
+		job.Bytes = counter.n + int64(bw.Buffered())
+		if n := len(result.Logs); n > 0 && span > 0 {
+			if ts, err := time.Parse(time.RFC3339Nano, result.Logs[n-1].Timestamp); err == nil {
+				job.Progress = min(1, max(0, float64(job.End.Sub(ts))/float64(span)))
+			}
+		}
+		m.mu.Unlock()
+
+		if result.Next == "" {
+			break
+		}
+		if opts.Cursor, err = query.DecodeCursor(result.Next); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	job.Bytes = counter.n
+	m.mu.Unlock()
+	return os.Rename(partPath, m.path(job.ID))
+}
+
+// cleanup forgets jobs that finished more than the TTL ago and deletes their
+// files, along with files left behind by jobs from before a restart
+func (m *ExportManager) cleanup(now time.Time) {
+	m.mu.Lock()
+	for id, job := range m.jobs {
+		if job.Expires != nil && now.After(*job.Expires) {
+			delete(m.jobs, id)
+			os.Remove(m.path(id))
+		}
+	}
+	m.mu.Unlock()
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || now.Sub(info.ModTime()) <= m.ttl {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".part"), ".ndjson")
+		if _, tracked := m.job(id); !tracked {
+			os.Remove(filepath.Join(m.dir, entry.Name()))
+		}
+	}
+}
+
+// countingWriter tracks the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type exportRequest struct {
+	Query string `json:"query"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Create handles POST /admin/export: it validates the query and range
+// (RFC3339, default the last hour), starts a background job and returns it
+// with 202 Accepted
+func (m *ExportManager) Create(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidJSON, "Invalid JSON", err.Error())
+		return
+	}
+	if req.Query == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeMissingField, "query is required", "")
+		return
+	}
+	parsed, err := query.ParseAdvancedQuery(req.Query)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeBadQuery, "Invalid query", err.Error())
+		return
+	}
+	if parsed.Aggregation != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeBadQuery, "Metric queries cannot be exported", "")
+		return
+	}
+
+	end := time.Now().UTC()
+	if req.End != "" {
+		if end, err = time.Parse(time.RFC3339, req.End); err != nil {
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid end time", err.Error())
+			return
+		}
+	}
+	start := end.Add(-time.Hour)
+	if req.Start != "" {
+		if start, err = time.Parse(time.RFC3339, req.Start); err != nil {
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid start time", err.Error())
+			return
+		}
+	}
+	if !start.Before(end) {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "start must be before end", "")
+		return
+	}
+
+	job, err := m.start(req.Query, start, end)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, ErrorCodeInternalError, "Failed to start export", err.Error())
+		return
+	}
+	log.Printf("[Export] Job %s started: %s from %s to %s", job.ID, job.Query, start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/export/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Get handles GET /admin/export/{id}: it serves the file of a finished job,
+// with range support so interrupted downloads can resume, and reports the
+// job's state otherwise or when ?status is given
+func (m *ExportManager) Get(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.job(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "export not found", http.StatusNotFound)
+		return
+	}
+
+	_, statusOnly := r.URL.Query()["status"]
+	if job.Status != ExportDone || statusOnly {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	file, err := os.Open(m.path(job.ID))
+	if err != nil {
+		WriteErrorResponse(w, http.StatusInternalServerError, ErrorCodeStorageError, "Export file unavailable", err.Error())
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "export-"+job.ID+".ndjson"))
+	http.ServeContent(w, r, "", *job.Finished, file)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func newTestExportManager(t *testing.T, lines int) (*ExportManager, time.Time) {
+	dir := t.TempDir()
+	writer := storage.NewWriter(filepath.Join(dir, "logs"), 1024*1024)
+	idx := index.NewIndex()
+
+	labels := map[string]string{"app": "api"}
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	entries := make([]models.LogEntry, lines)
+	for i := range entries {
+		entries[i] = models.LogEntry{Timestamp: base.Add(time.Duration(i) * time.Second), Line: "line", Labels: labels}
+	}
+	id, start, end, err := writer.WriteChunk(labels, entries)
+	if err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	idx.AddChunk(id, labels, start, end, lines)
+
+	executor := query.NewExecutor(idx, storage.NewReader(filepath.Join(dir, "logs")))
+	m := NewExportManager(executor, filepath.Join(dir, "exports"), time.Hour)
+	m.pageSize = 2
+	t.Cleanup(m.Stop)
+	return m, base
+}
+
+func TestExportManager_Export(t *testing.T) {
+	m, base := newTestExportManager(t, 5)
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/export", m.Create).Methods("POST")
+	router.HandleFunc("/admin/export/{id}", m.Get).Methods("GET")
+
+	body, _ := json.Marshal(exportRequest{
+		Query: `{app="api"}`,
+		Start: base.Add(-time.Minute).Format(time.RFC3339),
+		End:   time.Now().Format(time.RFC3339),
+	})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/admin/export", bytes.NewReader(body)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job ExportJob
+	json.NewDecoder(rec.Body).Decode(&job)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/export/"+job.ID+"?status", nil))
+		json.NewDecoder(rec.Body).Decode(&job)
+		if job.Status != ExportRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("export did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.Status != ExportDone || job.Lines != 5 || job.Progress != 1 {
+		t.Fatalf("unexpected job state %+v", job)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/export/"+job.ID, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected ndjson, got %q", ct)
+	}
+	var n int
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var l query.LogResponse
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("expected 5 exported lines, got %d", n)
+	}
+
+	// Interrupted downloads resume with a range request
+	req := httptest.NewRequest("GET", "/admin/export/"+job.ID, nil)
+	req.Header.Set("Range", "bytes=10-")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || int64(rec.Body.Len()) != job.Bytes-10 {
+		t.Errorf("expected 206 with %d bytes, got %d with %d", job.Bytes-10, rec.Code, rec.Body.Len())
+	}
+}
+
+func TestExportManager_RejectsBadRequests(t *testing.T) {
+	m, _ := newTestExportManager(t, 1)
+	for _, body := range []string{
+		`{}`,
+		`{"query": "count_over_time({app=\"api\"}[5m])"}`,
+		`{"query": "{app=\"api\"}", "start": "2024-01-02T00:00:00Z", "end": "2024-01-01T00:00:00Z"}`,
+	} {
+		rec := httptest.NewRecorder()
+		m.Create(rec, httptest.NewRequest("POST", "/admin/export", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/admin/export/missing", nil), map[string]string{"id": "missing"})
+	m.Get(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", rec.Code)
+	}
+}
+
+func TestExportManager_Cleanup(t *testing.T) {
+	m, _ := newTestExportManager(t, 1)
+	os.MkdirAll(m.dir, 0755)
+
+	expired := time.Now().Add(-time.Minute)
+	m.jobs["old"] = &ExportJob{ID: "old", Status: ExportDone, Expires: &expired}
+	os.WriteFile(m.path("old"), []byte("{}\n"), 0644)
+	fresh := time.Now().Add(time.Hour)
+	m.jobs["new"] = &ExportJob{ID: "new", Status: ExportDone, Expires: &fresh}
+	os.WriteFile(m.path("new"), []byte("{}\n"), 0644)
+
+	// Left behind by a job from before a restart
+	stray := m.path("stray")
+	os.WriteFile(stray, []byte("{}\n"), 0644)
+	os.Chtimes(stray, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+
+	m.cleanup(time.Now())
+
+	if _, ok := m.job("old"); ok {
+		t.Error("expected the expired job to be forgotten")
+	}
+	for path, want := range map[string]bool{m.path("old"): false, m.path("new"): true, stray: false} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s: expected exists=%v", filepath.Base(path), want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/query"
+)
+
+// StreamFreshness reports when a stream was last written to
+type StreamFreshness struct {
+	Labels     map[string]string `json:"labels"`
+	LastWrite  time.Time         `json:"last_write"`
+	AgeSeconds float64           `json:"age_seconds"`
+}
+
+// FreshnessHandler serves GET /admin/freshness
+type FreshnessHandler struct {
+	index *index.Index
+}
+
+// NewFreshnessHandler creates a handler reporting stream last-write times
+// from the index
+func NewFreshnessHandler(idx *index.Index) *FreshnessHandler {
+	return &FreshnessHandler{index: idx}
+}
+
+// Freshness lists the streams matching the query's selector with the time of
+// their newest entry, stalest first, for spotting agents that stopped
+// logging. With threshold (e.g. 15m or 1d) only streams silent for longer
+// are listed. Times come from chunk metadata, so no lines are read and
+// entries not yet flushed are not counted.
+func (h *FreshnessHandler) Freshness(w http.ResponseWriter, r *http.Request) {
+	queryStr := r.URL.Query().Get("query")
+	if queryStr == "" {
+		WriteValidationError(w, "query", "Query parameter is required")
+		return
+	}
+	parsed, err := query.ParseAdvancedQuery(queryStr)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeBadQuery, "Invalid query", err.Error())
+		return
+	}
+	if parsed.Aggregation != nil || len(parsed.LineFilters) > 0 || len(parsed.Pipeline) > 0 {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeBadQuery, "Freshness takes a stream selector only", "")
+		return
+	}
+
+	var threshold time.Duration
+	if s := r.URL.Query().Get("threshold"); s != "" {
+		if threshold, err = parseExtendedDuration(s); err != nil || threshold < 0 {
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeValidationError, "Invalid threshold", "Expected a duration such as 15m or 1d, got: "+s)
+			return
+		}
+	}
+
+	scope := keyScope(r)
+	now := time.Now().UTC()
+	streams := []StreamFreshness{}
+	for _, s := range h.index.LastWrites(func(labels map[string]string) bool {
+		for k, v := range scope {
+			if labels[k] != v {
+				return false
+			}
+		}
+		return parsed.MatchLabels(labels)
+	}) {
+		age := now.Sub(s.LastWrite)
+		if age < threshold {
+			continue
+		}
+		streams = append(streams, StreamFreshness{
+			Labels:     s.Labels,
+			LastWrite:  s.LastWrite,
+			AgeSeconds: max(0, age.Seconds()),
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if !streams[i].LastWrite.Equal(streams[j].LastWrite) {
+			return streams[i].LastWrite.Before(streams[j].LastWrite)
+		}
+		return labelsToKey(streams[i].Labels) < labelsToKey(streams[j].Labels)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"time":    now,
+		"streams": streams,
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/index"
+)
+
+func TestFreshnessHandler(t *testing.T) {
+	idx := index.NewIndex()
+	now := time.Now()
+	idx.AddChunk("a1", map[string]string{"app": "api", "host": "a"}, now.Add(-3*time.Hour), now.Add(-2*time.Hour), 10)
+	idx.AddChunk("a2", map[string]string{"app": "api", "host": "a"}, now.Add(-2*time.Hour), now.Add(-time.Minute), 10)
+	idx.AddChunk("b1", map[string]string{"app": "api", "host": "b"}, now.Add(-3*time.Hour), now.Add(-time.Hour), 10)
+	idx.AddChunk("w1", map[string]string{"app": "web"}, now.Add(-time.Hour), now, 10)
+	h := NewFreshnessHandler(idx)
+
+	get := func(url string) (int, []StreamFreshness) {
+		rec := httptest.NewRecorder()
+		h.Freshness(rec, httptest.NewRequest("GET", url, nil))
+		var body struct {
+			Streams []StreamFreshness `json:"streams"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Streams
+	}
+
+	code, streams := get(`/admin/freshness?query={app="api"}`)
+	if code != http.StatusOK || len(streams) != 2 {
+		t.Fatalf("expected 2 api streams, got %d %+v", code, streams)
+	}
+	if streams[0].Labels["host"] != "b" || streams[1].Labels["host"] != "a" {
+		t.Errorf("expected the stalest stream first, got %+v", streams)
+	}
+	if age := streams[1].AgeSeconds; age < 59 || age > 120 {
+		t.Errorf("expected host a to be about a minute old from its newest chunk, got %vs", age)
+	}
+
+	_, streams = get(`/admin/freshness?query={app="api"}&threshold=30m`)
+	if len(streams) != 1 || streams[0].Labels["host"] != "b" {
+		t.Errorf("expected only the stream silent past the threshold, got %+v", streams)
+	}
+
+	for _, url := range []string{
+		`/admin/freshness`,
+		`/admin/freshness?query={app="api"}%20|=%20"x"`,
+		`/admin/freshness?query={app="api"}&threshold=soon`,
+	} {
+		if code, _ := get(url); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", url, code)
+		}
+	}
+}
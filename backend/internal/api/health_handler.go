@@ -1,8 +1,11 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/logpulse/backend/internal/index"
@@ -19,6 +22,22 @@ type HealthHandler struct {
 	index     *index.Index
 	writer    *storage.Writer
 	streamHub *StreamHub
+	budget    *BodyBudget
+	decode    *DecodePool
+
+	// Cached result of the periodic chunk read probe
+	probeMu     sync.RWMutex
+	probeResult *ReadProbeResult
+	probeDone   chan struct{}
+}
+
+// ReadProbeResult is the outcome of the most recent chunk read probe
+type ReadProbeResult struct {
+	OK        bool      `json:"ok"`
+	ChunkID   string    `json:"chunkId"`
+	Entries   int       `json:"entries"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
 }
 
 // NewHealthHandler creates a new health handler
@@ -40,6 +59,73 @@ func (h *HealthHandler) SetStreamHub(hub *StreamHub) {
 	h.streamHub = hub
 }
 
+// SetBodyBudget sets the ingest body budget for metrics
+func (h *HealthHandler) SetBodyBudget(b *BodyBudget) {
+	h.budget = b
+}
+
+// SetDecodePool sets the ingest decode pool for metrics
+func (h *HealthHandler) SetDecodePool(p *DecodePool) {
+	h.decode = p
+}
+
+// StartReadProbe periodically reads back the most recent chunk to catch silent
+// corruption or permission problems. The result is cached for Health.
+func (h *HealthHandler) StartReadProbe(interval time.Duration) {
+	h.probeDone = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		h.runReadProbe()
+		for {
+			select {
+			case <-ticker.C:
+				h.runReadProbe()
+			case <-h.probeDone:
+				return
+			}
+		}
+	}()
+}
+
+// StopReadProbe stops the background read probe
+func (h *HealthHandler) StopReadProbe() {
+	if h.probeDone != nil {
+		close(h.probeDone)
+	}
+}
+
+// runReadProbe reads the latest chunk and records whether it decoded cleanly
+func (h *HealthHandler) runReadProbe() {
+	meta := h.index.LatestChunk()
+	if meta == nil {
+		// Nothing written yet; storage is trivially readable
+		return
+	}
+
+	result := &ReadProbeResult{ChunkID: meta.ID, CheckedAt: time.Now()}
+	entries, err := h.reader.VerifyChunk(meta.Labels, meta.ID)
+	result.Entries = entries
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("[HealthHandler] Read probe failed for chunk %s: %v", meta.ID, err)
+	} else {
+		result.OK = true
+	}
+
+	h.probeMu.Lock()
+	h.probeResult = result
+	h.probeMu.Unlock()
+}
+
+// ReadProbe returns the last read probe result, or nil if none has run
+func (h *HealthHandler) ReadProbe() *ReadProbeResult {
+	h.probeMu.RLock()
+	defer h.probeMu.RUnlock()
+	return h.probeResult
+}
+
 // Health handles GET /health
 func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 	lines, _, broadcasts := h.ingestor.GetMetrics()
@@ -47,7 +133,10 @@ func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 
 	var storageUsed int64
 	if h.writer != nil {
-		storageUsed = h.writer.GetStorageSize()
+		var err error
+		if storageUsed, err = h.writer.GetStorageSize(); err != nil {
+			log.Printf("[HealthHandler] Failed to read storage usage: %v", err)
+		}
 	}
 
 	var clientCount int
@@ -65,17 +154,32 @@ func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 		ingestionRate = int(lines / uptime)
 	}
 
+	status := "healthy"
+	readProbe := "null"
+	if probe := h.ReadProbe(); probe != nil {
+		if b, err := json.Marshal(probe); err == nil {
+			readProbe = string(b)
+		}
+		if !probe.OK {
+			status = "degraded"
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	if status != "healthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	fmt.Fprintf(w, `{
-		"status": "healthy",
+		"status": %q,
 		"ingestionRate": %d,
 		"storageUsed": %d,
 		"chunksCount": %d,
 		"uptime": %d,
 		"streamClients": %d,
 		"broadcastedLines": %d,
-		"droppedMessages": %d
-	}`, ingestionRate, storageUsed, chunkCount, uptime, clientCount, broadcasts, drops)
+		"droppedMessages": %d,
+		"readProbe": %s
+	}`, status, ingestionRate, storageUsed, chunkCount, uptime, clientCount, broadcasts, drops, readProbe)
 }
 
 // Metrics handles GET /metrics (Prometheus format)
@@ -85,15 +189,24 @@ func (h *HealthHandler) Metrics(w http.ResponseWriter, r *http.Request) {
 
 	var storageUsed int64
 	if h.writer != nil {
-		storageUsed = h.writer.GetStorageSize()
+		var err error
+		if storageUsed, err = h.writer.GetStorageSize(); err != nil {
+			log.Printf("[HealthHandler] Failed to read storage usage: %v", err)
+		}
 	}
 
 	var clientCount int
 	var drops int64
+	var queueLen, queueCap int
+	var queueHighWater int64
 	if h.streamHub != nil {
 		clientCount = h.streamHub.GetClientCount()
 		drops = h.streamHub.GetDroppedMessages()
+		queueLen, queueCap, queueHighWater = h.streamHub.GetQueueStats()
 	}
+	assignedTs, rejectedTs := h.ingestor.GetTimestampCounts()
+	truncatedLines, rejectedLines := h.ingestor.GetLongLineCounts()
+	lateEntries, rejectedLate := h.ingestor.GetLateCounts()
 
 	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 
@@ -126,6 +239,62 @@ lokiclone_broadcasted_lines_total %d
 # TYPE lokiclone_dropped_broadcasts_total counter
 lokiclone_dropped_broadcasts_total %d
 
+# HELP lokiclone_label_limit_rejected_streams_total Total streams rejected for having no labels left within the label limits
+# TYPE lokiclone_label_limit_rejected_streams_total counter
+lokiclone_label_limit_rejected_streams_total %d
+
+# HELP lokiclone_label_limit_dropped_labels_total Total labels stripped from streams for exceeding the label name or value limits
+# TYPE lokiclone_label_limit_dropped_labels_total counter
+lokiclone_label_limit_dropped_labels_total %d
+
+# HELP lokiclone_label_schema_violations_total Total streams that broke a label schema
+# TYPE lokiclone_label_schema_violations_total counter
+lokiclone_label_schema_violations_total %d
+
+# HELP lokiclone_detected_levels_total Total entries given a level label inferred from their line
+# TYPE lokiclone_detected_levels_total counter
+lokiclone_detected_levels_total %d
+
+# HELP lokiclone_json_label_skips_total Total JSON fields not promoted to labels for exceeding a value cap or the label name limit
+# TYPE lokiclone_json_label_skips_total counter
+lokiclone_json_label_skips_total %d
+
+# HELP lokiclone_assigned_timestamps_total Total entries stamped with their arrival time for lacking a valid timestamp
+# TYPE lokiclone_assigned_timestamps_total counter
+lokiclone_assigned_timestamps_total %d
+
+# HELP lokiclone_rejected_timestamps_total Total entries dropped for lacking a valid timestamp
+# TYPE lokiclone_rejected_timestamps_total counter
+lokiclone_rejected_timestamps_total %d
+
+# HELP lokiclone_late_entries_total Total entries older than the late window written to late chunks
+# TYPE lokiclone_late_entries_total counter
+lokiclone_late_entries_total %d
+
+# HELP lokiclone_rejected_late_entries_total Total entries dropped for arriving beyond the late window
+# TYPE lokiclone_rejected_late_entries_total counter
+lokiclone_rejected_late_entries_total %d
+
+# HELP lokiclone_truncated_lines_total Total lines truncated to the maximum line length
+# TYPE lokiclone_truncated_lines_total counter
+lokiclone_truncated_lines_total %d
+
+# HELP lokiclone_rejected_long_lines_total Total lines dropped for exceeding the maximum line length
+# TYPE lokiclone_rejected_long_lines_total counter
+lokiclone_rejected_long_lines_total %d
+
+# HELP lokiclone_broadcast_queue_length Current number of entries in the stream broadcast queue
+# TYPE lokiclone_broadcast_queue_length gauge
+lokiclone_broadcast_queue_length %d
+
+# HELP lokiclone_broadcast_queue_capacity Capacity of the stream broadcast queue
+# TYPE lokiclone_broadcast_queue_capacity gauge
+lokiclone_broadcast_queue_capacity %d
+
+# HELP lokiclone_broadcast_queue_high_water_mark Highest broadcast queue length observed since startup
+# TYPE lokiclone_broadcast_queue_high_water_mark gauge
+lokiclone_broadcast_queue_high_water_mark %d
+
 # HELP lokiclone_stream_clients_connected Current number of connected stream clients
 # TYPE lokiclone_stream_clients_connected gauge
 lokiclone_stream_clients_connected %d
@@ -141,5 +310,91 @@ lokiclone_storage_bytes %d
 # HELP lokiclone_uptime_seconds Server uptime in seconds
 # TYPE lokiclone_uptime_seconds gauge
 lokiclone_uptime_seconds %d
-`, bytes, lines, broadcasts, drops, clientCount, chunkCount, storageUsed, int64(time.Since(startTime).Seconds()))
+`, bytes, lines, broadcasts, drops, h.ingestor.GetLabelLimitRejects(), h.ingestor.GetDroppedLabels(), h.ingestor.GetLabelSchemaViolations(), h.ingestor.GetDetectedLevels(), h.ingestor.GetJSONLabelSkips(), assignedTs, rejectedTs, lateEntries, rejectedLate, truncatedLines, rejectedLines, queueLen, queueCap, queueHighWater, clientCount, chunkCount, storageUsed, int64(time.Since(startTime).Seconds()))
+
+	if h.budget != nil {
+		fmt.Fprintf(w, `
+# HELP lokiclone_ingest_inflight_body_bytes Request body bytes currently buffered by /ingest
+# TYPE lokiclone_ingest_inflight_body_bytes gauge
+lokiclone_ingest_inflight_body_bytes %d
+
+# HELP lokiclone_ingest_inflight_body_limit_bytes Configured budget for buffered /ingest bodies
+# TYPE lokiclone_ingest_inflight_body_limit_bytes gauge
+lokiclone_ingest_inflight_body_limit_bytes %d
+
+# HELP lokiclone_ingest_budget_rejected_total Total /ingest requests rejected for lack of body budget
+# TYPE lokiclone_ingest_budget_rejected_total counter
+lokiclone_ingest_budget_rejected_total %d
+`, h.budget.InUse(), h.budget.Limit(), h.budget.Rejected())
+	}
+
+	if h.decode != nil {
+		fmt.Fprintf(w, `
+# HELP lokiclone_ingest_decode_queue_length Ingest requests waiting for a decode worker
+# TYPE lokiclone_ingest_decode_queue_length gauge
+lokiclone_ingest_decode_queue_length %d
+
+# HELP lokiclone_ingest_decode_active Ingest requests currently being decoded
+# TYPE lokiclone_ingest_decode_active gauge
+lokiclone_ingest_decode_active %d
+
+# HELP lokiclone_ingest_decode_workers Configured number of concurrent ingest decodes
+# TYPE lokiclone_ingest_decode_workers gauge
+lokiclone_ingest_decode_workers %d
+
+# HELP lokiclone_ingest_decode_rejected_total Total ingest requests rejected while waiting for a decode worker
+# TYPE lokiclone_ingest_decode_rejected_total counter
+lokiclone_ingest_decode_rejected_total %d
+`, h.decode.Queued(), h.decode.Active(), h.decode.Workers(), h.decode.Rejected())
+	}
+
+	if h.streamHub != nil {
+		buffers := h.streamHub.GetClientBufferStats()
+		var perClient int64
+		if buffers.Clients > 0 {
+			perClient = buffers.BufferedBytes / int64(buffers.Clients)
+		}
+		fmt.Fprintf(w, `
+# HELP lokiclone_stream_client_buffered_bytes Bytes of messages buffered for all stream clients
+# TYPE lokiclone_stream_client_buffered_bytes gauge
+lokiclone_stream_client_buffered_bytes %d
+
+# HELP lokiclone_stream_client_buffered_bytes_per_client Average buffered bytes per stream client
+# TYPE lokiclone_stream_client_buffered_bytes_per_client gauge
+lokiclone_stream_client_buffered_bytes_per_client %d
+
+# HELP lokiclone_stream_client_buffered_bytes_max Buffered bytes of the most backed-up stream client
+# TYPE lokiclone_stream_client_buffered_bytes_max gauge
+lokiclone_stream_client_buffered_bytes_max %d
+
+# HELP lokiclone_stream_clients_compressed Stream clients buffering compressed messages
+# TYPE lokiclone_stream_clients_compressed gauge
+lokiclone_stream_clients_compressed %d
+
+# HELP lokiclone_stream_client_dropped_messages_total Total messages dropped for a full client buffer
+# TYPE lokiclone_stream_client_dropped_messages_total counter
+lokiclone_stream_client_dropped_messages_total %d
+
+# HELP lokiclone_stream_client_dropped_messages_max Messages dropped for a full buffer by the worst connected stream client
+# TYPE lokiclone_stream_client_dropped_messages_max gauge
+lokiclone_stream_client_dropped_messages_max %d
+
+# HELP lokiclone_stream_slow_clients_disconnected_total Total stream clients disconnected for overflowing their buffer
+# TYPE lokiclone_stream_slow_clients_disconnected_total counter
+lokiclone_stream_slow_clients_disconnected_total %d
+
+# HELP lokiclone_stream_rate_limited_messages_total Total messages dropped by per-client stream rate limits
+# TYPE lokiclone_stream_rate_limited_messages_total counter
+lokiclone_stream_rate_limited_messages_total %d
+
+# HELP lokiclone_stream_filter_groups Distinct filters among connected stream clients
+# TYPE lokiclone_stream_filter_groups gauge
+lokiclone_stream_filter_groups %d
+
+# HELP lokiclone_stream_filter_group_clients_max Stream clients sharing the most common filter
+# TYPE lokiclone_stream_filter_group_clients_max gauge
+lokiclone_stream_filter_group_clients_max %d
+`, buffers.BufferedBytes, perClient, buffers.MaxClientBytes, buffers.Compressed, buffers.DroppedMessages,
+			buffers.MaxClientDropped, buffers.Evicted, buffers.RateLimited, buffers.FilterGroups, buffers.MaxGroupClients)
+	}
 }
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestHealth_ReadProbeDegradesOnCorruptChunk(t *testing.T) {
+	dir := t.TempDir()
+	idx := index.NewIndex()
+	writer := storage.NewWriter(dir, 1024*1024)
+	reader := storage.NewReader(dir)
+	ingestor := ingest.NewIngestor(idx, writer, 100, nil)
+	h := NewHealthHandler(ingestor, reader, idx)
+
+	labels := map[string]string{"app": "api"}
+	now := time.Now()
+	chunkID, start, end, err := writer.WriteChunk(labels, []models.LogEntry{
+		{ID: "1", Timestamp: now, Line: "hello", Labels: labels},
+	})
+	if err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	idx.AddChunk(chunkID, labels, start, end, 1)
+
+	h.runReadProbe()
+	if probe := h.ReadProbe(); probe == nil || !probe.OK {
+		t.Fatalf("expected healthy probe, got %+v", probe)
+	}
+
+	chunkPath := filepath.Join(dir, models.Labels(labels).ToPath(), chunkID+".log")
+	if err := os.WriteFile(chunkPath, []byte("{not json\n"), 0644); err != nil {
+		t.Fatalf("corrupt chunk: %v", err)
+	}
+	h.runReadProbe()
+
+	rec := httptest.NewRecorder()
+	h.Health(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid health JSON: %v", err)
+	}
+	if body["status"] != "degraded" {
+		t.Errorf("expected degraded status, got %v", body["status"])
+	}
+}
@@ -2,7 +2,12 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/logpulse/backend/internal/plugin"
 
@@ -11,9 +16,16 @@ import (
 )
 
 
+// ExtraLabelsHeader carries comma-separated name=value labels to inject
+// into every stream of an ingest request
+const ExtraLabelsHeader = "X-LogPulse-Labels"
+
 type IngestHandler struct {
 	ingestor *ingest.Ingestor
 	notifier *plugin.WebhookNotifier
+
+	extraLabels   map[string]string
+	extraOverride bool
 }
 
 
@@ -22,6 +34,13 @@ func NewIngestHandler(ingestor *ingest.Ingestor, notifier *plugin.WebhookNotifie
 }
 
 
+// SetExtraLabels configures static labels merged into every ingested
+// stream. When override is false, labels sent by the agent take precedence.
+func (h *IngestHandler) SetExtraLabels(labels map[string]string, override bool) {
+	h.extraLabels = labels
+	h.extraOverride = override
+}
+
 func (h *IngestHandler) Ingest(w http.ResponseWriter, r *http.Request) {
 	var req models.IngestRequest
 
@@ -30,7 +49,20 @@ func (h *IngestHandler) Ingest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	extra, err := parseExtraLabels(r.Header.Get(ExtraLabelsHeader))
+	if err != nil {
+		http.Error(w, "Invalid "+ExtraLabelsHeader+" header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.injectLabels(&req, extra)
+	if err := applyKeyScope(&req, keyScope(r)); err != nil {
+		ingest.RecordRejectedRequest(ingest.RejectKeyScope, &req)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
 	if err := ingest.ValidateIngestRequest(&req); err != nil {
+		ingest.RecordRejectedRequest(ingest.RejectInvalidRequest, &req)
 		http.Error(w, "Validation error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -38,7 +70,7 @@ func (h *IngestHandler) Ingest(w http.ResponseWriter, r *http.Request) {
 
 	       accepted, err := h.ingestor.Ingest(&req)
 	       if err != nil {
-		       http.Error(w, "Ingestion error: "+err.Error(), http.StatusInternalServerError)
+		       writeIngestError(w, h.ingestor, err)
 		       return
 	       }
 
@@ -60,3 +92,65 @@ func (h *IngestHandler) Ingest(w http.ResponseWriter, r *http.Request) {
 		Accepted: accepted,
 	})
 }
+
+// writeIngestError answers a failed Ingest: 503 with Retry-After when the
+// ingestor pushed back, so clients retry later, and 500 otherwise
+func writeIngestError(w http.ResponseWriter, ing *ingest.Ingestor, err error) {
+	if errors.Is(err, ingest.ErrBackpressure) {
+		setRetryAfter(w, ing)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Ingestion error: "+err.Error(), http.StatusInternalServerError)
+}
+
+// setRetryAfter tells a client refused by back-pressure when to retry
+func setRetryAfter(w http.ResponseWriter, ing *ingest.Ingestor) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ing.RetryAfter().Seconds()))))
+}
+
+// injectLabels merges the configured and header labels into every stream.
+// Header labels take precedence over configured ones.
+func (h *IngestHandler) injectLabels(req *models.IngestRequest, header map[string]string) {
+	if len(h.extraLabels) == 0 && len(header) == 0 {
+		return
+	}
+	injected := make(map[string]string, len(h.extraLabels)+len(header))
+	for k, v := range h.extraLabels {
+		injected[k] = v
+	}
+	for k, v := range header {
+		injected[k] = v
+	}
+
+	for i := range req.Streams {
+		merged := make(map[string]string, len(injected)+len(req.Streams[i].Labels))
+		for k, v := range injected {
+			merged[k] = v
+		}
+		for k, v := range req.Streams[i].Labels {
+			if _, ok := injected[k]; ok && h.extraOverride {
+				continue
+			}
+			merged[k] = v
+		}
+		req.Streams[i].Labels = merged
+	}
+}
+
+// parseExtraLabels parses a header value such as "region=eu,env=prod"
+func parseExtraLabels(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=value, got %q", pair)
+		}
+		labels[name] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestParseExtraLabels(t *testing.T) {
+	labels, err := parseExtraLabels(" region=eu, env=prod ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if labels["region"] != "eu" || labels["env"] != "prod" || len(labels) != 2 {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+	for _, bad := range []string{"region", "=eu", "region=eu,,"} {
+		if _, err := parseExtraLabels(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestInjectLabels_Precedence(t *testing.T) {
+	newReq := func() *models.IngestRequest {
+		return &models.IngestRequest{Streams: []models.Stream{
+			{Labels: map[string]string{"app": "api", "env": "dev"}},
+		}}
+	}
+	header := map[string]string{"region": "eu"}
+
+	h := &IngestHandler{}
+	h.SetExtraLabels(map[string]string{"env": "prod", "region": "us"}, false)
+	req := newReq()
+	h.injectLabels(req, header)
+	got := req.Streams[0].Labels
+	if got["env"] != "dev" || got["region"] != "eu" || got["app"] != "api" {
+		t.Errorf("expected agent and header labels to win, got %v", got)
+	}
+
+	h.SetExtraLabels(map[string]string{"env": "prod"}, true)
+	req = newReq()
+	h.injectLabels(req, nil)
+	if env := req.Streams[0].Labels["env"]; env != "prod" {
+		t.Errorf("expected override to set env=prod, got %q", env)
+	}
+}
+
+func TestIngest_BackpressureAtHighWater(t *testing.T) {
+	ingestor := ingest.NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 100, nil)
+	if err := ingestor.SetBufferHighWater(3); err != nil {
+		t.Fatal(err)
+	}
+	h := NewIngestHandler(ingestor, nil)
+
+	post := func() *httptest.ResponseRecorder {
+		body := `{"streams":[{"labels":{"app":"api"},"entries":[` +
+			`{"ts":"2026-01-01T00:00:00Z","line":"a"},` +
+			`{"ts":"2026-01-01T00:00:01Z","line":"b"},` +
+			`{"ts":"2026-01-01T00:00:02Z","line":"c"}]}]}`
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/ingest", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		h.Ingest(rec, req)
+		return rec
+	}
+
+	if rec := post(); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 below the high-water mark, got %d: %s", rec.Code, rec.Body)
+	}
+	if n := ingestor.BufferedEntries(); n != 3 {
+		t.Fatalf("expected 3 buffered entries, got %d", n)
+	}
+
+	rec := post()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After at the high-water mark, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	ingestor.Flush()
+	if n := ingestor.BufferedEntries(); n != 0 {
+		t.Fatalf("expected no buffered entries after a flush, got %d", n)
+	}
+	if rec := post(); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 once flushed, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+)
+
+func TestAuthMiddleware_KeyScope(t *testing.T) {
+	keys := newAPIKeys(config.AuthConfig{
+		APIKey: "admin",
+		Keys: []config.APIKeyConfig{
+			{Name: "payments", Key: "pay", Labels: map[string]string{"team": "payments"}},
+			{Name: "ops", Key: "ops"},
+		},
+	})
+
+	var scope map[string]string
+	handler := authMiddleware(keys, nil, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope = keyScope(r)
+	}))
+
+	cases := []struct {
+		key    string
+		status int
+		team   string
+	}{
+		{"admin", http.StatusOK, ""},
+		{"ops", http.StatusOK, ""},
+		{"pay", http.StatusOK, "payments"},
+		{"", http.StatusUnauthorized, ""},
+		{"wrong", http.StatusUnauthorized, ""},
+	}
+	for _, c := range cases {
+		scope = nil
+		req := httptest.NewRequest("GET", "/query", nil)
+		req.Header.Set("X-API-Key", c.key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("key %q: expected status %d, got %d", c.key, c.status, rec.Code)
+		}
+		if scope["team"] != c.team {
+			t.Errorf("key %q: expected scope team=%q, got %v", c.key, c.team, scope)
+		}
+	}
+}
+
+func TestApplyKeyScope(t *testing.T) {
+	scope := map[string]string{"team": "payments"}
+
+	req := &models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}},
+		{Labels: map[string]string{"app": "worker", "team": "payments"}},
+	}}
+	if err := applyKeyScope(req, scope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, s := range req.Streams {
+		if s.Labels["team"] != "payments" {
+			t.Errorf("expected stream to be stamped with team=payments, got %v", s.Labels)
+		}
+	}
+
+	req = &models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api", "team": "search"}},
+	}}
+	if err := applyKeyScope(req, scope); err == nil {
+		t.Error("expected an out-of-scope label to be rejected")
+	}
+}
+
+func TestAuthMiddleware_ExemptPaths(t *testing.T) {
+	handler := authMiddleware(apiKeys{"secret": nil}, []string{"/health", "/metrics/"}, false)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for path, want := range map[string]int{
+		"/health":         http.StatusOK,
+		"/health/live":    http.StatusOK,
+		"/metrics":        http.StatusOK,
+		"/healthz":        http.StatusUnauthorized,
+		"/query":          http.StatusUnauthorized,
+		"/metrics-secret": http.StatusUnauthorized,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: expected %d without a key, got %d", path, want, rec.Code)
+		}
+	}
+}
+
+func TestLabels_KeyScope(t *testing.T) {
+	idx := index.NewIndex()
+	now := time.Now()
+	idx.AddChunk("c1", map[string]string{"team": "payments", "app": "api"}, now, now, 1)
+	idx.AddChunk("c2", map[string]string{"team": "search", "app": "indexer", "shard": "7"}, now, now, 1)
+	scoped := func(req *http.Request) *http.Request {
+		return req.WithContext(withKeyScope(req.Context(), map[string]string{"team": "payments"}))
+	}
+	get := func(handler http.HandlerFunc, req *http.Request, out interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("%s: %v", req.URL.Path, err)
+		}
+	}
+
+	q := NewQueryHandler(idx, nil)
+	var names, values []string
+	get(q.Labels, scoped(httptest.NewRequest("GET", "/labels", nil)), &names)
+	if want := []string{"app", "team"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected the scoped streams' names %v, got %v", want, names)
+	}
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/labels/app/values", nil), map[string]string{"name": "app"})
+	get(q.LabelValues, scoped(req), &values)
+	if want := []string{"api"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("expected the scoped streams' values %v, got %v", want, values)
+	}
+	get(q.LabelValues, req, &values)
+	if len(values) != 2 {
+		t.Errorf("expected every value without a scope, got %v", values)
+	}
+
+	l := NewLokiHandler(idx, nil)
+	var resp struct {
+		Data []string `json:"data"`
+	}
+	get(l.Labels, scoped(httptest.NewRequest("GET", "/loki/api/v1/labels", nil)), &resp)
+	if want := []string{"app", "team"}; !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("expected the scoped streams' names %v, got %v", want, resp.Data)
+	}
+	get(l.LabelValues, scoped(httptest.NewRequest("GET", "/loki/api/v1/label/team/values", nil)), &resp)
+	if want := []string{"payments"}; !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("expected only the key's team, got %v", resp.Data)
+	}
+}
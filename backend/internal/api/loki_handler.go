@@ -1,9 +1,11 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,7 +17,10 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/logpulse/backend/internal/clock"
 	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
 	"github.com/logpulse/backend/internal/query"
 	"github.com/logpulse/backend/internal/storage"
 )
@@ -26,7 +31,23 @@ type LokiHandler struct {
 	reader   *storage.Reader
 	executor *query.Executor
 
-	// Prometheus metrics
+	// instantLookback is the default window for instant queries
+	instantLookback time.Duration
+
+	// clock is "now" for default ranges and relative times
+	clock clock.Clock
+
+	// ingestor receives pushed entries (nil = push disabled), dropping
+	// those older than rejectOldSamples when set
+	ingestor         *ingest.Ingestor
+	rejectOldSamples time.Duration
+
+	// cache holds responses to query_range requests over closed ranges
+	// (nil = no caching)
+	cache *queryCache
+
+	// Prometheus metrics; metricDims are the optional labels recorded
+	metricDims   map[string]bool
 	requestCount *prometheus.CounterVec
 	latency      *prometheus.HistogramVec
 	errorCount   *prometheus.CounterVec
@@ -47,7 +68,7 @@ func NewLokiHandler(idx *index.Index, reader *storage.Reader) *LokiHandler {
 				Name: "loki_handler_requests_total",
 				Help: "Total number of requests to LokiHandler endpoints.",
 			},
-			[]string{"endpoint", "method"},
+			lokiMetricLabels,
 		)
 		lokiLatency = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
@@ -55,7 +76,7 @@ func NewLokiHandler(idx *index.Index, reader *storage.Reader) *LokiHandler {
 				Help:    "Request latency for LokiHandler endpoints.",
 				Buckets: prometheus.DefBuckets,
 			},
-			[]string{"endpoint", "method"},
+			lokiMetricLabels,
 		)
 		lokiErrorCount = prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -69,19 +90,49 @@ func NewLokiHandler(idx *index.Index, reader *storage.Reader) *LokiHandler {
 	})
 
 	return &LokiHandler{
-		index:        idx,
-		reader:       reader,
-		executor:     query.NewExecutor(idx, reader),
-		requestCount: lokiRequestCount,
-		latency:      lokiLatency,
-		errorCount:   lokiErrorCount,
+		index:           idx,
+		reader:          reader,
+		executor:        query.NewExecutor(idx, reader),
+		instantLookback: 5 * time.Minute,
+		clock:           clock.Real{},
+		requestCount:    lokiRequestCount,
+		latency:         lokiLatency,
+		errorCount:      lokiErrorCount,
+	}
+}
+
+// SetStrictConsistency makes queries fail on chunks missing from storage
+func (h *LokiHandler) SetStrictConsistency(strict bool) {
+	h.executor.SetStrictConsistency(strict)
+}
+
+// SetClock replaces the clock queries take "now" from
+func (h *LokiHandler) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// SetResultCache caches query_range responses for ranges ending in the
+// past, up to maxBytes of response bodies, each for ttl. Ranges reaching
+// now are always executed, since entries are still arriving for them.
+func (h *LokiHandler) SetResultCache(maxBytes int64, ttl time.Duration) {
+	h.cache = newQueryCache(maxBytes, ttl)
+}
+
+// SetInstantLookback sets the default window for instant queries
+func (h *LokiHandler) SetInstantLookback(d time.Duration) {
+	if d > 0 {
+		h.instantLookback = d
 	}
 }
 
 // LokiQueryRangeResponse represents Loki's query_range response format
 type LokiQueryRangeResponse struct {
-	Status string         `json:"status"`
-	Data   LokiResultData `json:"data"`
+	Status   string         `json:"status"`
+	Data     LokiResultData `json:"data"`
+	Warnings []string       `json:"warnings,omitempty"`
+	// NextCursor, passed back as the cursor parameter, fetches the lines
+	// past the limit; empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // LokiResultData contains the result type and values
@@ -102,12 +153,15 @@ func (h *LokiHandler) QueryRange(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(r.Context(), "QueryRange", trace.WithAttributes(
 		attribute.String("http.method", r.Method),
 		attribute.String("http.route", "/loki/api/v1/query_range"),
+		attribute.String("request.id", RequestIDFromContext(r.Context())),
 	))
 	defer span.End()
 	r = r.WithContext(ctx)
 	startObs := time.Now()
 	endpoint := "/loki/api/v1/query_range"
-	h.requestCount.WithLabelValues(endpoint, r.Method).Inc()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	w = sw
+	defer h.observe(endpoint, r.Method, sw, startObs)
 	queryStr := r.URL.Query().Get("query")
 	startStr := r.URL.Query().Get("start")
 	endStr := r.URL.Query().Get("end")
@@ -122,27 +176,28 @@ func (h *LokiHandler) QueryRange(w http.ResponseWriter, r *http.Request) {
 	// Parse time range (Loki uses nanoseconds or RFC3339)
 	var startTime, endTime time.Time
 	var err error
+	now := h.clock.Now()
 
 	if startStr != "" {
-		startTime, err = parseLokiTime(startStr)
+		startTime, err = parseLokiTime(startStr, now)
 		if err != nil {
 			h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
 			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid start time format", fmt.Sprintf("Expected nanoseconds or RFC3339 format, got: %s", startStr))
 			return
 		}
 	} else {
-		startTime = time.Now().Add(-1 * time.Hour)
+		startTime = now.Add(-1 * time.Hour)
 	}
 
 	if endStr != "" {
-		endTime, err = parseLokiTime(endStr)
+		endTime, err = parseLokiTime(endStr, now)
 		if err != nil {
 			h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
 			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid end time format", fmt.Sprintf("Expected nanoseconds or RFC3339 format, got: %s", endStr))
 			return
 		}
 	} else {
-		endTime = time.Now()
+		endTime = now
 	}
 
 	// Validate time range
@@ -170,57 +225,79 @@ func (h *LokiHandler) QueryRange(w http.ResponseWriter, r *http.Request) {
 		limit = parsedLimit
 	}
 
+	forward, ok := parseLokiDirection(r.URL.Query().Get("direction"))
+	if !ok {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeValidationError, "Invalid direction parameter", "Direction must be forward or backward")
+		return
+	}
+
+	// Metric queries are evaluated every step, by default so the range
+	// gives about 250 points as Loki does
+	step := defaultLokiStep(startTime, endTime)
+	if stepStr := r.URL.Query().Get("step"); stepStr != "" {
+		if step, err = parseStep(stepStr); err != nil || step < time.Second {
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeValidationError, "Invalid step parameter", "Step must be at least 1s, in seconds or as a duration")
+			return
+		}
+	}
+
+	// Pages run from the end of the range back, whichever the direction
+	// each page is sorted in
+	opts := query.ExecuteOptions{Scope: keyScope(r), Step: step, Dedup: r.URL.Query().Get("dedup") == "true"}
+	if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+		if opts.Cursor, err = query.DecodeCursor(cursorStr); err != nil {
+			WriteQueryError(w, err, "")
+			return
+		}
+	}
+
+	var cacheKey string
+	if h.cache != nil && endTime.Before(now) {
+		cacheKey = queryCacheKey(queryStr, startTime, endTime, step, limit, r.URL.Query().Get("direction"),
+			r.URL.Query().Get("cursor"), r.Header.Get("Accept"), opts.Dedup, opts.Scope)
+		if cached, ok := h.cache.get(cacheKey, now); ok {
+			w.Header().Set("Content-Type", cached.contentType)
+			w.Write(cached.body)
+			return
+		}
+	}
+
 	// Execute query
-	result, err := h.executor.Execute(queryStr, startTime, endTime, limit)
+	result, err := h.executor.ExecuteWithOptions(queryStr, startTime, endTime, limit, opts)
 	if err != nil {
 		h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
 		WriteQueryError(w, err, "")
 		return
 	}
 
-	// Convert to Loki format - group by labels
-	streamMap := make(map[string]*LokiStream)
-
-	for _, log := range result.Logs {
-		// Create label key for grouping
-		labelKey := labelsToKey(log.Labels)
-
-		if stream, exists := streamMap[labelKey]; exists {
-			// Add value to existing stream
-			parsedTime, _ := time.Parse(time.RFC3339Nano, log.Timestamp)
-			stream.Values = append(stream.Values, []string{
-				strconv.FormatInt(parsedTime.UnixNano(), 10),
-				log.Message,
-			})
-		} else {
-			// Create new stream
-			parsedTime, _ := time.Parse(time.RFC3339Nano, log.Timestamp)
-			streamMap[labelKey] = &LokiStream{
-				Stream: log.Labels,
-				Values: [][]string{
-					{strconv.FormatInt(parsedTime.UnixNano(), 10), log.Message},
-				},
-			}
-		}
+	format := lokiStreamsFormat
+	if result.Aggregation != nil {
+		format = lokiMatrixFormat
 	}
-
-	// Convert map to slice
-	streams := make([]LokiStream, 0, len(streamMap))
-	for _, stream := range streamMap {
-		streams = append(streams, *stream)
+	wopts := writeOptions{EvalTime: endTime, Forward: forward}
+	if cacheKey == "" {
+		writeResult(w, r, format, result, wopts)
+		return
 	}
 
-	response := LokiQueryRangeResponse{
-		Status: "success",
-		Data: LokiResultData{
-			ResultType: "streams",
-			Result:     streams,
-		},
+	format = negotiateFormat(r, format)
+	var body bytes.Buffer
+	if err := format.Write(&body, result, wopts); err == nil {
+		h.cache.put(cacheKey, format.ContentType, body.Bytes(), now)
 	}
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Write(body.Bytes())
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	h.latency.WithLabelValues(endpoint, r.Method).Observe(time.Since(startObs).Seconds())
+// lokiStepPoints is the number of points Loki splits a range into when a
+// query_range request gives no step
+const lokiStepPoints = 250
+
+// defaultLokiStep returns Loki's default step for a range: the whole
+// seconds giving at most lokiStepPoints points, and at least 1s
+func defaultLokiStep(startTime, endTime time.Time) time.Duration {
+	step := (endTime.Sub(startTime) + lokiStepPoints*time.Second - 1) / lokiStepPoints
+	return max(step.Truncate(time.Second), time.Second)
 }
 
 // Query handles GET /loki/api/v1/query (instant query)
@@ -229,15 +306,20 @@ func (h *LokiHandler) Query(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(r.Context(), "Query", trace.WithAttributes(
 		attribute.String("http.method", r.Method),
 		attribute.String("http.route", "/loki/api/v1/query"),
+		attribute.String("request.id", RequestIDFromContext(r.Context())),
 	))
 	defer span.End()
 	r = r.WithContext(ctx)
 	startObs := time.Now()
 	endpoint := "/loki/api/v1/query"
-	h.requestCount.WithLabelValues(endpoint, r.Method).Inc()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	w = sw
+	defer h.observe(endpoint, r.Method, sw, startObs)
 	// Instant query - use small time window
 	queryStr := r.URL.Query().Get("query")
 	limitStr := r.URL.Query().Get("limit")
+	timeStr := r.URL.Query().Get("time")
+	startStr := r.URL.Query().Get("start")
 
 	// Validate query parameter
 	if queryStr == "" {
@@ -245,8 +327,35 @@ func (h *LokiHandler) Query(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endTime := time.Now()
-	startTime := endTime.Add(-5 * time.Minute)
+	// Evaluate at the explicit time if given, otherwise now
+	now := h.clock.Now()
+	endTime := now
+	if timeStr != "" {
+		t, err := parseLokiTime(timeStr, now)
+		if err != nil {
+			h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid time format", fmt.Sprintf("Expected nanoseconds or RFC3339 format, got: %s", timeStr))
+			return
+		}
+		endTime = t
+	}
+
+	// An explicit start overrides the configured lookback
+	startTime := endTime.Add(-h.instantLookback)
+	if startStr != "" {
+		t, err := parseLokiTime(startStr, now)
+		if err != nil {
+			h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid start time format", fmt.Sprintf("Expected nanoseconds or RFC3339 format, got: %s", startStr))
+			return
+		}
+		if t.After(endTime) {
+			h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
+			WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid time range", "Start time must be before end time")
+			return
+		}
+		startTime = t
+	}
 
 	limit := 100
 	if limitStr != "" {
@@ -266,56 +375,39 @@ func (h *LokiHandler) Query(w http.ResponseWriter, r *http.Request) {
 		limit = parsedLimit
 	}
 
-	result, err := h.executor.Execute(queryStr, startTime, endTime, limit)
+	forward, ok := parseLokiDirection(r.URL.Query().Get("direction"))
+	if !ok {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeValidationError, "Invalid direction parameter", "Direction must be forward or backward")
+		return
+	}
+
+	opts := query.ExecuteOptions{Scope: keyScope(r), Dedup: r.URL.Query().Get("dedup") == "true"}
+	result, err := h.executor.ExecuteWithOptions(queryStr, startTime, endTime, limit, opts)
 	if err != nil {
 		h.errorCount.WithLabelValues(endpoint, r.Method).Inc()
 		WriteQueryError(w, err, "")
 		return
 	}
 
-	// Convert to Loki format
-	streamMap := make(map[string]*LokiStream)
-
-	for _, log := range result.Logs {
-		labelKey := labelsToKey(log.Labels)
-
-		parsedTime, _ := time.Parse(time.RFC3339Nano, log.Timestamp)
-		if stream, exists := streamMap[labelKey]; exists {
-			stream.Values = append(stream.Values, []string{
-				strconv.FormatInt(parsedTime.UnixNano(), 10),
-				log.Message,
-			})
-		} else {
-			streamMap[labelKey] = &LokiStream{
-				Stream: log.Labels,
-				Values: [][]string{
-					{strconv.FormatInt(parsedTime.UnixNano(), 10), log.Message},
-				},
-			}
-		}
-	}
-
-	streams := make([]LokiStream, 0, len(streamMap))
-	for _, stream := range streamMap {
-		streams = append(streams, *stream)
-	}
+	writeResult(w, r, lokiStreamsFormat, result, writeOptions{EvalTime: endTime, Forward: forward})
+}
 
-	response := LokiQueryRangeResponse{
-		Status: "success",
-		Data: LokiResultData{
-			ResultType: "streams",
-			Result:     streams,
-		},
+// parseLokiDirection reports whether a direction parameter orders stream
+// values oldest first. Loki's default, backward, orders them newest first;
+// either way the limit keeps the newest entries.
+func parseLokiDirection(s string) (forward bool, ok bool) {
+	switch strings.ToLower(s) {
+	case "", "backward":
+		return false, true
+	case "forward":
+		return true, true
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	h.latency.WithLabelValues(endpoint, r.Method).Observe(time.Since(startObs).Seconds())
+	return false, false
 }
 
 // Labels handles GET /loki/api/v1/labels
 func (h *LokiHandler) Labels(w http.ResponseWriter, r *http.Request) {
-	labels := h.index.GetAllLabels()
+	labels := scopedLabelNames(h.index, keyScope(r))
 
 	response := map[string]interface{}{
 		"status": "success",
@@ -341,7 +433,7 @@ func (h *LokiHandler) LabelValues(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	values := h.index.GetLabelValues(labelName)
+	values := scopedLabelValues(h.index, labelName, keyScope(r))
 
 	response := map[string]interface{}{
 		"status": "success",
@@ -352,14 +444,83 @@ func (h *LokiHandler) LabelValues(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// Series handles GET /loki/api/v1/series, listing the distinct label sets
+// of streams that match any of the match[] selectors and have chunks in the
+// start to end range (the last hour by default)
+func (h *LokiHandler) Series(w http.ResponseWriter, r *http.Request) {
+	selectors := r.URL.Query()["match[]"]
+	if len(selectors) == 0 {
+		WriteValidationError(w, "match[]", "At least one match[] selector is required")
+		return
+	}
+	startTime, endTime, ok := parseQueryRange(w, r, h.clock.Now())
+	if !ok {
+		return
+	}
+	if startTime.After(endTime) {
+		WriteErrorResponse(w, http.StatusBadRequest, ErrorCodeInvalidTimeRange, "Invalid time range", "Start time must be before end time")
+		return
+	}
+
+	matchers := make([]*query.ParsedQuery, 0, len(selectors))
+	for _, selector := range selectors {
+		parsed, err := query.ParseAdvancedQuery(selector)
+		if err != nil {
+			WriteQueryError(w, err, selector)
+			return
+		}
+		matchers = append(matchers, parsed)
+	}
+
+	scope := models.Labels(keyScope(r))
+	metas := h.index.FindChunkMetas(startTime, endTime, func(labels map[string]string) bool {
+		if !models.Labels(labels).Match(scope) {
+			return false
+		}
+		for _, m := range matchers {
+			if m.MatchLabels(labels) {
+				return true
+			}
+		}
+		return false
+	})
+
+	// A stream has many chunks; list each label set once, in a stable order
+	keys := make([]string, 0)
+	series := make(map[string]map[string]string)
+	for _, meta := range metas {
+		key := labelsToKey(meta.Labels)
+		if _, ok := series[key]; !ok {
+			series[key] = meta.Labels
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	data := make([]map[string]string, len(keys))
+	for i, key := range keys {
+		data[i] = series[key]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	})
+}
+
 // Ready handles GET /ready (health check for Grafana)
 func (h *LokiHandler) Ready(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ready"))
 }
 
-// parseLokiTime parses time in Loki format (nanoseconds or RFC3339)
-func parseLokiTime(s string) (time.Time, error) {
+// parseLokiTime parses time in Loki format (nanoseconds or RFC3339) or as a
+// relative expression such as now, now-1h or now-30m, taken from now
+func parseLokiTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "now") {
+		return parseRelativeTime(s, now)
+	}
+
 	// Try nanoseconds first
 	if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
 		return time.Unix(0, ns), nil
@@ -374,11 +535,63 @@ func parseLokiTime(s string) (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, s)
 }
 
-// labelsToKey creates a unique key from labels map
+// parseRelativeTime parses now[+-]<duration> relative to the given instant.
+// Durations accept Go syntax (1h30m) plus d and w suffixes for days and weeks.
+func parseRelativeTime(s string, now time.Time) (time.Time, error) {
+	rest := strings.TrimSpace(strings.TrimPrefix(s, "now"))
+	if rest == "" {
+		return now, nil
+	}
+
+	sign := rest[0]
+	if sign != '-' && sign != '+' {
+		return time.Time{}, fmt.Errorf("invalid relative time %q", s)
+	}
+
+	d, err := parseExtendedDuration(strings.TrimSpace(rest[1:]))
+	if err != nil || d <= 0 {
+		return time.Time{}, fmt.Errorf("invalid relative time %q", s)
+	}
+
+	if sign == '-' {
+		return now.Add(-d), nil
+	}
+	return now.Add(d), nil
+}
+
+// parseExtendedDuration parses a Go duration, also accepting a single
+// integer with a d (day) or w (week) suffix
+func parseExtendedDuration(s string) (time.Duration, error) {
+	if n := len(s); n > 1 && (s[n-1] == 'd' || s[n-1] == 'w') {
+		value, err := strconv.Atoi(s[:n-1])
+		if err != nil {
+			return 0, err
+		}
+		unit := 24 * time.Hour
+		if s[n-1] == 'w' {
+			unit *= 7
+		}
+		return time.Duration(value) * unit, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// labelsToKey creates a unique key from labels map. Keys are sorted so equal
+// label sets always give the same key, and values are quoted so a value
+// containing "," or "=" cannot collide with another label set.
 func labelsToKey(labels map[string]string) string {
-	key := ""
-	for k, v := range labels {
-		key += k + "=" + v + ","
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+		sb.WriteByte(',')
 	}
-	return key
+	return sb.String()
 }
@@ -0,0 +1,516 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestParseRelativeTime(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"now", now},
+		{"now-1h", now.Add(-time.Hour)},
+		{"now-30m", now.Add(-30 * time.Minute)},
+		{"now - 90s", now.Add(-90 * time.Second)},
+		{"now+5m", now.Add(5 * time.Minute)},
+		{"now-2d", now.Add(-48 * time.Hour)},
+		{"now-1w", now.Add(-7 * 24 * time.Hour)},
+		{"now-1h30m", now.Add(-90 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseRelativeTime(tt.input, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseRelativeTime_Invalid(t *testing.T) {
+	now := time.Now()
+	for _, input := range []string{"now-", "now-abc", "now*1h", "now-0s", "nowish"} {
+		if _, err := parseRelativeTime(input, now); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestParseLokiTime_AbsoluteFormats(t *testing.T) {
+	want := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	got, err := parseLokiTime("1705320000000000000", time.Now())
+	if err != nil || !got.Equal(want) {
+		t.Errorf("nanoseconds: expected %v, got %v (err %v)", want, got, err)
+	}
+
+	got, err = parseLokiTime("2024-01-15T12:00:00Z", time.Now())
+	if err != nil || !got.Equal(want) {
+		t.Errorf("RFC3339: expected %v, got %v (err %v)", want, got, err)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&LokiHandler{}).BuildInfo(rec, httptest.NewRequest("GET", "/loki/api/v1/status/buildinfo", nil))
+
+	var info map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if info["version"] != LokiCompatVersion || info["goVersion"] == "" {
+		t.Errorf("expected Loki version %s and a Go version, got %v", LokiCompatVersion, info)
+	}
+}
+
+func TestLabelsToKey_Stable(t *testing.T) {
+	labels := map[string]string{"app": "api", "env": "prod", "region": "eu", "team": "payments", "zone": "a"}
+	want := labelsToKey(labels)
+	for i := 0; i < 100; i++ {
+		// A fresh map each time gets a fresh iteration order
+		copied := make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		if got := labelsToKey(copied); got != want {
+			t.Fatalf("expected stable key %q, got %q", want, got)
+		}
+	}
+
+	a := labelsToKey(map[string]string{"a": "1,b=2"})
+	b := labelsToKey(map[string]string{"a": "1", "b": "2"})
+	if a == b {
+		t.Errorf("expected distinct label sets to get distinct keys, both got %q", a)
+	}
+}
+
+func TestLokiHandler_MetricLabels(t *testing.T) {
+	h := NewLokiHandler(index.NewIndex(), storage.NewReader(t.TempDir()))
+	if err := h.SetMetricLabels([]string{"tenant"}); err == nil {
+		t.Error("expected an error for a label outside the allowed set")
+	}
+	if err := h.SetMetricLabels([]string{"status_code", "status_class"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := testutil.ToFloat64(lokiRequestCount.WithLabelValues("/loki/api/v1/query_range", "GET", "400", "4xx"))
+	rec := httptest.NewRecorder()
+	h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a query, got %d", rec.Code)
+	}
+	after := testutil.ToFloat64(lokiRequestCount.WithLabelValues("/loki/api/v1/query_range", "GET", "400", "4xx"))
+	if after != before+1 {
+		t.Errorf("expected the 400 to be counted with its status labels, got %v -> %v", before, after)
+	}
+}
+
+func TestDropOldSamples(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	req := &models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}, Entries: []models.Entry{
+			{Ts: now.Add(-2 * time.Hour).Format(time.RFC3339), Line: "old"},
+			{Ts: now.Add(-time.Minute).Format(time.RFC3339), Line: "new"},
+			{Ts: "", Line: "untimed"},
+		}},
+		{Labels: map[string]string{"app": "web"}, Entries: []models.Entry{
+			{Ts: now.Add(-3 * time.Hour).Format(time.RFC3339), Line: "old"},
+		}},
+	}}
+
+	if dropped := dropOldSamples(req, time.Hour, now); dropped != 2 {
+		t.Errorf("expected 2 entries dropped, got %d", dropped)
+	}
+	if len(req.Streams) != 1 || len(req.Streams[0].Entries) != 2 || req.Streams[0].Entries[0].Line != "new" {
+		t.Errorf("expected only the api stream with its recent and untimed lines, got %+v", req.Streams)
+	}
+}
+
+func TestWriteResult_Formats(t *testing.T) {
+	result := &query.QueryResult{Logs: []query.LogResponse{
+		{Timestamp: "2024-01-01T00:00:00Z", Message: "first", Labels: map[string]string{"app": "api"}},
+		{Timestamp: "2024-01-01T00:00:01Z", Message: "second", Labels: map[string]string{"app": "api"}},
+	}}
+	evalTime := time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+	write := func(def *resultFormat, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		writeResult(rec, req, def, result, writeOptions{EvalTime: evalTime})
+		return rec
+	}
+
+	// The Loki endpoints answer as before, whatever JSON the client accepts
+	want := `{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"api"},"values":[["1704067201000000000","second"],["1704067200000000000","first"]]}]}}` + "\n"
+	for _, accept := range []string{"", "application/json", "*/*", "text/html"} {
+		rec := write(lokiStreamsFormat, accept)
+		if got := rec.Body.String(); got != want {
+			t.Errorf("Accept %q: expected unchanged Loki output\n%s\ngot\n%s", accept, want, got)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Accept %q: expected application/json, got %q", accept, ct)
+		}
+	}
+
+	rec := write(nativeFormat, "application/json")
+	var native query.QueryResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &native); err != nil || len(native.Logs) != 2 || native.Logs[0].Message != "first" {
+		t.Errorf("expected native output with messages, got %s (%v)", rec.Body.String(), err)
+	}
+
+	rec = write(nativeFormat, "application/vnd.loki.streams+json;q=0.5, application/x-ndjson")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("expected the preferred ndjson format, got %q", ct)
+	}
+	if lines := strings.Count(rec.Body.String(), "\n"); lines != 2 {
+		t.Errorf("expected one line per log, got %d lines: %s", lines, rec.Body.String())
+	}
+
+	result.Aggregation = &query.AggregationResult{Type: "count_over_time", Groups: []query.AggregationGroup{
+		{Labels: map[string]string{"app": "api"}, Value: 2},
+	}}
+	rec = write(lokiStreamsFormat, "application/vnd.loki.matrix+json")
+	want = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"api"},"values":[[1704067260,"2"]]}]}}` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("expected matrix\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestLokiQueryRange_OverlappingChunks(t *testing.T) {
+	dir := t.TempDir()
+	idx := index.NewIndex()
+	writer := storage.NewWriter(dir, 1024*1024)
+	labels := map[string]string{"app": "api"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The second chunk overlaps the first in time and repeats its last line
+	write := func(id string, offsets ...int) {
+		entries := make([]models.LogEntry, len(offsets))
+		for i, s := range offsets {
+			entries[i] = models.LogEntry{ID: id + strconv.Itoa(i), Timestamp: base.Add(time.Duration(s) * time.Second), Line: "line " + strconv.Itoa(s), Labels: labels}
+		}
+		chunkID, start, end, err := writer.WriteChunk(labels, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.AddChunk(chunkID, labels, start, end, len(entries))
+	}
+	write("a", 1, 3, 5)
+	write("b", 2, 4, 5)
+
+	h := NewLokiHandler(idx, storage.NewReader(dir))
+	values := func(direction string) []string {
+		rec := httptest.NewRecorder()
+		h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?query=%7Bapp%3D%22api%22%7D&start=2024-01-01T00:00:00Z&end=2024-01-01T00:01:00Z&direction="+direction, nil))
+		var resp LokiQueryRangeResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Data.Result) != 1 {
+			t.Fatalf("expected one stream, got %d: %v", rec.Code, err)
+		}
+		var lines []string
+		for _, v := range resp.Data.Result[0].Values {
+			lines = append(lines, v[1])
+		}
+		return lines
+	}
+
+	if got := strings.Join(values("forward"), ","); got != "line 1,line 2,line 3,line 4,line 5" {
+		t.Errorf("forward: expected sorted lines without the duplicate, got %s", got)
+	}
+	if got := strings.Join(values("backward"), ","); got != "line 5,line 4,line 3,line 2,line 1" {
+		t.Errorf("backward: expected newest first without the duplicate, got %s", got)
+	}
+
+	rec := httptest.NewRecorder()
+	h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?query=%7Bapp%3D%22api%22%7D&direction=sideways", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown direction, got %d", rec.Code)
+	}
+
+	// Metric queries answer with a matrix of one point per step
+	rec = httptest.NewRecorder()
+	h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?query=count_over_time(%7Bapp%3D%22api%22%7D%5B10s%5D)&start=2024-01-01T00:00:00Z&end=2024-01-01T00:01:00Z&step=10", nil))
+	var matrix LokiMatrixResponse
+	if err := json.NewDecoder(rec.Body).Decode(&matrix); err != nil || matrix.Data.ResultType != "matrix" || len(matrix.Data.Result) != 1 {
+		t.Fatalf("expected a matrix of one series, got %d: %v", rec.Code, err)
+	}
+	if points := matrix.Data.Result[0].Values; len(points) != 7 || points[1][0] != float64(base.Add(10*time.Second).Unix()) {
+		t.Errorf("expected 7 points 10s apart, got %v", points)
+	}
+
+	rec = httptest.NewRecorder()
+	h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?query=count_over_time(%7Bapp%3D%22api%22%7D%5B10s%5D)&step=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a zero step, got %d", rec.Code)
+	}
+}
+
+func TestLokiQueryRange_Cursor(t *testing.T) {
+	dir := t.TempDir()
+	idx := index.NewIndex()
+	writer := storage.NewWriter(dir, 1024*1024)
+	labels := map[string]string{"app": "api"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 5000 lines in chunks of 500, one millisecond apart
+	for c := 0; c < 10; c++ {
+		entries := make([]models.LogEntry, 500)
+		for i := range entries {
+			n := c*500 + i
+			entries[i] = models.LogEntry{ID: strconv.Itoa(n), Timestamp: base.Add(time.Duration(n) * time.Millisecond), Line: "line " + strconv.Itoa(n), Labels: labels}
+		}
+		chunkID, start, end, err := writer.WriteChunk(labels, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.AddChunk(chunkID, labels, start, end, len(entries))
+	}
+
+	h := NewLokiHandler(idx, storage.NewReader(dir))
+	seen := make(map[string]bool)
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		params := url.Values{
+			"query":     {`{app="api"}`},
+			"start":     {"2024-01-01T00:00:00Z"},
+			"end":       {"2024-01-01T00:01:00Z"},
+			"limit":     {"1000"},
+			"direction": {"forward"},
+		}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		rec := httptest.NewRecorder()
+		h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?"+params.Encode(), nil))
+		var resp LokiQueryRangeResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Data.Result) != 1 {
+			t.Fatalf("page %d: expected one stream, got %d: %v", page, rec.Code, err)
+		}
+		values := resp.Data.Result[0].Values
+		if len(values) != 1000 {
+			t.Fatalf("page %d: expected 1000 lines, got %d", page, len(values))
+		}
+		for _, v := range values {
+			if seen[v[1]] {
+				t.Fatalf("page %d: %s returned twice", page, v[1])
+			}
+			seen[v[1]] = true
+		}
+		if cursor = resp.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 5000 {
+		t.Errorf("expected all 5000 lines across the pages, got %d", len(seen))
+	}
+
+	rec := httptest.NewRecorder()
+	h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?query=%7Bapp%3D%22api%22%7D&cursor=!!!", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed cursor, got %d", rec.Code)
+	}
+}
+
+func TestDefaultLokiStep(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		rng, want time.Duration
+	}{
+		{time.Hour, 15 * time.Second},
+		{250 * time.Second, time.Second},
+		{time.Minute, time.Second},
+		{24 * time.Hour, 346 * time.Second},
+	} {
+		if got := defaultLokiStep(base, base.Add(tc.rng)); got != tc.want {
+			t.Errorf("range %v: expected step %v, got %v", tc.rng, tc.want, got)
+		}
+	}
+}
+
+func TestLokiHandler_Series(t *testing.T) {
+	idx := index.NewIndex()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := map[string]string{"app": "api", "env": "prod"}
+	idx.AddChunk("c1", api, base, base.Add(time.Minute), 1)
+	idx.AddChunk("c2", api, base.Add(time.Minute), base.Add(2*time.Minute), 1)
+	idx.AddChunk("c3", map[string]string{"app": "web", "env": "prod"}, base, base.Add(time.Minute), 1)
+	idx.AddChunk("c4", map[string]string{"app": "db", "env": "dev"}, base, base.Add(time.Minute), 1)
+	idx.AddChunk("stale", map[string]string{"app": "old", "env": "prod"}, base.Add(-48*time.Hour), base.Add(-47*time.Hour), 1)
+
+	h := NewLokiHandler(idx, nil)
+	series := func(params string) (int, []map[string]string) {
+		rec := httptest.NewRecorder()
+		h.Series(rec, httptest.NewRequest("GET", "/loki/api/v1/series?start=2024-01-01T00:00:00Z&end=2024-01-01T01:00:00Z&"+params, nil))
+		var resp struct {
+			Status string              `json:"status"`
+			Data   []map[string]string `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+
+	// Chunks of one stream are listed once; the stale stream is outside
+	// the range
+	code, data := series("match[]=" + url.QueryEscape(`{env="prod"}`))
+	if code != http.StatusOK || len(data) != 2 || data[0]["app"] != "api" || data[1]["app"] != "web" {
+		t.Errorf("expected the api and web streams, got %d %v", code, data)
+	}
+
+	// Selectors are alternatives
+	_, data = series("match[]=" + url.QueryEscape(`{app=~"a.*"}`) + "&match[]=" + url.QueryEscape(`{env="dev"}`))
+	if len(data) != 2 || data[0]["app"] != "api" || data[1]["app"] != "db" {
+		t.Errorf("expected the api and db streams, got %v", data)
+	}
+
+	if code, _ := series(""); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a selector, got %d", code)
+	}
+	if code, _ := series("match[]=" + url.QueryEscape(`{app=~"("}`)); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid selector, got %d", code)
+	}
+}
+
+// countingBackend counts the chunk objects read from a backend
+type countingBackend struct {
+	storage.StorageBackend
+	reads int
+}
+
+func (b *countingBackend) GetChunk(key string) (io.ReadCloser, error) {
+	b.reads++
+	return b.StorageBackend.GetChunk(key)
+}
+
+func TestLokiQueryRange_ResultCache(t *testing.T) {
+	backend := &countingBackend{StorageBackend: storage.NewMemoryBackend()}
+	idx := index.NewIndex()
+	labels := map[string]string{"app": "api"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []models.LogEntry{{ID: "1", Timestamp: base.Add(time.Second), Line: "hello", Labels: labels}}
+	chunkID, start, end, err := storage.NewWriterWithBackend(backend, 1024*1024).WriteChunk(labels, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.AddChunk(chunkID, labels, start, end, len(entries))
+
+	clk := clock.NewFake(base.Add(time.Hour))
+	h := NewLokiHandler(idx, storage.NewReaderWithBackend(backend))
+	h.SetClock(clk)
+	h.SetResultCache(1024*1024, time.Minute)
+
+	queryRange := func(params string) (string, int) {
+		t.Helper()
+		reads := backend.reads
+		rec := httptest.NewRecorder()
+		h.QueryRange(rec, httptest.NewRequest("GET", "/loki/api/v1/query_range?query=%7Bapp%3D%22api%22%7D&"+params, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "hello") {
+			t.Fatalf("expected the line, got %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String(), backend.reads - reads
+	}
+
+	closed := "start=2024-01-01T00:00:00Z&end=2024-01-01T00:10:00Z"
+	first, reads := queryRange(closed)
+	if reads == 0 {
+		t.Fatal("expected the first query to read chunks")
+	}
+	second, reads := queryRange(closed)
+	if reads != 0 || second != first {
+		t.Errorf("expected the identical query answered from the cache without reads, read %d", reads)
+	}
+	if _, reads := queryRange(closed + "&limit=10"); reads == 0 {
+		t.Error("expected a different limit to miss the cache")
+	}
+
+	// A range reaching now is still filling up
+	open := "start=2024-01-01T00:00:00Z&end=now"
+	queryRange(open)
+	if _, reads := queryRange(open); reads == 0 {
+		t.Error("expected a range ending now not to be cached")
+	}
+
+	clk.Advance(2 * time.Minute)
+	if _, reads := queryRange(closed); reads == 0 {
+		t.Error("expected the cached response to expire after the TTL")
+	}
+}
+
+func TestLokiQuery_InstantLookback(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	idx := index.NewIndex()
+	labels := map[string]string{"app": "api"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var entries []models.LogEntry
+	for _, m := range []int{1, 10, 50} {
+		entries = append(entries, models.LogEntry{ID: strconv.Itoa(m), Timestamp: base.Add(time.Duration(m) * time.Minute), Line: "minute " + strconv.Itoa(m), Labels: labels})
+	}
+	chunkID, start, end, err := storage.NewWriterWithBackend(backend, 1024*1024).WriteChunk(labels, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.AddChunk(chunkID, labels, start, end, len(entries))
+
+	h := NewLokiHandler(idx, storage.NewReaderWithBackend(backend))
+	h.SetClock(clock.NewFake(base.Add(time.Hour)))
+	instant := func(params string) (int, []string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.Query(rec, httptest.NewRequest("GET", "/loki/api/v1/query?query=%7Bapp%3D%22api%22%7D&direction=forward"+params, nil))
+		var resp LokiQueryRangeResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		var lines []string
+		for _, stream := range resp.Data.Result {
+			for _, v := range stream.Values {
+				lines = append(lines, v[1])
+			}
+		}
+		return rec.Code, lines
+	}
+
+	if _, lines := instant(""); len(lines) != 0 {
+		t.Errorf("expected nothing in the default 5m lookback, got %v", lines)
+	}
+	h.SetInstantLookback(15 * time.Minute)
+	if _, lines := instant(""); strings.Join(lines, ",") != "minute 50" {
+		t.Errorf("expected the last 15m, got %v", lines)
+	}
+	if _, lines := instant("&start=2024-01-01T00:05:00Z"); strings.Join(lines, ",") != "minute 10,minute 50" {
+		t.Errorf("expected an explicit start to override the lookback, got %v", lines)
+	}
+
+	errors := lokiErrorCount.WithLabelValues("/loki/api/v1/query", "GET")
+	before := testutil.ToFloat64(errors)
+	if code, _ := instant("&start=2024-01-01T00:30:00Z&time=2024-01-01T00:20:00Z"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a start after the evaluation time, got %d", code)
+	}
+	if after := testutil.ToFloat64(errors); after != before+1 {
+		t.Errorf("expected the rejected range to be counted as an error, got %v -> %v", before, after)
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LokiMetricDimensions are the optional labels of the Loki handler request
+// and latency metrics, on top of endpoint and method. Each has a small,
+// fixed set of values so enabling one cannot blow up series cardinality:
+//
+//	status_code   the HTTP status, e.g. "200", "400"
+//	status_class  the status class, e.g. "2xx", "5xx"
+var LokiMetricDimensions = []string{"status_code", "status_class"}
+
+// lokiMetricLabels are the label names of the request and latency metrics.
+// Disabled dimensions are recorded empty, which Prometheus treats as absent.
+var lokiMetricLabels = append([]string{"endpoint", "method"}, LokiMetricDimensions...)
+
+// SetMetricLabels enables optional dimensions from LokiMetricDimensions on
+// the request and latency metrics
+func (h *LokiHandler) SetMetricLabels(dims []string) error {
+	enabled := make(map[string]bool, len(dims))
+	for _, d := range dims {
+		if d != "status_code" && d != "status_class" {
+			return fmt.Errorf("unknown Loki metric label %q (allowed: %v)", d, LokiMetricDimensions)
+		}
+		enabled[d] = true
+	}
+	h.metricDims = enabled
+	return nil
+}
+
+// observe records a finished request with the enabled dimensions
+func (h *LokiHandler) observe(endpoint, method string, sw *statusWriter, start time.Time) {
+	values := []string{endpoint, method, "", ""}
+	if h.metricDims["status_code"] {
+		values[2] = strconv.Itoa(sw.status)
+	}
+	if h.metricDims["status_class"] {
+		values[3] = strconv.Itoa(sw.status/100) + "xx"
+	}
+	h.requestCount.WithLabelValues(values...).Inc()
+	h.latency.WithLabelValues(values...).Observe(time.Since(start).Seconds())
+}
+
+// statusWriter captures the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status, w.wrote = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+)
+
+// lokiPushRequest is the JSON body of POST /loki/api/v1/push
+type lokiPushRequest struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		// Values are [ts_ns, line] pairs; a third element carrying
+		// structured metadata is accepted and ignored
+		Values [][]json.RawMessage `json:"values"`
+	} `json:"streams"`
+}
+
+// SetIngestor enables the push endpoint, feeding pushed entries to ing
+func (h *LokiHandler) SetIngestor(ing *ingest.Ingestor) {
+	h.ingestor = ing
+}
+
+// SetRejectOldSamples drops pushed entries older than maxAge, as Loki's
+// reject_old_samples limit does (0 = accept any age)
+func (h *LokiHandler) SetRejectOldSamples(maxAge time.Duration) {
+	h.rejectOldSamples = maxAge
+}
+
+// Push handles POST /loki/api/v1/push, the endpoint Promtail, the Grafana
+// agent and other Loki clients ship to. Bodies are JSON, optionally gzip
+// encoded, or snappy-compressed protobuf PushRequests. Each stream's label
+// set becomes the stream labels of its entries. Success is 204 No Content,
+// or 200 with the count when entries were dropped as too old.
+func (h *LokiHandler) Push(w http.ResponseWriter, r *http.Request) {
+	if h.ingestor == nil {
+		http.Error(w, "Push is not enabled", http.StatusNotFound)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isProto := contentType == "application/x-protobuf"
+	if !isProto && contentType != "application/json" && contentType != "" {
+		http.Error(w, "Unsupported content type, expected application/json or application/x-protobuf", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readOTLPBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req *models.IngestRequest
+	if isProto {
+		req, err = decodeLokiPushProto(body)
+	} else {
+		req, err = decodeLokiPushJSON(body)
+	}
+	if err != nil {
+		ingest.RecordRejectedRequest(ingest.RejectInvalidRequest, req)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := applyKeyScope(req, keyScope(r)); err != nil {
+		ingest.RecordRejectedRequest(ingest.RejectKeyScope, req)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	dropped := 0
+	if h.rejectOldSamples > 0 {
+		dropped = dropOldSamples(req, h.rejectOldSamples, h.clock.Now())
+		ingest.RecordRejected(ingest.RejectTooOld, dropped)
+	}
+	if len(req.Streams) > 0 {
+		if _, err := h.ingestor.Ingest(req); err != nil {
+			writeIngestError(w, h.ingestor, err)
+			return
+		}
+	}
+
+	// Old samples are dropped rather than failing the push, which clients
+	// would retry; the count tells them what was left out
+	if dropped > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"dropped_old_samples": dropped})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeLokiPushJSON converts a JSON push body into an ingest request
+func decodeLokiPushJSON(body []byte) (*models.IngestRequest, error) {
+	var push lokiPushRequest
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, fmt.Errorf("invalid push body: %w", err)
+	}
+
+	req := &models.IngestRequest{Streams: make([]models.Stream, 0, len(push.Streams))}
+	for _, s := range push.Streams {
+		stream := models.Stream{Labels: s.Stream, Entries: make([]models.Entry, 0, len(s.Values))}
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				return req, fmt.Errorf("invalid push value: expected [timestamp, line]")
+			}
+			var tsStr, line string
+			if err := json.Unmarshal(v[0], &tsStr); err != nil {
+				return req, fmt.Errorf("invalid push timestamp %s", v[0])
+			}
+			if err := json.Unmarshal(v[1], &line); err != nil {
+				return req, fmt.Errorf("invalid push line: %w", err)
+			}
+			ns, err := strconv.ParseInt(tsStr, 10, 64)
+			if err != nil {
+				return req, fmt.Errorf("invalid push timestamp %q: expected nanoseconds", tsStr)
+			}
+			stream.Entries = append(stream.Entries, lokiPushEntry(ns, line))
+		}
+		req.Streams = append(req.Streams, stream)
+	}
+	return req, nil
+}
+
+// decodeLokiPushProto converts a snappy-compressed protobuf PushRequest
+// into an ingest request:
+//
+//	PushRequest   { repeated StreamAdapter streams = 1; }
+//	StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	EntryAdapter  { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func decodeLokiPushProto(body []byte) (*models.IngestRequest, error) {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+
+	req := &models.IngestRequest{}
+	err = eachProtoField(data, func(f protoField) error {
+		if f.number != 1 || f.typ != protowire.BytesType {
+			return nil
+		}
+		stream, err := decodeProtoLokiStream(f.bytes)
+		if err != nil {
+			return err
+		}
+		req.Streams = append(req.Streams, stream)
+		return nil
+	})
+	if err != nil {
+		return req, fmt.Errorf("invalid push protobuf: %w", err)
+	}
+	return req, nil
+}
+
+func decodeProtoLokiStream(b []byte) (models.Stream, error) {
+	var stream models.Stream
+	err := eachProtoField(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.number {
+		case 1: // labels
+			labels, err := parseLokiLabels(string(f.bytes))
+			if err != nil {
+				return err
+			}
+			stream.Labels = labels
+		case 2: // entries
+			var ns int64
+			var line string
+			err := eachProtoField(f.bytes, func(ef protoField) error {
+				switch {
+				case ef.number == 1 && ef.typ == protowire.BytesType:
+					var secs, nanos int64
+					err := eachProtoField(ef.bytes, func(tf protoField) error {
+						switch tf.number {
+						case 1:
+							secs = int64(tf.num)
+						case 2:
+							nanos = int64(int32(tf.num))
+						}
+						return nil
+					})
+					ns = secs*int64(time.Second) + nanos
+					return err
+				case ef.number == 2 && ef.typ == protowire.BytesType:
+					line = string(ef.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			stream.Entries = append(stream.Entries, lokiPushEntry(ns, line))
+		}
+		return nil
+	})
+	return stream, err
+}
+
+// lokiPushEntry converts a pushed [ts_ns, line] value into an ingest entry
+func lokiPushEntry(ns int64, line string) models.Entry {
+	return models.Entry{Ts: time.Unix(0, ns).UTC().Format(time.RFC3339Nano), Line: line}
+}
+
+// parseLokiLabels parses a label set in Prometheus text form, as protobuf
+// pushes carry it: {name="value", ...}
+func parseLokiLabels(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid stream labels %q", s)
+	}
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+	labels := make(map[string]string)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid stream labels %q", s)
+		}
+		name := strings.TrimSpace(rest[:eq])
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q in %q", name, s)
+		}
+		value, _ := strconv.Unquote(quoted)
+		labels[name] = value
+
+		rest = strings.TrimSpace(rest[len(quoted):])
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("invalid stream labels %q", s)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	return labels, nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestLokiPush(t *testing.T) {
+	ingestor := ingest.NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 100, nil)
+	h := NewLokiHandler(index.NewIndex(), nil)
+	h.SetIngestor(ingestor)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	h.SetClock(clock.NewFake(now))
+
+	push := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/loki/api/v1/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		h.Push(rec, req)
+		return rec
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"streams": []map[string]interface{}{{
+		"stream": map[string]string{"app": "api"},
+		"values": [][]interface{}{
+			{"1717243200000000000", "started"},
+			{"1717243201000000000", "ready", map[string]string{"trace_id": "abc"}},
+		},
+	}}})
+	if rec := push("application/json", body); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if lines, _, _ := ingestor.GetMetrics(); lines != 2 {
+		t.Errorf("expected 2 ingested lines, got %d", lines)
+	}
+
+	// Protobuf pushes are snappy-compressed PushRequests
+	var timestamp []byte
+	timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(now.Unix()))
+	timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, 500)
+	entry := protoBytes(nil, 1, timestamp)
+	entry = protoBytes(entry, 2, []byte("from promtail"))
+	stream := protoBytes(nil, 1, []byte(`{app="web", path="/a,\"b\""}`))
+	stream = protoBytes(stream, 2, entry)
+	pb := protoBytes(nil, 1, stream)
+
+	decoded, err := decodeLokiPushProto(snappy.Encode(nil, pb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := decoded.Streams[0]; s.Labels["path"] != `/a,"b"` || len(s.Labels) != 2 ||
+		s.Entries[0].Ts != "2024-06-01T12:00:00.0000005Z" || s.Entries[0].Line != "from promtail" {
+		t.Errorf("unexpected decoded stream %+v", s)
+	}
+	if rec := push("application/x-protobuf", snappy.Encode(nil, pb)); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := push("application/x-protobuf", pb); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an uncompressed protobuf body to be refused, got %d", rec.Code)
+	}
+
+	// Samples past the max age are dropped and counted
+	h.SetRejectOldSamples(time.Hour)
+	body, _ = json.Marshal(map[string]interface{}{"streams": []map[string]interface{}{{
+		"stream": map[string]string{"app": "api"},
+		"values": [][]string{{"1717232400000000000", "too old"}, {"1717243200000000000", "recent"}},
+	}}})
+	rec := push("application/json", body)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"dropped_old_samples\":1}\n" {
+		t.Errorf("expected one sample reported dropped, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	labels, err := parseLokiLabels(`{ app="api",env = "prod" }`)
+	if err != nil || len(labels) != 2 || labels["env"] != "prod" {
+		t.Errorf("unexpected labels %v (err %v)", labels, err)
+	}
+	if labels, err := parseLokiLabels("{}"); err != nil || len(labels) != 0 {
+		t.Errorf("expected no labels, got %v (err %v)", labels, err)
+	}
+	for _, bad := range []string{`app="api"`, `{app=api}`, `{app="api" env="prod"}`, `{="x"}`} {
+		if _, err := parseLokiLabels(bad); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DefaultMetricsStreamInterval is the refresh interval for /metrics/stream
+const DefaultMetricsStreamInterval = 2 * time.Second
+
+var (
+	sseMetricsOnce       sync.Once
+	metricsStreamClients prometheus.Gauge
+)
+
+func registerSSEMetrics() {
+	sseMetricsOnce.Do(func() {
+		metricsStreamClients = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "logpulse_metrics_stream_subscribers",
+			Help: "Clients currently subscribed to /metrics/stream.",
+		})
+		prometheus.MustRegister(metricsStreamClients)
+	})
+}
+
+// MetricsStreamer gathers the Prometheus exposition once per tick and fans
+// the rendered SSE event out to every /metrics/stream subscriber
+type MetricsStreamer struct {
+	interval time.Duration
+	gatherer prometheus.Gatherer
+	// writeTimeout bounds writing and flushing one event; a client that
+	// takes longer is disconnected
+	writeTimeout time.Duration
+
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewMetricsStreamer creates a streamer over the default Prometheus registry
+func NewMetricsStreamer(interval time.Duration) *MetricsStreamer {
+	if interval <= 0 {
+		interval = DefaultMetricsStreamInterval
+	}
+	registerSSEMetrics()
+	return &MetricsStreamer{
+		interval:    interval,
+		gatherer:    prometheus.DefaultGatherer,
+		subscribers: make(map[chan []byte]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// SetWriteTimeout bounds how long sending one event to a client may take
+// before the client is dropped; 0 leaves it to the connection's deadline
+func (m *MetricsStreamer) SetWriteTimeout(d time.Duration) {
+	m.writeTimeout = max(0, d)
+}
+
+// Start begins the gather loop in the background
+func (m *MetricsStreamer) Start() {
+	go m.run()
+}
+
+// Stop ends the gather loop
+func (m *MetricsStreamer) Stop() {
+	m.once.Do(func() { close(m.done) })
+}
+
+func (m *MetricsStreamer) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			idle := len(m.subscribers) == 0
+			m.mu.Unlock()
+			if idle {
+				continue
+			}
+
+			event, err := m.render()
+			if err != nil {
+				log.Printf("[MetricsStreamer] Failed to gather metrics: %v", err)
+				continue
+			}
+			m.publish(event)
+		}
+	}
+}
+
+// render gathers all metric families and formats them as one SSE event
+func (m *MetricsStreamer) render() ([]byte, error) {
+	families, err := m.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return nil, err
+	}
+
+	var text bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&text, mf); err != nil {
+			return nil, err
+		}
+	}
+
+	var event bytes.Buffer
+	event.WriteString("event: metrics\n")
+	for _, line := range strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n") {
+		event.WriteString("data: ")
+		event.WriteString(line)
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	return event.Bytes(), nil
+}
+
+// publish hands the event to every subscriber, skipping any that have not
+// consumed the previous one yet
+func (m *MetricsStreamer) publish(event []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (m *MetricsStreamer) subscribe() chan []byte {
+	ch := make(chan []byte, 1)
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+	metricsStreamClients.Inc()
+	return ch
+}
+
+func (m *MetricsStreamer) unsubscribe(ch chan []byte) {
+	m.mu.Lock()
+	if _, ok := m.subscribers[ch]; ok {
+		delete(m.subscribers, ch)
+		metricsStreamClients.Dec()
+	}
+	m.mu.Unlock()
+}
+
+// ServeHTTP handles the /metrics/stream SSE endpoint. It returns as soon as
+// a write or flush fails or the client goes away; a write to a client that
+// stopped reading is cut off by the write timeout rather than blocking the
+// handler.
+func (m *MetricsStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := m.subscribe()
+	defer m.unsubscribe(ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-m.done:
+			return
+		case event := <-ch:
+			if r.Context().Err() != nil {
+				return
+			}
+			if m.writeTimeout > 0 {
+				// Writers that cannot set deadlines rely on the server's
+				rc.SetWriteDeadline(time.Now().Add(m.writeTimeout))
+			}
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsStreamer_FanOut(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_events_total", Help: "Test counter."})
+	reg.MustRegister(counter)
+	counter.Add(3)
+
+	m := NewMetricsStreamer(0)
+	m.gatherer = reg
+	a, b := m.subscribe(), m.subscribe()
+	defer m.unsubscribe(a)
+	defer m.unsubscribe(b)
+
+	event, err := m.render()
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	m.publish(event)
+
+	for _, ch := range []chan []byte{a, b} {
+		got := string(<-ch)
+		if !strings.HasPrefix(got, "event: metrics\n") || !strings.HasSuffix(got, "\n\n") {
+			t.Errorf("malformed SSE event: %q", got)
+		}
+		if !strings.Contains(got, "data: test_events_total 3\n") {
+			t.Errorf("expected counter sample in event, got %q", got)
+		}
+	}
+
+	// A subscriber that has not drained the last event is skipped, not blocked
+	m.publish(event)
+	m.publish(event)
+	if len(a) != 1 {
+		t.Errorf("expected one pending event, got %d", len(a))
+	}
+}
+
+func TestMetricsStreamer_ClientDisconnect(t *testing.T) {
+	m := NewMetricsStreamer(10 * time.Millisecond)
+	m.SetWriteTimeout(time.Second)
+	m.Start()
+	defer m.Stop()
+
+	returned := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r)
+		close(returned)
+	}))
+	defer srv.Close()
+
+	before := testutil.ToFloat64(metricsStreamClients)
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "event: metrics\n" {
+		t.Fatalf("expected an event, got %q (%v)", line, err)
+	}
+	if got := testutil.ToFloat64(metricsStreamClients); got != before+1 {
+		t.Errorf("expected %v subscribers while connected, got %v", before+1, got)
+	}
+
+	resp.Body.Close()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return after the client disconnected")
+	}
+	if got := testutil.ToFloat64(metricsStreamClients); got != before {
+		t.Errorf("expected %v subscribers after disconnect, got %v", before, got)
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// dropOldSamples removes entries timestamped more than maxAge before now from
+// req, along with streams left empty, and returns how many were dropped.
+// Entries without a parseable timestamp are kept for the ingestor to stamp
+// or reject per ingest.missing_timestamp.
+func dropOldSamples(req *models.IngestRequest, maxAge time.Duration, now time.Time) int {
+	cutoff := now.Add(-maxAge)
+	dropped := 0
+	streams := req.Streams[:0]
+	for _, stream := range req.Streams {
+		entries := stream.Entries[:0]
+		for _, entry := range stream.Entries {
+			if ts, err := time.Parse(time.RFC3339, entry.Ts); err == nil && ts.Before(cutoff) {
+				dropped++
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		stream.Entries = entries
+		streams = append(streams, stream)
+	}
+	req.Streams = streams
+	return dropped
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpLogs is the decoded form of an OTLP ExportLogsServiceRequest (which
+// shares its layout with LogsData), independent of the wire encoding.
+// Attribute and body values are string, bool, int64, float64, []byte,
+// []interface{} or map[string]interface{}.
+type otlpLogs struct {
+	Resources []otlpResourceLogs
+}
+
+type otlpResourceLogs struct {
+	Attributes map[string]interface{}
+	Scopes     []otlpScopeLogs
+}
+
+type otlpScopeLogs struct {
+	Name       string
+	Version    string
+	Attributes map[string]interface{}
+	Records    []otlpLogRecord
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         uint64
+	ObservedTimeUnixNano uint64
+	SeverityNumber       int32
+	SeverityText         string
+	Body                 interface{}
+	Attributes           map[string]interface{}
+}
+
+// protoField is one decoded field of a protobuf message. Varint, fixed32
+// and fixed64 values are all widened into num.
+type protoField struct {
+	number protowire.Number
+	typ    protowire.Type
+	num    uint64
+	bytes  []byte
+}
+
+// eachProtoField walks the top-level fields of a protobuf message
+func eachProtoField(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := protoField{number: number, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.num, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.num, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.num = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(number, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeOTLPProto decodes a protobuf-encoded ExportLogsServiceRequest
+func decodeOTLPProto(b []byte) (*otlpLogs, error) {
+	logs := &otlpLogs{}
+	err := eachProtoField(b, func(f protoField) error {
+		if f.number != 1 || f.typ != protowire.BytesType {
+			return nil
+		}
+		rl, err := decodeProtoResourceLogs(f.bytes)
+		if err != nil {
+			return err
+		}
+		logs.Resources = append(logs.Resources, rl)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP protobuf: %w", err)
+	}
+	return logs, nil
+}
+
+func decodeProtoResourceLogs(b []byte) (otlpResourceLogs, error) {
+	rl := otlpResourceLogs{Attributes: make(map[string]interface{})}
+	err := eachProtoField(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.number {
+		case 1: // resource
+			return eachProtoField(f.bytes, func(rf protoField) error {
+				if rf.number == 1 && rf.typ == protowire.BytesType {
+					return decodeProtoKeyValue(rf.bytes, rl.Attributes)
+				}
+				return nil
+			})
+		case 2: // scope_logs
+			sl, err := decodeProtoScopeLogs(f.bytes)
+			if err != nil {
+				return err
+			}
+			rl.Scopes = append(rl.Scopes, sl)
+		}
+		return nil
+	})
+	return rl, err
+}
+
+func decodeProtoScopeLogs(b []byte) (otlpScopeLogs, error) {
+	sl := otlpScopeLogs{Attributes: make(map[string]interface{})}
+	err := eachProtoField(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.number {
+		case 1: // scope
+			return eachProtoField(f.bytes, func(sf protoField) error {
+				if sf.typ != protowire.BytesType {
+					return nil
+				}
+				switch sf.number {
+				case 1:
+					sl.Name = string(sf.bytes)
+				case 2:
+					sl.Version = string(sf.bytes)
+				case 3:
+					return decodeProtoKeyValue(sf.bytes, sl.Attributes)
+				}
+				return nil
+			})
+		case 2: // log_records
+			rec, err := decodeProtoLogRecord(f.bytes)
+			if err != nil {
+				return err
+			}
+			sl.Records = append(sl.Records, rec)
+		}
+		return nil
+	})
+	return sl, err
+}
+
+func decodeProtoLogRecord(b []byte) (otlpLogRecord, error) {
+	rec := otlpLogRecord{Attributes: make(map[string]interface{})}
+	err := eachProtoField(b, func(f protoField) error {
+		switch f.number {
+		case 1:
+			rec.TimeUnixNano = f.num
+		case 11:
+			rec.ObservedTimeUnixNano = f.num
+		case 2:
+			rec.SeverityNumber = int32(f.num)
+		case 3:
+			rec.SeverityText = string(f.bytes)
+		case 5:
+			v, err := decodeProtoAnyValue(f.bytes)
+			if err != nil {
+				return err
+			}
+			rec.Body = v
+		case 6:
+			if f.typ == protowire.BytesType {
+				return decodeProtoKeyValue(f.bytes, rec.Attributes)
+			}
+		}
+		return nil
+	})
+	return rec, err
+}
+
+// decodeProtoKeyValue decodes a KeyValue message into attrs
+func decodeProtoKeyValue(b []byte, attrs map[string]interface{}) error {
+	var key string
+	var value interface{}
+	err := eachProtoField(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			v, err := decodeProtoAnyValue(f.bytes)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		attrs[key] = value
+	}
+	return nil
+}
+
+func decodeProtoAnyValue(b []byte) (interface{}, error) {
+	var value interface{}
+	err := eachProtoField(b, func(f protoField) error {
+		switch f.number {
+		case 1:
+			value = string(f.bytes)
+		case 2:
+			value = f.num != 0
+		case 3:
+			value = int64(f.num)
+		case 4:
+			value = math.Float64frombits(f.num)
+		case 5:
+			var values []interface{}
+			err := eachProtoField(f.bytes, func(af protoField) error {
+				if af.number != 1 || af.typ != protowire.BytesType {
+					return nil
+				}
+				v, err := decodeProtoAnyValue(af.bytes)
+				values = append(values, v)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			value = values
+		case 6:
+			kv := make(map[string]interface{})
+			err := eachProtoField(f.bytes, func(kf protoField) error {
+				if kf.number != 1 || kf.typ != protowire.BytesType {
+					return nil
+				}
+				return decodeProtoKeyValue(kf.bytes, kv)
+			})
+			if err != nil {
+				return err
+			}
+			value = kv
+		case 7:
+			value = append([]byte(nil), f.bytes...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// OTLP/JSON encodes 64-bit integers as decimal strings, but plain numbers
+// are accepted as well
+type otlpJSONUint64 uint64
+
+func (u *otlpJSONUint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*u = otlpJSONUint64(v)
+	return nil
+}
+
+type otlpJSONInt64 int64
+
+func (i *otlpJSONInt64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = otlpJSONInt64(v)
+	return nil
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string        `json:"stringValue"`
+	BoolValue   *bool          `json:"boolValue"`
+	IntValue    *otlpJSONInt64 `json:"intValue"`
+	DoubleValue *float64       `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue *string `json:"bytesValue"`
+}
+
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name       string             `json:"name"`
+				Version    string             `json:"version"`
+				Attributes []otlpJSONKeyValue `json:"attributes"`
+			} `json:"scope"`
+			LogRecords []struct {
+				TimeUnixNano         otlpJSONUint64     `json:"timeUnixNano"`
+				ObservedTimeUnixNano otlpJSONUint64     `json:"observedTimeUnixNano"`
+				SeverityNumber       int32              `json:"severityNumber"`
+				SeverityText         string             `json:"severityText"`
+				Body                 otlpJSONAnyValue   `json:"body"`
+				Attributes           []otlpJSONKeyValue `json:"attributes"`
+			} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+// decodeOTLPJSON decodes an OTLP/JSON ExportLogsServiceRequest
+func decodeOTLPJSON(b []byte) (*otlpLogs, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("invalid OTLP JSON: %w", err)
+	}
+
+	logs := &otlpLogs{}
+	for _, jrl := range req.ResourceLogs {
+		rl := otlpResourceLogs{Attributes: jsonAttributes(jrl.Resource.Attributes)}
+		for _, jsl := range jrl.ScopeLogs {
+			sl := otlpScopeLogs{
+				Name:       jsl.Scope.Name,
+				Version:    jsl.Scope.Version,
+				Attributes: jsonAttributes(jsl.Scope.Attributes),
+			}
+			for _, jrec := range jsl.LogRecords {
+				sl.Records = append(sl.Records, otlpLogRecord{
+					TimeUnixNano:         uint64(jrec.TimeUnixNano),
+					ObservedTimeUnixNano: uint64(jrec.ObservedTimeUnixNano),
+					SeverityNumber:       jrec.SeverityNumber,
+					SeverityText:         jrec.SeverityText,
+					Body:                 jrec.Body.value(),
+					Attributes:           jsonAttributes(jrec.Attributes),
+				})
+			}
+			rl.Scopes = append(rl.Scopes, sl)
+		}
+		logs.Resources = append(logs.Resources, rl)
+	}
+	return logs, nil
+}
+
+func jsonAttributes(kvs []otlpJSONKeyValue) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		if kv.Key != "" {
+			attrs[kv.Key] = kv.Value.value()
+		}
+	}
+	return attrs
+}
+
+func (v otlpJSONAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, av := range v.ArrayValue.Values {
+			values = append(values, av.value())
+		}
+		return values
+	case v.KvlistValue != nil:
+		return jsonAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		b, err := base64.StdEncoding.DecodeString(*v.BytesValue)
+		if err != nil {
+			return *v.BytesValue
+		}
+		return b
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+)
+
+// maxOTLPBodyBytes bounds the decompressed size of an OTLP request
+const maxOTLPBodyBytes = 32 << 20
+
+// maxOTLPLabelValueLen drops attribute values too long to be useful labels
+const maxOTLPLabelValueLen = 256
+
+// DefaultOTLPLabelAttributes are the resource and scope attributes promoted
+// to labels when none are configured
+var DefaultOTLPLabelAttributes = []string{
+	"service.name",
+	"service.namespace",
+	"deployment.environment",
+	"k8s.namespace.name",
+	"k8s.container.name",
+	"host.name",
+}
+
+// OTLPHandler receives OpenTelemetry logs on /v1/logs (OTLP/HTTP, protobuf
+// or JSON). Only allowlisted resource and scope attributes become labels, so
+// per-record attributes such as trace IDs cannot blow up stream cardinality.
+type OTLPHandler struct {
+	ingestor   *ingest.Ingestor
+	labelAttrs map[string]string // attribute key -> label name
+	maxLabels  int
+
+	droppedLabels int64
+}
+
+func NewOTLPHandler(ingestor *ingest.Ingestor, labelAttributes []string, maxLabels int) *OTLPHandler {
+	if len(labelAttributes) == 0 {
+		labelAttributes = DefaultOTLPLabelAttributes
+	}
+	attrs := make(map[string]string, len(labelAttributes))
+	for _, key := range labelAttributes {
+		attrs[key] = otlpLabelName(key)
+	}
+	return &OTLPHandler{ingestor: ingestor, labelAttrs: attrs, maxLabels: maxLabels}
+}
+
+func (h *OTLPHandler) Logs(w http.ResponseWriter, r *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isProto := contentType == "application/x-protobuf"
+	if !isProto && contentType != "application/json" {
+		http.Error(w, "Unsupported content type, expected application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readOTLPBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var logs *otlpLogs
+	if isProto {
+		logs, err = decodeOTLPProto(body)
+	} else {
+		logs, err = decodeOTLPJSON(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &models.IngestRequest{Streams: h.buildStreams(logs)}
+	if err := applyKeyScope(req, keyScope(r)); err != nil {
+		ingest.RecordRejectedRequest(ingest.RejectKeyScope, req)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if len(req.Streams) > 0 {
+		if _, err := h.ingestor.Ingest(req); err != nil {
+			writeIngestError(w, h.ingestor, err)
+			return
+		}
+	}
+
+	// An empty ExportLogsServiceResponse signals full success
+	if isProto {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+func readOTLPBody(r *http.Request) ([]byte, error) {
+	var reader io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, maxOTLPBodyBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if len(body) > maxOTLPBodyBytes {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxOTLPBodyBytes)
+	}
+	return body, nil
+}
+
+// buildStreams groups log records into streams keyed by their resource and
+// scope labels plus the level derived from the severity
+func (h *OTLPHandler) buildStreams(logs *otlpLogs) []models.Stream {
+	var streams []models.Stream
+	byHash := make(map[string]int)
+
+	for _, rl := range logs.Resources {
+		for _, sl := range rl.Scopes {
+			base := h.labelsFor(rl.Attributes, sl.Attributes)
+
+			for _, rec := range sl.Records {
+				labels := make(map[string]string, len(base)+1)
+				for k, v := range base {
+					labels[k] = v
+				}
+				if level := otlpSeverityLevel(rec.SeverityNumber, rec.SeverityText); level != "" {
+					labels["level"] = level
+				}
+
+				hash := models.Labels(labels).Hash()
+				i, ok := byHash[hash]
+				if !ok {
+					i = len(streams)
+					byHash[hash] = i
+					streams = append(streams, models.Stream{Labels: labels})
+				}
+				streams[i].Entries = append(streams[i].Entries, models.Entry{
+					Ts:   otlpTimestamp(rec).Format(time.RFC3339Nano),
+					Line: otlpValueString(rec.Body),
+				})
+			}
+		}
+	}
+	return streams
+}
+
+// labelsFor promotes allowlisted attributes to labels, scope attributes
+// winning over resource attributes, capped at maxLabels
+func (h *OTLPHandler) labelsFor(resource, scope map[string]interface{}) map[string]string {
+	labels := make(map[string]string)
+	for _, attrs := range []map[string]interface{}{resource, scope} {
+		for key, value := range attrs {
+			name, ok := h.labelAttrs[key]
+			if !ok {
+				continue
+			}
+			s := otlpValueString(value)
+			if s == "" || len(s) > maxOTLPLabelValueLen || strings.Contains(s, "\n") {
+				continue
+			}
+			labels[name] = s
+		}
+	}
+
+	if h.maxLabels > 0 && len(labels) > h.maxLabels {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[h.maxLabels:] {
+			delete(labels, name)
+		}
+		dropped := atomic.AddInt64(&h.droppedLabels, 1)
+		if dropped == 1 || dropped%100 == 0 {
+			log.Printf("[OTLP] WARNING: Resource exceeds %d labels, dropped %v. Total truncated resources: %d",
+				h.maxLabels, names[h.maxLabels:], dropped)
+		}
+	}
+
+	// Streams need at least one label; follow the OTel default service name
+	if len(labels) == 0 {
+		labels["service_name"] = "unknown_service"
+	}
+	return labels
+}
+
+// otlpLabelName converts an attribute key such as service.name into a
+// valid label name
+func otlpLabelName(key string) string {
+	var sb strings.Builder
+	for i, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+			sb.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// otlpSeverityLevel maps an OTLP severity number to a level label, falling
+// back to the severity text when the number is unset
+func otlpSeverityLevel(number int32, text string) string {
+	switch {
+	case number >= 1 && number <= 4:
+		return "trace"
+	case number >= 5 && number <= 8:
+		return "debug"
+	case number >= 9 && number <= 12:
+		return "info"
+	case number >= 13 && number <= 16:
+		return "warn"
+	case number >= 17 && number <= 20:
+		return "error"
+	case number >= 21 && number <= 24:
+		return "fatal"
+	}
+	return strings.ToLower(strings.TrimSpace(text))
+}
+
+func otlpTimestamp(rec otlpLogRecord) time.Time {
+	if rec.TimeUnixNano != 0 {
+		return time.Unix(0, int64(rec.TimeUnixNano)).UTC()
+	}
+	if rec.ObservedTimeUnixNano != 0 {
+		return time.Unix(0, int64(rec.ObservedTimeUnixNano)).UTC()
+	}
+	return time.Now().UTC()
+}
+
+// otlpValueString renders a decoded AnyValue as a log line or label value.
+// Structured values are encoded as JSON.
+func otlpValueString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return hex.EncodeToString(val)
+	case bool, int64, float64:
+		return fmt.Sprint(val)
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Sprint(val)
+		}
+		return string(b)
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func protoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func protoKeyValue(key, value string) []byte {
+	anyValue := protoBytes(nil, 1, []byte(value))
+	kv := protoBytes(nil, 1, []byte(key))
+	return protoBytes(kv, 2, anyValue)
+}
+
+func TestDecodeOTLPProto(t *testing.T) {
+	var resource []byte
+	resource = protoBytes(resource, 1, protoKeyValue("service.name", "checkout"))
+	resource = protoBytes(resource, 1, protoKeyValue("host.name", "node-1"))
+
+	var record []byte
+	record = protowire.AppendTag(record, 1, protowire.Fixed64Type)
+	record = protowire.AppendFixed64(record, 1700000000000000000)
+	record = protowire.AppendTag(record, 2, protowire.VarintType)
+	record = protowire.AppendVarint(record, 17)
+	record = protoBytes(record, 5, protoBytes(nil, 1, []byte("payment failed")))
+	record = protoBytes(record, 6, protoKeyValue("trace_id", "abc"))
+
+	scopeLogs := protoBytes(nil, 1, protoBytes(nil, 1, []byte("otel-go")))
+	scopeLogs = protoBytes(scopeLogs, 2, record)
+
+	resourceLogs := protoBytes(nil, 1, resource)
+	resourceLogs = protoBytes(resourceLogs, 2, scopeLogs)
+	payload := protoBytes(nil, 1, resourceLogs)
+
+	logs, err := decodeOTLPProto(payload)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	h := NewOTLPHandler(nil, nil, 0)
+	streams := h.buildStreams(logs)
+	if len(streams) != 1 || len(streams[0].Entries) != 1 {
+		t.Fatalf("expected one stream with one entry, got %+v", streams)
+	}
+	labels := streams[0].Labels
+	if labels["service_name"] != "checkout" || labels["host_name"] != "node-1" || labels["level"] != "error" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	if _, ok := labels["trace_id"]; ok {
+		t.Error("record attributes must not become labels")
+	}
+	entry := streams[0].Entries[0]
+	if entry.Line != "payment failed" || entry.Ts != "2023-11-14T22:13:20Z" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
+
+func TestOTLPHandler_JSON(t *testing.T) {
+	dir := t.TempDir()
+	ingestor := ingest.NewIngestor(index.NewIndex(), storage.NewWriter(dir, 1024*1024), 100, nil)
+	h := NewOTLPHandler(ingestor, []string{"service.name", "k8s.pod.name"}, 1)
+
+	body := `{"resourceLogs":[{"resource":{"attributes":[
+		{"key":"service.name","value":{"stringValue":"api"}},
+		{"key":"k8s.pod.name","value":{"stringValue":"api-7f9c"}}]},
+		"scopeLogs":[{"logRecords":[
+			{"timeUnixNano":"1700000000000000000","severityNumber":9,"body":{"stringValue":"started"}},
+			{"severityText":"WARN","body":{"kvlistValue":{"values":[{"key":"msg","value":{"stringValue":"slow"}}]}}}
+		]}]}]}`
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/logs", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	h.Logs(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if lines, _, _ := ingestor.GetMetrics(); lines != 2 {
+		t.Errorf("expected 2 ingested lines, got %d", lines)
+	}
+
+	logs, err := decodeOTLPJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	streams := h.buildStreams(logs)
+	if len(streams) != 2 {
+		t.Fatalf("expected a stream per level, got %d", len(streams))
+	}
+	for _, s := range streams {
+		if len(s.Labels) != 2 || s.Labels["k8s_pod_name"] != "api-7f9c" {
+			t.Errorf("expected labels capped to one attribute plus level, got %v", s.Labels)
+		}
+	}
+	if streams[1].Labels["level"] != "warn" || streams[1].Entries[0].Line != `{"msg":"slow"}` {
+		t.Errorf("unexpected second stream %+v", streams[1])
+	}
+
+	req = httptest.NewRequest("POST", "/v1/logs", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "text/plain")
+	rec = httptest.NewRecorder()
+	h.Logs(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", rec.Code)
+	}
+}
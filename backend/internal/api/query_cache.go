@@ -0,0 +1,116 @@
+package api
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queryCache keeps serialized query_range responses for a TTL, evicting the
+// least recently used once their bodies exceed maxBytes
+type queryCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cachedResponse, most recent first
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key         string
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+var (
+	queryCacheMetricsOnce sync.Once
+	queryCacheHits        prometheus.Counter
+	queryCacheMisses      prometheus.Counter
+)
+
+func newQueryCache(maxBytes int64, ttl time.Duration) *queryCache {
+	queryCacheMetricsOnce.Do(func() {
+		queryCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "logpulse_query_cache_hits_total",
+			Help: "Total query_range requests answered from the result cache.",
+		})
+		queryCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "logpulse_query_cache_misses_total",
+			Help: "Total cacheable query_range requests not found in the result cache.",
+		})
+		prometheus.MustRegister(queryCacheHits, queryCacheMisses)
+	})
+	return &queryCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// queryCacheKey identifies a query_range response by every parameter that
+// shapes it, including the API key's scope and the accepted formats
+func queryCacheKey(query string, start, end time.Time, step time.Duration, limit int, direction, cursor, accept string, dedup bool, scope map[string]string) string {
+	return strings.Join([]string{
+		query,
+		strconv.FormatInt(start.UnixNano(), 10),
+		strconv.FormatInt(end.UnixNano(), 10),
+		step.String(),
+		strconv.Itoa(limit),
+		direction,
+		cursor,
+		accept,
+		strconv.FormatBool(dedup),
+		labelsToKey(scope),
+	}, "\x00")
+}
+
+// get returns the unexpired response cached under key
+func (c *queryCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && now.After(el.Value.(*cachedResponse).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		queryCacheMisses.Inc()
+		return nil, false
+	}
+	queryCacheHits.Inc()
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedResponse), true
+}
+
+// put caches a response body under key, unless it alone exceeds the cache
+func (c *queryCache) put(key, contentType string, body []byte, now time.Time) {
+	if int64(len(body)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	resp := &cachedResponse{key: key, contentType: contentType, body: body, expires: now.Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(resp)
+	c.size += int64(len(body))
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops a cached response; mu must be held
+func (c *queryCache) remove(el *list.Element) {
+	resp := c.lru.Remove(el).(*cachedResponse)
+	delete(c.entries, resp.key)
+	c.size -= int64(len(resp.body))
+}
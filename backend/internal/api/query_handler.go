@@ -7,16 +7,23 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/clock"
 	"github.com/logpulse/backend/internal/index"
 	"github.com/logpulse/backend/internal/query"
 	"github.com/logpulse/backend/internal/storage"
 )
 
+// maxContextLines bounds the context parameter on /query
+const maxContextLines = 100
+
 // QueryHandler handles log queries
 type QueryHandler struct {
 	index    *index.Index
 	reader   *storage.Reader
 	executor *query.Executor
+
+	// clock is "now" for default ranges and relative times
+	clock clock.Clock
 }
 
 // NewQueryHandler creates a new query handler
@@ -25,63 +32,107 @@ func NewQueryHandler(idx *index.Index, reader *storage.Reader) *QueryHandler {
 		index:    idx,
 		reader:   reader,
 		executor: query.NewExecutor(idx, reader),
+		clock:    clock.Real{},
 	}
 }
 
+// SetClock replaces the clock queries take "now" from
+func (h *QueryHandler) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// SetStrictConsistency makes queries fail on chunks missing from storage
+func (h *QueryHandler) SetStrictConsistency(strict bool) {
+	h.executor.SetStrictConsistency(strict)
+}
+
 // Query handles GET /query
 func (h *QueryHandler) Query(w http.ResponseWriter, r *http.Request) {
 	queryStr := r.URL.Query().Get("query")
-	startStr := r.URL.Query().Get("start")
-	endStr := r.URL.Query().Get("end")
 	limitStr := r.URL.Query().Get("limit")
 
 	// Parse time range
-	var startTime, endTime time.Time
+	startTime, endTime, ok := parseQueryRange(w, r, h.clock.Now())
+	if !ok {
+		return
+	}
 	var err error
 
-	if startStr != "" {
-		startTime, err = time.Parse(time.RFC3339, startStr)
-		if err != nil {
-			http.Error(w, "Invalid start time format", http.StatusBadRequest)
+	// Parse limit
+	limit := 100
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+	}
+
+	// Parse context lines around each match
+	var opts query.ExecuteOptions
+	if contextStr := r.URL.Query().Get("context"); contextStr != "" {
+		opts.Context, err = strconv.Atoi(contextStr)
+		if err != nil || opts.Context < 0 || opts.Context > maxContextLines {
+			http.Error(w, "Invalid context: must be between 0 and "+strconv.Itoa(maxContextLines), http.StatusBadRequest)
 			return
 		}
-	} else {
-		startTime = time.Now().Add(-1 * time.Hour)
 	}
 
-	if endStr != "" {
-		endTime, err = time.Parse(time.RFC3339, endStr)
+	// Resume from a previous page; next is the parameter's older name
+	cursorStr := r.URL.Query().Get("cursor")
+	if cursorStr == "" {
+		cursorStr = r.URL.Query().Get("next")
+	}
+	if cursorStr != "" {
+		opts.Cursor, err = query.DecodeCursor(cursorStr)
 		if err != nil {
-			http.Error(w, "Invalid end time format", http.StatusBadRequest)
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
 			return
 		}
-	} else {
-		endTime = time.Now()
 	}
 
-	// Parse limit
-	limit := 100
-	if limitStr != "" {
-		limit, err = strconv.Atoi(limitStr)
-		if err != nil || limit <= 0 {
-			limit = 100
+	opts.Scope = keyScope(r)
+	opts.IncludeDropped = r.URL.Query().Get("include_dropped") == "true"
+	opts.Dedup = r.URL.Query().Get("dedup") == "true"
+
+	// Keep only streams whose match count is within [min_count, max_count]
+	for param, bound := range map[string]*int{"min_count": &opts.MinCount, "max_count": &opts.MaxCount} {
+		if s := r.URL.Query().Get(param); s != "" {
+			*bound, err = strconv.Atoi(s)
+			if err != nil || *bound < 0 {
+				http.Error(w, "Invalid "+param+": must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
 		}
 	}
+	if opts.MaxCount > 0 && opts.MinCount > opts.MaxCount {
+		http.Error(w, "Invalid count range: min_count exceeds max_count", http.StatusBadRequest)
+		return
+	}
 
 	// Execute query
-	result, err := h.executor.Execute(queryStr, startTime, endTime, limit)
+	result, err := h.executor.ExecuteWithOptions(queryStr, startTime, endTime, limit, opts)
 	if err != nil {
-		http.Error(w, "Query error: "+err.Error(), http.StatusBadRequest)
+		status := http.StatusBadRequest
+		if qe, ok := err.(*query.QueryError); ok && qe.Type == "storage_inconsistency" {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, "Query error: "+err.Error(), status)
 		return
 	}
 
+	writeResult(w, r, nativeFormat, result, writeOptions{EvalTime: endTime})
+}
+
+// Macros handles GET /query/macros, listing the configured query macros
+// for autocomplete
+func (h *QueryHandler) Macros(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(query.Macros())
 }
 
 // Labels handles GET /labels
 func (h *QueryHandler) Labels(w http.ResponseWriter, r *http.Request) {
-	labels := h.index.GetAllLabels()
+	labels := scopedLabelNames(h.index, keyScope(r))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(labels)
@@ -92,8 +143,123 @@ func (h *QueryHandler) LabelValues(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	labelName := vars["name"]
 
-	values := h.index.GetLabelValues(labelName)
+	values := scopedLabelValues(h.index, labelName, keyScope(r))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(values)
 }
+
+// Distinct handles GET /query/distinct, returning the distinct values of a
+// field over the lines matching the query
+func (h *QueryHandler) Distinct(w http.ResponseWriter, r *http.Request) {
+	queryStr := r.URL.Query().Get("query")
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		http.Error(w, "Missing field parameter", http.StatusBadRequest)
+		return
+	}
+
+	startTime, endTime, ok := parseQueryRange(w, r, h.clock.Now())
+	if !ok {
+		return
+	}
+
+	limit := query.MaxDistinctValues
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 || n > query.MaxDistinctValues {
+			http.Error(w, "Invalid limit: must be between 1 and "+strconv.Itoa(query.MaxDistinctValues), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	result, err := h.executor.DistinctValuesWithOptions(queryStr, field, startTime, endTime, limit, query.ExecuteOptions{Scope: keyScope(r)})
+	if err != nil {
+		http.Error(w, "Query error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// defaultVolumeBuckets is the number of buckets /query/volume aims for when
+// no step is given
+const defaultVolumeBuckets = 100
+
+// Volume handles GET /query/volume, returning the number of matching lines
+// per step-wide bucket as [[ts, count], ...] without the lines themselves.
+// step is in seconds or a duration such as 5m; by default the range is split
+// into about 100 buckets.
+func (h *QueryHandler) Volume(w http.ResponseWriter, r *http.Request) {
+	queryStr := r.URL.Query().Get("query")
+
+	startTime, endTime, ok := parseQueryRange(w, r, h.clock.Now())
+	if !ok {
+		return
+	}
+	if !startTime.Before(endTime) {
+		http.Error(w, "Invalid time range: start must be before end", http.StatusBadRequest)
+		return
+	}
+
+	step := endTime.Sub(startTime) / defaultVolumeBuckets
+	if step < time.Second {
+		step = time.Second
+	}
+	if stepStr := r.URL.Query().Get("step"); stepStr != "" {
+		var err error
+		if step, err = parseStep(stepStr); err != nil || step < time.Second {
+			http.Error(w, "Invalid step: must be at least 1s", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.executor.Volume(r.Context(), queryStr, startTime, endTime, step, query.ExecuteOptions{Scope: keyScope(r)})
+	if err != nil {
+		status := http.StatusBadRequest
+		if qe, ok := err.(*query.QueryError); ok && qe.Type == "storage_inconsistency" {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, "Query error: "+err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseStep parses a step given in seconds or as a duration
+func parseStep(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return parseExtendedDuration(s)
+}
+
+// parseQueryRange reads start and end, defaulting to the hour up to now. It
+// writes a 400 and returns false when either is malformed.
+func parseQueryRange(w http.ResponseWriter, r *http.Request, now time.Time) (time.Time, time.Time, bool) {
+	startTime := now.Add(-1 * time.Hour)
+	endTime := now
+	var err error
+
+	if startStr := r.URL.Query().Get("start"); startStr != "" {
+		startTime, err = parseLokiTime(startStr, now)
+		if err != nil {
+			http.Error(w, "Invalid start time format", http.StatusBadRequest)
+			return startTime, endTime, false
+		}
+	}
+
+	if endStr := r.URL.Query().Get("end"); endStr != "" {
+		endTime, err = parseLokiTime(endStr, now)
+		if err != nil {
+			http.Error(w, "Invalid end time format", http.StatusBadRequest)
+			return startTime, endTime, false
+		}
+	}
+
+	return startTime, endTime, true
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// readOnlyPaths are the endpoints a read-only replica does not serve: those
+// that write to storage, and live tailing, which only sees entries ingested
+// by the node itself. Each also covers the paths below it.
+var readOnlyPaths = []string{
+	"/ingest",
+	"/v1/logs",
+	"/loki/api/v1/push",
+	"/admin/import",
+	"/admin/migrate",
+	"/admin/selftest",
+	"/admin/drain",
+	"/stream",
+}
+
+// readOnlyMiddleware answers requests to readOnlyPaths with 405 so clients
+// pushing to a read-only replica fail fast instead of being dropped
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnlyPath(r.URL.Path) {
+			w.Header().Set("Allow", "")
+			WriteErrorResponse(w, http.StatusMethodNotAllowed, ErrorCodeReadOnly,
+				"Server is a read-only replica", "Send writes to a read-write node")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func readOnlyPath(path string) bool {
+	for _, p := range readOnlyPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	handler := readOnlyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/ingest", http.StatusMethodNotAllowed},
+		{"PUT", "/ingest/uploads/abc", http.StatusMethodNotAllowed},
+		{"POST", "/v1/logs", http.StatusMethodNotAllowed},
+		{"POST", "/loki/api/v1/push", http.StatusMethodNotAllowed},
+		{"POST", "/admin/import", http.StatusMethodNotAllowed},
+		{"GET", "/stream", http.StatusMethodNotAllowed},
+		{"GET", "/query", http.StatusOK},
+		{"GET", "/loki/api/v1/query_range", http.StatusOK},
+		{"GET", "/labels", http.StatusOK},
+		{"GET", "/ingestion-stats", http.StatusOK},
+		{"GET", "/health", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.want, rec.Code)
+		}
+	}
+}
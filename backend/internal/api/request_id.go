@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader carries a request's correlation ID, both ways
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds an incoming ID kept as is
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// requestIDMiddleware gives every request an ID, the caller's X-Request-ID
+// when it sends a usable one, else a random one. The ID is stored in the
+// request context and set on the response before the handler runs, so
+// error responses and spans can report it.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the ID of the request ctx belongs to, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces, so a
+// caller's ID cannot inject into headers or log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random 128-bit hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestRequestID_ErrorResponseAndSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	h := NewLokiHandler(index.NewIndex(), storage.NewReader(t.TempDir()))
+	handler := requestIDMiddleware(http.HandlerFunc(h.QueryRange))
+
+	for _, c := range []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{"honored", "req-7f3a9c", true},
+		{"generated", "", false},
+		{"unusable", "bad id\r\nX-Injected: 1", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/loki/api/v1/query_range", nil)
+			if c.incoming != "" {
+				req.Header.Set(RequestIDHeader, c.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400 without a query, got %d", rec.Code)
+			}
+
+			id := rec.Header().Get(RequestIDHeader)
+			if c.kept && id != c.incoming {
+				t.Errorf("expected the incoming ID %q, got %q", c.incoming, id)
+			}
+			if !c.kept && len(id) != 32 {
+				t.Errorf("expected a generated 32-character ID, got %q", id)
+			}
+
+			var resp ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.RequestID != id {
+				t.Errorf("expected request_id %q in the body, got %q", id, resp.RequestID)
+			}
+
+			spans := recorder.Ended()
+			if len(spans) == 0 {
+				t.Fatal("expected a span")
+			}
+			var spanID string
+			for _, attr := range spans[len(spans)-1].Attributes() {
+				if attr.Key == "request.id" {
+					spanID = attr.Value.AsString()
+				}
+			}
+			if spanID != id {
+				t.Errorf("expected request.id %q on the span, got %q", id, spanID)
+			}
+		})
+	}
+}
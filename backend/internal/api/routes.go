@@ -1,7 +1,11 @@
 package api
 
 import (
+	"log"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -10,11 +14,15 @@ import (
 	"github.com/logpulse/backend/internal/index"
 	"github.com/logpulse/backend/internal/ingest"
 	"github.com/logpulse/backend/internal/plugin"
+	"github.com/logpulse/backend/internal/query"
 	"github.com/logpulse/backend/internal/ratelimiter"
 	"github.com/logpulse/backend/internal/storage"
 )
 
-// NewRouterWithWebhooks configures the main HTTP router.
+// NewRouterWithWebhooks configures the main HTTP router. Ingest routes are
+// rate limited by limiter, or by cfg.RateLimit when it is nil. /health and
+// /metrics are served by healthHandler, whose read probe the caller starts
+// and stops; nil serves them from a handler without one.
 func NewRouterWithWebhooks(
 	ingestor *ingest.Ingestor,
 	reader *storage.Reader,
@@ -22,56 +30,180 @@ func NewRouterWithWebhooks(
 	cfg *config.Config,
 	streamHub *StreamHub,
 	webhookNotifier interface{},
+	alertManager *plugin.AlertManager,
+	limiter *ratelimiter.Limiter,
+	healthHandler *HealthHandler,
 ) *mux.Router {
 	router := mux.NewRouter()
 
-	healthHandler := NewHealthHandler(ingestor, reader, labelIndex)
+	if healthHandler == nil {
+		healthHandler = NewHealthHandler(ingestor, reader, labelIndex)
+		healthHandler.SetStreamHub(streamHub)
+	}
 	var ingestHandler *IngestHandler
 	if webhookNotifier != nil {
 		ingestHandler = NewIngestHandler(ingestor, webhookNotifier.(*plugin.WebhookNotifier))
 	} else {
 		ingestHandler = NewIngestHandler(ingestor, nil)
 	}
+	ingestHandler.SetExtraLabels(cfg.Ingest.ExtraLabels, cfg.Ingest.ExtraLabelsOverride)
+	otlpHandler := NewOTLPHandler(ingestor, cfg.OTLP.LabelAttributes, cfg.OTLP.MaxLabels)
 	queryHandler := NewQueryHandler(labelIndex, reader)
+	queryHandler.SetStrictConsistency(cfg.Query.StrictConsistency)
 	streamHandler := NewStreamHandler(streamHub)
 	lokiHandler := NewLokiHandler(labelIndex, reader)
+	lokiHandler.SetInstantLookback(cfg.Query.InstantLookback)
+	lokiHandler.SetStrictConsistency(cfg.Query.StrictConsistency)
+	if err := lokiHandler.SetMetricLabels(cfg.Query.LokiMetricLabels); err != nil {
+		log.Printf("[Loki] Ignoring metric labels: %v", err)
+	}
+	if rc := cfg.Query.ResultCache; rc.Enabled {
+		lokiHandler.SetResultCache(rc.MaxBytes, rc.TTL)
+	}
 	alertHandler := NewAlertHandler()
+	alertHandler.SetAlertManager(alertManager)
+	adminExecutor := query.NewExecutor(labelIndex, reader)
+	adminHandler := NewAdminHandler(ingestor, adminExecutor)
+	exportDir := cfg.Query.ExportDir
+	if exportDir == "" {
+		exportDir = filepath.Join(filepath.Dir(cfg.Storage.Path), "exports")
+	}
+	exportManager := NewExportManager(adminExecutor, exportDir, cfg.Query.ExportTTL)
+	exportManager.Start()
+	tenantHandler := NewTenantHandler(labelIndex, reader, cfg.Tenancy.Label)
+	freshnessHandler := NewFreshnessHandler(labelIndex)
+	drainer := NewDrainer(ingestor, time.Duration(cfg.Shutdown.DrainGrace)*time.Second)
+	metricsStreamer := NewMetricsStreamer(cfg.Metrics.StreamInterval)
+	metricsStreamer.SetWriteTimeout(cfg.Metrics.StreamWriteTimeout)
+	metricsStreamer.Start()
+
+	if limiter == nil {
+		limiter = ratelimiter.New(cfg.RateLimit)
+	}
+	ingestLimit := limiter.Middleware
 
-	router.Use(corsMiddleware)
+	// Preflights are answered by the CORS middleware; by default they skip
+	// auth and rate limiting, but both can be made to apply
+	var preflight http.Handler = http.HandlerFunc(preflightOK)
+	if cfg.RateLimit.CountPreflight {
+		preflight = limitPath("/ingest", ingestLimit, preflight)
+		preflight = limitPath("/v1/logs", ingestLimit, preflight)
+	}
+	if cfg.Auth.Enabled && cfg.Auth.EnforceOnPreflight {
+		preflight = authMiddleware(newAPIKeys(cfg.Auth), nil, true)(preflight)
+	}
+
+	// First, so every later middleware and error response sees the ID
+	router.Use(requestIDMiddleware)
+	// requestIDMiddleware does not wrap the ResponseWriter, so deadlines are
+	// still set on the connection's own
+	router.Use(routeTimeoutMiddleware(cfg.Server.RouteTimeouts))
+	router.Use(corsMiddleware(cfg.CORS, preflight))
 	router.Use(loggingMiddleware)
+	router.Use(drainer.Middleware)
+	if cfg.ReadOnly() {
+		router.Use(readOnlyMiddleware)
+	}
 
 	if cfg.Auth.Enabled {
-		router.Use(authMiddleware(cfg.Auth.APIKey))
+		if len(cfg.Auth.ExemptPaths) > 0 {
+			log.Printf("[Auth] API key not required for paths: %s", strings.Join(cfg.Auth.ExemptPaths, ", "))
+		}
+		router.Use(authMiddleware(newAPIKeys(cfg.Auth), cfg.Auth.ExemptPaths, cfg.Auth.EnforceOnPreflight))
+	}
+	// Inside auth, so the tenant is checked against the key's scope
+	if cfg.Tenancy.Enabled {
+		router.Use(tenantMiddleware(cfg.Tenancy, cfg.Auth.ExemptPaths))
 	}
 
 	router.HandleFunc("/health", healthHandler.Health).Methods("GET", "OPTIONS")
 	router.HandleFunc("/metrics", healthHandler.Metrics).Methods("GET", "OPTIONS")
 	router.Handle("/prometheus-metrics", promhttp.Handler()).Methods("GET")
-	router.HandleFunc("/metrics/stream", ServeMetricsSSE).Methods("GET")
+	router.Handle("/metrics/stream", metricsStreamer).Methods("GET")
 
-	// Apply rate limiting to /ingest endpoint
-	router.Handle("/ingest", ratelimiter.Middleware(&cfg.RateLimit)(http.HandlerFunc(ingestHandler.Ingest))).Methods("POST", "OPTIONS")
+	// Apply rate limiting, the in-flight body budget and the decode pool to
+	// /ingest. The pool sits inside the budget so queued requests hold their
+	// body budget while waiting to decode.
+	decodePool := NewDecodePool(cfg.Ingest.DecodeWorkers, cfg.Ingest.DecodeWait)
+	healthHandler.SetDecodePool(decodePool)
+	var ingestChain http.Handler = decodePool.Middleware(http.HandlerFunc(ingestHandler.Ingest))
+	var ingestBudget *BodyBudget
+	if cfg.Ingest.MaxInflightBytes > 0 {
+		ingestBudget = NewBodyBudget(cfg.Ingest.MaxInflightBytes, cfg.Ingest.InflightWait)
+		healthHandler.SetBodyBudget(ingestBudget)
+		ingestChain = ingestBudget.Middleware(ingestChain)
+	}
+	router.Handle("/ingest", ingestLimit(ingestChain)).Methods("POST", "OPTIONS")
+
+	// Resumable uploads for backfills; chunks go through the same limits
+	uploadHandler := NewUploadHandler(ingestHandler)
+	var uploadChain http.Handler = decodePool.Middleware(http.HandlerFunc(uploadHandler.Append))
+	if ingestBudget != nil {
+		uploadChain = ingestBudget.Middleware(uploadChain)
+	}
+	router.HandleFunc("/ingest/uploads", uploadHandler.Create).Methods("POST", "OPTIONS")
+	router.Handle("/ingest/uploads/{id}", ingestLimit(uploadChain)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/ingest/uploads/{id}", uploadHandler.Status).Methods("GET")
+	router.HandleFunc("/ingest/uploads/{id}/finalize", uploadHandler.Finalize).Methods("POST", "OPTIONS")
+
+	// OTLP/HTTP logs from OpenTelemetry collectors, under the same limits
+	var otlpChain http.Handler = decodePool.Middleware(http.HandlerFunc(otlpHandler.Logs))
+	if ingestBudget != nil {
+		otlpChain = ingestBudget.Middleware(otlpChain)
+	}
+	router.Handle("/v1/logs", ingestLimit(otlpChain)).Methods("POST", "OPTIONS")
+
+	// Loki push API for Promtail and other Loki clients, likewise
+	lokiHandler.SetIngestor(ingestor)
+	if cfg.Ingest.RejectOldSamples {
+		lokiHandler.SetRejectOldSamples(cfg.Ingest.RejectOldSamplesMaxAge)
+	}
+	var pushChain http.Handler = decodePool.Middleware(http.HandlerFunc(lokiHandler.Push))
+	if ingestBudget != nil {
+		pushChain = ingestBudget.Middleware(pushChain)
+	}
+	router.Handle("/loki/api/v1/push", ingestLimit(pushChain)).Methods("POST", "OPTIONS")
 
 	router.HandleFunc("/query", queryHandler.Query).Methods("GET", "OPTIONS")
+	router.HandleFunc("/query/distinct", queryHandler.Distinct).Methods("GET", "OPTIONS")
+	router.HandleFunc("/query/volume", queryHandler.Volume).Methods("GET", "OPTIONS")
+	router.HandleFunc("/query/macros", queryHandler.Macros).Methods("GET", "OPTIONS")
 	router.HandleFunc("/labels", queryHandler.Labels).Methods("GET", "OPTIONS")
 	router.HandleFunc("/labels/{name}/values", queryHandler.LabelValues).Methods("GET", "OPTIONS")
 
-	// WebSocket for live tailing
+	// WebSocket for live tailing, and SSE for clients that cannot upgrade
 	router.HandleFunc("/stream", streamHandler.HandleStream).Methods("GET")
+	router.HandleFunc("/stream/sse", streamHandler.HandleSSE).Methods("GET")
 
 	router.HandleFunc("/alerts", alertHandler.GetAlerts).Methods("GET", "OPTIONS")
 	router.HandleFunc("/alerts", alertHandler.CreateAlert).Methods("POST", "OPTIONS")
+	router.HandleFunc("/alerts/export", alertHandler.ExportAlerts).Methods("GET", "OPTIONS")
+	router.HandleFunc("/alerts/import", alertHandler.ImportAlerts).Methods("POST", "OPTIONS")
 	router.HandleFunc("/alerts/{id}", alertHandler.GetAlert).Methods("GET", "OPTIONS")
 	router.HandleFunc("/alerts/{id}", alertHandler.UpdateAlert).Methods("PUT", "OPTIONS")
 	router.HandleFunc("/alerts/{id}", alertHandler.DeleteAlert).Methods("DELETE", "OPTIONS")
 	router.HandleFunc("/alerts/{id}/status", alertHandler.UpdateAlertStatus).Methods("PATCH", "OPTIONS")
+	router.HandleFunc("/alerts/{id}/state", alertHandler.GetAlertState).Methods("GET", "OPTIONS")
+
+	// Admin endpoints always require the API key
+	router.Handle("/admin/selftest", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(adminHandler.Selftest))).Methods("POST")
+	router.Handle("/admin/import", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(adminHandler.ImportLegacy))).Methods("POST")
+	router.Handle("/admin/migrate", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(adminHandler.Migrate))).Methods("POST")
+	router.Handle("/admin/migrate", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(adminHandler.MigrationStatus))).Methods("GET")
+	router.Handle("/admin/export", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(exportManager.Create))).Methods("POST")
+	router.Handle("/admin/export/{id}", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(exportManager.Get))).Methods("GET")
+	router.Handle("/admin/tenants", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(tenantHandler.List))).Methods("GET")
+	router.Handle("/admin/freshness", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(freshnessHandler.Freshness))).Methods("GET")
+	router.Handle("/admin/drain", requireAPIKey(cfg.Auth.APIKey, http.HandlerFunc(drainer.Drain))).Methods("POST")
 
 	// Loki-compatible API for Grafana
-	router.HandleFunc("/ready", lokiHandler.Ready).Methods("GET", "OPTIONS")
+	router.HandleFunc("/ready", drainer.ReadyGate(lokiHandler.Ready)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/loki/api/v1/status/buildinfo", lokiHandler.BuildInfo).Methods("GET", "OPTIONS")
 	router.HandleFunc("/loki/api/v1/query_range", lokiHandler.QueryRange).Methods("GET", "OPTIONS")
 	router.HandleFunc("/loki/api/v1/query", lokiHandler.Query).Methods("GET", "OPTIONS")
 	router.HandleFunc("/loki/api/v1/labels", lokiHandler.Labels).Methods("GET", "OPTIONS")
 	router.HandleFunc("/loki/api/v1/label/{name}/values", lokiHandler.LabelValues).Methods("GET", "OPTIONS")
+	router.HandleFunc("/loki/api/v1/series", lokiHandler.Series).Methods("GET", "OPTIONS")
 
 	return router
 }
@@ -84,22 +216,7 @@ func NewRouter(
 	cfg *config.Config,
 	streamHub *StreamHub,
 ) *mux.Router {
-	return NewRouterWithWebhooks(ingestor, reader, labelIndex, cfg, streamHub, nil)
-}
-
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
+	return NewRouterWithWebhooks(ingestor, reader, labelIndex, cfg, streamHub, nil, nil, nil, nil)
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -108,10 +225,18 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func authMiddleware(apiKey string) mux.MiddlewareFunc {
+// authMiddleware accepts any configured API key and records the key's label
+// scope in the request context for the ingest and query handlers to enforce.
+// Requests under an exempt path prefix need no key.
+func authMiddleware(keys apiKeys, exempt []string, enforceOnPreflight bool) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == "OPTIONS" {
+			if r.Method == "OPTIONS" && !enforceOnPreflight {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if pathExempt(r.URL.Path, exempt) {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -127,12 +252,26 @@ func authMiddleware(apiKey string) mux.MiddlewareFunc {
 				key = r.Header.Get("Authorization")
 			}
 
-			if key != apiKey {
+			scope, ok := keys[key]
+			if !ok {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			ctx := ratelimiter.WithAPIKey(r.Context(), key)
+			next.ServeHTTP(w, r.WithContext(withKeyScope(ctx, scope)))
 		})
 	}
 }
+
+// pathExempt reports whether path is one of the prefixes or below one, by
+// whole segments: /health covers /health/live but not /healthz
+func pathExempt(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		p = strings.TrimSuffix(p, "/")
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
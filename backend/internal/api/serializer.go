@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logpulse/backend/internal/query"
+)
+
+// resultFormat renders a query result as a response body. Each endpoint
+// has a default format; a client picks another by naming its media type in
+// the Accept header.
+type resultFormat struct {
+	// MediaType selects the format in Accept headers
+	MediaType string
+	// ContentType is written with the response
+	ContentType string
+	// Write encodes the result
+	Write func(w io.Writer, result *query.QueryResult, opts writeOptions) error
+}
+
+// writeOptions carries the request parameters that shape a result's encoding
+type writeOptions struct {
+	// EvalTime is the end of the queried range
+	EvalTime time.Time
+	// Forward orders Loki stream values oldest first rather than newest first
+	Forward bool
+}
+
+// Result formats. The Loki formats answer with application/json, as Loki
+// does, and are selected in Accept by their vendor media type.
+var (
+	nativeFormat = &resultFormat{
+		MediaType:   "application/json",
+		ContentType: "application/json",
+		Write:       writeNative,
+	}
+	lokiStreamsFormat = &resultFormat{
+		MediaType:   "application/vnd.loki.streams+json",
+		ContentType: "application/json",
+		Write:       writeLokiStreams,
+	}
+	lokiMatrixFormat = &resultFormat{
+		MediaType:   "application/vnd.loki.matrix+json",
+		ContentType: "application/json",
+		Write:       writeLokiMatrix,
+	}
+	ndjsonFormat = &resultFormat{
+		MediaType:   "application/x-ndjson",
+		ContentType: "application/x-ndjson",
+		Write:       writeNDJSON,
+	}
+)
+
+// resultFormats lists the formats Accept negotiation chooses from
+var resultFormats = []*resultFormat{nativeFormat, lokiStreamsFormat, lokiMatrixFormat, ndjsonFormat}
+
+// negotiateFormat returns the first format named in the request's Accept
+// header, in the client's order of preference, or def when none is. The
+// default's media and content types and wildcards keep the default, so
+// plain application/json stays native on /query and Loki on /loki
+// endpoints.
+func negotiateFormat(r *http.Request, def *resultFormat) *resultFormat {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return def
+	}
+
+	type candidate struct {
+		format *resultFormat
+		q      float64
+	}
+	var best *candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil || q <= 0 {
+				continue
+			}
+		}
+		var f *resultFormat
+		switch {
+		case mediaType == def.MediaType || mediaType == def.ContentType || mediaType == "*/*" || mediaType == "application/*":
+			f = def
+		default:
+			for _, rf := range resultFormats {
+				if rf.MediaType == mediaType {
+					f = rf
+					break
+				}
+			}
+		}
+		if f != nil && (best == nil || q > best.q) {
+			best = &candidate{format: f, q: q}
+		}
+	}
+	if best == nil {
+		return def
+	}
+	return best.format
+}
+
+// writeResult writes a query result in the format negotiated for the
+// request, def unless the Accept header asks for another
+func writeResult(w http.ResponseWriter, r *http.Request, def *resultFormat, result *query.QueryResult, opts writeOptions) {
+	format := negotiateFormat(r, def)
+	w.Header().Set("Content-Type", format.ContentType)
+	format.Write(w, result, opts)
+}
+
+// writeNative encodes the result as the executor returns it
+func writeNative(w io.Writer, result *query.QueryResult, _ writeOptions) error {
+	return json.NewEncoder(w).Encode(result)
+}
+
+// writeLokiStreams groups log lines by their labels into Loki streams of
+// [nanosecond timestamp, line] values. Each stream's values are sorted by
+// timestamp in the requested direction, keeping scan order for equal
+// timestamps, and lines repeated with the same timestamp, as overlapping
+// chunks produce, are written once.
+func writeLokiStreams(w io.Writer, result *query.QueryResult, opts writeOptions) error {
+	type value struct {
+		ts   int64
+		line string
+	}
+	type stream struct {
+		labels map[string]string
+		values []value
+		seen   map[value]bool
+	}
+	streamMap := make(map[string]*stream)
+	var order []string
+
+	for _, log := range result.Logs {
+		labelKey := labelsToKey(log.Labels)
+		s, exists := streamMap[labelKey]
+		if !exists {
+			s = &stream{labels: log.Labels, seen: make(map[value]bool)}
+			streamMap[labelKey] = s
+			order = append(order, labelKey)
+		}
+
+		parsedTime, _ := time.Parse(time.RFC3339Nano, log.Timestamp)
+		v := value{ts: parsedTime.UnixNano(), line: log.Message}
+		if s.seen[v] {
+			continue
+		}
+		s.seen[v] = true
+		s.values = append(s.values, v)
+	}
+
+	streams := make([]LokiStream, 0, len(streamMap))
+	for _, key := range order {
+		s := streamMap[key]
+		sort.SliceStable(s.values, func(i, j int) bool {
+			if opts.Forward {
+				return s.values[i].ts < s.values[j].ts
+			}
+			return s.values[i].ts > s.values[j].ts
+		})
+		values := make([][]string, len(s.values))
+		for i, v := range s.values {
+			values[i] = []string{strconv.FormatInt(v.ts, 10), v.line}
+		}
+		streams = append(streams, LokiStream{Stream: s.labels, Values: values})
+	}
+
+	return json.NewEncoder(w).Encode(LokiQueryRangeResponse{
+		Status: "success",
+		Data: LokiResultData{
+			ResultType: "streams",
+			Result:     streams,
+		},
+		Warnings:   result.Warnings,
+		NextCursor: result.Next,
+	})
+}
+
+// LokiMatrixResponse represents Loki's response to a metric query
+type LokiMatrixResponse struct {
+	Status   string               `json:"status"`
+	Data     LokiMatrixResultData `json:"data"`
+	Warnings []string             `json:"warnings,omitempty"`
+}
+
+// LokiMatrixResultData contains the series of a metric query
+type LokiMatrixResultData struct {
+	ResultType string       `json:"resultType"`
+	Result     []LokiSeries `json:"result"`
+}
+
+// LokiSeries is one labelled series of [unix seconds, "value"] samples
+type LokiSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+// writeLokiMatrix renders an aggregation as a Loki matrix: a series over
+// time, one sample per group at the evaluation time, or a single sample for a scalar
+// result. Log results have no series and render an empty matrix.
+func writeLokiMatrix(w io.Writer, result *query.QueryResult, opts writeOptions) error {
+	series := []LokiSeries{}
+	sample := func(t time.Time, v float64) [2]interface{} {
+		return [2]interface{}{float64(t.UnixMilli()) / 1000, strconv.FormatFloat(v, 'f', -1, 64)}
+	}
+
+	if agg := result.Aggregation; agg != nil {
+		switch {
+		case len(agg.Series) > 0:
+			s := LokiSeries{Metric: map[string]string{}, Values: [][2]interface{}{}}
+			for _, p := range agg.Series {
+				t, err := time.Parse(time.RFC3339, p.Timestamp)
+				if err != nil {
+					continue
+				}
+				s.Values = append(s.Values, sample(t, p.Value))
+			}
+			series = append(series, s)
+		case len(agg.Groups) > 0:
+			for _, g := range agg.Groups {
+				series = append(series, LokiSeries{
+					Metric: g.Labels,
+					Values: [][2]interface{}{sample(opts.EvalTime, g.Value)},
+				})
+			}
+		default:
+			series = append(series, LokiSeries{
+				Metric: map[string]string{},
+				Values: [][2]interface{}{sample(opts.EvalTime, agg.Value)},
+			})
+		}
+	}
+
+	return json.NewEncoder(w).Encode(LokiMatrixResponse{
+		Status: "success",
+		Data: LokiMatrixResultData{
+			ResultType: "matrix",
+			Result:     series,
+		},
+		Warnings: result.Warnings,
+	})
+}
+
+// writeNDJSON writes one log line per line, followed by the aggregation,
+// if any, as a final {"aggregation": ...} line
+func writeNDJSON(w io.Writer, result *query.QueryResult, _ writeOptions) error {
+	enc := json.NewEncoder(w)
+	for _, l := range result.Logs {
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	if result.Aggregation != nil {
+		return enc.Encode(map[string]interface{}{"aggregation": result.Aggregation})
+	}
+	return nil
+}
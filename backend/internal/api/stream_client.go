@@ -0,0 +1,301 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// DefaultClientBufferSize is the number of messages buffered for each live
+// tail client before new messages for it are dropped
+const DefaultClientBufferSize = 256
+
+// CompressParam is the /stream query parameter that opts a connection into
+// compressed buffering (compress=true). Messages waiting for a slow client
+// are then held deflated and inflated just before the write, trading CPU
+// for hub memory. What goes over the wire is unchanged.
+const CompressParam = "compress"
+
+// RateParam is the /stream query parameter setting the most messages per
+// second sent to the connection (0 = unlimited), in place of the hub's
+// default. Messages over the rate are dropped for that client only and
+// their number is reported in a "dropped" frame.
+const RateParam = "rate"
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// deflate compresses a message for a client's buffer
+func deflate(msg []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(msg)
+	w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// outboundMessage is a message waiting in a client's buffer; event is the
+// frame's type
+type outboundMessage struct {
+	event      string
+	data       []byte
+	compressed bool
+}
+
+// streamSink is the transport a live tail client's frames are written to,
+// a WebSocket or an SSE response. Filtering, buffering and drop counting are
+// the hub's and the client's; the sink only writes.
+type streamSink interface {
+	// writeFrame sends one JSON frame whose type is event
+	writeFrame(event string, data []byte) error
+	// close ends the connection, first telling the client why when reason
+	// is set; frames written afterwards fail. Without a reason it does not
+	// block.
+	close(reason string)
+}
+
+// wsSink writes frames as WebSocket text messages
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func (s wsSink) writeFrame(_ string, data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (s wsSink) close(reason string) {
+	if reason != "" {
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason)
+		s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+	s.conn.Close()
+}
+
+// streamClient is a live tail connection with its own buffer of pending
+// messages, drained by a dedicated writer goroutine so one slow client does
+// not hold up the others
+type streamClient struct {
+	sink     streamSink
+	compress bool
+	limit    int
+	// limiter caps the messages per second sent to the client; nil is
+	// unlimited
+	limiter *rate.Limiter
+
+	mu       sync.Mutex
+	filter   StreamFilter
+	queue    []outboundMessage
+	buffered int64 // bytes held in queue
+	// rateDropped counts messages dropped by the limiter and not yet
+	// reported to the client
+	rateDropped int64
+	// dropped counts messages dropped for a full buffer, and overflows
+	// those dropped since the last one buffered
+	dropped   int64
+	overflows int
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newStreamClient(sink streamSink, filter StreamFilter, compress bool, limit int) *streamClient {
+	if limit <= 0 {
+		limit = DefaultClientBufferSize
+	}
+	return &streamClient{
+		sink:     sink,
+		compress: compress,
+		limit:    limit,
+		filter:   filter,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// setRate limits the client to perSecond messages, with bursts of up to a
+// second's worth; 0 removes the limit
+func (c *streamClient) setRate(perSecond float64) {
+	if perSecond <= 0 {
+		c.limiter = nil
+		return
+	}
+	c.limiter = rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond)))
+}
+
+// allow reports whether the client's rate admits another message. Refused
+// messages are counted and reported ahead of the next admitted one.
+func (c *streamClient) allow() bool {
+	if c.limiter == nil {
+		return true
+	}
+	if !c.limiter.Allow() {
+		c.mu.Lock()
+		c.rateDropped++
+		c.mu.Unlock()
+		return false
+	}
+	c.reportDropped()
+	return true
+}
+
+// reportDropped queues a frame with the number of messages the rate limit
+// dropped since the last report
+func (c *streamClient) reportDropped() {
+	c.mu.Lock()
+	n := c.rateDropped
+	c.rateDropped = 0
+	c.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":   "dropped",
+		"reason": "rate_limit",
+		"count":  n,
+	})
+	var deflated []byte
+	if !c.enqueue("dropped", frame, &deflated) {
+		// Report them with the next frame instead
+		c.mu.Lock()
+		c.rateDropped += n
+		c.mu.Unlock()
+	}
+}
+
+func (c *streamClient) getFilter() StreamFilter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.filter
+}
+
+func (c *streamClient) setFilter(f StreamFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filter = f
+}
+
+// enqueue buffers a frame of type event for the client and reports false
+// when the buffer is full. deflated is the compressed form of msg, shared
+// between clients, and is computed on first use.
+func (c *streamClient) enqueue(event string, msg []byte, deflated *[]byte) bool {
+	out := outboundMessage{event: event, data: msg}
+	if c.compress {
+		if *deflated == nil {
+			*deflated = deflate(msg)
+		}
+		out = outboundMessage{event: event, data: *deflated, compressed: true}
+	}
+
+	c.mu.Lock()
+	if len(c.queue) >= c.limit {
+		c.dropped++
+		c.overflows++
+		c.mu.Unlock()
+		return false
+	}
+	c.overflows = 0
+	c.queue = append(c.queue, out)
+	c.buffered += int64(len(out.data))
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (c *streamClient) pop() (outboundMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return outboundMessage{}, false
+	}
+	msg := c.queue[0]
+	c.queue[0] = outboundMessage{}
+	c.queue = c.queue[1:]
+	c.buffered -= int64(len(msg.data))
+	return msg, true
+}
+
+// dropStats returns the messages dropped for a full buffer, in all and
+// since the last one buffered
+func (c *streamClient) dropStats() (dropped int64, overflows int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped, c.overflows
+}
+
+// bufferedBytes returns the bytes of messages waiting to be written
+func (c *streamClient) bufferedBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buffered
+}
+
+// writePump writes buffered messages until the client is closed or a write
+// fails, in which case the client is handed to unregister
+func (c *streamClient) writePump(unregister chan<- *streamClient) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		}
+
+		for {
+			msg, ok := c.pop()
+			if !ok {
+				break
+			}
+			data := msg.data
+			if msg.compressed {
+				var err error
+				if data, err = inflate(data); err != nil {
+					log.Printf("[StreamHub] Failed to inflate buffered message: %v", err)
+					continue
+				}
+			}
+			if err := c.sink.writeFrame(msg.event, data); err != nil {
+				log.Printf("[StreamHub] Write error: %v", err)
+				select {
+				case unregister <- c:
+				case <-c.done:
+				}
+				return
+			}
+		}
+	}
+}
+
+// close stops the writer goroutine and releases the buffer
+func (c *streamClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.queue, c.buffered = nil, 0
+		c.mu.Unlock()
+	})
+}
@@ -3,16 +3,18 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-
 	"github.com/gorilla/websocket"
+	"github.com/logpulse/backend/internal/logging"
 	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
 )
 
 var upgrader = websocket.Upgrader{
@@ -23,49 +25,148 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// StreamHub manages WebSocket connections for live streaming
+// Drop policies applied when the broadcast queue is full
+const (
+	DropNewest = "drop_newest" // discard the incoming entry (default)
+	DropOldest = "drop_oldest" // evict the oldest queued entry to make room
+)
+
+// DefaultBroadcastBufferSize is the broadcast queue capacity used by NewStreamHub
+const DefaultBroadcastBufferSize = 5000
+
+// StreamHub manages live tail clients, over WebSockets or SSE
 type StreamHub struct {
-	clients      map[*websocket.Conn]StreamFilter
-	register     chan *clientRegistration
-	unregister   chan *websocket.Conn
+	clients map[*streamClient]struct{}
+	// groups holds the connected clients by filter, so an entry is matched
+	// once per distinct filter rather than once per client
+	groups       map[string]*filterGroup
+	register     chan *streamClient
+	unregister   chan *streamClient
 	broadcast    chan *models.LogEntry
+	dropOldest   bool
 	mu           sync.RWMutex
 	dropCount    int64
+	highWater    int64
 	broadcastErr chan error
 	ctx          context.Context
 	cancel       context.CancelFunc
-}
 
-type clientRegistration struct {
-	conn   *websocket.Conn
-	filter StreamFilter
+	// clientBufferSize caps the messages buffered per client; clientDrops
+	// counts messages dropped because a client's buffer was full
+	clientBufferSize int
+	clientDrops      int64
+	// maxOverflows disconnects a client after that many messages in a row
+	// were dropped for its full buffer (0 = never); evictions counts them
+	maxOverflows int
+	evictions    int64
+	// clientRate is the default messages per second per client (0 =
+	// unlimited); rateDrops counts messages it held back
+	clientRate float64
+	rateDrops  int64
+
+	logger *slog.Logger
 }
 
+// StreamFilter selects the entries a live tail client receives: those
+// carrying all of Labels and matching Query, a LogQL selector with line
+// filters such as {app=~"api|web"} |= "error"
 type StreamFilter struct {
 	Labels map[string]string `json:"labels"`
+	Query  string            `json:"query,omitempty"`
+
+	parsed *query.ParsedQuery
+	// scope is the labels the client's API key is confined to; it is set
+	// from the request, never from a filter the client sends
+	scope models.Labels
+}
+
+// newStreamFilter builds a filter, parsing queryStr with the executor's
+// LogQL parser. Aggregations and pipeline stages are refused, as live tail
+// delivers each entry on its own and unchanged.
+func newStreamFilter(labels map[string]string, queryStr string) (StreamFilter, error) {
+	f := StreamFilter{Labels: labels, Query: queryStr}
+	if queryStr == "" {
+		return f, nil
+	}
+	parsed, err := query.ParseAdvancedQuery(queryStr)
+	if err != nil {
+		return f, err
+	}
+	if parsed.Aggregation != nil || len(parsed.Pipeline) > 0 {
+		return f, fmt.Errorf("live tail queries only take a selector and line filters")
+	}
+	f.parsed = parsed
+	return f, nil
+}
+
+// Match reports whether an entry passes the filter
+func (f StreamFilter) Match(entry *models.LogEntry) bool {
+	if !models.Labels(entry.Labels).Match(f.scope) {
+		return false
+	}
+	for k, v := range f.Labels {
+		if entry.Labels[k] != v {
+			return false
+		}
+	}
+	return f.parsed == nil || (f.parsed.MatchLabels(entry.Labels) && f.parsed.MatchLine(entry.Line))
+}
+
+// streamErrorFrame is the message telling a client its filter was refused
+func streamErrorFrame(err error) []byte {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":  "error",
+		"error": err.Error(),
+	})
+	return msg
+}
+
+// filterGroup is the set of clients tailing with the same filter
+type filterGroup struct {
+	filter  StreamFilter
+	clients map[*streamClient]struct{}
+}
+
+// filterKey identifies a filter's group; filters with the same labels,
+// query and scope share a key whatever order the labels were given in
+func filterKey(f StreamFilter) string {
+	return labelsToKey(f.Labels) + "\x00" + f.Query + "\x00" + labelsToKey(f.scope)
 }
 
 // NewStreamHub creates a new streaming hub
 func NewStreamHub() *StreamHub {
+	return NewStreamHubWithBuffer(DefaultBroadcastBufferSize, DropNewest)
+}
+
+// NewStreamHubWithBuffer creates a streaming hub with a broadcast queue of the
+// given capacity and drop policy. Each queued entry holds a pointer to a log
+// entry, so memory grows with bufferSize times the average entry size.
+func NewStreamHubWithBuffer(bufferSize int, dropPolicy string) *StreamHub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBroadcastBufferSize
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &StreamHub{
-		clients:      make(map[*websocket.Conn]StreamFilter),
-		register:     make(chan *clientRegistration, 100),
-		unregister:   make(chan *websocket.Conn, 100),
-		broadcast:    make(chan *models.LogEntry, 5000),
+		clients:      make(map[*streamClient]struct{}),
+		groups:       make(map[string]*filterGroup),
+		register:     make(chan *streamClient, 100),
+		unregister:   make(chan *streamClient, 100),
+		broadcast:    make(chan *models.LogEntry, bufferSize),
+		dropOldest:   dropPolicy == DropOldest,
 		dropCount:    0,
 		broadcastErr: make(chan error, 100),
 		ctx:          ctx,
 		cancel:       cancel,
+		logger:       logging.Component("StreamHub"),
 	}
 }
 
 // Run starts the hub's main loop with context support
 func (h *StreamHub) Run(ctx context.Context) {
-	log.Println("[StreamHub] Starting hub")
+	h.logger.Info("Starting hub")
 	defer func() {
 		h.cancel() // Cancel internal context
-		log.Println("[StreamHub] Hub stopped")
+		h.logger.Info("Hub stopped")
 	}()
 
 	ticker := time.NewTicker(30 * time.Second)
@@ -74,25 +175,31 @@ func (h *StreamHub) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("[StreamHub] Context cancelled, shutting down")
+			h.logger.Info("Context cancelled, shutting down")
 			h.closeAllClients()
 			return
 
-		case reg := <-h.register:
+		case client := <-h.register:
 			h.mu.Lock()
-			h.clients[reg.conn] = reg.filter
+			h.clients[client] = struct{}{}
+			h.joinGroup(client)
 			clientCount := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("[StreamHub] Client connected with filter %v. Total: %d", reg.filter.Labels, clientCount)
+			go client.writePump(h.unregister)
+			h.logger.Info("Client connected",
+				"filter", client.getFilter().Labels, "compressed_buffer", client.compress, "clients", clientCount)
 
-		case conn := <-h.unregister:
+		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[conn]; ok {
-				delete(h.clients, conn)
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				h.leaveGroup(client)
 				clientCount := len(h.clients)
 				h.mu.Unlock()
-				conn.Close()
-				log.Printf("[StreamHub] Client disconnected. Total: %d", clientCount)
+				client.close()
+				client.sink.close("")
+				dropped, _ := client.dropStats()
+				h.logger.Info("Client disconnected", "dropped", dropped, "clients", clientCount)
 			} else {
 				h.mu.Unlock()
 			}
@@ -106,61 +213,124 @@ func (h *StreamHub) Run(ctx context.Context) {
 	}
 }
 
-// processBroadcast sends log entry to matching clients
+// processBroadcast queues a log entry for every client whose filter
+// matches. The filter is evaluated once per group of clients sharing it,
+// and the message is serialized, and compressed, once for all clients; each
+// client's writer goroutine delivers it, so a slow client only fills its
+// own buffer and never holds up the rest of its group. A client that keeps
+// overflowing its buffer is disconnected.
 func (h *StreamHub) processBroadcast(entry *models.LogEntry) {
 	h.mu.RLock()
-	clientCount := len(h.clients)
-	clientsCopy := make([]*websocket.Conn, 0, clientCount)
-	filtersCopy := make([]StreamFilter, 0, clientCount)
-
-	for conn, filter := range h.clients {
-		clientsCopy = append(clientsCopy, conn)
-		filtersCopy = append(filtersCopy, filter)
+	var clients []*streamClient
+	for _, group := range h.groups {
+		if !group.filter.Match(entry) {
+			continue
+		}
+		for client := range group.clients {
+			clients = append(clients, client)
+		}
 	}
 	h.mu.RUnlock()
 
-	failedConns := make([]*websocket.Conn, 0)
+	var msg, deflated []byte
+	var slow []*streamClient
+	for _, client := range clients {
+		if !client.allow() {
+			atomic.AddInt64(&h.rateDrops, 1)
+			continue
+		}
 
-	for i, conn := range clientsCopy {
-		filter := filtersCopy[i]
+		if msg == nil {
+			msg, _ = json.Marshal(map[string]interface{}{
+				"type": "log",
+				"data": map[string]interface{}{
+					"id":        entry.ID,
+					"timestamp": entry.Timestamp.Format(time.RFC3339Nano),
+					"message":   entry.Line,
+					"labels":    entry.Labels,
+					"level":     entry.Labels["level"],
+				},
+			})
+		}
 
-		if !matchesFilter(entry.Labels, filter.Labels) {
-			continue
+		if !client.enqueue("log", msg, &deflated) {
+			drops := atomic.AddInt64(&h.clientDrops, 1)
+			if drops == 1 || drops%100 == 0 {
+				h.logger.Warn("Client buffer full, dropping message", "client_drops", drops)
+			}
+			if _, overflows := client.dropStats(); h.maxOverflows > 0 && overflows >= h.maxOverflows {
+				slow = append(slow, client)
+			}
 		}
+	}
+	for _, client := range slow {
+		h.evict(client)
+	}
+}
 
-		msg, _ := json.Marshal(map[string]interface{}{
-			"type": "log",
-			"data": map[string]interface{}{
-				"id":        entry.ID,
-				"timestamp": entry.Timestamp.Format(time.RFC3339Nano),
-				"message":   entry.Line,
-				"labels":    entry.Labels,
-				"level":     entry.Labels["level"],
-			},
-		})
+// evict disconnects a client that stopped keeping up, with a close frame
+// saying why
+func (h *StreamHub) evict(client *streamClient) {
+	h.mu.Lock()
+	_, ok := h.clients[client]
+	if ok {
+		delete(h.clients, client)
+		h.leaveGroup(client)
+	}
+	clientCount := len(h.clients)
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
 
-		// Non-blocking write with timeout
-		done := make(chan error, 1)
-		go func(c *websocket.Conn, m []byte) {
-			c.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			done <- c.WriteMessage(websocket.TextMessage, m)
-		}(conn, msg)
+	atomic.AddInt64(&h.evictions, 1)
+	// The close frame waits for any write in progress to the client, so it
+	// is sent off the hub's goroutine, before the client's handler is told
+	// to return
+	go func() {
+		client.sink.close("client too slow, messages dropped")
+		client.close()
+	}()
+	dropped, _ := client.dropStats()
+	h.logger.Warn("Disconnected slow client", "dropped", dropped, "clients", clientCount)
+}
 
-		select {
-		case err := <-done:
-			if err != nil {
-				log.Printf("[StreamHub] Write error: %v", err)
-				failedConns = append(failedConns, conn)
-			}
-		case <-time.After(6 * time.Second):
-			log.Printf("[StreamHub] Write timeout")
-			failedConns = append(failedConns, conn)
+// joinGroup adds a client to the group for its filter; h.mu must be held
+func (h *StreamHub) joinGroup(client *streamClient) {
+	filter := client.getFilter()
+	key := filterKey(filter)
+	group, ok := h.groups[key]
+	if !ok {
+		group = &filterGroup{filter: filter, clients: make(map[*streamClient]struct{})}
+		h.groups[key] = group
+	}
+	group.clients[client] = struct{}{}
+}
+
+// leaveGroup removes a client from the group for its filter, dropping the
+// group once empty; h.mu must be held
+func (h *StreamHub) leaveGroup(client *streamClient) {
+	key := filterKey(client.getFilter())
+	if group, ok := h.groups[key]; ok {
+		delete(group.clients, client)
+		if len(group.clients) == 0 {
+			delete(h.groups, key)
 		}
 	}
+}
 
-	// Unregister failed connections
-	for _, conn := range failedConns {
-		h.unregister <- conn
+// setClientFilter changes a client's filter, moving it to the new filter's
+// group if it is still connected
+func (h *StreamHub) setClientFilter(client *streamClient, f StreamFilter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, connected := h.clients[client]
+	if connected {
+		h.leaveGroup(client)
+	}
+	client.setFilter(f)
+	if connected {
+		h.joinGroup(client)
 	}
 }
 
@@ -169,11 +339,13 @@ func (h *StreamHub) closeAllClients() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	for conn := range h.clients {
-		conn.Close()
+	for client := range h.clients {
+		client.close()
+		client.sink.close("")
 	}
-	h.clients = make(map[*websocket.Conn]StreamFilter)
-	log.Printf("[StreamHub] All clients disconnected")
+	h.clients = make(map[*streamClient]struct{})
+	h.groups = make(map[string]*filterGroup)
+	h.logger.Info("All clients disconnected")
 }
 
 // logStatus logs current hub status
@@ -184,8 +356,8 @@ func (h *StreamHub) logStatus() {
 	h.mu.RUnlock()
 
 	if clientCount > 0 || drops > 0 {
-		log.Printf("[StreamHub] Status - Clients: %d, Drops: %d, QueueLen: %d/%d",
-			clientCount, drops, len(h.broadcast), cap(h.broadcast))
+		h.logger.Info("Status",
+			"clients", clientCount, "drops", drops, "queue_len", len(h.broadcast), "queue_cap", cap(h.broadcast))
 	}
 }
 
@@ -194,74 +366,135 @@ func (h *StreamHub) Broadcast(entry *models.LogEntry) {
 	select {
 	case h.broadcast <- entry:
 		// Successfully queued
+		h.observeQueueLength()
+		return
 	default:
-		// Channel full, drop message and track
-		drops := atomic.AddInt64(&h.dropCount, 1)
-		if drops%100 == 0 {
-			log.Printf("[StreamHub] WARN: Broadcast channel full, dropping message. Total drops: %d", drops)
+	}
+
+	// Channel full: under drop_oldest, evict the oldest entry and retry once
+	if h.dropOldest {
+		select {
+		case <-h.broadcast:
+		default:
+		}
+		select {
+		case h.broadcast <- entry:
+		default:
 		}
 	}
-}
 
-// matchesFilter checks if log labels match the filter
-func matchesFilter(logLabels, filterLabels map[string]string) bool {
-	if len(filterLabels) == 0 {
-		return true
+	// Either the incoming or the evicted entry was lost
+	drops := atomic.AddInt64(&h.dropCount, 1)
+	if drops%100 == 0 {
+		h.logger.Warn("Broadcast channel full, dropping message", "drops", drops)
 	}
-	for k, v := range filterLabels {
-		if logLabels[k] != v {
-			return false
+}
+
+// observeQueueLength records the broadcast queue high-water mark
+func (h *StreamHub) observeQueueLength() {
+	n := int64(len(h.broadcast))
+	for {
+		hw := atomic.LoadInt64(&h.highWater)
+		if n <= hw || atomic.CompareAndSwapInt64(&h.highWater, hw, n) {
+			return
 		}
 	}
-	return true
 }
 
-// StreamHandler handles WebSocket connections for live log streaming
+// GetQueueStats returns the current broadcast queue length, its capacity and
+// the highest length observed since startup
+func (h *StreamHub) GetQueueStats() (length, capacity int, highWater int64) {
+	return len(h.broadcast), cap(h.broadcast), atomic.LoadInt64(&h.highWater)
+}
+
+// StreamHandler handles live log streaming over WebSockets and SSE
 type StreamHandler struct {
 	hub *StreamHub
+	// heartbeat is how often an idle SSE stream gets a comment line
+	heartbeat time.Duration
+	logger    *slog.Logger
 }
 
 // NewStreamHandler creates a new stream handler
 func NewStreamHandler(hub *StreamHub) *StreamHandler {
-	return &StreamHandler{hub: hub}
+	return &StreamHandler{hub: hub, heartbeat: 15 * time.Second, logger: logging.Component("StreamHandler")}
+}
+
+// streamOptions is what a live tail request asks for in its query string
+type streamOptions struct {
+	filter   StreamFilter
+	compress bool
+	rate     float64
+}
+
+// parseStreamOptions reads the filter, compression and rate of a /stream
+// or /stream/sse request: every parameter but query, compress and rate is
+// a label to match
+func (h *StreamHandler) parseStreamOptions(r *http.Request) (streamOptions, error) {
+	labels := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		if key != "query" && key != CompressParam && key != RateParam && len(values) > 0 {
+			labels[key] = values[0]
+		}
+	}
+	filter, err := newStreamFilter(labels, r.URL.Query().Get("query"))
+	if err != nil {
+		return streamOptions{}, err
+	}
+	filter.scope = keyScope(r)
+	opts := streamOptions{filter: filter, rate: h.hub.clientRate}
+	opts.compress, _ = strconv.ParseBool(r.URL.Query().Get(CompressParam))
+	if s := r.URL.Query().Get(RateParam); s != "" {
+		if n, err := strconv.ParseFloat(s, 64); err == nil && n >= 0 {
+			opts.rate = n
+		}
+	}
+	return opts, nil
+}
+
+// welcomeFrame is the first message of a live tail connection
+func (opts streamOptions) welcomeFrame() []byte {
+	welcome, _ := json.Marshal(map[string]interface{}{
+		"type":       "connected",
+		"message":    "Connected to log stream",
+		"filter":     opts.filter.Labels,
+		"query":      opts.filter.Query,
+		"compressed": opts.compress,
+		"rate":       opts.rate,
+	})
+	return welcome
 }
 
 // HandleStream handles GET /stream WebSocket endpoint
 func (h *StreamHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("[StreamHandler] WebSocket upgrade error: %v", err)
+		h.logger.Error("WebSocket upgrade failed", "error", err)
 		return
 	}
 
-	filter := StreamFilter{
-		Labels: make(map[string]string),
-	}
-
-	for key, values := range r.URL.Query() {
-		if key != "query" && len(values) > 0 {
-			filter.Labels[key] = values[0]
-		}
+	opts, err := h.parseStreamOptions(r)
+	if err != nil {
+		// Refuse the stream rather than tail everything
+		conn.WriteMessage(websocket.TextMessage, streamErrorFrame(err))
+		conn.Close()
+		return
 	}
 
-	h.hub.register <- &clientRegistration{
-		conn:   conn,
-		filter: filter,
-	}
+	// The welcome is written before registering; afterwards only the
+	// client's writer goroutine writes data messages
+	conn.WriteMessage(websocket.TextMessage, opts.welcomeFrame())
 
-	welcome, _ := json.Marshal(map[string]interface{}{
-		"type":    "connected",
-		"message": "Connected to log stream",
-		"filter":  filter.Labels,
-	})
-	conn.WriteMessage(websocket.TextMessage, welcome)
+	client := newStreamClient(wsSink{conn: conn}, opts.filter, opts.compress, h.hub.clientBufferSize)
+	client.setRate(opts.rate)
+	h.hub.register <- client
 
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
 		defer func() {
-			h.hub.unregister <- conn
+			h.hub.unregister <- client
 		}()
 
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -274,7 +507,7 @@ func (h *StreamHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
 			_, message, err := conn.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("[StreamHandler] WebSocket error: %v", err)
+					h.logger.Warn("WebSocket error", "error", err)
 				}
 				return
 			}
@@ -285,22 +518,32 @@ func (h *StreamHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if msg["type"] == "filter" {
-				if labels, ok := msg["labels"].(map[string]interface{}); ok {
-					newFilter := StreamFilter{Labels: make(map[string]string)}
+				labels, hasLabels := msg["labels"].(map[string]interface{})
+				queryStr, hasQuery := msg["query"].(string)
+				if hasLabels || hasQuery {
+					newLabels := make(map[string]string)
 					for k, v := range labels {
 						if str, ok := v.(string); ok {
-							newFilter.Labels[k] = str
+							newLabels[k] = str
 						}
 					}
-					h.hub.mu.Lock()
-					h.hub.clients[conn] = newFilter
-					h.hub.mu.Unlock()
-
-					confirm, _ := json.Marshal(map[string]interface{}{
-						"type":   "filter_updated",
-						"filter": newFilter.Labels,
-					})
-					conn.WriteMessage(websocket.TextMessage, confirm)
+
+					// An invalid query keeps the current filter
+					event, reply := "filter_updated", []byte(nil)
+					if newFilter, err := newStreamFilter(newLabels, queryStr); err != nil {
+						event, reply = "error", streamErrorFrame(err)
+					} else {
+						// A new filter cannot widen the key's scope
+						newFilter.scope = opts.filter.scope
+						h.hub.setClientFilter(client, newFilter)
+						reply, _ = json.Marshal(map[string]interface{}{
+							"type":   "filter_updated",
+							"filter": newFilter.Labels,
+							"query":  newFilter.Query,
+						})
+					}
+					var deflated []byte
+					client.enqueue(event, reply, &deflated)
 				}
 			}
 
@@ -316,8 +559,11 @@ func (h *StreamHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
 		case <-done:
 			return
 		case <-ticker.C:
-			if err := conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				h.hub.unregister <- conn
+			// Report rate-limited drops even when no message follows them
+			client.reportDropped()
+			// Control frames may be written alongside the writer goroutine
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(5*time.Second)); err != nil {
+				h.hub.unregister <- client
 				return
 			}
 		}
@@ -336,67 +582,83 @@ func (h *StreamHub) GetDroppedMessages() int64 {
 	return atomic.LoadInt64(&h.dropCount)
 }
 
-// ResetDropCounter resets the dropped message counter
-func (h *StreamHub) ResetDropCounter() {
-	atomic.StoreInt64(&h.dropCount, 0)
+// SetClientBufferSize caps the messages buffered for each client; clients
+// connected afterwards use the new size
+func (h *StreamHub) SetClientBufferSize(n int) {
+	h.clientBufferSize = n
 }
 
-// ServeMetricsSSE handles /metrics/stream SSE endpoint
-func ServeMetricsSSE(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
+// SetMaxClientOverflows disconnects a client once n messages in a row were
+// dropped because its buffer was full (0 = never), so a stalled client
+// stops holding a full buffer
+func (h *StreamHub) SetMaxClientOverflows(n int) error {
+	if n < 0 {
+		return fmt.Errorf("client overflow limit must not be negative, got %d", n)
 	}
+	h.maxOverflows = n
+	return nil
+}
 
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-r.Context().Done():
-			return
-		case <-ticker.C:
-			w.Write([]byte("event: metrics\n"))
-			w.Write([]byte("data: "))
-			promhttp.Handler().ServeHTTP(&sseWriter{w}, r)
-			w.Write([]byte("\n\n"))
-			flusher.Flush()
-		}
+// SetClientRate sets the default messages per second sent to each client
+// (0 = unlimited); clients connected afterwards use it unless they ask for
+// another rate
+func (h *StreamHub) SetClientRate(perSecond float64) error {
+	if perSecond < 0 {
+		return fmt.Errorf("client rate must not be negative, got %g", perSecond)
 	}
+	h.clientRate = perSecond
+	return nil
 }
 
-// sseWriter wraps http.ResponseWriter for SSE
-type sseWriter struct {
-	http.ResponseWriter
+// ClientBufferStats summarizes the memory held in client buffers
+type ClientBufferStats struct {
+	Clients         int
+	Compressed      int   // clients buffering compressed messages
+	BufferedBytes   int64 // across all clients
+	MaxClientBytes  int64
+	DroppedMessages int64 // dropped for a full client buffer
+	RateLimited     int64 // dropped by client rate limits
+	// MaxClientDropped is the most messages dropped for a connected
+	// client's full buffer, and Evicted the clients disconnected for
+	// overflowing it
+	MaxClientDropped int64
+	Evicted          int64
+	// FilterGroups is the number of distinct filters being tailed, and
+	// MaxGroupClients the clients sharing the most popular one
+	FilterGroups    int
+	MaxGroupClients int
 }
 
-func (w *sseWriter) Write(p []byte) (int, error) {
-	s := string(p)
-	s = s[:len(s)-1]
-	lines := []byte("")
-	for _, line := range splitLines(s) {
-		lines = append(lines, []byte("\ndata: "+line)...)
-	}
-	return w.ResponseWriter.Write(lines)
-}
+// GetClientBufferStats returns the bytes buffered per client, as an
+// estimate of the hub's memory per client
+func (h *StreamHub) GetClientBufferStats() ClientBufferStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-func splitLines(s string) []string {
-	var lines []string
-	start := 0
-	for i := 0; i < len(s); i++ {
-		if s[i] == '\n' {
-			lines = append(lines, s[start:i])
-			start = i + 1
-		}
+	stats := ClientBufferStats{
+		Clients:         len(h.clients),
+		DroppedMessages: atomic.LoadInt64(&h.clientDrops),
+		RateLimited:     atomic.LoadInt64(&h.rateDrops),
+		Evicted:         atomic.LoadInt64(&h.evictions),
+		FilterGroups:    len(h.groups),
 	}
-	if start < len(s) {
-		lines = append(lines, s[start:])
+	for _, group := range h.groups {
+		stats.MaxGroupClients = max(stats.MaxGroupClients, len(group.clients))
+	}
+	for client := range h.clients {
+		n := client.bufferedBytes()
+		stats.BufferedBytes += n
+		stats.MaxClientBytes = max(stats.MaxClientBytes, n)
+		dropped, _ := client.dropStats()
+		stats.MaxClientDropped = max(stats.MaxClientDropped, dropped)
+		if client.compress {
+			stats.Compressed++
+		}
 	}
-	return lines
+	return stats
 }
 
+// ResetDropCounter resets the dropped message counter
+func (h *StreamHub) ResetDropCounter() {
+	atomic.StoreInt64(&h.dropCount, 0)
+}
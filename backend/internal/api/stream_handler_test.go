@@ -0,0 +1,563 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/logpulse/backend/internal/models"
+)
+
+func TestBroadcast_DropPolicies(t *testing.T) {
+	entries := []*models.LogEntry{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+
+	newest := NewStreamHubWithBuffer(2, DropNewest)
+	for _, e := range entries {
+		newest.Broadcast(e)
+	}
+	if got := (<-newest.broadcast).ID; got != "1" {
+		t.Errorf("drop_newest: expected oldest entry 1 to be kept, got %s", got)
+	}
+
+	oldest := NewStreamHubWithBuffer(2, DropOldest)
+	for _, e := range entries {
+		oldest.Broadcast(e)
+	}
+	if got := (<-oldest.broadcast).ID; got != "2" {
+		t.Errorf("drop_oldest: expected entry 1 to be evicted, got %s", got)
+	}
+
+	for _, hub := range []*StreamHub{newest, oldest} {
+		if drops := hub.GetDroppedMessages(); drops != 1 {
+			t.Errorf("expected 1 drop, got %d", drops)
+		}
+		if _, capacity, highWater := hub.GetQueueStats(); capacity != 2 || highWater != 2 {
+			t.Errorf("expected capacity 2 and high-water 2, got %d and %d", capacity, highWater)
+		}
+	}
+}
+
+func TestStreamHub_CompressedClientBuffer(t *testing.T) {
+	hub := NewStreamHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(NewStreamHandler(hub).HandleStream))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?app=api&compress=true"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var welcome map[string]interface{}
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatalf("welcome: %v", err)
+	}
+	if welcome["compressed"] != true {
+		t.Errorf("expected the welcome to confirm compression, got %v", welcome)
+	}
+	if filter := welcome["filter"].(map[string]interface{}); len(filter) != 1 || filter["app"] != "api" {
+		t.Errorf("expected compress to stay out of the filter, got %v", filter)
+	}
+
+	for hub.GetClientBufferStats().Clients == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := hub.GetClientBufferStats(); stats.Compressed != 1 {
+		t.Errorf("expected 1 compressed client, got %+v", stats)
+	}
+
+	hub.Broadcast(&models.LogEntry{ID: "skip", Line: "other", Labels: map[string]string{"app": "web"}})
+	hub.Broadcast(&models.LogEntry{ID: "1", Line: strings.Repeat("hello ", 50), Labels: map[string]string{"app": "api"}})
+
+	var msg struct {
+		Type string `json:"type"`
+		Data struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		} `json:"data"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if msg.Type != "log" || msg.Data.ID != "1" || msg.Data.Message != strings.Repeat("hello ", 50) {
+		t.Errorf("expected the matching entry inflated intact, got %+v", msg)
+	}
+}
+
+func TestStreamClient_Buffer(t *testing.T) {
+	msg, _ := json.Marshal(map[string]string{"message": strings.Repeat("x", 1000)})
+
+	plain := newStreamClient(nil, StreamFilter{}, false, 2)
+	compressed := newStreamClient(nil, StreamFilter{}, true, 2)
+	var deflated []byte
+	for i := 0; i < 2; i++ {
+		if !plain.enqueue("log", msg, &deflated) || !compressed.enqueue("log", msg, &deflated) {
+			t.Fatal("expected room in the buffers")
+		}
+	}
+	if plain.enqueue("log", msg, &deflated) {
+		t.Error("expected a full buffer to refuse the message")
+	}
+	if plain.bufferedBytes() != int64(2*len(msg)) {
+		t.Errorf("expected %d plain bytes buffered, got %d", 2*len(msg), plain.bufferedBytes())
+	}
+	if n := compressed.bufferedBytes(); n == 0 || n >= int64(len(msg)) {
+		t.Errorf("expected compressed buffering to hold well under %d bytes, got %d", 2*len(msg), n)
+	}
+
+	out, _ := compressed.pop()
+	data, err := inflate(out.data)
+	if err != nil || string(data) != string(msg) {
+		t.Errorf("expected the message to inflate back, got %v", err)
+	}
+	if compressed.bufferedBytes() != int64(len(deflated)) {
+		t.Errorf("expected one message left buffered, got %d bytes", compressed.bufferedBytes())
+	}
+}
+
+func TestStreamClient_RateLimit(t *testing.T) {
+	client := newStreamClient(nil, StreamFilter{}, false, 10)
+	client.setRate(2)
+
+	admitted := 0
+	for i := 0; i < 5; i++ {
+		if client.allow() {
+			admitted++
+		}
+	}
+	if admitted != 2 {
+		t.Fatalf("expected a burst of 2 messages admitted, got %d", admitted)
+	}
+
+	// The next admitted message is preceded by the drop report
+	client.setRate(1000)
+	if !client.allow() {
+		t.Fatal("expected a message admitted after raising the rate")
+	}
+	out, ok := client.pop()
+	if !ok {
+		t.Fatal("expected a dropped frame to be queued")
+	}
+	var frame struct {
+		Type  string `json:"type"`
+		Count int    `json:"count"`
+	}
+	if err := json.Unmarshal(out.data, &frame); err != nil || frame.Type != "dropped" || frame.Count != 3 {
+		t.Errorf("expected a dropped frame counting 3, got %s", out.data)
+	}
+
+	client.setRate(0)
+	for i := 0; i < 100; i++ {
+		if !client.allow() {
+			t.Fatal("expected no limit at rate 0")
+		}
+	}
+}
+
+func TestStreamHub_FilterGroups(t *testing.T) {
+	hub := NewStreamHub()
+	prod := StreamFilter{Labels: map[string]string{"env": "prod"}}
+	fast := newStreamClient(wsSink{}, prod, false, 10)
+	slow := newStreamClient(wsSink{}, prod, false, 1)
+	dev := newStreamClient(wsSink{}, StreamFilter{Labels: map[string]string{"env": "dev", "app": "api"}}, false, 10)
+	hub.mu.Lock()
+	for _, c := range []*streamClient{fast, slow, dev} {
+		hub.clients[c] = struct{}{}
+		hub.joinGroup(c)
+	}
+	hub.mu.Unlock()
+
+	if stats := hub.GetClientBufferStats(); stats.FilterGroups != 2 || stats.MaxGroupClients != 2 {
+		t.Errorf("expected 2 groups of at most 2 clients, got %d and %d", stats.FilterGroups, stats.MaxGroupClients)
+	}
+
+	for i := 0; i < 3; i++ {
+		hub.processBroadcast(&models.LogEntry{ID: "x", Labels: map[string]string{"env": "prod", "app": "api"}})
+	}
+	// The slow client's full buffer costs only its own messages
+	if len(fast.queue) != 3 || len(slow.queue) != 1 || len(dev.queue) != 0 {
+		t.Errorf("expected 3, 1 and 0 queued, got %d, %d and %d", len(fast.queue), len(slow.queue), len(dev.queue))
+	}
+	if &fast.queue[0].data[0] != &slow.queue[0].data[0] {
+		t.Error("expected the group to share one serialized message")
+	}
+
+	// Filters with the same labels share a group
+	hub.setClientFilter(dev, StreamFilter{Labels: map[string]string{"env": "prod"}})
+	if stats := hub.GetClientBufferStats(); stats.FilterGroups != 1 || stats.MaxGroupClients != 3 {
+		t.Errorf("expected 1 group of 3 clients, got %d and %d", stats.FilterGroups, stats.MaxGroupClients)
+	}
+	hub.processBroadcast(&models.LogEntry{ID: "y", Labels: map[string]string{"env": "prod"}})
+	if len(dev.queue) != 1 {
+		t.Errorf("expected the refiltered client to receive the entry, got %d queued", len(dev.queue))
+	}
+}
+
+func TestStreamHandler_QueryFilter(t *testing.T) {
+	hub := NewStreamHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(NewStreamHandler(hub).HandleStream))
+	defer server.Close()
+	base := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?query="
+
+	// A query that does not parse is refused rather than tailing everything
+	conn, _, err := websocket.DefaultDialer.Dial(base+url.QueryEscape(`{app="api"} |~ "("`), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	var frame map[string]interface{}
+	if err := conn.ReadJSON(&frame); err != nil || frame["type"] != "error" {
+		t.Errorf("expected an error frame, got %v (%v)", frame, err)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial(base+url.QueryEscape(`{app=~"api|web"} |= "error"`), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&frame); err != nil || frame["type"] != "connected" {
+		t.Fatalf("expected the welcome, got %v (%v)", frame, err)
+	}
+	for hub.GetClientBufferStats().Clients == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var msg struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+		Query string `json:"query"`
+		Data  struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	read := func() {
+		t.Helper()
+		msg.Type, msg.Error, msg.Query, msg.Data.ID = "", "", "", ""
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+
+	hub.Broadcast(&models.LogEntry{ID: "db", Line: "error", Labels: map[string]string{"app": "db"}})
+	hub.Broadcast(&models.LogEntry{ID: "ok", Line: "done", Labels: map[string]string{"app": "api"}})
+	hub.Broadcast(&models.LogEntry{ID: "web", Line: "upstream error", Labels: map[string]string{"app": "web"}})
+	if read(); msg.Type != "log" || msg.Data.ID != "web" {
+		t.Errorf("expected only the matching entry, got %+v", msg)
+	}
+
+	// An invalid update is reported and keeps the current filter
+	conn.WriteJSON(map[string]interface{}{"type": "filter", "query": `count_over_time({app="api"}[5m])`})
+	if read(); msg.Type != "error" || msg.Error == "" {
+		t.Errorf("expected an error frame for an aggregation, got %+v", msg)
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "filter", "query": `{app="db"} != "debug"`})
+	if read(); msg.Type != "filter_updated" || msg.Query != `{app="db"} != "debug"` {
+		t.Errorf("expected the query update confirmed, got %+v", msg)
+	}
+	hub.Broadcast(&models.LogEntry{ID: "web2", Line: "error", Labels: map[string]string{"app": "web"}})
+	hub.Broadcast(&models.LogEntry{ID: "db2", Line: "slow query", Labels: map[string]string{"app": "db"}})
+	if read(); msg.Type != "log" || msg.Data.ID != "db2" {
+		t.Errorf("expected the entry matching the new query, got %+v", msg)
+	}
+}
+
+func TestStreamHandler_KeyScope(t *testing.T) {
+	hub := NewStreamHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	stream := NewStreamHandler(hub).HandleStream
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream(w, r.WithContext(withKeyScope(r.Context(), map[string]string{"team": "a"})))
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/stream", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		Type string `json:"type"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "connected" {
+		t.Fatalf("expected the welcome, got %+v (%v)", msg, err)
+	}
+	for hub.GetClientBufferStats().Clients == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	hub.Broadcast(&models.LogEntry{ID: "b1", Labels: map[string]string{"team": "b", "app": "api"}})
+	hub.Broadcast(&models.LogEntry{ID: "a1", Labels: map[string]string{"team": "a", "app": "api"}})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Data.ID != "a1" {
+		t.Errorf("expected only the key's team, got %+v (%v)", msg, err)
+	}
+
+	// A filter the client sends cannot widen the scope
+	conn.WriteJSON(map[string]interface{}{"type": "filter", "query": `{app="api"}`})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "filter_updated" {
+		t.Fatalf("expected the update confirmed, got %+v (%v)", msg, err)
+	}
+	hub.Broadcast(&models.LogEntry{ID: "b2", Labels: map[string]string{"team": "b", "app": "api"}})
+	hub.Broadcast(&models.LogEntry{ID: "a2", Labels: map[string]string{"team": "a", "app": "api"}})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Data.ID != "a2" {
+		t.Errorf("expected only the key's team after refiltering, got %+v (%v)", msg, err)
+	}
+}
+
+func TestStreamHandler_SSE(t *testing.T) {
+	hub := NewStreamHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	handler := NewStreamHandler(hub)
+	handler.heartbeat = 20 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleSSE))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream/sse?query=" + url.QueryEscape(`{app="api"} |~ "("`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid query refused with 400, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/stream/sse?app=api&query=" + url.QueryEscape(`{app="api"} |= "error"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+
+	// next returns the next event's name and data, skipping heartbeats
+	events := bufio.NewReader(resp.Body)
+	heartbeats := 0
+	next := func() (string, map[string]interface{}) {
+		t.Helper()
+		var event string
+		var frame map[string]interface{}
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			switch {
+			case line == ": heartbeat\n":
+				heartbeats++
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &frame); err != nil {
+					t.Fatalf("data: %v", err)
+				}
+			case line == "\n" && event != "":
+				return event, frame
+			}
+		}
+	}
+
+	if event, frame := next(); event != "connected" || frame["query"] != `{app="api"} |= "error"` {
+		t.Fatalf("expected the connected event first, got %s %v", event, frame)
+	}
+	for hub.GetClientCount() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	hub.Broadcast(&models.LogEntry{ID: "1", Line: "error: web", Labels: map[string]string{"app": "web"}})
+	hub.Broadcast(&models.LogEntry{ID: "2", Line: "all good", Labels: map[string]string{"app": "api"}})
+	hub.Broadcast(&models.LogEntry{ID: "3", Line: "error: api", Labels: map[string]string{"app": "api"}})
+	hub.Broadcast(&models.LogEntry{ID: "4", Line: "another error", Labels: map[string]string{"app": "api"}})
+	for _, id := range []string{"3", "4"} {
+		event, frame := next()
+		data, _ := frame["data"].(map[string]interface{})
+		if event != "log" || frame["type"] != "log" || data["id"] != id {
+			t.Errorf("expected log event %s, got %s %v", id, event, frame)
+		}
+	}
+
+	// Heartbeats keep an idle stream open
+	for heartbeats == 0 {
+		if line, err := events.ReadString('\n'); err != nil {
+			t.Fatalf("read: %v", err)
+		} else if line == ": heartbeat\n" {
+			heartbeats++
+		}
+	}
+
+	resp.Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.GetClientCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client unregistered after disconnecting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fakeSink records the frames written to it; a stalled one blocks every
+// write until closed
+type fakeSink struct {
+	stalled bool
+
+	mu     sync.Mutex
+	frames []string
+	reason string
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeSink(stalled bool) *fakeSink {
+	return &fakeSink{stalled: stalled, closed: make(chan struct{})}
+}
+
+func (s *fakeSink) writeFrame(event string, data []byte) error {
+	if s.stalled {
+		<-s.closed
+		return errStreamClosed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = append(s.frames, string(data))
+	return nil
+}
+
+func (s *fakeSink) close(reason string) {
+	s.mu.Lock()
+	if reason != "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+	s.once.Do(func() { close(s.closed) })
+}
+
+func (s *fakeSink) received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.frames)
+}
+
+func TestStreamHub_StalledClient(t *testing.T) {
+	hub := NewStreamHub()
+	hub.SetClientBufferSize(4)
+	if err := hub.SetMaxClientOverflows(10); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	stalled := newFakeSink(true)
+	stalledClient := newStreamClient(stalled, StreamFilter{}, false, hub.clientBufferSize)
+	hub.register <- stalledClient
+	var fast []*fakeSink
+	for i := 0; i < 3; i++ {
+		sink := newFakeSink(false)
+		fast = append(fast, sink)
+		hub.register <- newStreamClient(sink, StreamFilter{}, false, hub.clientBufferSize)
+	}
+	for hub.GetClientCount() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Each message reaches every fast client before the next is sent, while
+	// the stalled client never completes a write
+	const messages = 50
+	for i := 0; i < messages; i++ {
+		hub.Broadcast(&models.LogEntry{ID: strconv.Itoa(i), Labels: map[string]string{"app": "api"}})
+		deadline := time.Now().Add(2 * time.Second)
+		for _, sink := range fast {
+			for sink.received() < i+1 {
+				if time.Now().After(deadline) {
+					t.Fatalf("message %d: fast client held up, %d received", i, sink.received())
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}
+	for _, sink := range fast {
+		if sink.received() != messages {
+			t.Errorf("expected every message delivered to a fast client, got %d", sink.received())
+		}
+	}
+
+	// The stalled client buffered 4 and lost the rest until 10 overflows
+	// disconnected it
+	select {
+	case <-stalled.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the stalled client disconnected")
+	}
+	stalled.mu.Lock()
+	reason := stalled.reason
+	stalled.mu.Unlock()
+	if reason == "" {
+		t.Error("expected a reason given to the stalled client")
+	}
+	if dropped, _ := stalledClient.dropStats(); dropped != 10 {
+		t.Errorf("expected 10 messages dropped for the stalled client, got %d", dropped)
+	}
+	stats := hub.GetClientBufferStats()
+	if stats.Clients != 3 || stats.Evicted != 1 || stats.MaxClientDropped != 0 {
+		t.Errorf("expected the 3 fast clients left with no drops and 1 eviction, got %+v", stats)
+	}
+}
+
+func TestWSSink_CloseReason(t *testing.T) {
+	closed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		wsSink{conn: conn}.close("client too slow")
+		close(closed)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "client too slow" {
+		t.Errorf("expected a close frame with the reason, got %v", err)
+	}
+	<-closed
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// sseSink writes frames as Server-Sent Events, each named by its frame type
+// with the JSON frame as data. The hub's writer goroutine and the handler's
+// heartbeat share the response, so writes are serialized, and none happen
+// once the handler has shut the sink down and returned.
+type sseSink struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	mu     sync.Mutex
+	closed atomic.Bool
+}
+
+func (s *sseSink) writeFrame(event string, data []byte) error {
+	return s.write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)))
+}
+
+// heartbeat writes a comment line, which EventSource ignores, so proxies
+// do not time out an idle stream
+func (s *sseSink) heartbeat() error {
+	return s.write([]byte(": heartbeat\n\n"))
+}
+
+func (s *sseSink) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return errStreamClosed
+	}
+	// Writers that cannot set deadlines rely on the server's
+	s.rc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// close stops further writes; the handler, seeing the client closed, ends
+// the response. A reason is sent as an error event first.
+func (s *sseSink) close(reason string) {
+	if reason != "" {
+		s.writeFrame("error", streamErrorFrame(errors.New(reason)))
+	}
+	s.closed.Store(true)
+}
+
+// shutdown stops further writes once any write in progress has finished,
+// so the handler can return
+func (s *sseSink) shutdown() {
+	s.mu.Lock()
+	s.closed.Store(true)
+	s.mu.Unlock()
+}
+
+// HandleSSE handles GET /stream/sse, live tail over Server-Sent Events for
+// clients whose proxies break WebSocket upgrades. It takes the same query
+// parameters as /stream and sends the same frames, as "connected", "log"
+// and "dropped" events. The filter is fixed for the connection; an invalid
+// one is refused with 400.
+func (h *StreamHandler) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	opts, err := h.parseStreamOptions(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(streamErrorFrame(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keep nginx and similar proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sink := &sseSink{w: w, rc: rc}
+	defer sink.shutdown()
+	if err := sink.writeFrame("connected", opts.welcomeFrame()); err != nil {
+		return
+	}
+
+	client := newStreamClient(sink, opts.filter, opts.compress, h.hub.clientBufferSize)
+	client.setRate(opts.rate)
+	h.hub.register <- client
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			h.hub.unregister <- client
+			return
+		case <-client.done:
+			// A write failed, the client was too slow or the hub shut down
+			return
+		case <-ticker.C:
+			// Report rate-limited drops even when no message follows them
+			client.reportDropped()
+			if err := sink.heartbeat(); err != nil {
+				h.hub.unregister <- client
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/config"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestTenantMiddleware(t *testing.T) {
+	cfg := config.TenancyConfig{Enabled: true, Header: "X-Scope-OrgID", Label: "tenant"}
+
+	var scope map[string]string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope = keyScope(r)
+	})
+	serve := func(cfg config.TenancyConfig, path, tenant string, keyScope map[string]string) int {
+		scope = nil
+		req := httptest.NewRequest("GET", path, nil)
+		if tenant != "" {
+			req.Header.Set("X-Scope-OrgID", tenant)
+		}
+		req = req.WithContext(withKeyScope(req.Context(), keyScope))
+		rec := httptest.NewRecorder()
+		tenantMiddleware(cfg, []string{"/health"})(inner).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(cfg, "/query", "acme", nil); code != http.StatusOK || scope["tenant"] != "acme" {
+		t.Errorf("header: expected 200 with tenant=acme, got %d %v", code, scope)
+	}
+	if code := serve(cfg, "/query", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("no header: expected 401, got %d", code)
+	}
+	if code := serve(cfg, "/health", "", nil); code != http.StatusOK || scope != nil {
+		t.Errorf("exempt path: expected 200 without scope, got %d %v", code, scope)
+	}
+	if code := serve(cfg, "/admin/tenants", "", nil); code != http.StatusOK || scope != nil {
+		t.Errorf("admin path: expected 200 without scope, got %d %v", code, scope)
+	}
+
+	withDefault := cfg
+	withDefault.DefaultTenant = "legacy"
+	if code := serve(withDefault, "/ingest", "", nil); code != http.StatusOK || scope["tenant"] != "legacy" {
+		t.Errorf("default: expected 200 with tenant=legacy, got %d %v", code, scope)
+	}
+
+	// The tenant adds to a key's scope but cannot escape it
+	keyed := map[string]string{"team": "payments", "tenant": "acme"}
+	if code := serve(cfg, "/query", "acme", keyed); code != http.StatusOK || scope["team"] != "payments" {
+		t.Errorf("key scope: expected 200 keeping team, got %d %v", code, scope)
+	}
+	if code := serve(cfg, "/query", "other", keyed); code != http.StatusForbidden {
+		t.Errorf("key scope: expected 403 for another tenant, got %d", code)
+	}
+}
+
+func TestTenantHandler_List(t *testing.T) {
+	dir := t.TempDir()
+	writer := storage.NewWriter(dir, 1024*1024)
+	idx := index.NewIndex()
+	add := func(labels map[string]string, lines int) {
+		entries := make([]models.LogEntry, lines)
+		for i := range entries {
+			entries[i] = models.LogEntry{Timestamp: time.Now(), Line: "line", Labels: labels}
+		}
+		id, start, end, err := writer.WriteChunk(labels, entries)
+		if err != nil {
+			t.Fatalf("write chunk: %v", err)
+		}
+		idx.AddChunk(id, labels, start, end, lines)
+	}
+	add(map[string]string{"tenant": "acme", "app": "api"}, 2)
+	add(map[string]string{"tenant": "acme", "app": "api"}, 1)
+	add(map[string]string{"tenant": "acme", "app": "web"}, 1)
+	add(map[string]string{"tenant": "beta", "app": "api"}, 4)
+	add(map[string]string{"app": "old"}, 1)
+
+	rec := httptest.NewRecorder()
+	NewTenantHandler(idx, storage.NewReader(dir), "tenant").List(rec, httptest.NewRequest("GET", "/admin/tenants", nil))
+
+	var resp struct {
+		Tenants    []TenantStats `json:"tenants"`
+		Untenanted *TenantStats  `json:"untenanted"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(resp.Tenants) != 2 || resp.Tenants[0].Tenant != "acme" || resp.Tenants[1].Tenant != "beta" {
+		t.Fatalf("unexpected tenants %+v", resp.Tenants)
+	}
+	acme := resp.Tenants[0]
+	if acme.Streams != 2 || acme.Chunks != 3 || acme.Entries != 4 || acme.Bytes == 0 {
+		t.Errorf("unexpected acme stats %+v", acme)
+	}
+	if resp.Untenanted == nil || resp.Untenanted.Streams != 1 || resp.Untenanted.Chunks != 1 {
+		t.Errorf("unexpected untenanted stats %+v", resp.Untenanted)
+	}
+
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".log" {
+			total += info.Size()
+		}
+		return nil
+	})
+	var listed int64
+	for _, s := range resp.Tenants {
+		listed += s.Bytes
+	}
+	if listed+resp.Untenanted.Bytes != total {
+		t.Errorf("expected %d bytes in total, listed %d", total, listed+resp.Untenanted.Bytes)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/config"
+)
+
+// routeTimeoutMiddleware replaces the server-wide read/write deadlines for
+// requests matching a configured path prefix. The connection deadlines are
+// moved so long exports and streams are not cut off, and the request
+// context carries the same deadline so handlers stop work in time. A zero
+// timeout clears both.
+func routeTimeoutMiddleware(routes []config.RouteTimeout) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(routes) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rt, ok := matchRouteTimeout(routes, r.URL.Path)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var deadline time.Time
+			if rt.Timeout > 0 {
+				deadline = time.Now().Add(rt.Timeout)
+				ctx, cancel := context.WithDeadline(r.Context(), deadline)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+
+			// Writers that cannot change deadlines keep the server defaults
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func matchRouteTimeout(routes []config.RouteTimeout, path string) (config.RouteTimeout, bool) {
+	for _, rt := range routes {
+		if strings.HasPrefix(path, rt.Path) {
+			return rt, true
+		}
+	}
+	return config.RouteTimeout{}, false
+}
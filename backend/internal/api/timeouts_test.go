@@ -0,0 +1,61 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/config"
+)
+
+func TestRouteTimeoutMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(routeTimeoutMiddleware([]config.RouteTimeout{
+		{Path: "/slow", Timeout: 0},
+		{Path: "/tight", Timeout: 50 * time.Millisecond},
+	}))
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	}
+	router.HandleFunc("/slow", slow)
+	router.HandleFunc("/default", slow)
+	cancelled := make(chan bool, 1)
+	router.HandleFunc("/tight", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+	})
+
+	srv := httptest.NewUnstartedServer(router)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if body, err := get("/slow"); err != nil || body != "done" {
+		t.Errorf("expected /slow to outlive the write timeout, got %q (%v)", body, err)
+	}
+	if body, err := get("/default"); err == nil && body == "done" {
+		t.Error("expected /default to be cut off by the server write timeout")
+	}
+	get("/tight")
+	if !<-cancelled {
+		t.Error("expected /tight to see its context deadline")
+	}
+}
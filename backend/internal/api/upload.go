@@ -0,0 +1,309 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/models"
+)
+
+// UploadOffsetHeader carries the byte offset of an upload chunk in requests
+// and the bytes received so far in responses
+const UploadOffsetHeader = "Upload-Offset"
+
+const (
+	// maxUploadChunkBytes bounds the body of a single upload chunk
+	maxUploadChunkBytes = 16 * 1024 * 1024
+	// uploadSessionTTL is how long an idle upload session is kept for the
+	// client to resume
+	uploadSessionTTL = time.Hour
+)
+
+// uploadLine is one NDJSON line of an upload; labels are merged over the
+// session's labels
+type uploadLine struct {
+	Ts     string            `json:"ts"`
+	Line   string            `json:"line"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// uploadSession tracks the bytes of an upload received and ingested so far.
+// A line split across chunks is held in pending until its newline arrives.
+type uploadSession struct {
+	mu sync.Mutex
+
+	ID       string            `json:"id"`
+	Labels   map[string]string `json:"labels"`
+	Offset   int64             `json:"offset"`
+	Lines    int64             `json:"lines"`
+	Accepted int64             `json:"accepted"`
+	Created  time.Time         `json:"created"`
+	Updated  time.Time         `json:"updated"`
+	Final    bool              `json:"finalized"`
+
+	scope   map[string]string
+	pending []byte
+}
+
+// UploadHandler implements resumable NDJSON uploads for bulk backfills. A
+// client creates a session, sends the file in ordered chunks tagged with
+// their byte offset and finalizes it. Every complete line is ingested as its
+// chunk arrives, so after a failure the client asks for the offset and
+// resumes from there; chunks re-sent below the offset are not ingested
+// twice. Sessions live in memory and expire after an hour idle.
+type UploadHandler struct {
+	ingest *IngestHandler
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// NewUploadHandler creates an upload handler that ingests through h, so
+// injected labels and key scopes apply as on /ingest
+func NewUploadHandler(h *IngestHandler) *UploadHandler {
+	return &UploadHandler{ingest: h, sessions: make(map[string]*uploadSession)}
+}
+
+type createUploadRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// Create handles POST /ingest/uploads with the labels shared by every line
+func (h *UploadHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req createUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	session := &uploadSession{
+		ID:      hex.EncodeToString(buf),
+		Labels:  req.Labels,
+		Created: now,
+		Updated: now,
+		scope:   keyScope(r),
+	}
+
+	h.mu.Lock()
+	h.expire(now)
+	h.sessions[session.ID] = session
+	h.mu.Unlock()
+
+	w.Header().Set("Location", "/ingest/uploads/"+session.ID)
+	writeUploadStatus(w, http.StatusCreated, session)
+}
+
+// Status handles GET /ingest/uploads/{id}, reporting the offset to resume at
+func (h *UploadHandler) Status(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	writeUploadStatus(w, http.StatusOK, session)
+}
+
+// Append handles PUT /ingest/uploads/{id}. The Upload-Offset header must not
+// be past the bytes received; bytes before it are skipped as re-sent. A
+// chunk is ingested whole or, when a line is invalid, not at all.
+func (h *UploadHandler) Append(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid "+UploadOffsetHeader+" header", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadChunkBytes))
+	if err != nil {
+		http.Error(w, "Failed to read chunk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.Final {
+		http.Error(w, "upload already finalized", http.StatusConflict)
+		return
+	}
+	if offset > session.Offset {
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+		http.Error(w, fmt.Sprintf("offset %d is past the %d bytes received", offset, session.Offset), http.StatusConflict)
+		return
+	}
+	// Skip the part of the chunk that was already received
+	if skip := session.Offset - offset; skip > 0 {
+		if skip >= int64(len(body)) {
+			writeUploadStatus(w, http.StatusOK, session)
+			return
+		}
+		body = body[skip:]
+	}
+
+	data := append(session.pending[:len(session.pending):len(session.pending)], body...)
+	cut := bytes.LastIndexByte(data, '\n') + 1
+	if len(data)-cut > maxUploadChunkBytes {
+		http.Error(w, "line exceeds the maximum chunk size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if status, err := h.ingestLines(r, session, data[:cut]); err != nil {
+		if status == http.StatusServiceUnavailable {
+			setRetryAfter(w, h.ingest.ingestor)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	session.pending = append([]byte(nil), data[cut:]...)
+	session.Offset += int64(len(body))
+	session.Updated = time.Now().UTC()
+
+	writeUploadStatus(w, http.StatusOK, session)
+}
+
+// Finalize handles POST /ingest/uploads/{id}/finalize: it ingests a last
+// line without a trailing newline and closes the session
+func (h *UploadHandler) Finalize(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !session.Final {
+		if status, err := h.ingestLines(r, session, session.pending); err != nil {
+			if status == http.StatusServiceUnavailable {
+				setRetryAfter(w, h.ingest.ingestor)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		session.pending = nil
+		session.Final = true
+		session.Updated = time.Now().UTC()
+		log.Printf("[Upload] Session %s finalized: %d bytes, %d lines, %d entries accepted",
+			session.ID, session.Offset, session.Lines, session.Accepted)
+	}
+
+	// Finalized sessions are kept until they expire so a client that lost
+	// the response can retry
+	writeUploadStatus(w, http.StatusOK, session)
+}
+
+// ingestLines parses complete NDJSON lines and ingests them as one request,
+// grouping consecutive lines with the same labels into a stream
+func (h *UploadHandler) ingestLines(r *http.Request, session *uploadSession, data []byte) (int, error) {
+	if !reflect.DeepEqual(keyScope(r), session.scope) {
+		return http.StatusForbidden, fmt.Errorf("Forbidden: upload belongs to another API key scope")
+	}
+
+	var req models.IngestRequest
+	lineNo := session.Lines
+	for len(data) > 0 {
+		var raw []byte
+		raw, data, _ = bytes.Cut(data, []byte("\n"))
+		lineNo++
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+
+		var line uploadLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("line %d: invalid JSON: %v", lineNo, err)
+		}
+		labels := session.Labels
+		if len(line.Labels) > 0 {
+			labels = make(map[string]string, len(session.Labels)+len(line.Labels))
+			for k, v := range session.Labels {
+				labels[k] = v
+			}
+			for k, v := range line.Labels {
+				labels[k] = v
+			}
+		}
+
+		entry := models.Entry{Ts: line.Ts, Line: line.Line}
+		if n := len(req.Streams); n > 0 && reflect.DeepEqual(req.Streams[n-1].Labels, labels) {
+			req.Streams[n-1].Entries = append(req.Streams[n-1].Entries, entry)
+			continue
+		}
+		req.Streams = append(req.Streams, models.Stream{Labels: labels, Entries: []models.Entry{entry}})
+	}
+
+	if len(req.Streams) > 0 {
+		h.ingest.injectLabels(&req, nil)
+		if err := applyKeyScope(&req, session.scope); err != nil {
+			ingest.RecordRejectedRequest(ingest.RejectKeyScope, &req)
+			return http.StatusForbidden, fmt.Errorf("Forbidden: %v", err)
+		}
+		if err := ingest.ValidateIngestRequest(&req); err != nil {
+			ingest.RecordRejectedRequest(ingest.RejectInvalidRequest, &req)
+			return http.StatusBadRequest, fmt.Errorf("Validation error: %v", err)
+		}
+		accepted, err := h.ingest.ingestor.Ingest(&req)
+		if errors.Is(err, ingest.ErrBackpressure) {
+			return http.StatusServiceUnavailable, err
+		}
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("Ingestion error: %v", err)
+		}
+		session.Accepted += int64(accepted)
+	}
+	session.Lines = lineNo
+	return 0, nil
+}
+
+// session looks up the session named in the path, writing a 404 if missing
+func (h *UploadHandler) session(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	h.mu.Lock()
+	h.expire(time.Now().UTC())
+	session, ok := h.sessions[mux.Vars(r)["id"]]
+	h.mu.Unlock()
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+	}
+	return session, ok
+}
+
+// expire drops sessions idle for longer than uploadSessionTTL; h.mu is held
+func (h *UploadHandler) expire(now time.Time) {
+	for id, s := range h.sessions {
+		s.mu.Lock()
+		idle := now.Sub(s.Updated)
+		s.mu.Unlock()
+		if idle > uploadSessionTTL {
+			delete(h.sessions, id)
+		}
+	}
+}
+
+func writeUploadStatus(w http.ResponseWriter, status int, session *uploadSession) {
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(session)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/ingest"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestUploadHandler_Resume(t *testing.T) {
+	ing := ingest.NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	h := NewUploadHandler(NewIngestHandler(ing, nil))
+	router := mux.NewRouter()
+	router.HandleFunc("/ingest/uploads", h.Create).Methods("POST")
+	router.HandleFunc("/ingest/uploads/{id}", h.Append).Methods("PUT")
+	router.HandleFunc("/ingest/uploads/{id}", h.Status).Methods("GET")
+	router.HandleFunc("/ingest/uploads/{id}/finalize", h.Finalize).Methods("POST")
+
+	var session struct {
+		ID       string `json:"id"`
+		Offset   int64  `json:"offset"`
+		Lines    int64  `json:"lines"`
+		Accepted int64  `json:"accepted"`
+	}
+	do := func(method, path string, offset int64, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if offset >= 0 {
+			req.Header.Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code < 300 {
+			json.NewDecoder(rec.Body).Decode(&session)
+		}
+		return rec.Code
+	}
+
+	if code := do("POST", "/ingest/uploads", -1, `{"labels": {"app": "backfill"}}`); code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", code)
+	}
+	path := "/ingest/uploads/" + session.ID
+
+	file := `{"ts": "2024-01-01T00:00:00Z", "line": "one"}
+{"ts": "2024-01-01T00:00:01Z", "line": "two", "labels": {"host": "h1"}}
+{"ts": "2024-01-01T00:00:02Z", "line": "three"}`
+	first := file[:60]
+
+	// The first chunk ends mid-line; only the complete line is ingested
+	if code := do("PUT", path, 0, first); code != http.StatusOK || session.Offset != 60 || session.Accepted != 1 {
+		t.Fatalf("first chunk: got %d %+v", code, session)
+	}
+	// A gap is refused, a re-sent chunk is not ingested twice
+	if code := do("PUT", path, 100, file[60:]); code != http.StatusConflict {
+		t.Errorf("gap: expected 409, got %d", code)
+	}
+	if code := do("PUT", path, 0, first); code != http.StatusOK || session.Accepted != 1 {
+		t.Errorf("re-sent chunk: got %d %+v", code, session)
+	}
+	// An overlapping chunk only contributes its new bytes
+	if code := do("PUT", path, 50, file[50:]); code != http.StatusOK || session.Offset != int64(len(file)) || session.Accepted != 2 {
+		t.Fatalf("overlapping chunk: got %d %+v", code, session)
+	}
+	if code := do("GET", path, -1, ""); code != http.StatusOK || session.Offset != int64(len(file)) {
+		t.Errorf("status: got %d %+v", code, session)
+	}
+
+	if code := do("POST", path+"/finalize", -1, ""); code != http.StatusOK || session.Lines != 3 || session.Accepted != 3 {
+		t.Fatalf("finalize: got %d %+v", code, session)
+	}
+	if code := do("PUT", path, session.Offset, "{}\n"); code != http.StatusConflict {
+		t.Errorf("after finalize: expected 409, got %d", code)
+	}
+}
+
+func TestUploadHandler_InvalidChunk(t *testing.T) {
+	ing := ingest.NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	h := NewUploadHandler(NewIngestHandler(ing, nil))
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, httptest.NewRequest("POST", "/ingest/uploads", strings.NewReader(`{"labels": {"app": "backfill"}}`)))
+	var session uploadSession
+	json.NewDecoder(rec.Body).Decode(&session)
+
+	req := httptest.NewRequest("PUT", "/ingest/uploads/"+session.ID, strings.NewReader("{\"line\": \"ok\"}\nnot json\n"))
+	req.Header.Set(UploadOffsetHeader, "0")
+	req = mux.SetURLVars(req, map[string]string{"id": session.ID})
+	rec = httptest.NewRecorder()
+	h.Append(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	// Nothing from the rejected chunk is kept, so it can be fixed and re-sent
+	if s := h.sessions[session.ID]; s.Offset != 0 || s.Accepted != 0 {
+		t.Errorf("expected the chunk to be discarded, got %+v", s)
+	}
+	if lines, _, _ := ing.GetMetrics(); lines != 0 {
+		t.Errorf("expected no lines ingested, got %d", lines)
+	}
+}
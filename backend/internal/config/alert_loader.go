@@ -1,24 +1,81 @@
 package config
 
 import (
-	"os"
 	"gopkg.in/yaml.v3"
+	"os"
 )
 
 type AlertRule struct {
-	Name      string            `yaml:"name" json:"name"`
-	Expr      string            `yaml:"expr" json:"expr"`
-	Threshold float64           `yaml:"threshold" json:"threshold"`
-	Window    string            `yaml:"window" json:"window"`
-	Channels  []string          `yaml:"channels" json:"channels"`
-	Labels    map[string]string `yaml:"labels" json:"labels"`
+	Name           string            `yaml:"name" json:"name"`
+	Expr           string            `yaml:"expr" json:"expr"`
+	Threshold      float64           `yaml:"threshold" json:"threshold"`
+	Condition      string            `yaml:"condition,omitempty" json:"condition,omitempty"`
+	Duration       string            `yaml:"duration,omitempty" json:"duration,omitempty"`
+	Severity       string            `yaml:"severity,omitempty" json:"severity,omitempty"`
+	Enabled        *bool             `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Window         string            `yaml:"window,omitempty" json:"window"`
+	RepeatInterval string            `yaml:"repeat_interval,omitempty" json:"repeat_interval,omitempty"`
+	Channels       []string          `yaml:"channels,omitempty" json:"channels"`
+	Labels         map[string]string `yaml:"labels,omitempty" json:"labels"`
+	Annotations    map[string]string `yaml:"annotations,omitempty" json:"annotations,omitempty"`
 }
 
 type AlertSettings struct {
-	Alerts []AlertRule `yaml:"alerts" json:"alerts"`
+	// RepeatInterval is the default minimum time between notifications for
+	// a rule that keeps firing; rules may override it
+	RepeatInterval string      `yaml:"repeat_interval,omitempty" json:"repeat_interval,omitempty"`
+	Alerts         []AlertRule `yaml:"alerts" json:"alerts"`
+	// Notifiers are alert destinations instantiated by type; rules refer to
+	// them by name in their channels
+	Notifiers []NotifierConfig `yaml:"notifiers,omitempty" json:"notifiers,omitempty"`
+	// QuietHours mutes notifications on a recurring schedule
+	QuietHours *QuietHoursConfig `yaml:"quiet_hours,omitempty" json:"quiet_hours,omitempty"`
+}
+
+// QuietHoursConfig is a recurring mute schedule. Rules whose severity is
+// listed in Severities (every rule when empty) are muted during the windows,
+// except severities listed in Exempt.
+type QuietHoursConfig struct {
+	Timezone   string              `yaml:"timezone" json:"timezone"`
+	Severities []string            `yaml:"severities,omitempty" json:"severities,omitempty"`
+	Exempt     []string            `yaml:"exempt_severities,omitempty" json:"exempt_severities,omitempty"`
+	Windows    []QuietWindowConfig `yaml:"windows" json:"windows"`
+}
+
+// QuietWindowConfig is a day/time range; End before Start runs overnight
+type QuietWindowConfig struct {
+	Days  []string `yaml:"days,omitempty" json:"days,omitempty"`
+	Start string   `yaml:"start,omitempty" json:"start,omitempty"`
+	End   string   `yaml:"end,omitempty" json:"end,omitempty"`
+}
+
+// NotifierConfig selects a registered notifier type (webhook, slack or
+// pagerduty), e.g.
+//
+//	notifiers:
+//	  - name: slack
+//	    type: slack
+//	    settings:
+//	      webhook_url: https://hooks.slack.com/services/...
+//	  - name: oncall
+//	    type: pagerduty
+//	    settings:
+//	      routing_key: <integration key>
+type NotifierConfig struct {
+	Name     string                 `yaml:"name" json:"name"`
+	Type     string                 `yaml:"type" json:"type"`
+	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings,omitempty"`
 }
 
 func LoadAlerts(path string) ([]AlertRule, error) {
+	as, err := LoadAlertSettings(path)
+	if err != nil {
+		return nil, err
+	}
+	return as.Alerts, nil
+}
+
+func LoadAlertSettings(path string) (*AlertSettings, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -27,5 +84,5 @@ func LoadAlerts(path string) ([]AlertRule, error) {
 	if err := yaml.Unmarshal(data, &as); err != nil {
 		return nil, err
 	}
-	return as.Alerts, nil
+	return &as, nil
 }
@@ -1,33 +1,154 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// labelNameRE matches the label names ingest accepts
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,127}$`)
+
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Storage  StorageConfig  `yaml:"storage"`
-	Ingest   IngestConfig   `yaml:"ingest"`
-	Auth     AuthConfig     `yaml:"auth"`
-	Shutdown ShutdownConfig `yaml:"shutdown"`
+	// Mode is read-write (the default) or read-only. A read-only node serves
+	// queries against storage written by another node: it runs no ingestor,
+	// stream hub, retention or index snapshots, refuses writes with 405 and
+	// rereads chunk metadata every index.refresh_interval.
+	Mode      string          `yaml:"mode"`
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Ingest    IngestConfig    `yaml:"ingest"`
+	Index     IndexConfig     `yaml:"index"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Tenancy   TenancyConfig   `yaml:"tenancy"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	CORS      CORSConfig      `yaml:"cors"`
+	OTLP      OTLPConfig      `yaml:"otlp"`
+	Streaming StreamingConfig `yaml:"streaming"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Alerting  AlertingConfig  `yaml:"alerting"`
+	Query     QueryConfig     `yaml:"query"`
+	Health    HealthConfig    `yaml:"health"`
+	Shutdown  ShutdownConfig  `yaml:"shutdown"`
+	Logging   LoggingConfig   `yaml:"logging"`
+}
+
+// Server modes
+const (
+	ModeReadWrite = "read-write"
+	ModeReadOnly  = "read-only"
+)
+
+// ReadOnly reports whether the node is a read-only replica
+func (c *Config) ReadOnly() bool {
+	return c.Mode == ModeReadOnly
 }
 
 type ServerConfig struct {
-	Port         string `yaml:"port"`
-	ReadTimeout  string `yaml:"read_timeout"`
-	WriteTimeout string `yaml:"write_timeout"`
-	IdleTimeout  string `yaml:"idle_timeout"`
+	Port         string        `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// RouteTimeouts override the read/write timeouts for requests whose path
+	// starts with Path; the first matching entry wins
+	RouteTimeouts []RouteTimeout `yaml:"route_timeouts"`
+}
+
+// RouteTimeout sets the request deadline for a path prefix. A zero Timeout
+// lifts the deadline entirely, e.g. for long-lived streams.
+type RouteTimeout struct {
+	Path    string        `yaml:"path"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// defaultRouteTimeouts keep streaming endpoints open past the global write
+// timeout when route_timeouts is not configured
+func defaultRouteTimeouts() []RouteTimeout {
+	return []RouteTimeout{
+		{Path: "/stream", Timeout: 0},
+		{Path: "/metrics/stream", Timeout: 0},
+	}
 }
 
 type StorageConfig struct {
+	// Backend is where chunks are kept: local (files under Path) or s3
+	Backend            string `yaml:"backend"`
 	Path               string `yaml:"path"`
 	ChunkSizeBytes     int    `yaml:"chunk_size_bytes"`
 	RetentionDays      int    `yaml:"retention_days"`
 	CompressionEnabled bool   `yaml:"compression_enabled"`
+	Encoding           string `yaml:"encoding"` // json (default) or msgpack
+	// ChunkSizeOverrides set chunk_size_bytes per stream selector; the
+	// first matching entry wins
+	ChunkSizeOverrides []ChunkSizeOverride `yaml:"chunk_size_overrides"`
+	// RetentionExclude lists stream selectors whose chunks retention never
+	// deletes, e.g. `{job="audit"}`
+	RetentionExclude []string `yaml:"retention_exclude"`
+	// MaxStorageBytes caps the disk space chunks take (0 = unlimited); past
+	// it the oldest chunks are deleted, whatever their age, until usage is
+	// LowWaterPercent of the cap
+	MaxStorageBytes int64 `yaml:"max_storage_bytes"`
+	LowWaterPercent int   `yaml:"low_water_percent"`
+	// Compaction bounds the resources chunk compaction may take from
+	// ingestion and queries
+	Compaction CompactionConfig `yaml:"compaction"`
+	// S3 locates the bucket of the s3 backend
+	S3 S3Config `yaml:"s3"`
+}
+
+// Storage backends
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+// S3Config locates an S3-compatible bucket for chunks
+type S3Config struct {
+	// Endpoint is the server URL of MinIO or another S3-compatible store
+	// (empty = AWS S3 in Region)
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Prefix is prepended to every object key, e.g. "logpulse/"
+	Prefix string `yaml:"prefix"`
+	// Credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key"`
+	Timeout         time.Duration `yaml:"timeout"`
+}
+
+// CompactionConfig limits the chunk compaction job
+type CompactionConfig struct {
+	// Interval is the time between passes merging each stream's runs of
+	// small chunks into chunks under chunk_size_bytes (0 = no compaction)
+	Interval time.Duration `yaml:"interval"`
+	// Workers is the number of streams compacted concurrently
+	Workers int `yaml:"workers"`
+	// MaxMergeBytes caps the chunk bytes held in memory by one merge;
+	// larger runs of small chunks are merged in several passes
+	MaxMergeBytes int64 `yaml:"max_merge_bytes"`
+	// WindowStart and WindowEnd (HH:MM in WindowTimezone, default UTC)
+	// restrict compaction to a daily window; a window whose end is not
+	// after its start runs past midnight. Both empty compacts at any time.
+	WindowStart    string `yaml:"window_start"`
+	WindowEnd      string `yaml:"window_end"`
+	WindowTimezone string `yaml:"window_timezone"`
+	// PauseBufferedBytes pauses compaction while the ingestor holds more
+	// unflushed bytes than this (0 = never pause)
+	PauseBufferedBytes int64 `yaml:"pause_buffered_bytes"`
+}
+
+// ChunkSizeOverride sets chunk_size_bytes for streams matching Selector
+type ChunkSizeOverride struct {
+	Selector       string `yaml:"selector"`
+	ChunkSizeBytes int    `yaml:"chunk_size_bytes"`
 }
 
 type IngestConfig struct {
@@ -35,17 +156,347 @@ type IngestConfig struct {
 	FlushInterval int `yaml:"flush_interval_ms"`
 	MaxBatchSize  int `yaml:"max_batch_size"`
 	Workers       int `yaml:"workers"`
+	// MaxChunkAge finalizes a stream's open chunk once its oldest entry has
+	// been buffered this long, even below the size limit (0 = no limit)
+	MaxChunkAge time.Duration `yaml:"max_chunk_age"`
+	// ExtraLabels are merged into every stream received on /ingest
+	ExtraLabels map[string]string `yaml:"extra_labels"`
+	// ExtraLabelsOverride lets injected labels replace agent-provided ones
+	// with the same name; by default the agent's value wins
+	ExtraLabelsOverride bool `yaml:"extra_labels_override"`
+	// StripANSI lists stream selectors whose lines have ANSI escape
+	// sequences removed before storage ("{}" matches every stream)
+	StripANSI []string `yaml:"strip_ansi"`
+	// MetricLabels are the stream labels the ingested lines and bytes
+	// counters are broken down by; empty exports totals only
+	MetricLabels []string `yaml:"metric_labels"`
+	// MissingTimestamp handles entries without a valid RFC3339 timestamp:
+	// "assign" (default) stamps them with their arrival time, "reject"
+	// drops them
+	MissingTimestamp string `yaml:"missing_timestamp"`
+	// LateWindow is how far behind its arrival an entry may be timestamped
+	// and still join its stream's open chunk (0 = any age). Older entries
+	// go to a separate late chunk or are rejected according to LateLogs.
+	LateWindow time.Duration `yaml:"late_window"`
+	LateLogs   string        `yaml:"late_logs"`
+	// RejectOldSamples drops entries pushed to the Loki push endpoint that
+	// are older than RejectOldSamplesMaxAge, as Loki's limits of the same
+	// names do, so a replaying client cannot write behind retention
+	RejectOldSamples       bool          `yaml:"reject_old_samples"`
+	RejectOldSamplesMaxAge time.Duration `yaml:"reject_old_samples_max_age"`
+	// MaxLineBytes caps the length of a stored line (0 = no limit). Longer
+	// lines are truncated or rejected according to LongLines.
+	MaxLineBytes int    `yaml:"max_line_bytes"`
+	LongLines    string `yaml:"long_lines"`
+	// MaxInflightBytes caps the request body bytes buffered at once across
+	// all concurrent /ingest requests (0 = unlimited)
+	MaxInflightBytes int64 `yaml:"max_inflight_bytes"`
+	// InflightWait is how long a request waits for budget before a 503
+	InflightWait time.Duration `yaml:"inflight_wait"`
+	// DecodeWorkers caps the ingest requests decoded concurrently, apart
+	// from the flush workers (0 = GOMAXPROCS). Others wait up to DecodeWait
+	// before a 503.
+	DecodeWorkers int           `yaml:"decode_workers"`
+	DecodeWait    time.Duration `yaml:"decode_wait"`
+	// BufferHighWater is the number of entries waiting in ingest buffers
+	// past which requests get a 503 until flushes catch up (0 = never)
+	BufferHighWater int `yaml:"buffer_high_water"`
+	// LabelSchemas declare the labels matching streams must carry; streams
+	// that break one are rejected or, with LabelSchemaAction "warn", only
+	// counted and logged
+	LabelSchemas      []LabelSchema `yaml:"label_schemas"`
+	LabelSchemaAction string        `yaml:"label_schema_action"`
+	// LevelDetection infers a level label from the line for streams
+	// without one; the first entry whose selector matches applies
+	LevelDetection []LevelDetection `yaml:"level_detection"`
+	// JSONLabels promote fields of JSON lines to labels for streams
+	// matching a selector; the first entry whose selector matches applies
+	JSONLabels []JSONLabels `yaml:"json_labels"`
+	// WAL logs accepted entries to disk before they are acknowledged, so
+	// entries still buffered when the process dies are replayed at startup
+	WAL WALConfig `yaml:"wal"`
+}
+
+// WALConfig configures the ingestor's write-ahead log
+type WALConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// SegmentSizeBytes is the size at which a segment is sealed and a new
+	// one started (0 = 64MB); sealed segments are deleted once every entry
+	// in them is in a chunk
+	SegmentSizeBytes int64 `yaml:"segment_size_bytes"`
+	// Sync fsyncs every append, so acknowledged entries also survive a
+	// power loss, at the cost of ingest latency
+	Sync bool `yaml:"sync"`
+	// Compress gzips sealed segments in the background
+	Compress bool `yaml:"compress"`
+}
+
+// JSONLabels promotes the top-level Fields of JSON lines, flattening
+// objects, to labels named Prefix plus the field. MaxValues caps each
+// label's distinct values; further values are not promoted.
+type JSONLabels struct {
+	Selector  string   `yaml:"selector"`
+	Fields    []string `yaml:"fields"`
+	Prefix    string   `yaml:"prefix"`
+	MaxValues int      `yaml:"max_values"`
+}
+
+// LevelDetection lists the rules inferring levels for streams matching
+// Selector; without rules the usual severity words are recognized
+type LevelDetection struct {
+	Selector string      `yaml:"selector"`
+	Rules    []LevelRule `yaml:"rules"`
+}
+
+// LevelRule sets Level for lines matching Pattern, a regular expression, or
+// containing one of Keywords as a word (case-insensitive)
+type LevelRule struct {
+	Level    string   `yaml:"level"`
+	Pattern  string   `yaml:"pattern"`
+	Keywords []string `yaml:"keywords"`
+}
+
+// LabelSchema lists the required and, optionally, the only other allowed
+// labels of streams matching Selector
+type LabelSchema struct {
+	Selector string   `yaml:"selector"`
+	Required []string `yaml:"required"`
+	Allowed  []string `yaml:"allowed"`
+}
+
+type OTLPConfig struct {
+	// LabelAttributes lists the resource and scope attributes promoted to
+	// labels on /v1/logs (dots become underscores); empty uses the defaults
+	LabelAttributes []string `yaml:"label_attributes"`
+	// MaxLabels caps the attribute labels per stream (0 = unlimited)
+	MaxLabels int `yaml:"max_labels"`
+}
+
+type IndexConfig struct {
+	// MaxLabelNames caps the distinct label names tracked and
+	// MaxLabelValuesPerName the distinct values of each (0 = unlimited).
+	// Labels past either limit are dropped from incoming streams.
+	MaxLabelNames         int `yaml:"max_label_names"`
+	MaxLabelValuesPerName int `yaml:"max_label_values_per_name"`
+	// SnapshotPath is where the index is saved on graceful shutdown and
+	// every SnapshotInterval, so startup only rereads the chunk metadata of
+	// streams changed since. Empty disables snapshots; startup then reads
+	// all chunk metadata.
+	SnapshotPath     string        `yaml:"snapshot_path"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	// RefreshInterval is how often a read-only node picks up chunks written
+	// or deleted by the writer
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
 }
 
 type AuthConfig struct {
 	Enabled bool   `yaml:"enabled"`
 	APIKey  string `yaml:"api_key"`
+	// EnforceOnPreflight requires the API key on OPTIONS preflights
+	// instead of letting them through unauthenticated.
+	EnforceOnPreflight bool `yaml:"enforce_on_preflight"`
+	// Keys are additional API keys, optionally limited to streams carrying
+	// fixed labels. APIKey stays unrestricted and is the only admin key.
+	Keys []APIKeyConfig `yaml:"keys"`
+	// ExemptPaths are path prefixes served without an API key, so probes
+	// and scrapers need no credentials. Unset means the health, readiness
+	// and metrics endpoints; an empty list protects everything.
+	ExemptPaths []string `yaml:"exempt_paths"`
+}
+
+// defaultAuthExemptPaths are the probe and scrape endpoints
+func defaultAuthExemptPaths() []string {
+	return []string{"/health", "/ready", "/metrics", "/prometheus-metrics"}
+}
+
+// APIKeyConfig is an API key whose requests are confined to streams with
+// Labels: ingested streams are stamped with them and queries only see
+// matching streams. Without labels the key is unrestricted.
+type APIKeyConfig struct {
+	Name   string            `yaml:"name"`
+	Key    string            `yaml:"key"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type RateLimitConfig struct {
+	Enabled           bool     `yaml:"enabled"`
+	RequestsPerMinute int      `yaml:"requests_per_minute"`
+	Burst             int      `yaml:"burst"`
+	WhitelistIPs      []string `yaml:"whitelist_ips"`
+	BlacklistIPs      []string `yaml:"blacklist_ips"`
+	TrustedProxies    []string `yaml:"trusted_proxies"`
+	// CountPreflight charges OPTIONS preflights against the rate limit
+	// instead of letting them through for free.
+	CountPreflight bool `yaml:"count_preflight"`
+	// KeyRequestsPerMinute and KeyBurst limit each API key, for requests
+	// the auth middleware accepted one for; 0 uses RequestsPerMinute and
+	// Burst. Without auth every request is limited by IP.
+	KeyRequestsPerMinute int `yaml:"key_requests_per_minute"`
+	KeyBurst             int `yaml:"key_burst"`
+}
+
+// KeyLimits returns the rate and burst applied to each API key
+func (c RateLimitConfig) KeyLimits() (requestsPerMinute, burst int) {
+	requestsPerMinute, burst = c.KeyRequestsPerMinute, c.KeyBurst
+	if requestsPerMinute == 0 {
+		requestsPerMinute = c.RequestsPerMinute
+	}
+	if burst == 0 {
+		burst = c.Burst
+	}
+	return requestsPerMinute, burst
+}
+
+type CORSConfig struct {
+	// AllowedOrigins lists the origins that receive CORS headers and a
+	// successful preflight. "*" allows any origin.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// AllowCredentials sends Access-Control-Allow-Credentials. It requires
+	// an explicit origin list.
+	AllowCredentials bool `yaml:"allow_credentials"`
+}
+
+type StreamingConfig struct {
+	// BroadcastBufferSize is the capacity of the live-tail broadcast queue
+	BroadcastBufferSize int `yaml:"broadcast_buffer_size"`
+	// DropPolicy is drop_newest (default) or drop_oldest when the queue is full
+	DropPolicy string `yaml:"drop_policy"`
+	// ClientBufferSize caps the messages buffered for each client; clients
+	// connecting with ?compress=true hold them compressed
+	ClientBufferSize int `yaml:"client_buffer_size"`
+	// MaxClientOverflows disconnects a client once this many messages in a
+	// row were dropped for its full buffer (0 = never)
+	MaxClientOverflows int `yaml:"max_client_overflows"`
+	// MaxClientRate is the default messages per second delivered to each
+	// client (0 = unlimited); excess messages are dropped for that client
+	// and reported to it. Clients may ask for another rate with ?rate=.
+	MaxClientRate float64 `yaml:"max_client_rate"`
+}
+
+type MetricsConfig struct {
+	// StreamInterval is how often /metrics/stream gathers and pushes metrics
+	StreamInterval time.Duration `yaml:"stream_interval"`
+	// StreamWriteTimeout drops a /metrics/stream client that takes longer
+	// than this to accept an event
+	StreamWriteTimeout time.Duration `yaml:"stream_write_timeout"`
+}
+
+// DefaultAlertEvaluationInterval is how often alert rules are evaluated
+const DefaultAlertEvaluationInterval = 60 * time.Second
+
+// DefaultAlertQueryTimeout bounds each alert rule query, well under the 60s
+// evaluation interval
+const DefaultAlertQueryTimeout = 10 * time.Second
+
+type AlertingConfig struct {
+	// EvaluationInterval is how often every alert rule is evaluated
+	EvaluationInterval time.Duration `yaml:"evaluation_interval"`
+	// QueryTimeout is the deadline for each rule's evaluation query; rules
+	// whose query exceeds it are skipped for that tick
+	QueryTimeout time.Duration `yaml:"query_timeout"`
+	// WebhookQueue makes webhook delivery durable
+	WebhookQueue WebhookQueueConfig `yaml:"webhook_queue"`
+}
+
+// WebhookQueueConfig configures the file-backed queue webhook deliveries
+// wait in until they succeed. Deliveries pending at shutdown are retried at
+// the next start.
+type WebhookQueueConfig struct {
+	// Path is the queue file; empty sends each webhook once, in memory
+	Path string `yaml:"path"`
+	// MaxSize bounds the pending deliveries; the oldest is dropped when full
+	MaxSize int `yaml:"max_size"`
+	// Workers is the number of deliveries sent concurrently
+	Workers int `yaml:"workers"`
+	// MinBackoff is the delay before the first retry, doubled after each
+	// failure up to MaxBackoff
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// MaxAttempts drops a delivery after this many failures (0 = never)
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+type QueryConfig struct {
+	// InstantLookback is the window used by instant queries when the
+	// request does not provide an explicit range.
+	InstantLookback time.Duration `yaml:"instant_lookback"`
+	// StrictConsistency fails queries when the index references chunks
+	// missing from storage instead of skipping them.
+	StrictConsistency bool `yaml:"strict_consistency"`
+	// NamedSets maps a set name to a file of values, referenced from
+	// queries as `label in @name`.
+	NamedSets map[string]string `yaml:"named_sets"`
+	// Macros maps a name to a query fragment that queries reference as
+	// $name, or $name(arg, ...) when the fragment uses $1, $2, ...
+	Macros map[string]string `yaml:"macros"`
+	// ExportDir holds the files of POST /admin/export jobs; empty means an
+	// exports directory next to storage.path
+	ExportDir string `yaml:"export_dir"`
+	// ExportTTL is how long finished exports are kept for download
+	ExportTTL time.Duration `yaml:"export_ttl"`
+	// LokiMetricLabels adds optional labels to the Loki handler request
+	// metrics: status_code and/or status_class
+	LokiMetricLabels []string `yaml:"loki_metric_labels"`
+	// PrefetchBytes bounds the chunk data each query reads ahead of the
+	// chunk it is scanning, hiding storage latency (0 = no read-ahead)
+	PrefetchBytes int64 `yaml:"prefetch_bytes"`
+	// StreamWarningThreshold adds a warning to results spanning more
+	// streams than this, naming the labels with the most distinct values
+	// (0 = disabled)
+	StreamWarningThreshold int `yaml:"stream_warning_threshold"`
+	// ResultCache caches Loki query_range responses over ranges that have
+	// ended, which dashboards re-issue on every refresh
+	ResultCache QueryCacheConfig `yaml:"result_cache"`
+}
+
+// QueryCacheConfig sizes the query result cache
+type QueryCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxBytes bounds the cached response bodies; the least recently used
+	// are evicted past it
+	MaxBytes int64 `yaml:"max_bytes"`
+	// TTL is how long a response is served from the cache, bounding how
+	// stale it gets when late entries land in its range
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type HealthConfig struct {
+	// ReadProbeInterval is how often a recent chunk is read back to verify
+	// storage is readable (0 = disabled)
+	ReadProbeInterval time.Duration `yaml:"read_probe_interval"`
+}
+
+// TenancyConfig maps a request header to a tenant label. Ingested streams
+// are stamped with the label and queries only see streams carrying it.
+type TenancyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Header names the tenant, X-Scope-OrgID as in Loki
+	Header string `yaml:"header"`
+	// Label is the stream label holding the tenant
+	Label string `yaml:"label"`
+	// DefaultTenant serves requests without the header; when empty they
+	// are rejected
+	DefaultTenant string `yaml:"default_tenant"`
 }
 
 type ShutdownConfig struct {
 	HTTPTimeout     int `yaml:"http_timeout_seconds"`
 	IngestorTimeout int `yaml:"ingestor_timeout_seconds"`
 	ProgressLog     int `yaml:"progress_log_interval_seconds"`
+	// DrainGrace is how long POST /admin/drain keeps /ready passing after
+	// it starts refusing new requests
+	DrainGrace int `yaml:"drain_grace_seconds"`
+}
+
+// LoggingConfig configures the server's own log output
+type LoggingConfig struct {
+	// Format is text (default), human-readable key=value lines, or json,
+	// one object per line
+	Format string `yaml:"format"`
+	// Level is the least severe level logged: debug, info (default), warn
+	// or error
+	Level string `yaml:"level"`
 }
 
 func Load(path string) (*Config, error) {
@@ -60,6 +511,68 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.Auth.ExemptPaths == nil {
+		cfg.Auth.ExemptPaths = defaultAuthExemptPaths()
+	}
+	for i, p := range cfg.Auth.ExemptPaths {
+		if !strings.HasPrefix(p, "/") || p == "/" {
+			return nil, fmt.Errorf("auth.exempt_paths[%d] must be a path below /, got %q", i, p)
+		}
+	}
+
+	// Validate API keys
+	seenKeys := map[string]bool{cfg.Auth.APIKey: cfg.Auth.APIKey != ""}
+	for i, k := range cfg.Auth.Keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("auth.keys[%d].key must not be empty", i)
+		}
+		if seenKeys[k.Key] {
+			return nil, fmt.Errorf("auth.keys[%d] (%s) duplicates another API key", i, k.Name)
+		}
+		seenKeys[k.Key] = true
+	}
+
+	// Validate tenancy
+	if cfg.Tenancy.Header == "" {
+		cfg.Tenancy.Header = "X-Scope-OrgID"
+	}
+	if cfg.Tenancy.Label == "" {
+		cfg.Tenancy.Label = "tenant"
+	}
+	if !labelNameRE.MatchString(cfg.Tenancy.Label) {
+		return nil, fmt.Errorf("tenancy.label must be a valid label name, got %q", cfg.Tenancy.Label)
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeReadWrite
+	case ModeReadWrite, ModeReadOnly:
+	default:
+		return nil, fmt.Errorf("mode must be %s or %s, got %q", ModeReadWrite, ModeReadOnly, cfg.Mode)
+	}
+
+	// Validate server timeouts
+	if cfg.Server.ReadTimeout <= 0 {
+		cfg.Server.ReadTimeout = 15 * time.Second
+	}
+	if cfg.Server.WriteTimeout <= 0 {
+		cfg.Server.WriteTimeout = 15 * time.Second
+	}
+	if cfg.Server.IdleTimeout <= 0 {
+		cfg.Server.IdleTimeout = 60 * time.Second
+	}
+	if cfg.Server.RouteTimeouts == nil {
+		cfg.Server.RouteTimeouts = defaultRouteTimeouts()
+	}
+	for i, rt := range cfg.Server.RouteTimeouts {
+		if !strings.HasPrefix(rt.Path, "/") {
+			return nil, fmt.Errorf("server.route_timeouts[%d].path must start with /, got %q", i, rt.Path)
+		}
+		if rt.Timeout < 0 {
+			return nil, fmt.Errorf("server.route_timeouts[%d].timeout must not be negative, got %s", i, rt.Timeout)
+		}
+	}
+
 	// Validate and clamp shutdown timeouts to prevent panics
 	if cfg.Shutdown.HTTPTimeout <= 0 {
 		cfg.Shutdown.HTTPTimeout = 30 // Default to 30 seconds
@@ -70,6 +583,308 @@ func Load(path string) (*Config, error) {
 	if cfg.Shutdown.ProgressLog <= 0 {
 		cfg.Shutdown.ProgressLog = 2 // Default to 2 seconds
 	}
+	if cfg.Shutdown.DrainGrace < 0 {
+		return nil, fmt.Errorf("shutdown.drain_grace_seconds must not be negative, got %d", cfg.Shutdown.DrainGrace)
+	}
+	if cfg.RateLimit.KeyRequestsPerMinute < 0 || cfg.RateLimit.KeyBurst < 0 {
+		return nil, fmt.Errorf("rate_limit.key_requests_per_minute and rate_limit.key_burst must not be negative")
+	}
+
+	// Validate chunk rotation
+	if cfg.Ingest.FlushInterval < 0 {
+		return nil, fmt.Errorf("ingest.flush_interval_ms must not be negative, got %d", cfg.Ingest.FlushInterval)
+	}
+	if cfg.Ingest.FlushInterval == 0 {
+		cfg.Ingest.FlushInterval = 5000 // Default to 5 seconds
+	}
+	if cfg.Ingest.MaxChunkAge < 0 {
+		return nil, fmt.Errorf("ingest.max_chunk_age must not be negative, got %s", cfg.Ingest.MaxChunkAge)
+	}
+
+	switch cfg.Ingest.MissingTimestamp {
+	case "":
+		cfg.Ingest.MissingTimestamp = "assign"
+	case "assign", "reject":
+	default:
+		return nil, fmt.Errorf("ingest.missing_timestamp must be assign or reject, got %q", cfg.Ingest.MissingTimestamp)
+	}
+
+	if cfg.Ingest.LateWindow < 0 {
+		return nil, fmt.Errorf("ingest.late_window must not be negative, got %s", cfg.Ingest.LateWindow)
+	}
+	switch cfg.Ingest.LateLogs {
+	case "":
+		cfg.Ingest.LateLogs = "separate"
+	case "separate", "reject":
+	default:
+		return nil, fmt.Errorf("ingest.late_logs must be separate or reject, got %q", cfg.Ingest.LateLogs)
+	}
+	if cfg.Ingest.RejectOldSamplesMaxAge < 0 {
+		return nil, fmt.Errorf("ingest.reject_old_samples_max_age must not be negative, got %s", cfg.Ingest.RejectOldSamplesMaxAge)
+	}
+	if cfg.Ingest.RejectOldSamplesMaxAge == 0 {
+		cfg.Ingest.RejectOldSamplesMaxAge = 7 * 24 * time.Hour
+	}
+
+	if cfg.Ingest.MaxLineBytes < 0 {
+		return nil, fmt.Errorf("ingest.max_line_bytes must not be negative, got %d", cfg.Ingest.MaxLineBytes)
+	}
+	switch cfg.Ingest.LongLines {
+	case "":
+		cfg.Ingest.LongLines = "truncate"
+	case "truncate", "reject":
+	default:
+		return nil, fmt.Errorf("ingest.long_lines must be truncate or reject, got %q", cfg.Ingest.LongLines)
+	}
+	for i := range cfg.Ingest.JSONLabels {
+		rule := &cfg.Ingest.JSONLabels[i]
+		if rule.MaxValues < 0 {
+			return nil, fmt.Errorf("ingest.json_labels[%d].max_values must not be negative, got %d", i, rule.MaxValues)
+		}
+		if rule.MaxValues == 0 {
+			rule.MaxValues = 100
+		}
+	}
+
+	switch cfg.Ingest.LabelSchemaAction {
+	case "":
+		cfg.Ingest.LabelSchemaAction = "reject"
+	case "reject", "warn":
+	default:
+		return nil, fmt.Errorf("ingest.label_schema_action must be reject or warn, got %q", cfg.Ingest.LabelSchemaAction)
+	}
+
+	// Validate ingest body budget
+	if cfg.Ingest.MaxInflightBytes < 0 {
+		return nil, fmt.Errorf("ingest.max_inflight_bytes must not be negative, got %d", cfg.Ingest.MaxInflightBytes)
+	}
+	if cfg.Ingest.InflightWait < 0 {
+		cfg.Ingest.InflightWait = 0
+	}
+
+	// Validate ingest decode pool
+	if cfg.Ingest.DecodeWorkers < 0 {
+		return nil, fmt.Errorf("ingest.decode_workers must not be negative, got %d", cfg.Ingest.DecodeWorkers)
+	}
+	if cfg.Ingest.DecodeWorkers == 0 {
+		cfg.Ingest.DecodeWorkers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.Ingest.DecodeWait <= 0 {
+		cfg.Ingest.DecodeWait = 5 * time.Second
+	}
+	if cfg.Ingest.BufferHighWater < 0 {
+		return nil, fmt.Errorf("ingest.buffer_high_water must not be negative, got %d", cfg.Ingest.BufferHighWater)
+	}
+
+	// Validate the write-ahead log
+	if cfg.Ingest.WAL.SegmentSizeBytes < 0 {
+		return nil, fmt.Errorf("ingest.wal.segment_size_bytes must not be negative, got %d", cfg.Ingest.WAL.SegmentSizeBytes)
+	}
+	if cfg.Ingest.WAL.Enabled && cfg.Ingest.WAL.Dir == "" {
+		return nil, fmt.Errorf("ingest.wal.dir must be set when the WAL is enabled")
+	}
+
+	switch cfg.Logging.Format {
+	case "":
+		cfg.Logging.Format = "text"
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("logging.format must be text or json, got %q", cfg.Logging.Format)
+	}
+	switch cfg.Logging.Level {
+	case "":
+		cfg.Logging.Level = "info"
+	case "debug", "info", "warn", "error":
+	default:
+		return nil, fmt.Errorf("logging.level must be debug, info, warn or error, got %q", cfg.Logging.Level)
+	}
+
+	// Validate streaming settings
+	if cfg.Streaming.BroadcastBufferSize <= 0 {
+		cfg.Streaming.BroadcastBufferSize = 5000
+	}
+	switch cfg.Streaming.DropPolicy {
+	case "":
+		cfg.Streaming.DropPolicy = "drop_newest"
+	case "drop_newest", "drop_oldest":
+	default:
+		return nil, fmt.Errorf("streaming.drop_policy must be drop_newest or drop_oldest, got %q", cfg.Streaming.DropPolicy)
+	}
+	if cfg.Streaming.ClientBufferSize <= 0 {
+		cfg.Streaming.ClientBufferSize = 256
+	}
+	if cfg.Streaming.MaxClientOverflows < 0 {
+		return nil, fmt.Errorf("streaming.max_client_overflows must not be negative, got %d", cfg.Streaming.MaxClientOverflows)
+	}
+	if cfg.Streaming.MaxClientRate < 0 {
+		return nil, fmt.Errorf("streaming.max_client_rate must not be negative, got %g", cfg.Streaming.MaxClientRate)
+	}
+
+	if cfg.OTLP.MaxLabels < 0 {
+		return nil, fmt.Errorf("otlp.max_labels must not be negative, got %d", cfg.OTLP.MaxLabels)
+	}
+
+	// Validate CORS origins
+	if len(cfg.CORS.AllowedOrigins) == 0 {
+		cfg.CORS.AllowedOrigins = []string{"*"}
+	}
+	if cfg.CORS.AllowCredentials {
+		for _, origin := range cfg.CORS.AllowedOrigins {
+			if origin == "*" {
+				return nil, fmt.Errorf("cors.allow_credentials requires explicit cors.allowed_origins, not \"*\"")
+			}
+		}
+	}
+
+	// Validate metrics stream interval
+	if cfg.Metrics.StreamInterval <= 0 {
+		cfg.Metrics.StreamInterval = 2 * time.Second
+	}
+	if cfg.Metrics.StreamWriteTimeout < 0 {
+		return nil, fmt.Errorf("metrics.stream_write_timeout must not be negative, got %s", cfg.Metrics.StreamWriteTimeout)
+	}
+	if cfg.Metrics.StreamWriteTimeout == 0 {
+		cfg.Metrics.StreamWriteTimeout = 10 * time.Second
+	}
+
+	if cfg.Alerting.EvaluationInterval < 0 {
+		return nil, fmt.Errorf("alerting.evaluation_interval must not be negative, got %s", cfg.Alerting.EvaluationInterval)
+	}
+	if cfg.Alerting.EvaluationInterval == 0 {
+		cfg.Alerting.EvaluationInterval = DefaultAlertEvaluationInterval
+	}
+	// Validate alert query deadline
+	if cfg.Alerting.QueryTimeout <= 0 {
+		cfg.Alerting.QueryTimeout = DefaultAlertQueryTimeout
+	}
+	wq := &cfg.Alerting.WebhookQueue
+	if wq.MaxSize < 0 || wq.Workers < 0 || wq.MaxAttempts < 0 {
+		return nil, fmt.Errorf("alerting.webhook_queue max_size, workers and max_attempts must not be negative")
+	}
+	if wq.MinBackoff < 0 || wq.MaxBackoff < 0 {
+		return nil, fmt.Errorf("alerting.webhook_queue backoffs must not be negative")
+	}
+	if wq.MaxSize == 0 {
+		wq.MaxSize = 1000
+	}
+	if wq.Workers == 0 {
+		wq.Workers = 4
+	}
+	if wq.MinBackoff == 0 {
+		wq.MinBackoff = time.Second
+	}
+	if wq.MaxBackoff == 0 {
+		wq.MaxBackoff = 5 * time.Minute
+	}
+	if wq.MaxBackoff < wq.MinBackoff {
+		return nil, fmt.Errorf("alerting.webhook_queue.max_backoff (%s) must not be below min_backoff (%s)", wq.MaxBackoff, wq.MinBackoff)
+	}
+
+	// Validate the storage backend
+	switch cfg.Storage.Backend {
+	case "":
+		cfg.Storage.Backend = StorageBackendLocal
+	case StorageBackendLocal:
+	case StorageBackendS3:
+		if cfg.Storage.S3.Bucket == "" {
+			return nil, fmt.Errorf("storage.s3.bucket is required for the s3 backend")
+		}
+		if cfg.Storage.S3.Timeout < 0 {
+			return nil, fmt.Errorf("storage.s3.timeout must not be negative")
+		}
+	default:
+		return nil, fmt.Errorf("storage.backend must be local or s3, got %q", cfg.Storage.Backend)
+	}
+
+	// Validate the storage cap
+	if cfg.Storage.MaxStorageBytes < 0 {
+		return nil, fmt.Errorf("storage.max_storage_bytes must not be negative, got %d", cfg.Storage.MaxStorageBytes)
+	}
+	if cfg.Storage.LowWaterPercent == 0 {
+		cfg.Storage.LowWaterPercent = 90
+	}
+	if cfg.Storage.LowWaterPercent < 1 || cfg.Storage.LowWaterPercent > 100 {
+		return nil, fmt.Errorf("storage.low_water_percent must be between 1 and 100, got %d", cfg.Storage.LowWaterPercent)
+	}
+
+	// Validate compaction limits
+	cc := &cfg.Storage.Compaction
+	if cc.Interval < 0 || cc.Workers < 0 || cc.MaxMergeBytes < 0 || cc.PauseBufferedBytes < 0 {
+		return nil, fmt.Errorf("storage.compaction interval, workers, max_merge_bytes and pause_buffered_bytes must not be negative")
+	}
+	if cc.Workers == 0 {
+		cc.Workers = 1
+	}
+	if cc.MaxMergeBytes == 0 {
+		cc.MaxMergeBytes = 64 * 1024 * 1024
+	}
+	if (cc.WindowStart == "") != (cc.WindowEnd == "") {
+		return nil, fmt.Errorf("storage.compaction.window_start and window_end must be set together")
+	}
+	for name, v := range map[string]string{"window_start": cc.WindowStart, "window_end": cc.WindowEnd} {
+		if _, err := time.Parse("15:04", v); v != "" && err != nil {
+			return nil, fmt.Errorf("storage.compaction.%s must be HH:MM, got %q", name, v)
+		}
+	}
+	if cc.WindowTimezone != "" {
+		if _, err := time.LoadLocation(cc.WindowTimezone); err != nil {
+			return nil, fmt.Errorf("storage.compaction.window_timezone: %v", err)
+		}
+	}
+
+	// Validate query defaults
+	if cfg.Query.InstantLookback < 0 {
+		return nil, fmt.Errorf("query.instant_lookback must be a positive duration, got %s", cfg.Query.InstantLookback)
+	}
+	if cfg.Query.InstantLookback == 0 {
+		cfg.Query.InstantLookback = 5 * time.Minute
+	}
+	if cfg.Index.MaxLabelNames < 0 {
+		return nil, fmt.Errorf("index.max_label_names must not be negative, got %d", cfg.Index.MaxLabelNames)
+	}
+	if cfg.Index.MaxLabelValuesPerName < 0 {
+		return nil, fmt.Errorf("index.max_label_values_per_name must not be negative, got %d", cfg.Index.MaxLabelValuesPerName)
+	}
+	if cfg.Index.SnapshotInterval < 0 {
+		return nil, fmt.Errorf("index.snapshot_interval must not be negative, got %s", cfg.Index.SnapshotInterval)
+	}
+	if cfg.Index.SnapshotInterval == 0 {
+		cfg.Index.SnapshotInterval = 5 * time.Minute
+	}
+	if cfg.Index.RefreshInterval < 0 {
+		return nil, fmt.Errorf("index.refresh_interval must not be negative, got %s", cfg.Index.RefreshInterval)
+	}
+	if cfg.Index.RefreshInterval == 0 {
+		cfg.Index.RefreshInterval = 30 * time.Second
+	}
+
+	if cfg.Query.ExportTTL < 0 {
+		return nil, fmt.Errorf("query.export_ttl must be a positive duration, got %s", cfg.Query.ExportTTL)
+	}
+	if cfg.Query.PrefetchBytes < 0 {
+		return nil, fmt.Errorf("query.prefetch_bytes must not be negative, got %d", cfg.Query.PrefetchBytes)
+	}
+	if cfg.Query.StreamWarningThreshold < 0 {
+		return nil, fmt.Errorf("query.stream_warning_threshold must not be negative, got %d", cfg.Query.StreamWarningThreshold)
+	}
+	if cfg.Query.ExportTTL == 0 {
+		cfg.Query.ExportTTL = 24 * time.Hour
+	}
+	rc := &cfg.Query.ResultCache
+	if rc.MaxBytes < 0 || rc.TTL < 0 {
+		return nil, fmt.Errorf("query.result_cache max_bytes and ttl must not be negative")
+	}
+	if rc.MaxBytes == 0 {
+		rc.MaxBytes = 64 * 1024 * 1024
+	}
+	if rc.TTL == 0 {
+		rc.TTL = 5 * time.Minute
+	}
+	for _, l := range cfg.Query.LokiMetricLabels {
+		if l != "status_code" && l != "status_class" {
+			return nil, fmt.Errorf("query.loki_metric_labels may only contain status_code and status_class, got %q", l)
+		}
+	}
 
 	// Override with environment variables
 	if port := os.Getenv("LOGPULSE_PORT"); port != "" {
@@ -97,6 +912,16 @@ func Load(path string) (*Config, error) {
 			cfg.RateLimit.Burst = val
 		}
 	}
+	if rpm := os.Getenv("LOGPULSE_RATE_LIMIT_KEY_RPM"); rpm != "" {
+		if val, err := strconv.Atoi(rpm); err == nil {
+			cfg.RateLimit.KeyRequestsPerMinute = val
+		}
+	}
+	if burst := os.Getenv("LOGPULSE_RATE_LIMIT_KEY_BURST"); burst != "" {
+		if val, err := strconv.Atoi(burst); err == nil {
+			cfg.RateLimit.KeyBurst = val
+		}
+	}
 	if whitelist := os.Getenv("LOGPULSE_RATE_LIMIT_WHITELIST"); whitelist != "" {
 		ips := strings.Split(whitelist, ",")
 		for i := range ips {
@@ -124,26 +949,100 @@ func Load(path string) (*Config, error) {
 
 func DefaultConfig() *Config {
 	return &Config{
+		Mode: ModeReadWrite,
 		Server: ServerConfig{
-			Port: "8080",
+			Port:          "8080",
+			ReadTimeout:   15 * time.Second,
+			WriteTimeout:  15 * time.Second,
+			IdleTimeout:   60 * time.Second,
+			RouteTimeouts: defaultRouteTimeouts(),
 		},
 		Storage: StorageConfig{
-			Path:           "./data/logs",
-			ChunkSizeBytes: 1024 * 1024, // 1MB
-			RetentionDays:  7,
+			Backend:         StorageBackendLocal,
+			Path:            "./data/logs",
+			ChunkSizeBytes:  1024 * 1024, // 1MB
+			RetentionDays:   7,
+			LowWaterPercent: 90,
+			Compaction: CompactionConfig{
+				Interval:      10 * time.Minute,
+				Workers:       1,
+				MaxMergeBytes: 64 * 1024 * 1024,
+			},
 		},
 		Ingest: IngestConfig{
-			BufferSize:    1000,
-			FlushInterval: 5000,
+			BufferSize:             1000,
+			FlushInterval:          5000,
+			MissingTimestamp:       "assign",
+			LateLogs:               "separate",
+			RejectOldSamplesMaxAge: 7 * 24 * time.Hour,
+			LongLines:              "truncate",
+			LabelSchemaAction:      "reject",
+			DecodeWorkers:          runtime.GOMAXPROCS(0),
+			MetricLabels:           []string{"app", "level"},
+			DecodeWait:             5 * time.Second,
+			WAL: WALConfig{
+				Dir: "./data/wal",
+			},
 		},
 		Auth: AuthConfig{
-			Enabled: false,
-			APIKey:  "",
+			Enabled:     false,
+			APIKey:      "",
+			ExemptPaths: defaultAuthExemptPaths(),
+		},
+		Index: IndexConfig{
+			SnapshotPath:     "./data/index.db",
+			SnapshotInterval: 5 * time.Minute,
+			RefreshInterval:  30 * time.Second,
+		},
+		Tenancy: TenancyConfig{
+			Header: "X-Scope-OrgID",
+			Label:  "tenant",
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"*"},
+		},
+		OTLP: OTLPConfig{
+			MaxLabels: 10,
+		},
+		Streaming: StreamingConfig{
+			BroadcastBufferSize: 5000,
+			DropPolicy:          "drop_newest",
+			ClientBufferSize:    256,
+			MaxClientOverflows:  1000,
+		},
+		Metrics: MetricsConfig{
+			StreamInterval:     2 * time.Second,
+			StreamWriteTimeout: 10 * time.Second,
+		},
+		Alerting: AlertingConfig{
+			EvaluationInterval: DefaultAlertEvaluationInterval,
+			QueryTimeout:       DefaultAlertQueryTimeout,
+			WebhookQueue: WebhookQueueConfig{
+				Path:       "./data/webhook_queue.json",
+				MaxSize:    1000,
+				Workers:    4,
+				MinBackoff: time.Second,
+				MaxBackoff: 5 * time.Minute,
+			},
+		},
+		Query: QueryConfig{
+			InstantLookback: 5 * time.Minute,
+			ExportTTL:       24 * time.Hour,
+			PrefetchBytes:   32 * 1024 * 1024,
+			ResultCache: QueryCacheConfig{
+				MaxBytes: 64 * 1024 * 1024,
+				TTL:      5 * time.Minute,
+			},
 		},
 		Shutdown: ShutdownConfig{
 			HTTPTimeout:     30,
 			IngestorTimeout: 30,
 			ProgressLog:     2,
+			DrainGrace:      10,
+		},
+		Logging: LoggingConfig{
+			Format: "text",
+			Level:  "info",
 		},
 	}
 }
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadYAML loads a config file holding data
+func loadYAML(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad_CompactionDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, "storage:\n  compaction:\n    window_start: \"22:00\"\n    window_end: \"05:00\"\n    window_timezone: Europe/Berlin\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := cfg.Storage.Compaction
+	if cc.Workers != 1 {
+		t.Errorf("expected 1 worker by default, got %d", cc.Workers)
+	}
+	if cc.MaxMergeBytes != 64*1024*1024 {
+		t.Errorf("expected max_merge_bytes to default to 64MB, got %d", cc.MaxMergeBytes)
+	}
+}
+
+func TestLoad_CompactionWindowErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"start without end", "window_start: \"22:00\"", "must be set together"},
+		{"end without start", "window_end: \"05:00\"", "must be set together"},
+		{"bad time", "window_start: \"22:00\"\n    window_end: \"5pm\"", "window_end must be HH:MM"},
+		{"out of range time", "window_start: \"24:30\"\n    window_end: \"05:00\"", "window_start must be HH:MM"},
+		{"unknown timezone", "window_start: \"22:00\"\n    window_end: \"05:00\"\n    window_timezone: Mars/Olympus_Mons", "window_timezone"},
+		{"negative workers", "workers: -1", "must not be negative"},
+	}
+	for _, c := range cases {
+		_, err := loadYAML(t, "storage:\n  compaction:\n    "+c.yaml+"\n")
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+}
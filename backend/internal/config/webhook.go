@@ -3,8 +3,13 @@ package config
 type WebhookConfig struct {
 	URL    string   `yaml:"url" json:"url"`
 	Events []string `yaml:"events" json:"events"`
+	// Match restricts alert events to rules whose labels contain every pair
+	Match map[string]string `yaml:"match" json:"match,omitempty"`
 }
 
 type WebhookSettings struct {
 	Webhooks []WebhookConfig `yaml:"webhooks" json:"webhooks"`
+	// Notifiers are alert channels of a registered type, as in alerts.yaml;
+	// names must not repeat across the two files
+	Notifiers []NotifierConfig `yaml:"notifiers,omitempty" json:"notifiers,omitempty"`
 }
@@ -6,6 +6,14 @@ import (
 )
 
 func LoadWebhooks(path string) ([]WebhookConfig, error) {
+	ws, err := LoadWebhookSettings(path)
+	if err != nil {
+		return nil, err
+	}
+	return ws.Webhooks, nil
+}
+
+func LoadWebhookSettings(path string) (*WebhookSettings, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -14,5 +22,5 @@ func LoadWebhooks(path string) ([]WebhookConfig, error) {
 	if err := yaml.Unmarshal(data, &ws); err != nil {
 		return nil, err
 	}
-	return ws.Webhooks, nil
+	return &ws, nil
 }
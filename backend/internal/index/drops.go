@@ -0,0 +1,134 @@
+package index
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// Drop counts are kept per stream, reason and minute of the dropped entries'
+// timestamps, for entries timestamped within the last dropRetention. They
+// live in memory only and start over on restart.
+const (
+	dropBucket    = time.Minute
+	dropRetention = 24 * time.Hour
+)
+
+// DroppedEntries counts the entries of a stream dropped, or stored
+// truncated, at ingest for one reason. Start and End bound the minutes the
+// entries were timestamped in.
+type DroppedEntries struct {
+	Labels map[string]string `json:"labels"`
+	Reason string            `json:"reason"`
+	Start  time.Time         `json:"start"`
+	End    time.Time         `json:"end"`
+	Count  int64             `json:"count"`
+}
+
+type dropKey struct {
+	reason string
+	bucket int64 // unix seconds of the bucket's start
+}
+
+type droppedStream struct {
+	labels map[string]string
+	counts map[dropKey]int64
+}
+
+type dropLedger struct {
+	mu        sync.Mutex
+	streams   map[string]*droppedStream
+	lastPrune time.Time
+}
+
+// RecordDrop counts n entries of the stream with labels, timestamped ts,
+// that ingestion dropped or truncated for reason
+func (idx *Index) RecordDrop(labels map[string]string, ts time.Time, reason string, n int) {
+	now := time.Now()
+	if n <= 0 || ts.Before(now.Add(-dropRetention)) {
+		return
+	}
+	d := &idx.drops
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) >= dropBucket {
+		d.prune(now.Add(-dropRetention))
+		d.lastPrune = now
+	}
+	if d.streams == nil {
+		d.streams = make(map[string]*droppedStream)
+	}
+	hash := models.Labels(labels).Hash()
+	s, ok := d.streams[hash]
+	if !ok {
+		s = &droppedStream{labels: labels, counts: make(map[dropKey]int64)}
+		d.streams[hash] = s
+	}
+	s.counts[dropKey{reason: reason, bucket: ts.Truncate(dropBucket).Unix()}] += int64(n)
+}
+
+// prune forgets buckets that ended before cutoff
+func (d *dropLedger) prune(cutoff time.Time) {
+	oldest := cutoff.Truncate(dropBucket).Unix()
+	for hash, s := range d.streams {
+		for key := range s.counts {
+			if key.bucket < oldest {
+				delete(s.counts, key)
+			}
+		}
+		if len(s.counts) == 0 {
+			delete(d.streams, hash)
+		}
+	}
+}
+
+// Drops returns, per matching stream and reason, the entries dropped or
+// truncated at ingest whose timestamps fall in the minutes overlapping
+// [start, end], sorted by stream then reason
+func (idx *Index) Drops(match func(labels map[string]string) bool, start, end time.Time) []DroppedEntries {
+	d := &idx.drops
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	first, last := start.Truncate(dropBucket).Unix(), end.Unix()
+	var out []DroppedEntries
+	for _, s := range d.streams {
+		if !match(s.labels) {
+			continue
+		}
+		byReason := make(map[string]*DroppedEntries)
+		for key, n := range s.counts {
+			if key.bucket < first || key.bucket > last {
+				continue
+			}
+			from := time.Unix(key.bucket, 0).UTC()
+			to := from.Add(dropBucket)
+			e, ok := byReason[key.reason]
+			if !ok {
+				byReason[key.reason] = &DroppedEntries{Labels: s.labels, Reason: key.reason, Start: from, End: to, Count: n}
+				continue
+			}
+			e.Count += n
+			if from.Before(e.Start) {
+				e.Start = from
+			}
+			if to.After(e.End) {
+				e.End = to
+			}
+		}
+		for _, e := range byReason {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := models.Labels(out[i].Labels).ToPath(), models.Labels(out[j].Labels).ToPath()
+		if a != b {
+			return a < b
+		}
+		return out[i].Reason < out[j].Reason
+	})
+	return out
+}
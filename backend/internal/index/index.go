@@ -1,19 +1,33 @@
 package index
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/logpulse/backend/internal/models"
 )
 
-// Index is an in-memory label-to-chunk mapping
+// Index is an in-memory label-to-chunk mapping. Chunk lookups scan an
+// immutable snapshot of the chunk metadata rather than holding the lock,
+// so queries and ingestion updates do not wait on each other.
 type Index struct {
 	mu sync.RWMutex
 
+	// version counts changes to chunkMeta; snap is the snapshot of the
+	// version last taken, rebuilt by the first lookup after a change
+	version uint64
+	snap    atomic.Pointer[chunkSnapshot]
+
 	// labelIndex maps label hash -> list of chunk IDs
 	labelIndex map[string][]string
 
+	// streamPos is the position of each stream in the last snapshot's
+	// streams; dirty lists the streams changed since, rebuilt by the next
+	streamPos map[string]int
+	dirty     map[string]struct{}
+
 	// chunkMeta stores chunk metadata by ID
 	chunkMeta map[string]*models.ChunkMeta
 
@@ -22,29 +36,280 @@ type Index struct {
 
 	// labelValues tracks all values for each label key
 	labelValues map[string]map[string]struct{}
+
+	// maxLabelNames caps the number of distinct label keys and
+	// maxLabelValues the distinct values of each (0 = unlimited)
+	maxLabelNames  int
+	maxLabelValues int
+
+	// drops counts entries lost at ingest, under its own lock
+	drops dropLedger
+}
+
+// chunkSnapshot lists the indexed chunks by stream as of one version of
+// the index. Metadata is never modified once indexed, so the snapshot can be
+// read without the lock.
+type chunkSnapshot struct {
+	version uint64
+	streams []*streamChunks
+}
+
+// metas returns the metadata of every chunk in the snapshot
+func (s *chunkSnapshot) metas() []*models.ChunkMeta {
+	n := 0
+	for _, stream := range s.streams {
+		n += len(stream.metas)
+	}
+	metas := make([]*models.ChunkMeta, 0, n)
+	for _, stream := range s.streams {
+		metas = append(metas, stream.metas...)
+	}
+	return metas
+}
+
+// streamChunks lists one stream's chunks sorted by start time, so lookups
+// find the chunks overlapping a range by binary search instead of checking
+// every chunk. Like the snapshot holding it, it is never modified.
+type streamChunks struct {
+	hash   string
+	labels map[string]string
+	metas  []*models.ChunkMeta
+	// maxEnd[i] is the latest end time among metas[:i+1]; it never
+	// decreases, so it can be searched for the first chunk ending in range
+	maxEnd []int64
+}
+
+func newStreamChunks(hash string, metas []*models.ChunkMeta) *streamChunks {
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].StartTime != metas[j].StartTime {
+			return metas[i].StartTime < metas[j].StartTime
+		}
+		return metas[i].ID < metas[j].ID
+	})
+	s := &streamChunks{hash: hash, labels: metas[0].Labels, metas: metas, maxEnd: make([]int64, len(metas))}
+	for i, meta := range metas {
+		s.maxEnd[i] = meta.EndTime
+		if i > 0 && s.maxEnd[i-1] > meta.EndTime {
+			s.maxEnd[i] = s.maxEnd[i-1]
+		}
+	}
+	return s
+}
+
+// overlapping appends the chunks overlapping [start, end] to dst
+func (s *streamChunks) overlapping(dst []*models.ChunkMeta, start, end int64) []*models.ChunkMeta {
+	i := sort.Search(len(s.maxEnd), func(i int) bool { return s.maxEnd[i] >= start })
+	for ; i < len(s.metas) && s.metas[i].StartTime <= end; i++ {
+		if s.metas[i].EndTime >= start {
+			dst = append(dst, s.metas[i])
+		}
+	}
+	return dst
+}
+
+// snapshot returns the chunks as currently indexed. When the index changed
+// since the last snapshot it re-sorts only the streams that changed, under
+// the lock, and shares the others with the last snapshot, so the work done
+// per change does not grow with the chunks indexed.
+func (idx *Index) snapshot() *chunkSnapshot {
+	idx.mu.RLock()
+	if s := idx.snap.Load(); s != nil && s.version == idx.version {
+		idx.mu.RUnlock()
+		return s
+	}
+	idx.mu.RUnlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	last := idx.snap.Load()
+	if last != nil && last.version == idx.version {
+		return last
+	}
+	var streams []*streamChunks
+	if last != nil {
+		// Earlier snapshots are being read, so changes go to a copy
+		streams = append(make([]*streamChunks, 0, len(last.streams)+len(idx.dirty)), last.streams...)
+	}
+	for hash := range idx.dirty {
+		var metas []*models.ChunkMeta
+		for _, id := range idx.labelIndex[hash] {
+			if meta := idx.chunkMeta[id]; meta != nil {
+				metas = append(metas, meta)
+			}
+		}
+		pos, ok := idx.streamPos[hash]
+		switch {
+		case len(metas) > 0 && ok:
+			streams[pos] = newStreamChunks(hash, metas)
+		case len(metas) > 0:
+			idx.streamPos[hash] = len(streams)
+			streams = append(streams, newStreamChunks(hash, metas))
+		case ok:
+			// Move the last stream into the emptied one's place
+			end := len(streams) - 1
+			streams[pos] = streams[end]
+			idx.streamPos[streams[pos].hash] = pos
+			streams = streams[:end]
+			delete(idx.streamPos, hash)
+		}
+		delete(idx.dirty, hash)
+	}
+
+	s := &chunkSnapshot{version: idx.version, streams: streams}
+	idx.snap.Store(s)
+	return s
 }
 
 // NewIndex creates a new in-memory index
 func NewIndex() *Index {
 	return &Index{
 		labelIndex:  make(map[string][]string),
+		streamPos:   make(map[string]int),
+		dirty:       make(map[string]struct{}),
 		chunkMeta:   make(map[string]*models.ChunkMeta),
 		labelKeys:   make(map[string]struct{}),
 		labelValues: make(map[string]map[string]struct{}),
 	}
 }
 
+// SetMaxLabelNames caps the number of distinct label names the index tracks.
+// A value of 0 disables the limit.
+func (idx *Index) SetMaxLabelNames(n int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.maxLabelNames = n
+}
+
+// SetMaxLabelValues caps the number of distinct values the index tracks for
+// each label name. A value of 0 disables the limit.
+func (idx *Index) SetMaxLabelValues(n int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.maxLabelValues = n
+}
+
+// AdmitLabels checks each label of a set against the label name and value
+// limits before it is ingested, reserving the names and values that fit.
+// Unlike AdmitLabelNames it admits labels one by one: it returns the names
+// of labels that would pass the name limit and of those whose value would
+// pass their name's value limit, both sorted, and the caller drops them.
+func (idx *Index) AdmitLabels(labels map[string]string) (overNames, overValues []string) {
+	idx.mu.RLock()
+	known := true
+	for k, v := range labels {
+		if _, ok := idx.labelValues[k][v]; !ok {
+			known = false
+			break
+		}
+	}
+	idx.mu.RUnlock()
+	if known {
+		return nil, nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	// Admit new names in order, so which ones fit does not depend on map
+	// iteration
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if _, ok := idx.labelKeys[k]; !ok {
+			if idx.maxLabelNames > 0 && len(idx.labelKeys) >= idx.maxLabelNames {
+				overNames = append(overNames, k)
+				continue
+			}
+			idx.labelKeys[k] = struct{}{}
+		}
+		values := idx.labelValues[k]
+		if values == nil {
+			values = make(map[string]struct{})
+			idx.labelValues[k] = values
+		}
+		if _, ok := values[labels[k]]; !ok {
+			if idx.maxLabelValues > 0 && len(values) >= idx.maxLabelValues {
+				overValues = append(overValues, k)
+				continue
+			}
+			values[labels[k]] = struct{}{}
+		}
+	}
+	return overNames, overValues
+}
+
+// AdmitLabelNames checks a label set against the label name limit before it
+// is ingested. New names are reserved when they fit; otherwise nothing is
+// reserved and the names that would exceed the limit are returned.
+func (idx *Index) AdmitLabelNames(labels map[string]string) []string {
+	idx.mu.RLock()
+	limit := idx.maxLabelNames
+	var newNames []string
+	for k := range labels {
+		if _, ok := idx.labelKeys[k]; !ok {
+			newNames = append(newNames, k)
+		}
+	}
+	idx.mu.RUnlock()
+
+	if len(newNames) == 0 || limit <= 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	// Re-check under the write lock; another ingest may have reserved names
+	pending := newNames[:0]
+	for _, k := range newNames {
+		if _, ok := idx.labelKeys[k]; !ok {
+			pending = append(pending, k)
+		}
+	}
+	if len(idx.labelKeys)+len(pending) > idx.maxLabelNames {
+		sort.Strings(pending)
+		return pending
+	}
+	for _, k := range pending {
+		idx.labelKeys[k] = struct{}{}
+	}
+	return nil
+}
+
 // AddChunk registers a new chunk in the index
 func (idx *Index) AddChunk(chunkID string, labels map[string]string, startTime, endTime time.Time, entryCount int) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
+	idx.addChunk(chunkID, labels, startTime, endTime, entryCount)
+}
+
+// ReplaceChunks swaps the chunks oldIDs for one chunk holding their entries,
+// as compaction writes it, in a single change, so no lookup sees both or
+// neither
+func (idx *Index) ReplaceChunks(oldIDs []string, chunkID string, labels map[string]string, startTime, endTime time.Time, entryCount int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.addChunk(chunkID, labels, startTime, endTime, entryCount)
+	for _, id := range oldIDs {
+		idx.removeChunk(id)
+	}
+}
 
+func (idx *Index) addChunk(chunkID string, labels map[string]string, startTime, endTime time.Time, entryCount int) {
 	// Create label hash
 	l := models.Labels(labels)
 	hash := l.Hash()
 
-	// Add to label index
-	idx.labelIndex[hash] = append(idx.labelIndex[hash], chunkID)
+	// Add to label index; a chunk indexed again only has its metadata
+	// replaced
+	if _, exists := idx.chunkMeta[chunkID]; !exists {
+		idx.labelIndex[hash] = append(idx.labelIndex[hash], chunkID)
+	}
+	idx.dirty[hash] = struct{}{}
+	idx.version++
 
 	// Store chunk metadata
 	idx.chunkMeta[chunkID] = &models.ChunkMeta{
@@ -67,27 +332,80 @@ func (idx *Index) AddChunk(chunkID string, labels map[string]string, startTime,
 
 // FindChunks returns chunk IDs matching the query labels and time range
 func (idx *Index) FindChunks(query map[string]string, startTime, endTime time.Time) []string {
-	idx.mu.RLock()
-	defer idx.mu.RUnlock()
+	return idx.FindChunksFunc(startTime, endTime, func(labels map[string]string) bool {
+		return models.Labels(labels).Match(models.Labels(query))
+	})
+}
+
+// FindChunksFunc returns the IDs of chunks overlapping the time range whose
+// stream labels satisfy match. match must not modify the labels.
+func (idx *Index) FindChunksFunc(startTime, endTime time.Time, match func(labels map[string]string) bool) []string {
+	metas := idx.FindChunkMetas(startTime, endTime, match)
+	ids := make([]string, len(metas))
+	for i, meta := range metas {
+		ids[i] = meta.ID
+	}
+	return ids
+}
 
-	var matchingChunks []string
+// FindChunkMetas returns the metadata of chunks overlapping the time range
+// whose stream labels satisfy match, all from one consistent snapshot of
+// the index. match runs once per stream with chunks in the range, without
+// the index locked, so a slow matcher does not hold up ingestion. The
+// metadata is shared and must not be modified.
+func (idx *Index) FindChunkMetas(startTime, endTime time.Time, match func(labels map[string]string) bool) []*models.ChunkMeta {
+	var matching []*models.ChunkMeta
 	startUnix := startTime.Unix()
 	endUnix := endTime.Unix()
+	for _, stream := range idx.snapshot().streams {
+		n := len(matching)
+		if matching = stream.overlapping(matching, startUnix, endUnix); len(matching) > n && !match(stream.labels) {
+			matching = matching[:n]
+		}
+	}
+	return matching
+}
 
-	// Iterate all chunks and check matches
-	for chunkID, meta := range idx.chunkMeta {
-		// Check time overlap
-		if meta.EndTime < startUnix || meta.StartTime > endUnix {
+// StreamLastWrite is the end time of a stream's newest indexed chunk
+type StreamLastWrite struct {
+	Labels    map[string]string
+	LastWrite time.Time
+}
+
+// LastWrites returns the newest chunk end time of every stream whose labels
+// satisfy match, read from chunk metadata alone. Entries still buffered by
+// the ingestor are not indexed yet, so it lags writes by up to a flush.
+func (idx *Index) LastWrites(match func(labels map[string]string) bool) []StreamLastWrite {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var streams []StreamLastWrite
+	for _, chunkIDs := range idx.labelIndex {
+		var labels map[string]string
+		var newest int64
+		for _, id := range chunkIDs {
+			meta := idx.chunkMeta[id]
+			if meta == nil {
+				continue
+			}
+			if labels == nil {
+				if !match(meta.Labels) {
+					break
+				}
+				labels = meta.Labels
+			}
+			newest = max(newest, meta.EndTime)
+		}
+		if labels == nil {
 			continue
 		}
-
-		// Check label match
-		if models.Labels(meta.Labels).Match(models.Labels(query)) {
-			matchingChunks = append(matchingChunks, chunkID)
+		copied := make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
 		}
+		streams = append(streams, StreamLastWrite{Labels: copied, LastWrite: time.Unix(newest, 0).UTC()})
 	}
-
-	return matchingChunks
+	return streams
 }
 
 // GetChunkMeta returns metadata for a specific chunk
@@ -97,6 +415,18 @@ func (idx *Index) GetChunkMeta(chunkID string) *models.ChunkMeta {
 	return idx.chunkMeta[chunkID]
 }
 
+// LatestChunk returns metadata for the chunk with the most recent end time,
+// or nil if the index is empty
+func (idx *Index) LatestChunk() *models.ChunkMeta {
+	var latest *models.ChunkMeta
+	for _, meta := range idx.snapshot().metas() {
+		if latest == nil || meta.EndTime > latest.EndTime {
+			latest = meta
+		}
+	}
+	return latest
+}
+
 // GetAllLabels returns all unique label keys
 func (idx *Index) GetAllLabels() []string {
 	idx.mu.RLock()
@@ -109,6 +439,18 @@ func (idx *Index) GetAllLabels() []string {
 	return keys
 }
 
+// StreamLabels returns the label set of every indexed stream that satisfies
+// match. The maps are shared with the index and must not be modified.
+func (idx *Index) StreamLabels(match func(labels map[string]string) bool) []map[string]string {
+	var labels []map[string]string
+	for _, stream := range idx.snapshot().streams {
+		if match(stream.labels) {
+			labels = append(labels, stream.labels)
+		}
+	}
+	return labels
+}
+
 // GetLabelValues returns all values for a label key
 func (idx *Index) GetLabelValues(labelKey string) []string {
 	idx.mu.RLock()
@@ -127,7 +469,10 @@ func (idx *Index) GetLabelValues(labelKey string) []string {
 func (idx *Index) RemoveChunk(chunkID string) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
+	idx.removeChunk(chunkID)
+}
 
+func (idx *Index) removeChunk(chunkID string) {
 	meta, exists := idx.chunkMeta[chunkID]
 	if !exists {
 		return
@@ -142,9 +487,11 @@ func (idx *Index) RemoveChunk(chunkID string) {
 			break
 		}
 	}
+	idx.dirty[hash] = struct{}{}
 
 	// Remove chunk metadata
 	delete(idx.chunkMeta, chunkID)
+	idx.version++
 }
 
 // Stats returns index statistics
@@ -153,3 +500,14 @@ func (idx *Index) Stats() (chunkCount int, labelCount int) {
 	defer idx.mu.RUnlock()
 	return len(idx.chunkMeta), len(idx.labelKeys)
 }
+
+// ChunksByLabelValue groups the metadata of every chunk carrying the label
+// by its value. Chunks without the label are grouped under "".
+func (idx *Index) ChunksByLabelValue(name string) map[string][]models.ChunkMeta {
+	groups := make(map[string][]models.ChunkMeta)
+	for _, meta := range idx.snapshot().metas() {
+		v := meta.Labels[name]
+		groups[v] = append(groups[v], *meta)
+	}
+	return groups
+}
@@ -0,0 +1,548 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+func TestAdmitLabelNames_Limit(t *testing.T) {
+	idx := NewIndex()
+	idx.SetMaxLabelNames(3)
+
+	if rejected := idx.AdmitLabelNames(map[string]string{"app": "api", "env": "prod"}); rejected != nil {
+		t.Fatalf("expected labels to be admitted, got rejected %v", rejected)
+	}
+
+	// Known names never count against the limit
+	now := time.Now()
+	idx.AddChunk("c1", map[string]string{"app": "web", "env": "dev"}, now, now, 1)
+	if rejected := idx.AdmitLabelNames(map[string]string{"app": "db", "level": "info"}); rejected != nil {
+		t.Fatalf("expected third name to be admitted, got rejected %v", rejected)
+	}
+
+	rejected := idx.AdmitLabelNames(map[string]string{"app": "db", "pod": "p1", "host": "h1"})
+	if len(rejected) != 2 || rejected[0] != "host" || rejected[1] != "pod" {
+		t.Fatalf("expected [host pod] to be rejected, got %v", rejected)
+	}
+
+	// A rejected admission must not reserve any of its names
+	if _, labelCount := idx.Stats(); labelCount != 3 {
+		t.Errorf("expected 3 tracked label names, got %d", labelCount)
+	}
+}
+
+func TestAdmitLabelNames_Unlimited(t *testing.T) {
+	idx := NewIndex()
+	for i := 0; i < 100; i++ {
+		name := "l" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		if rejected := idx.AdmitLabelNames(map[string]string{name: "v"}); rejected != nil {
+			t.Fatalf("unexpected rejection without a limit: %v", rejected)
+		}
+	}
+}
+
+func TestAdmitLabels_Limits(t *testing.T) {
+	idx := NewIndex()
+	idx.SetMaxLabelNames(3)
+	idx.SetMaxLabelValues(2)
+
+	for _, pod := range []string{"p1", "p2"} {
+		if names, values := idx.AdmitLabels(map[string]string{"app": "api", "pod": pod}); names != nil || values != nil {
+			t.Fatalf("expected labels to be admitted, got %v and %v", names, values)
+		}
+	}
+
+	// Labels are admitted one by one: env still fits, the third pod and the
+	// fourth name do not
+	names, values := idx.AdmitLabels(map[string]string{"app": "api", "pod": "p3", "env": "prod", "host": "h1"})
+	if len(names) != 1 || names[0] != "host" {
+		t.Errorf("expected [host] past the name limit, got %v", names)
+	}
+	if len(values) != 1 || values[0] != "pod" {
+		t.Errorf("expected [pod] past the value limit, got %v", values)
+	}
+	if got := idx.GetLabelValues("env"); len(got) != 1 || got[0] != "prod" {
+		t.Errorf("expected env=prod reserved, got %v", got)
+	}
+
+	// Known values stay admitted at the limit
+	if names, values := idx.AdmitLabels(map[string]string{"pod": "p1", "env": "prod"}); names != nil || values != nil {
+		t.Errorf("expected known labels to be admitted, got %v and %v", names, values)
+	}
+	if _, labelCount := idx.Stats(); labelCount != 3 {
+		t.Errorf("expected 3 tracked label names, got %d", labelCount)
+	}
+}
+
+func TestRecover_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	writer := storage.NewWriter(filepath.Join(dir, "logs"), 1024*1024)
+	reader := storage.NewReader(filepath.Join(dir, "logs"))
+	snapshot := filepath.Join(dir, "index.db")
+	base := time.Now().Add(-time.Hour)
+
+	write := func(labels map[string]string) string {
+		id, _, _, err := writer.WriteChunk(labels, []models.LogEntry{{ID: "1", Timestamp: base, Line: "x", Labels: labels}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	api := map[string]string{"app": "api"}
+	web := map[string]string{"app": "web"}
+	write(api)
+	webChunk := write(web)
+
+	// No snapshot yet: every stream is scanned
+	idx := NewIndex()
+	stats, err := idx.Recover(snapshot, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FromSnapshot || stats.Rescanned != 2 || stats.Chunks != 2 {
+		t.Fatalf("expected a full scan of 2 streams and 2 chunks, got %+v", stats)
+	}
+	if err := idx.PersistIndex(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age both stream directories past the snapshot, then change only api
+	old := time.Now().Add(-time.Hour)
+	for _, labels := range []map[string]string{api, web} {
+		os.Chtimes(filepath.Join(dir, "logs", models.Labels(labels).ToPath()), old, old)
+	}
+	newChunk := write(api)
+
+	idx = NewIndex()
+	stats, err = idx.Recover(snapshot, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.FromSnapshot || stats.Rescanned != 1 || stats.Chunks != 3 {
+		t.Fatalf("expected the snapshot plus a rescan of api only, got %+v", stats)
+	}
+	if idx.GetChunkMeta(newChunk) == nil {
+		t.Error("expected the chunk written after the snapshot to be indexed")
+	}
+
+	// A stream deleted since the snapshot is dropped
+	writer.DeleteChunk(web, webChunk)
+	idx = NewIndex()
+	if stats, err = idx.Recover(snapshot, reader); err != nil {
+		t.Fatal(err)
+	}
+	if idx.GetChunkMeta(webChunk) != nil || stats.Chunks != 2 {
+		t.Errorf("expected the deleted stream's chunk to be dropped, got %+v", stats)
+	}
+
+	// An unreadable snapshot falls back to a full scan
+	os.WriteFile(snapshot, []byte("garbage"), 0644)
+	idx = NewIndex()
+	if stats, err = idx.Recover(snapshot, reader); err != nil {
+		t.Fatal(err)
+	}
+	if stats.FromSnapshot || stats.Chunks != 2 {
+		t.Errorf("expected a full scan after a corrupt snapshot, got %+v", stats)
+	}
+}
+
+func TestRefresh_FollowsWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer := storage.NewWriter(dir, 1024*1024)
+	reader := storage.NewReader(dir)
+	base := time.Now().Add(-time.Hour)
+
+	write := func(labels map[string]string) string {
+		id, _, _, err := writer.WriteChunk(labels, []models.LogEntry{{ID: "1", Timestamp: base, Line: "x", Labels: labels}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	api := map[string]string{"app": "api"}
+	web := map[string]string{"app": "web"}
+	write(api)
+	webChunk := write(web)
+
+	replica := NewIndex()
+	if _, err := replica.Recover("", reader); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age web past the last refresh; api gets a new chunk
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, models.Labels(web).ToPath()), old, old)
+	last := time.Now()
+	newChunk := write(api)
+
+	stats, err := replica.Refresh(reader, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rescanned != 1 || stats.Chunks != 3 || replica.GetChunkMeta(newChunk) == nil {
+		t.Fatalf("expected only api to be reread and its new chunk indexed, got %+v", stats)
+	}
+
+	// Chunks the writer deletes are dropped
+	writer.DeleteChunk(web, webChunk)
+	if stats, err = replica.Refresh(reader, last); err != nil {
+		t.Fatal(err)
+	}
+	if replica.GetChunkMeta(webChunk) != nil || stats.Chunks != 2 {
+		t.Errorf("expected the deleted chunk to be dropped, got %+v", stats)
+	}
+}
+
+func TestFindChunkMetas_Snapshot(t *testing.T) {
+	idx := NewIndex()
+	base := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	idx.AddChunk("a", map[string]string{"app": "api"}, base, base, 1)
+	all := func(map[string]string) bool { return true }
+
+	// Lookups run without the lock, so ingestion can proceed from a matcher
+	var found []*models.ChunkMeta
+	found = idx.FindChunkMetas(base, base, func(labels map[string]string) bool {
+		idx.AddChunk("b", map[string]string{"app": "web"}, base, base, 1)
+		return true
+	})
+	if len(found) != 1 || found[0].ID != "a" {
+		t.Fatalf("expected the lookup to see only the chunks indexed when it began, got %d", len(found))
+	}
+	if n := len(idx.FindChunkMetas(base, base, all)); n != 2 {
+		t.Errorf("expected the next lookup to see the added chunk, got %d", n)
+	}
+
+	idx.RemoveChunk("a")
+	if ids := idx.FindChunks(map[string]string{}, base, base); len(ids) != 1 || ids[0] != "b" {
+		t.Errorf("expected the removed chunk to be gone, got %v", ids)
+	}
+	if latest := idx.LatestChunk(); latest == nil || latest.ID != "b" {
+		t.Errorf("expected b as the latest chunk, got %+v", latest)
+	}
+}
+
+// findChunksLocked is the lookup as it was before snapshots, matching with
+// the read lock held, for comparison in BenchmarkFindChunks_MixedLoad
+func findChunksLocked(idx *Index, startTime, endTime time.Time, match func(map[string]string) bool) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	n := 0
+	for _, meta := range idx.chunkMeta {
+		if meta.EndTime < startTime.Unix() || meta.StartTime > endTime.Unix() {
+			continue
+		}
+		if match(meta.Labels) {
+			n++
+		}
+	}
+	return n
+}
+
+// BenchmarkFindChunks_MixedLoad measures query lookups running in parallel
+// while chunks are added at a steady rate, with and without snapshots
+func BenchmarkFindChunks_MixedLoad(b *testing.B) {
+	base := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	match := func(labels map[string]string) bool {
+		return strings.HasPrefix(labels["pod"], "api-1")
+	}
+	lookups := map[string]func(idx *Index) int{
+		"snapshot": func(idx *Index) int { return len(idx.FindChunkMetas(base, base.Add(time.Hour), match)) },
+		"locked":   func(idx *Index) int { return findChunksLocked(idx, base, base.Add(time.Hour), match) },
+	}
+	for _, name := range []string{"locked", "snapshot"} {
+		lookup := lookups[name]
+		b.Run(name, func(b *testing.B) {
+			idx := NewIndex()
+			for i := 0; i < 20000; i++ {
+				labels := map[string]string{"app": "api", "pod": fmt.Sprintf("api-%d", i%500)}
+				idx.AddChunk(fmt.Sprintf("chunk_%d", i), labels, base, base.Add(time.Minute), 100)
+			}
+
+			// Ingestion adds a chunk every 100µs, keeping the index the same
+			// size for both lookups
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				ticker := time.NewTicker(100 * time.Microsecond)
+				defer ticker.Stop()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C:
+					}
+					labels := map[string]string{"app": "api", "pod": fmt.Sprintf("api-%d", i%500)}
+					idx.AddChunk(fmt.Sprintf("new_%d", i), labels, base, base.Add(time.Minute), 100)
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					lookup(idx)
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// BenchmarkFindChunkMetas_AfterWrite times a chunk added and then looked
+// up, the snapshot rebuilt in between, while other goroutines query
+// throughout: the latency ingestion and queries see from each other. Only
+// the stream written is rebuilt, so it should not grow with the index.
+func BenchmarkFindChunkMetas_AfterWrite(b *testing.B) {
+	base := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	match := func(labels map[string]string) bool {
+		return labels["pod"] == "api-1"
+	}
+	for _, chunks := range []int{10000, 100000} {
+		b.Run(fmt.Sprintf("chunks=%d", chunks), func(b *testing.B) {
+			// A chunk a second across 1000 streams
+			idx := NewIndex()
+			add := func(id string, i int) {
+				labels := map[string]string{"app": "api", "pod": fmt.Sprintf("api-%d", i%1000)}
+				start := base.Add(time.Duration(i) * time.Second)
+				idx.AddChunk(id, labels, start, start.Add(time.Second), 100)
+			}
+			for i := 0; i < chunks; i++ {
+				add(fmt.Sprintf("chunk_%d", i), i)
+			}
+			// The last hour, and the chunks added during the run
+			start := base.Add(time.Duration(chunks)*time.Second - time.Hour)
+			end := start.Add(365 * 24 * time.Hour)
+
+			stop := make(chan struct{})
+			var readers sync.WaitGroup
+			for r := 0; r < 4; r++ {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						idx.FindChunkMetas(start, end, match)
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				add(fmt.Sprintf("new_%d", i), chunks+i)
+				idx.FindChunkMetas(start, end, match)
+			}
+			b.StopTimer()
+			close(stop)
+			readers.Wait()
+		})
+	}
+}
+
+func TestFindChunkMetas_TimeRange(t *testing.T) {
+	idx := NewIndex()
+	base := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	api := map[string]string{"app": "api"}
+	// Added out of order; "long" spans the others, so a chunk that starts
+	// early can still overlap a later range
+	idx.AddChunk("c3", api, base.Add(20*time.Minute), base.Add(30*time.Minute), 1)
+	idx.AddChunk("c1", api, base, base.Add(10*time.Minute), 1)
+	idx.AddChunk("long", api, base.Add(-time.Hour), base.Add(time.Hour), 1)
+	idx.AddChunk("c2", api, base.Add(10*time.Minute), base.Add(20*time.Minute), 1)
+	idx.AddChunk("web", map[string]string{"app": "web"}, base, base.Add(time.Hour), 1)
+
+	calls := 0
+	isAPI := func(labels map[string]string) bool {
+		calls++
+		return labels["app"] == "api"
+	}
+	ids := func(metas []*models.ChunkMeta) string {
+		var out []string
+		for _, m := range metas {
+			out = append(out, m.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if got := ids(idx.FindChunkMetas(base.Add(15*time.Minute), base.Add(25*time.Minute), isAPI)); got != "long,c2,c3" {
+		t.Errorf("expected long,c2,c3 in start order, got %s", got)
+	}
+	if calls > 2 {
+		t.Errorf("expected the matcher to run once per stream, ran %d times", calls)
+	}
+	if got := ids(idx.FindChunkMetas(base.Add(2*time.Hour), base.Add(3*time.Hour), isAPI)); got != "" {
+		t.Errorf("expected nothing past the chunks, got %s", got)
+	}
+
+	idx.RemoveChunk("long")
+	if got := ids(idx.FindChunkMetas(base.Add(15*time.Minute), base.Add(25*time.Minute), isAPI)); got != "c2,c3" {
+		t.Errorf("expected the removed chunk to be gone, got %s", got)
+	}
+}
+
+// findChunkMetasScan is the lookup as it was before streams were kept in
+// time order, checking every chunk, for BenchmarkFindChunkMetas_TimeRange
+func findChunkMetasScan(idx *Index, startTime, endTime time.Time, match func(map[string]string) bool) int {
+	n := 0
+	for _, meta := range idx.snapshot().metas() {
+		if meta.EndTime < startTime.Unix() || meta.StartTime > endTime.Unix() {
+			continue
+		}
+		if match(meta.Labels) {
+			n++
+		}
+	}
+	return n
+}
+
+// BenchmarkFindChunkMetas_TimeRange looks up the last hour of a stream
+// selector in a month of chunks, with and without the time-ordered streams
+func BenchmarkFindChunkMetas_TimeRange(b *testing.B) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	idx := NewIndex()
+	// 50 streams, each with a chunk every 30 minutes for 30 days: 72000
+	const streams, perStream = 50, 30 * 48
+	for s := 0; s < streams; s++ {
+		labels := map[string]string{"app": "api", "pod": fmt.Sprintf("api-%d", s)}
+		for c := 0; c < perStream; c++ {
+			start := base.Add(time.Duration(c) * 30 * time.Minute)
+			idx.AddChunk(fmt.Sprintf("chunk_%d_%d", s, c), labels, start, start.Add(30*time.Minute), 100)
+		}
+	}
+	end := base.Add(perStream * 30 * time.Minute)
+	start := end.Add(-time.Hour)
+	match := func(labels map[string]string) bool {
+		return strings.HasPrefix(labels["pod"], "api-1")
+	}
+	if got, want := len(idx.FindChunkMetas(start, end, match)), findChunkMetasScan(idx, start, end, match); got != want {
+		b.Fatalf("lookups disagree: %d and %d chunks", got, want)
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			findChunkMetasScan(idx, start, end, match)
+		}
+	})
+	b.Run("sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			idx.FindChunkMetas(start, end, match)
+		}
+	})
+}
+
+// fakeMetas is a MetaSource serving metadata from memory
+type fakeMetas map[string][]models.ChunkMeta
+
+func (f fakeMetas) StreamDirs() (map[string]time.Time, error) {
+	dirs := make(map[string]time.Time, len(f))
+	for dir := range f {
+		dirs[dir] = time.Now()
+	}
+	return dirs, nil
+}
+
+func (f fakeMetas) ReadStreamMetas(dir string) ([]models.ChunkMeta, error) {
+	return f[dir], nil
+}
+
+func TestSync_SkipsReplacedChunks(t *testing.T) {
+	api := map[string]string{"app": "api"}
+	dir := models.Labels(api).ToPath()
+	base := time.Now().Add(-time.Hour).Unix()
+	chunk := func(id string, replaces ...string) models.ChunkMeta {
+		return models.ChunkMeta{ID: id, Labels: api, StartTime: base, EndTime: base, EntryCount: 1, Replaces: replaces}
+	}
+	src := fakeMetas{dir: {chunk("c1"), chunk("c2")}}
+
+	replica := NewIndex()
+	if _, err := replica.Recover("", src); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction stopped after writing the merged chunk, before deleting
+	// the chunks it replaces
+	src[dir] = append(src[dir], chunk("merged", "c1", "c2"))
+	stats, err := replica.Refresh(src, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks != 1 || replica.GetChunkMeta("merged") == nil {
+		t.Errorf("expected only the merged chunk indexed on refresh, got %+v", stats)
+	}
+
+	idx := NewIndex()
+	if stats, err = idx.Recover("", src); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks != 1 || idx.GetChunkMeta("c1") != nil || idx.GetChunkMeta("c2") != nil {
+		t.Errorf("expected only the merged chunk indexed on recovery, got %+v", stats)
+	}
+}
+
+// BenchmarkChunkLookup compares finding the chunks of one stream that
+// overlap an hour through the index with walking the chunk metadata on
+// disk, as queries did before the index kept chunks by stream and time
+func BenchmarkChunkLookup(b *testing.B) {
+	dir := b.TempDir()
+	writer := storage.NewWriter(dir, 1024*1024)
+	reader := storage.NewReader(dir)
+	base := time.Now().Add(-100 * time.Hour).Truncate(time.Hour)
+	for s := 0; s < 100; s++ {
+		labels := map[string]string{"app": fmt.Sprintf("app-%d", s)}
+		for c := 0; c < 100; c++ {
+			ts := base.Add(time.Duration(c) * time.Hour)
+			if _, _, _, err := writer.WriteChunk(labels, []models.LogEntry{{ID: "1", Timestamp: ts, Line: "x", Labels: labels}}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	idx := NewIndex()
+	if _, err := idx.Recover("", reader); err != nil {
+		b.Fatal(err)
+	}
+
+	want := map[string]string{"app": "app-42"}
+	start, end := base.Add(50*time.Hour), base.Add(51*time.Hour)
+	match := func(labels map[string]string) bool { return models.Labels(labels).Match(want) }
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if metas := idx.FindChunkMetas(start, end, match); len(metas) != 2 {
+				b.Fatalf("expected 2 chunks, got %d", len(metas))
+			}
+		}
+	})
+	b.Run("walk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dirs, err := reader.StreamDirs()
+			if err != nil {
+				b.Fatal(err)
+			}
+			var found int
+			for dir := range dirs {
+				metas, _ := reader.ReadStreamMetas(dir)
+				for _, meta := range metas {
+					if match(meta.Labels) && meta.EndTime >= start.Unix() && meta.StartTime <= end.Unix() {
+						found++
+					}
+				}
+			}
+			if found != 2 {
+				b.Fatalf("expected 2 chunks, got %d", found)
+			}
+		}
+	})
+}
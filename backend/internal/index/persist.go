@@ -2,104 +2,118 @@ package index
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/boltdb/bolt"
 	"github.com/logpulse/backend/internal/models"
 )
 
-// NOTE: BoltDB persistence will be added later
-// For now, the index is purely in-memory
+var (
+	chunksBucket = []byte("chunks")
+	infoBucket   = []byte("info")
+	takenKey     = []byte("taken")
+)
 
-// PersistIndex saves the index to BoltDB
+// PersistIndex writes a snapshot of the index to a BoltDB file at dbPath.
+// The file is written beside dbPath and renamed over it, so a crash never
+// leaves a partial snapshot behind. The snapshot records when it was taken.
 func (idx *Index) PersistIndex(dbPath string) error {
-		// Implement BoltDB persistence
-		db, err := bolt.Open(dbPath, 0600, nil)
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := dbPath + ".tmp"
+	os.Remove(tmpPath)
+	db, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	// Write from a snapshot so ingestion is not held up for the duration
+	snap := idx.snapshot()
+	taken := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		chunks, err := tx.CreateBucket(chunksBucket)
 		if err != nil {
 			return err
 		}
-		defer db.Close()
-
-		err = db.Update(func(tx *bolt.Tx) error {
-			chunks, err := tx.CreateBucketIfNotExists([]byte("chunks"))
+		for _, meta := range snap.metas() {
+			buf, err := json.Marshal(meta)
 			if err != nil {
 				return err
 			}
-			labels, err := tx.CreateBucketIfNotExists([]byte("labels"))
-			if err != nil {
+			if err := chunks.Put([]byte(meta.ID), buf); err != nil {
 				return err
 			}
-			// Store chunk metadata
-			for id, meta := range idx.chunkMeta {
-				buf, err := json.Marshal(meta)
-				if err != nil {
-					return err
-				}
-				if err := chunks.Put([]byte(id), buf); err != nil {
-					return err
-				}
-			}
-			// Store label key-value mappings
-			for key, values := range idx.labelValues {
-				vlist := make([]string, 0, len(values))
-				for v := range values {
-					vlist = append(vlist, v)
-				}
-				buf, err := json.Marshal(vlist)
-				if err != nil {
-					return err
-				}
-				if err := labels.Put([]byte(key), buf); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
+		}
+
+		info, err := tx.CreateBucket(infoBucket)
+		if err != nil {
+			return err
+		}
+		return info.Put(takenKey, []byte(taken.Format(time.RFC3339Nano)))
+	})
+
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
 		return err
+	}
+	return os.Rename(tmpPath, dbPath)
 }
 
-// LoadIndex loads the index from BoltDB
+// LoadIndex loads an index from a snapshot written by PersistIndex
 func LoadIndex(dbPath string) (*Index, error) {
-		// Implement BoltDB loading
-		db, err := bolt.Open(dbPath, 0600, nil)
-		if err != nil {
-			return nil, err
-		}
-		defer db.Close()
+	idx := NewIndex()
+	if _, err := idx.Restore(dbPath); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
 
-		idx := NewIndex()
-		err = db.View(func(tx *bolt.Tx) error {
-			chunks := tx.Bucket([]byte("chunks"))
-			if chunks != nil {
-				err := chunks.ForEach(func(k, v []byte) error {
-					var meta models.ChunkMeta
-					if err := json.Unmarshal(v, &meta); err != nil {
-						return err
-					}
-					idx.chunkMeta[string(k)] = &meta
-					return nil
-				})
-				if err != nil {
-					return err
-				}
-			}
-			labels := tx.Bucket([]byte("labels"))
-			if labels != nil {
-				err := labels.ForEach(func(k, v []byte) error {
-					var vlist []string
-					if err := json.Unmarshal(v, &vlist); err != nil {
-						return err
-					}
-					m := make(map[string]struct{})
-					for _, val := range vlist {
-						m[val] = struct{}{}
-					}
-					idx.labelValues[string(k)] = m
-					return nil
-				})
-				if err != nil {
-					return err
-				}
+// Restore adds the chunks of a snapshot written by PersistIndex to idx and
+// returns the time the snapshot was taken
+func (idx *Index) Restore(dbPath string) (time.Time, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return time.Time{}, err
+	}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	var taken time.Time
+	var metas []models.ChunkMeta
+	err = db.View(func(tx *bolt.Tx) error {
+		info := tx.Bucket(infoBucket)
+		chunks := tx.Bucket(chunksBucket)
+		if info == nil || chunks == nil {
+			return fmt.Errorf("not an index snapshot")
+		}
+		var err error
+		if taken, err = time.Parse(time.RFC3339Nano, string(info.Get(takenKey))); err != nil {
+			return fmt.Errorf("snapshot time: %w", err)
+		}
+		return chunks.ForEach(func(k, v []byte) error {
+			var meta models.ChunkMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return fmt.Errorf("chunk %s: %w", k, err)
 			}
+			metas = append(metas, meta)
 			return nil
 		})
-		return idx, err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, meta := range metas {
+		idx.AddChunk(meta.ID, meta.Labels, time.Unix(meta.StartTime, 0), time.Unix(meta.EndTime, 0), meta.EntryCount)
+	}
+	return taken, nil
 }
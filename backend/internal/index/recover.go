@@ -0,0 +1,142 @@
+package index
+
+import (
+	"log"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// snapshotSlack widens the window of stream directories rescanned after a
+// snapshot, covering chunks written just before it was taken but indexed
+// just after
+const snapshotSlack = time.Minute
+
+// MetaSource lists the chunk metadata on disk, as storage.Reader does
+type MetaSource interface {
+	// StreamDirs returns every stream directory with its modification time
+	StreamDirs() (map[string]time.Time, error)
+	// ReadStreamMetas returns the metadata of the chunks in a directory
+	ReadStreamMetas(dir string) ([]models.ChunkMeta, error)
+}
+
+// RecoverStats describes how Recover rebuilt, or Refresh updated, the index
+type RecoverStats struct {
+	FromSnapshot bool
+	Rescanned    int // stream directories whose .meta files were read
+	Streams      int
+	Chunks       int
+	Duration     time.Duration
+}
+
+// Recover rebuilds the index from the chunk metadata on disk. With a snapshot
+// at snapshotPath it loads the snapshot and reads only the stream
+// directories created or changed since (a directory's modification time
+// moves when chunks are written into or deleted from it), dropping indexed
+// chunks that are gone. Without a usable snapshot every directory is read.
+func (idx *Index) Recover(snapshotPath string, src MetaSource) (RecoverStats, error) {
+	start := time.Now()
+	var stats RecoverStats
+
+	var since time.Time
+	if snapshotPath != "" {
+		taken, err := idx.Restore(snapshotPath)
+		if err == nil {
+			stats.FromSnapshot = true
+			since = taken.Add(-snapshotSlack)
+		} else {
+			log.Printf("[Index] Snapshot %s unusable, scanning all chunk metadata: %v", snapshotPath, err)
+		}
+	}
+
+	err := idx.sync(src, since, &stats)
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// Refresh brings the index up to date with chunks written or deleted by
+// another process sharing the storage, as a read-only replica does. Only
+// stream directories modified since (less snapshotSlack, which covers
+// directory times coarser than the refresh interval) are read; a zero since
+// reads them all.
+func (idx *Index) Refresh(src MetaSource, since time.Time) (RecoverStats, error) {
+	start := time.Now()
+	var stats RecoverStats
+	if !since.IsZero() {
+		since = since.Add(-snapshotSlack)
+	}
+	err := idx.sync(src, since, &stats)
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// sync reconciles the index with the chunk metadata on disk, reading the
+// stream directories modified since, or all of them when since is zero
+func (idx *Index) sync(src MetaSource, since time.Time, stats *RecoverStats) error {
+	dirs, err := src.StreamDirs()
+	if err != nil {
+		return err
+	}
+	stats.Streams = len(dirs)
+
+	// Group the indexed chunks by stream directory
+	indexed := make(map[string]map[string]bool)
+	for _, meta := range idx.snapshot().metas() {
+		dir := models.Labels(meta.Labels).ToPath()
+		if indexed[dir] == nil {
+			indexed[dir] = make(map[string]bool)
+		}
+		indexed[dir][meta.ID] = true
+	}
+
+	// Drop chunks of streams whose directory no longer exists
+	for dir, ids := range indexed {
+		if _, ok := dirs[dir]; !ok {
+			for id := range ids {
+				idx.RemoveChunk(id)
+			}
+		}
+	}
+
+	for dir, modified := range dirs {
+		if !since.IsZero() && modified.Before(since) {
+			continue
+		}
+		metas, err := src.ReadStreamMetas(dir)
+		if err != nil {
+			log.Printf("[Index] WARN: failed to read chunk metadata in %s: %v", dir, err)
+			continue
+		}
+		stats.Rescanned++
+
+		// Compaction writes a merged chunk before deleting the chunks it
+		// replaces, so a crash or a replica's read in between finds both;
+		// only the merged chunk is indexed, or its lines would be read twice
+		replaced := make(map[string]bool)
+		for _, meta := range metas {
+			for _, id := range meta.Replaces {
+				replaced[id] = true
+			}
+		}
+
+		onDisk := make(map[string]bool, len(metas))
+		for _, meta := range metas {
+			if replaced[meta.ID] {
+				continue
+			}
+			onDisk[meta.ID] = true
+			if !indexed[dir][meta.ID] {
+				start, end := meta.Bounds()
+				idx.ReplaceChunks(meta.Replaces, meta.ID, meta.Labels, start, end, meta.EntryCount)
+			}
+		}
+		for id := range indexed[dir] {
+			if !onDisk[id] {
+				idx.RemoveChunk(id)
+			}
+		}
+	}
+
+	stats.Chunks, _ = idx.Stats()
+	return nil
+}
@@ -0,0 +1,43 @@
+package ingest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/logpulse/backend/internal/query"
+)
+
+// StripANSI removes ANSI escape sequences from a log line. It shares its
+// definition of an escape with the decolorize query stage.
+func StripANSI(line string) string {
+	return query.StripANSI(line)
+}
+
+// SetStripANSI enables stripping ANSI escape sequences from lines of streams
+// matching any of the given selectors (e.g. `{app="cli"}`). An empty
+// selector or `{}` matches every stream; nil disables stripping.
+func (ing *Ingestor) SetStripANSI(selectors []string) error {
+	parsed := make([]*query.ParsedQuery, 0, len(selectors))
+	for _, sel := range selectors {
+		if strings.TrimSpace(sel) == "{}" {
+			sel = ""
+		}
+		p, err := query.ParseAdvancedQuery(sel)
+		if err != nil {
+			return fmt.Errorf("invalid strip_ansi selector %q: %w", sel, err)
+		}
+		parsed = append(parsed, p)
+	}
+	ing.stripANSI = parsed
+	return nil
+}
+
+// shouldStripANSI reports whether a stream's lines are cleaned of escapes
+func (ing *Ingestor) shouldStripANSI(labels map[string]string) bool {
+	for _, p := range ing.stripANSI {
+		if p.MatchLabels(labels) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package ingest
+
+import "testing"
+
+func TestStripANSI(t *testing.T) {
+	cases := map[string]string{
+		"plain line":                                   "plain line",
+		"\x1b[31mERROR\x1b[0m disk full":               "ERROR disk full",
+		"\x1b[1;32m✓\x1b[39;49m done":                  "✓ done",
+		"\x1b]0;title\x07prompt":                       "prompt",
+		"\x1b[2K\x1b[1Gprogress 50%":                   "progress 50%",
+		"\x1b]8;;https://x.io\x1b\\link\x1b]8;;\x1b\\": "link",
+	}
+	for in, want := range cases {
+		if got := StripANSI(in); got != want {
+			t.Errorf("StripANSI(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSetStripANSI_Selectors(t *testing.T) {
+	ing := &Ingestor{}
+	if err := ing.SetStripANSI([]string{`{app="cli"}`}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ing.shouldStripANSI(map[string]string{"app": "cli"}) {
+		t.Error("expected matching stream to be stripped")
+	}
+	if ing.shouldStripANSI(map[string]string{"app": "api"}) {
+		t.Error("expected other streams to be left alone")
+	}
+
+	if err := ing.SetStripANSI([]string{"{}"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ing.shouldStripANSI(map[string]string{"app": "api"}) {
+		t.Error("expected {} to match every stream")
+	}
+}
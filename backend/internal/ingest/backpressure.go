@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrBackpressure is returned by Ingest, with nothing accepted, while the
+// entries buffered across all streams are at the high-water mark. Clients
+// should retry after RetryAfter.
+var ErrBackpressure = errors.New("ingest buffers are full, retry later")
+
+var (
+	bufferMetricsOnce sync.Once
+	bufferedEntries   prometheus.Gauge
+)
+
+func registerBufferMetrics() {
+	bufferMetricsOnce.Do(func() {
+		bufferedEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "logpulse_ingest_buffered_entries",
+			Help: "Log entries held in ingest buffers, not yet written to chunks.",
+		})
+		prometheus.MustRegister(bufferedEntries)
+	})
+}
+
+// SetBufferHighWater refuses ingest requests with ErrBackpressure while n
+// or more entries are buffered across all streams, so clients back off
+// until flushes catch up (0 = never refuse). A request admitted below the
+// mark is accepted whole, so the buffers may end up somewhat above it.
+func (ing *Ingestor) SetBufferHighWater(n int) error {
+	if n < 0 {
+		return fmt.Errorf("buffer high-water mark must not be negative, got %d", n)
+	}
+	ing.highWater = int64(n)
+	return nil
+}
+
+// BufferedEntries returns the entries buffered across all streams
+func (ing *Ingestor) BufferedEntries() int64 {
+	return atomic.LoadInt64(&ing.buffered)
+}
+
+// BufferedBytes returns the line bytes buffered across all streams
+func (ing *Ingestor) BufferedBytes() int64 {
+	ing.bufferMu.Lock()
+	defer ing.bufferMu.Unlock()
+	var n int64
+	for _, buf := range ing.buffers {
+		n += int64(buf.size)
+	}
+	return n
+}
+
+// RetryAfter is how long a client refused with ErrBackpressure should wait:
+// one flush interval, which drains the buffers, and at least a second
+func (ing *Ingestor) RetryAfter() time.Duration {
+	return max(ing.flushInterval, time.Second)
+}
+
+// overHighWater reports whether new requests are refused
+func (ing *Ingestor) overHighWater() bool {
+	return ing.highWater > 0 && atomic.LoadInt64(&ing.buffered) >= ing.highWater
+}
+
+// addBuffered counts n entries added to (or, negative, flushed from) buffers
+func (ing *Ingestor) addBuffered(n int) {
+	atomic.AddInt64(&ing.buffered, int64(n))
+	bufferedEntries.Add(float64(n))
+}
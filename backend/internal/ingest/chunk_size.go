@@ -0,0 +1,63 @@
+package ingest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
+)
+
+// ChunkSizeOverride sets the rotation size for streams matching Selector
+type ChunkSizeOverride struct {
+	Selector string
+	Bytes    int
+}
+
+type chunkSizeOverride struct {
+	selector *query.ParsedQuery
+	bytes    int
+}
+
+// SetChunkSizeOverrides configures per-selector chunk sizes, so busy streams
+// can use large chunks and quiet ones small chunks. Overrides are checked in
+// order and the first match wins; unmatched streams use the global size from
+// SetChunkRotation. Must be called before Ingest.
+func (ing *Ingestor) SetChunkSizeOverrides(overrides []ChunkSizeOverride) error {
+	parsed := make([]chunkSizeOverride, 0, len(overrides))
+	for _, o := range overrides {
+		if o.Bytes <= 0 {
+			return fmt.Errorf("chunk size override %q must be positive, got %d", o.Selector, o.Bytes)
+		}
+		sel := o.Selector
+		if strings.TrimSpace(sel) == "{}" {
+			sel = ""
+		}
+		p, err := query.ParseAdvancedQuery(sel)
+		if err != nil {
+			return fmt.Errorf("invalid chunk size override selector %q: %w", o.Selector, err)
+		}
+		parsed = append(parsed, chunkSizeOverride{selector: p, bytes: o.Bytes})
+	}
+	ing.chunkSizeOverrides = parsed
+	return nil
+}
+
+// chunkSizeFor returns the rotation size for a stream
+func (ing *Ingestor) chunkSizeFor(labels map[string]string) int {
+	for _, o := range ing.chunkSizeOverrides {
+		if o.selector.MatchLabels(labels) {
+			return o.bytes
+		}
+	}
+	return ing.maxChunkBytes
+}
+
+// newBuffer creates an empty buffer for a stream
+func (ing *Ingestor) newBuffer(labels map[string]string) *logBuffer {
+	return &logBuffer{
+		labels:   labels,
+		entries:  make([]models.LogEntry, 0, ing.bufSize),
+		maxBytes: ing.chunkSizeFor(labels),
+	}
+}
@@ -1,6 +1,7 @@
 package ingest
 
 import (
+	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
@@ -8,7 +9,9 @@ import (
 
 	"github.com/logpulse/backend/internal/index"
 	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
 	"github.com/logpulse/backend/internal/storage"
+	"github.com/logpulse/backend/internal/wal"
 )
 
 // StreamBroadcaster interface for live log streaming
@@ -23,10 +26,24 @@ type Ingestor struct {
 	broadcaster StreamBroadcaster
 	bufSize     int
 
+	// Chunk rotation: buffers are also finalized once they hold
+	// maxChunkBytes of lines or their first entry is maxChunkAge old
+	flushInterval time.Duration
+	maxChunkBytes int
+	maxChunkAge   time.Duration
+
+	// Per-selector chunk size limits, first match wins over maxChunkBytes
+	chunkSizeOverrides []chunkSizeOverride
+
 	// Buffer per label set
 	buffers  map[string]*logBuffer
 	bufferMu sync.Mutex
 
+	// buffered counts the entries in all buffers; at highWater and above
+	// requests are refused (0 = never)
+	buffered  int64
+	highWater int64
+
 	// Broadcast queue with bounded goroutines
 	broadcastQueue  chan models.LogEntry
 	numBroadcasters int
@@ -36,12 +53,62 @@ type Ingestor struct {
 	ingestedBytes     int64
 	broadcastedLines  int64
 	droppedBroadcasts int64
+	labelLimitRejects int64
+	droppedLabels     int64
+	assignedTs        int64
+	rejectedTs        int64
+	truncatedLines    int64
+	rejectedLines     int64
+	schemaViolations  int64
+	lateEntries       int64
+	rejectedLate      int64
+	detectedLevels    int64
+	jsonLabelSkips    int64
 	metricsMu         sync.RWMutex
 
+	// Lines longer than maxLineBytes are truncated, or dropped when
+	// rejectLongLines is set (0 = no limit)
+	maxLineBytes    int
+	rejectLongLines bool
+
+	// Entries without a valid timestamp are dropped instead of being
+	// stamped with the time they arrived
+	rejectMissingTs bool
+
+	// Entries timestamped more than lateWindow before they arrive go to a
+	// separate late chunk, or are dropped when rejectLate is set
+	lateWindow time.Duration
+	rejectLate bool
+
 	// Flush progress tracking
 	flushProgress     *FlushProgress
 	flushProgressLock sync.RWMutex
 
+	// Selectors of streams whose lines have ANSI escapes removed
+	stripANSI []*query.ParsedQuery
+
+	// Label schemas checked for every stream; violating streams are
+	// dropped unless warnLabelSchema is set
+	labelSchemas    []labelSchema
+	warnLabelSchema bool
+
+	// Rules inferring a level label from the line, per stream selector
+	levelDetections []levelDetection
+
+	// Label names already warned about being dropped by a cardinality limit
+	labelWarned map[string]struct{}
+	labelWarnMu sync.Mutex
+
+	// Rules promoting JSON fields of the line to labels, per stream selector
+	jsonLabels []*jsonLabels
+
+	// Write-ahead log of accepted entries, which walSeq numbers. walPinned
+	// is the oldest segment holding entries whose flush failed, kept for
+	// the next replay. All three are guarded by bufferMu.
+	wal       *wal.WAL
+	walSeq    uint64
+	walPinned uint64
+
 	// Kubernetes context
 	k8sLabels      map[string]string
 	k8sAnnotations map[string]string
@@ -60,18 +127,31 @@ type FlushProgress struct {
 }
 
 type logBuffer struct {
-	labels  map[string]string
-	entries []models.LogEntry
-	size    int
+	labels   map[string]string
+	entries  []models.LogEntry
+	size     int
+	openedAt time.Time // when the first pending entry was buffered
+	maxBytes int       // rotation size for this stream (0 = no limit)
+
+	// WAL position of the pending entries: the oldest segment that may
+	// hold one, and the first and last entry numbers (0 = none logged)
+	walSegment uint64
+	walFirst   uint64
+	walLast    uint64
 }
 
 // NewIngestor creates a new log ingestor
 func NewIngestor(idx *index.Index, writer *storage.Writer, bufferSize int, broadcaster StreamBroadcaster) *Ingestor {
+	registerRejectMetrics()
+	registerBufferMetrics()
+	registerLabelLimitMetrics()
+	registerStreamMetrics()
 	return &Ingestor{
 		index:           idx,
 		writer:          writer,
 		broadcaster:     broadcaster,
 		bufSize:         bufferSize,
+		flushInterval:   5 * time.Second,
 		buffers:         make(map[string]*logBuffer),
 		broadcastQueue:  make(chan models.LogEntry, bufferSize*2), // Bounded queue
 		numBroadcasters: 4,                                        // Tunable: number of broadcast workers
@@ -81,6 +161,17 @@ func NewIngestor(idx *index.Index, writer *storage.Writer, bufferSize int, broad
 	}
 }
 
+// SetChunkRotation configures when buffered streams are written out as
+// chunks. flushInterval is the periodic flush of every buffer (0 disables
+// it); maxBytes and maxAge finalize an individual buffer once it holds that
+// many line bytes or its oldest entry has waited that long (0 = no limit).
+// Must be called before Start.
+func (ing *Ingestor) SetChunkRotation(flushInterval time.Duration, maxBytes int, maxAge time.Duration) {
+	ing.flushInterval = flushInterval
+	ing.maxChunkBytes = maxBytes
+	ing.maxChunkAge = maxAge
+}
+
 // Start begins the background flush and broadcast workers
 func (ing *Ingestor) Start() {
 	ing.wg.Add(1)
@@ -170,11 +261,25 @@ func ExtractK8sContext(labels map[string]string) (map[string]string, map[string]
 	return k8sLabels, k8sAnnotations
 }
 
-// Ingest processes incoming log streams
+// admittedEntry is an entry Ingest accepted for target, not yet buffered
+type admittedEntry struct {
+	target    *logBuffer
+	entry     models.LogEntry
+	truncated bool
+}
+
+// Ingest processes incoming log streams. Past the buffer high-water mark
+// it accepts nothing and returns ErrBackpressure.
 func (ing *Ingestor) Ingest(req *models.IngestRequest) (int, error) {
+	if ing.overHighWater() {
+		RecordRejectedRequest(RejectBackpressure, req)
+		return 0, ErrBackpressure
+	}
 	accepted := 0
+	arrival := time.Now()
+	assigned := 0
 
-	for _, stream := range req.Streams {
+	for _, stream := range ing.detectLevels(ing.promoteJSONLabels(req.Streams)) {
 		// Extract and store Kubernetes context if present
 		k8sLabels, k8sAnnotations := ExtractK8sContext(stream.Labels)
 		if len(k8sLabels) > 0 {
@@ -185,38 +290,135 @@ func (ing *Ingestor) Ingest(req *models.IngestRequest) (int, error) {
 		}
 		if err := ValidateStream(&stream); err != nil {
 			log.Printf("[Ingestor] Invalid stream: %v", err)
+			ing.recordDroppedStream(RejectInvalidStream, &stream, arrival)
+			continue
+		}
+		if problem := ing.checkLabelSchemas(stream.Labels); problem != "" {
+			violations := atomic.AddInt64(&ing.schemaViolations, 1)
+			if violations == 1 || violations%100 == 0 {
+				action := "rejecting"
+				if ing.warnLabelSchema {
+					action = "accepting"
+				}
+				log.Printf("[Ingestor] WARNING: Label schema violation, %s stream %v: %s. Total violations: %d",
+					action, stream.Labels, problem, violations)
+			}
+			if !ing.warnLabelSchema {
+				ing.recordDroppedStream(RejectLabelSchema, &stream, arrival)
+				continue
+			}
+		}
+
+		// Bound index memory by dropping labels past the label name and
+		// value limits; a stream left with no labels is refused
+		if stream.Labels = ing.limitLabels(stream.Labels); len(stream.Labels) == 0 {
+			rejects := atomic.AddInt64(&ing.labelLimitRejects, 1)
+			if rejects == 1 || rejects%100 == 0 {
+				log.Printf("[Ingestor] WARNING: Label limits reached, rejecting stream with no labels left. Total rejects: %d",
+					rejects)
+			}
+			ing.recordDroppedStream(RejectLabelLimit, &stream, arrival)
 			continue
 		}
 
 		labelHash := models.Labels(stream.Labels).Hash()
+		stripANSI := ing.shouldStripANSI(stream.Labels)
 
+		var admitted []admittedEntry
 		ing.bufferMu.Lock()
 		buf, exists := ing.buffers[labelHash]
 		if !exists {
-			buf = &logBuffer{
-				labels:  stream.Labels,
-				entries: make([]models.LogEntry, 0, ing.bufSize),
-			}
+			buf = ing.newBuffer(stream.Labels)
 			ing.buffers[labelHash] = buf
 		}
 
 		for _, entry := range stream.Entries {
 			ts, err := time.Parse(time.RFC3339, entry.Ts)
 			if err != nil {
-				ts = time.Now()
+				if ing.rejectMissingTs {
+					rejects := atomic.AddInt64(&ing.rejectedTs, 1)
+					if rejects == 1 || rejects%100 == 0 {
+						log.Printf("[Ingestor] WARNING: Dropping entry with invalid timestamp %q. Total dropped: %d",
+							entry.Ts, rejects)
+					}
+					ing.recordDropped(RejectInvalidTimestamp, stream.Labels, arrival)
+					continue
+				}
+				// Each assigned timestamp is a nanosecond after the last,
+				// so such entries keep their order within the batch
+				assigned++
+				ts = arrival.Add(time.Duration(assigned))
+				atomic.AddInt64(&ing.assignedTs, 1)
+			}
+			target := ing.admitLate(buf, labelHash, ts, arrival)
+			if target == nil {
+				continue
 			}
 
-			logEntry := models.LogEntry{
-				ID:        generateLogID(),
-				Timestamp: ts,
-				Line:      entry.Line,
-				Labels:    stream.Labels,
+			line, truncated := entry.Line, false
+			if stripANSI {
+				line = StripANSI(line)
+			}
+			if ing.maxLineBytes > 0 && len(line) > ing.maxLineBytes {
+				if ing.rejectLongLines {
+					rejects := atomic.AddInt64(&ing.rejectedLines, 1)
+					if rejects == 1 || rejects%100 == 0 {
+						log.Printf("[Ingestor] WARNING: Dropping %d byte line over the %d byte limit. Total dropped: %d",
+							len(line), ing.maxLineBytes, rejects)
+					}
+					ing.recordDropped(RejectLineTooLong, stream.Labels, ts)
+					continue
+				}
+				line = TruncateLine(line, ing.maxLineBytes)
+				truncated = true
 			}
 
-			buf.entries = append(buf.entries, logEntry)
-			buf.size += len(entry.Line)
-			accepted++
+			admitted = append(admitted, admittedEntry{
+				target:    target,
+				truncated: truncated,
+				entry: models.LogEntry{
+					ID:        generateLogID(),
+					Timestamp: ts,
+					Line:      line,
+					Labels:    stream.Labels,
+				},
+			})
+		}
 
+		// The entries are logged before they are buffered, broadcast or
+		// counted, so a failed append leaves no trace of them, and a flush
+		// is always noted after the entries it covers
+		if ing.wal != nil && len(admitted) > 0 {
+			record := walRecord{Labels: stream.Labels}
+			for i := range admitted {
+				ing.trackWAL(&record, &admitted[i].entry, admitted[i].target != buf)
+			}
+			// The record is appended after this, so it lands in this
+			// segment or a later one
+			segment := ing.wal.Segment()
+			if err := ing.appendWAL(&record); err != nil {
+				ing.bufferMu.Unlock()
+				log.Printf("[Ingestor] ERROR failed to append to the WAL: %v", err)
+				return accepted, fmt.Errorf("write-ahead log: %w", err)
+			}
+			for i, a := range admitted {
+				ing.markWAL(a.target, segment, record.Entries[i].Seq)
+			}
+		}
+
+		streamLines, streamBytes := 0, 0
+		for _, a := range admitted {
+			target, logEntry, line := a.target, a.entry, a.entry.Line
+			if a.truncated {
+				atomic.AddInt64(&ing.truncatedLines, 1)
+				ing.index.RecordDrop(stream.Labels, logEntry.Timestamp, DropTruncated, 1)
+			}
+			if len(target.entries) == 0 {
+				target.openedAt = time.Now()
+			}
+			target.entries = append(target.entries, logEntry)
+			target.size += len(line)
+			ing.addBuffered(1)
 			accepted++
 
 			// Queue broadcast instead of spawning goroutine
@@ -225,16 +427,21 @@ func (ing *Ingestor) Ingest(req *models.IngestRequest) (int, error) {
 			// Update metrics
 			ing.metricsMu.Lock()
 			ing.ingestedLines++
-			ing.ingestedBytes += int64(len(entry.Line))
+			ing.ingestedBytes += int64(len(line))
 			ing.metricsMu.Unlock()
+			streamLines++
+			streamBytes += len(line)
+		}
+		if streamLines > 0 {
+			ingestedStreams.add(stream.Labels, streamLines, streamBytes)
 		}
 
-		// Flush if buffer is full
-		if len(buf.entries) >= ing.bufSize {
-			ing.flushBuffer(labelHash, buf)
-			ing.buffers[labelHash] = &logBuffer{
-				labels:  stream.Labels,
-				entries: make([]models.LogEntry, 0, ing.bufSize),
+		// Flush if buffer is full or has reached its size or age limit
+		for _, hash := range []string{labelHash, labelHash + lateBufferSuffix} {
+			b, ok := ing.buffers[hash]
+			if ok && (len(b.entries) >= ing.bufSize || ing.shouldRotate(b, time.Now())) {
+				ing.flushBuffer(hash, b)
+				ing.buffers[hash] = ing.newBuffer(stream.Labels)
 			}
 		}
 		ing.bufferMu.Unlock()
@@ -246,6 +453,27 @@ func (ing *Ingestor) Ingest(req *models.IngestRequest) (int, error) {
 	return accepted, nil
 }
 
+// recordDropped counts an entry of the stream with labels, timestamped ts,
+// rejected for reason: in the rejection metric, and in the index so queries
+// over its time can report it
+func (ing *Ingestor) recordDropped(reason string, labels map[string]string, ts time.Time) {
+	RecordRejected(reason, 1)
+	ing.index.RecordDrop(labels, ts, reason, 1)
+}
+
+// recordDroppedStream counts every entry of a stream rejected as a whole,
+// each at its own timestamp or, lacking a valid one, at arrival
+func (ing *Ingestor) recordDroppedStream(reason string, stream *models.Stream, arrival time.Time) {
+	RecordRejected(reason, len(stream.Entries))
+	for _, entry := range stream.Entries {
+		ts, err := time.Parse(time.RFC3339, entry.Ts)
+		if err != nil {
+			ts = arrival
+		}
+		ing.index.RecordDrop(stream.Labels, ts, reason, 1)
+	}
+}
+
 // enqueueBroadcast attempts to queue a log entry for broadcast
 func (ing *Ingestor) enqueueBroadcast(entry models.LogEntry) {
 	select {
@@ -275,22 +503,176 @@ func (ing *Ingestor) broadcastWorker() {
 	log.Printf("[Ingestor] Broadcast worker exiting")
 }
 
-// flushWorker periodically flushes buffers
+// flushWorker periodically flushes buffers, and finalizes buffers past
+// their age limit between periodic flushes
 func (ing *Ingestor) flushWorker() {
 	defer ing.wg.Done()
-	ticker := time.NewTicker(5 * time.Second)
+
+	tick := ing.flushInterval
+	if ing.maxChunkAge > 0 {
+		// Check ages often enough that a chunk overshoots by at most ~25%
+		ageTick := ing.maxChunkAge / 4
+		if ageTick < 100*time.Millisecond {
+			ageTick = 100 * time.Millisecond
+		}
+		if tick <= 0 || ageTick < tick {
+			tick = ageTick
+		}
+	}
+	if tick <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
+	lastFlush := time.Now()
 
 	for {
 		select {
-		case <-ticker.C:
-			ing.flushAll()
+		case now := <-ticker.C:
+			if ing.flushInterval > 0 && now.Sub(lastFlush) >= ing.flushInterval {
+				ing.flushAll()
+				lastFlush = now
+			} else {
+				ing.flushExpired(now)
+			}
 		case <-ing.stopChan:
 			return
 		}
 	}
 }
 
+// Flush writes out every buffered entry immediately and returns how many
+// entries were flushed
+func (ing *Ingestor) Flush() int {
+	ing.bufferMu.Lock()
+	defer ing.bufferMu.Unlock()
+
+	flushed := 0
+	for hash, buf := range ing.buffers {
+		if len(buf.entries) > 0 {
+			flushed += len(buf.entries)
+			ing.flushBuffer(hash, buf)
+			buf.entries = buf.entries[:0]
+			buf.size = 0
+		}
+	}
+	return flushed
+}
+
+// FlushStream writes out the buffered entries of one stream immediately,
+// including its late entries
+func (ing *Ingestor) FlushStream(labels map[string]string) {
+	hash := models.Labels(labels).Hash()
+
+	ing.bufferMu.Lock()
+	defer ing.bufferMu.Unlock()
+
+	for _, key := range []string{hash, hash + lateBufferSuffix} {
+		if buf, ok := ing.buffers[key]; ok && len(buf.entries) > 0 {
+			ing.flushBuffer(key, buf)
+			buf.entries = buf.entries[:0]
+			buf.size = 0
+		}
+	}
+}
+
+// PurgeStream deletes every stored chunk of a stream and removes it from the
+// index. It returns the number of chunks removed.
+func (ing *Ingestor) PurgeStream(labels map[string]string) (int, error) {
+	ing.FlushStream(labels)
+
+	chunkIDs := ing.index.FindChunks(labels, time.Time{}, time.Now().Add(24*time.Hour))
+	removed := 0
+	for _, chunkID := range chunkIDs {
+		meta := ing.index.GetChunkMeta(chunkID)
+		if meta == nil || models.Labels(meta.Labels).Hash() != models.Labels(labels).Hash() {
+			continue
+		}
+		if err := ing.writer.DeleteChunk(meta.Labels, chunkID); err != nil {
+			return removed, err
+		}
+		ing.index.RemoveChunk(chunkID)
+		removed++
+	}
+	return removed, nil
+}
+
+// Policies for entries whose timestamp is missing or unparseable
+const (
+	MissingTimestampAssign = "assign"
+	MissingTimestampReject = "reject"
+)
+
+// SetMissingTimestamp selects how entries without a valid RFC3339 timestamp
+// are handled: "assign" stamps them with the arrival time, "reject" drops them
+func (ing *Ingestor) SetMissingTimestamp(policy string) error {
+	switch policy {
+	case MissingTimestampAssign, "":
+		ing.rejectMissingTs = false
+	case MissingTimestampReject:
+		ing.rejectMissingTs = true
+	default:
+		return fmt.Errorf("unknown missing timestamp policy %q", policy)
+	}
+	return nil
+}
+
+// NewMigration prepares an upgrade of the stored chunk metadata to the
+// current schema, serialized with the ingestor's own chunk writes and
+// deletes
+func (ing *Ingestor) NewMigration() *storage.Migration {
+	return storage.NewMigration(ing.writer)
+}
+
+// ImportLegacyChunks adopts the gzip-compressed chunks in dir as chunks of the
+// stream with the given labels and registers them in the index. Chunks
+// imported earlier are registered again if the index does not know them.
+func (ing *Ingestor) ImportLegacyChunks(dir string, labels map[string]string) (*storage.LegacyImport, error) {
+	if rejected := ing.index.AdmitLabelNames(labels); len(rejected) > 0 {
+		return nil, fmt.Errorf("label names %v exceed the label name limit", rejected)
+	}
+
+	result, err := ing.writer.ImportLegacyChunks(dir, labels)
+	if err != nil {
+		return nil, err
+	}
+	for _, metas := range [][]models.ChunkMeta{result.Imported, result.Existing} {
+		for _, meta := range metas {
+			if ing.index.GetChunkMeta(meta.ID) != nil {
+				continue
+			}
+			ing.index.AddChunk(meta.ID, meta.Labels, time.Unix(meta.StartTime, 0), time.Unix(meta.EndTime, 0), meta.EntryCount)
+		}
+	}
+	return result, nil
+}
+
+// shouldRotate reports whether a buffer has reached its byte or age limit
+func (ing *Ingestor) shouldRotate(buf *logBuffer, now time.Time) bool {
+	if len(buf.entries) == 0 {
+		return false
+	}
+	if buf.maxBytes > 0 && buf.size >= buf.maxBytes {
+		return true
+	}
+	return ing.maxChunkAge > 0 && now.Sub(buf.openedAt) >= ing.maxChunkAge
+}
+
+// flushExpired flushes only the buffers that have reached a rotation limit
+func (ing *Ingestor) flushExpired(now time.Time) {
+	ing.bufferMu.Lock()
+	defer ing.bufferMu.Unlock()
+
+	for hash, buf := range ing.buffers {
+		if ing.shouldRotate(buf, now) {
+			ing.flushBuffer(hash, buf)
+			buf.entries = buf.entries[:0]
+			buf.size = 0
+		}
+	}
+}
+
 // flushAll flushes all buffers
 func (ing *Ingestor) flushAll() {
 	ing.bufferMu.Lock()
@@ -333,15 +715,19 @@ func (ing *Ingestor) flushBuffer(hash string, buf *logBuffer) {
 	if len(buf.entries) == 0 {
 		return
 	}
+	// Callers empty the buffer whether or not the write succeeds
+	ing.addBuffered(-len(buf.entries))
 
 	startTime := time.Now()
 	chunkID, startTs, endTs, err := ing.writer.WriteChunk(buf.labels, buf.entries)
 	if err != nil {
 		log.Printf("[Ingestor] ERROR failed to write chunk: %v", err)
+		ing.pinWAL(buf)
 		return
 	}
 
 	ing.index.AddChunk(chunkID, buf.labels, startTs, endTs, len(buf.entries))
+	ing.commitWAL(hash, buf)
 	elapsed := time.Since(startTime)
 	log.Printf("[Ingestor] Flushed chunk: ID=%s, entries=%d, labels=%v, duration=%v",
 		chunkID, len(buf.entries), buf.labels, elapsed)
@@ -354,6 +740,30 @@ func (ing *Ingestor) GetMetrics() (lines int64, bytes int64, broadcasts int64) {
 	return ing.ingestedLines, ing.ingestedBytes, atomic.LoadInt64(&ing.broadcastedLines)
 }
 
+// GetTimestampCounts returns how many entries were stamped with their arrival
+// time and how many were dropped for lacking a valid timestamp
+func (ing *Ingestor) GetTimestampCounts() (assigned, rejected int64) {
+	return atomic.LoadInt64(&ing.assignedTs), atomic.LoadInt64(&ing.rejectedTs)
+}
+
+// GetLongLineCounts returns how many lines were truncated and how many were
+// dropped for exceeding the maximum line length
+func (ing *Ingestor) GetLongLineCounts() (truncated, rejected int64) {
+	return atomic.LoadInt64(&ing.truncatedLines), atomic.LoadInt64(&ing.rejectedLines)
+}
+
+// GetLabelSchemaViolations returns the number of streams that broke a label
+// schema, whether they were rejected or only warned about
+func (ing *Ingestor) GetLabelSchemaViolations() int64 {
+	return atomic.LoadInt64(&ing.schemaViolations)
+}
+
+// GetLabelLimitRejects returns the count of streams rejected for having no
+// labels left within the label limits
+func (ing *Ingestor) GetLabelLimitRejects() int64 {
+	return atomic.LoadInt64(&ing.labelLimitRejects)
+}
+
 // GetDroppedBroadcasts returns the count of dropped broadcasts
 func (ing *Ingestor) GetDroppedBroadcasts() int64 {
 	return atomic.LoadInt64(&ing.droppedBroadcasts)
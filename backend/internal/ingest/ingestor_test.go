@@ -0,0 +1,751 @@
+package ingest
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+	"github.com/logpulse/backend/internal/wal"
+)
+
+func TestFlushExpired_MaxChunkAge(t *testing.T) {
+	idx := index.NewIndex()
+	ing := NewIngestor(idx, storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	ing.SetChunkRotation(0, 0, time.Minute)
+
+	now := time.Now().UTC()
+	req := &models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}, Entries: []models.Entry{{Ts: now.Format(time.RFC3339), Line: "hello"}}},
+	}}
+	if _, err := ing.Ingest(req); err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+
+	ing.flushExpired(time.Now())
+	if chunks, _ := idx.Stats(); chunks != 0 {
+		t.Fatalf("expected young buffer to stay open, got %d chunks", chunks)
+	}
+
+	ing.flushExpired(time.Now().Add(2 * time.Minute))
+	if chunks, _ := idx.Stats(); chunks != 1 {
+		t.Errorf("expected buffer past max_chunk_age to be flushed, got %d chunks", chunks)
+	}
+}
+
+func TestShouldRotate_MaxChunkBytes(t *testing.T) {
+	ing := &Ingestor{}
+	ing.SetChunkRotation(0, 10, 0)
+	buf := ing.newBuffer(map[string]string{"app": "api"})
+	buf.entries = make([]models.LogEntry, 2)
+	buf.size = 9
+	if ing.shouldRotate(buf, time.Now()) {
+		t.Error("expected buffer under the byte limit to stay open")
+	}
+	buf.size = 10
+	if !ing.shouldRotate(buf, time.Now()) {
+		t.Error("expected buffer at the byte limit to rotate")
+	}
+}
+
+func TestChunkSizeFor_Overrides(t *testing.T) {
+	ing := &Ingestor{}
+	ing.SetChunkRotation(0, 1024*1024, 0)
+	err := ing.SetChunkSizeOverrides([]ChunkSizeOverride{
+		{Selector: `{app="nginx"}`, Bytes: 8 * 1024 * 1024},
+		{Selector: `{env=~"dev|test"}`, Bytes: 256 * 1024},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		labels map[string]string
+		want   int
+	}{
+		{map[string]string{"app": "nginx", "env": "dev"}, 8 * 1024 * 1024}, // first match wins
+		{map[string]string{"app": "api", "env": "test"}, 256 * 1024},
+		{map[string]string{"app": "api", "env": "prod"}, 1024 * 1024},
+	}
+	for _, c := range cases {
+		if got := ing.chunkSizeFor(c.labels); got != c.want {
+			t.Errorf("chunkSizeFor(%v) = %d, want %d", c.labels, got, c.want)
+		}
+	}
+
+	if err := ing.SetChunkSizeOverrides([]ChunkSizeOverride{{Selector: `{app="x"}`, Bytes: 0}}); err == nil {
+		t.Error("expected error for non-positive size")
+	}
+}
+
+func TestIngest_MissingTimestamp(t *testing.T) {
+	newReq := func() *models.IngestRequest {
+		return &models.IngestRequest{Streams: []models.Stream{{
+			Labels: map[string]string{"app": "api"},
+			Entries: []models.Entry{
+				{Line: "first"},
+				{Ts: "yesterday", Line: "second"},
+				{Line: "third"},
+				{Ts: "2024-01-01T00:00:00Z", Line: "explicit"},
+			},
+		}}}
+	}
+
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	before := time.Now()
+	ing.Ingest(newReq())
+
+	buf := ing.buffers[models.Labels{"app": "api"}.Hash()]
+	if len(buf.entries) != 4 {
+		t.Fatalf("expected all 4 entries to be kept, got %d", len(buf.entries))
+	}
+	for i := 1; i < 3; i++ {
+		if !buf.entries[i].Timestamp.After(buf.entries[i-1].Timestamp) {
+			t.Errorf("expected assigned timestamps to keep batch order, got %v then %v",
+				buf.entries[i-1].Timestamp, buf.entries[i].Timestamp)
+		}
+	}
+	if buf.entries[0].Timestamp.Before(before) {
+		t.Errorf("expected the arrival time to be assigned, got %v", buf.entries[0].Timestamp)
+	}
+	if assigned, rejected := ing.GetTimestampCounts(); assigned != 3 || rejected != 0 {
+		t.Errorf("expected 3 assigned and 0 rejected, got %d and %d", assigned, rejected)
+	}
+
+	ing = NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetMissingTimestamp(MissingTimestampReject); err != nil {
+		t.Fatal(err)
+	}
+	ing.Ingest(newReq())
+	buf = ing.buffers[models.Labels{"app": "api"}.Hash()]
+	if len(buf.entries) != 1 || buf.entries[0].Line != "explicit" {
+		t.Errorf("expected only the timestamped entry to be kept, got %+v", buf.entries)
+	}
+	if _, rejected := ing.GetTimestampCounts(); rejected != 3 {
+		t.Errorf("expected 3 rejected entries, got %d", rejected)
+	}
+}
+
+func TestIngest_MaxLineLength(t *testing.T) {
+	long := strings.Repeat("é", 50) // 100 bytes
+	newReq := func() *models.IngestRequest {
+		return &models.IngestRequest{Streams: []models.Stream{{
+			Labels:  map[string]string{"app": "api"},
+			Entries: []models.Entry{{Line: "short"}, {Line: long}},
+		}}}
+	}
+
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetMaxLineLength(41, LongLineTruncate); err != nil {
+		t.Fatal(err)
+	}
+	ing.Ingest(newReq())
+	buf := ing.buffers[models.Labels{"app": "api"}.Hash()]
+	got := buf.entries[1].Line
+	if len(got) > 41 || !strings.HasSuffix(got, TruncationMarker) || !utf8.ValidString(got) {
+		t.Errorf("expected a valid UTF-8 prefix of at most 41 bytes ending in the marker, got %q", got)
+	}
+	if buf.entries[0].Line != "short" {
+		t.Errorf("expected short lines untouched, got %q", buf.entries[0].Line)
+	}
+
+	ing = NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	ing.SetMaxLineLength(41, LongLineReject)
+	ing.Ingest(newReq())
+	buf = ing.buffers[models.Labels{"app": "api"}.Hash()]
+	if len(buf.entries) != 1 {
+		t.Errorf("expected the long line to be dropped, got %d entries", len(buf.entries))
+	}
+	if _, rejected := ing.GetLongLineCounts(); rejected != 1 {
+		t.Errorf("expected 1 rejected line, got %d", rejected)
+	}
+}
+
+func TestIngest_AcceptedCount(t *testing.T) {
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetMaxLineLength(41, LongLineReject); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}, Entries: []models.Entry{{Line: "one"}, {Line: "two"}}},
+		{Labels: map[string]string{"app": "web"}, Entries: []models.Entry{{Line: "three"}, {Line: strings.Repeat("x", 50)}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 3 {
+		t.Errorf("expected each kept line counted once, got accepted=%d", accepted)
+	}
+}
+
+func TestIngest_LabelSchemas(t *testing.T) {
+	schemas := []LabelSchema{
+		{Selector: `{app="payments"}`, Required: []string{"env", "region"}, Allowed: []string{"pod"}},
+	}
+	streams := []map[string]string{
+		{"app": "payments", "env": "prod", "region": "eu"},
+		{"app": "payments", "env": "prod", "region": "eu", "pod": "p-1"},
+		{"app": "payments", "env": "prod"},
+		{"app": "payments", "env": "prod", "region": "eu", "host": "h1"},
+		{"app": "api"},
+	}
+	newReq := func() *models.IngestRequest {
+		req := &models.IngestRequest{}
+		for _, labels := range streams {
+			req.Streams = append(req.Streams, models.Stream{
+				Labels:  labels,
+				Entries: []models.Entry{{Ts: "2024-01-01T00:00:00Z", Line: "line"}},
+			})
+		}
+		return req
+	}
+
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetLabelSchemas(schemas, LabelSchemaReject); err != nil {
+		t.Fatal(err)
+	}
+	ing.Ingest(newReq())
+	for i, labels := range streams {
+		_, kept := ing.buffers[models.Labels(labels).Hash()]
+		if want := i != 2 && i != 3; kept != want {
+			t.Errorf("stream %v: expected kept=%v", labels, want)
+		}
+	}
+	if v := ing.GetLabelSchemaViolations(); v != 2 {
+		t.Errorf("expected 2 violations, got %d", v)
+	}
+
+	ing = NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetLabelSchemas(schemas, LabelSchemaWarn); err != nil {
+		t.Fatal(err)
+	}
+	ing.Ingest(newReq())
+	if len(ing.buffers) != len(streams) || ing.GetLabelSchemaViolations() != 2 {
+		t.Errorf("warn: expected all %d streams kept and 2 violations, got %d and %d",
+			len(streams), len(ing.buffers), ing.GetLabelSchemaViolations())
+	}
+
+	if err := ing.SetLabelSchemas([]LabelSchema{{Selector: `{app="x"}`}}, LabelSchemaReject); err == nil {
+		t.Error("expected an error for a schema without labels")
+	}
+	if err := ing.SetLabelSchemas(schemas, "drop"); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
+
+func TestIngest_LateWindow(t *testing.T) {
+	now := time.Now().UTC()
+	newReq := func() *models.IngestRequest {
+		return &models.IngestRequest{Streams: []models.Stream{{
+			Labels: map[string]string{"app": "api"},
+			Entries: []models.Entry{
+				{Ts: now.Add(-time.Minute).Format(time.RFC3339), Line: "recent"},
+				{Ts: now.Add(-3 * time.Hour).Format(time.RFC3339), Line: "late"},
+				{Line: "assigned"},
+			},
+		}}}
+	}
+	hash := models.Labels{"app": "api"}.Hash()
+
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetLateWindow(time.Hour, LateLogsSeparate); err != nil {
+		t.Fatal(err)
+	}
+	ing.Ingest(newReq())
+	if buf := ing.buffers[hash]; len(buf.entries) != 2 {
+		t.Errorf("expected 2 entries in the open buffer, got %d", len(buf.entries))
+	}
+	late := ing.buffers[hash+lateBufferSuffix]
+	if late == nil || len(late.entries) != 1 || late.entries[0].Line != "late" {
+		t.Fatalf("expected the late entry in the late buffer, got %+v", late)
+	}
+
+	// Both buffers become separate chunks, each with its own time range
+	ing.FlushStream(map[string]string{"app": "api"})
+	chunks := ing.index.FindChunks(map[string]string{"app": "api"}, now.Add(-4*time.Hour), now.Add(-2*time.Hour))
+	if len(chunks) != 1 {
+		t.Fatalf("expected only the late chunk to cover 3h ago, got %d chunks", len(chunks))
+	}
+	if separated, rejected := ing.GetLateCounts(); separated != 1 || rejected != 0 {
+		t.Errorf("expected 1 separated and 0 rejected, got %d and %d", separated, rejected)
+	}
+
+	ing = NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetLateWindow(time.Hour, LateLogsReject); err != nil {
+		t.Fatal(err)
+	}
+	ing.Ingest(newReq())
+	if _, ok := ing.buffers[hash+lateBufferSuffix]; ok || len(ing.buffers[hash].entries) != 2 {
+		t.Errorf("expected the late entry to be dropped")
+	}
+	if _, rejected := ing.GetLateCounts(); rejected != 1 {
+		t.Errorf("expected 1 rejected, got %d", rejected)
+	}
+}
+
+func TestIngest_LevelDetection(t *testing.T) {
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	err := ing.SetLevelDetection([]LevelDetection{
+		{Selector: `{app="legacy"}`},
+		{Selector: `{app="custom"}`, Rules: []LevelRule{{Level: "error", Pattern: `^E\d{4} `}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := func(lines ...string) []models.Entry {
+		out := make([]models.Entry, len(lines))
+		for i, line := range lines {
+			out[i] = models.Entry{Ts: "2024-01-01T00:00:00Z", Line: line}
+		}
+		return out
+	}
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "legacy"}, Entries: entries("ERROR disk full", "Warning: slow", "errors: none", "ERROR again")},
+		{Labels: map[string]string{"app": "legacy", "level": "info"}, Entries: entries("ERROR but labelled")},
+		{Labels: map[string]string{"app": "custom"}, Entries: entries("E0042 boom", "ERROR ignored")},
+		{Labels: map[string]string{"app": "other"}, Entries: entries("ERROR untouched")},
+	}})
+
+	expected := map[string]int{
+		models.Labels{"app": "legacy", "level": "error"}.Hash(): 2,
+		models.Labels{"app": "legacy", "level": "warn"}.Hash():  1,
+		models.Labels{"app": "legacy"}.Hash():                   1,
+		models.Labels{"app": "legacy", "level": "info"}.Hash():  1,
+		models.Labels{"app": "custom", "level": "error"}.Hash(): 1,
+		models.Labels{"app": "custom"}.Hash():                   1,
+		models.Labels{"app": "other"}.Hash():                    1,
+	}
+	if len(ing.buffers) != len(expected) {
+		t.Errorf("expected %d streams, got %d", len(expected), len(ing.buffers))
+	}
+	for hash, n := range expected {
+		if buf := ing.buffers[hash]; buf == nil || len(buf.entries) != n {
+			t.Errorf("expected %d entries in stream %s, got %+v", n, hash, buf)
+		}
+	}
+	if got := ing.GetDetectedLevels(); got != 4 {
+		t.Errorf("expected 4 detected levels, got %d", got)
+	}
+
+	if err := ing.SetLevelDetection([]LevelDetection{{Rules: []LevelRule{{Level: "error"}}}}); err == nil {
+		t.Error("expected an error for a rule without pattern or keywords")
+	}
+	if err := ing.SetLevelDetection([]LevelDetection{{Rules: []LevelRule{{Level: "error", Pattern: "("}}}}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestIngest_JSONLabels(t *testing.T) {
+	idx := index.NewIndex()
+	idx.SetMaxLabelNames(3)
+	ing := NewIngestor(idx, storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	err := ing.SetJSONLabels([]JSONLabels{
+		{Selector: `{app="api"}`, Fields: []string{"status", "http", "env"}, Prefix: "json_", MaxValues: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := func(lines ...string) []models.Entry {
+		out := make([]models.Entry, len(lines))
+		for i, line := range lines {
+			out[i] = models.Entry{Ts: "2024-01-01T00:00:00Z", Line: line}
+		}
+		return out
+	}
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}, Entries: entries(
+			`{"status":200,"msg":"ok"}`,
+			`{"status":500,"http":{"method":"GET"}}`,
+			`{"status":404}`, // past the value cap
+			`not json`,
+			`{"status":200,"env":"prod"}`, // json_env is past the name limit
+		)},
+		{Labels: map[string]string{"app": "web"}, Entries: entries(`{"status":200}`)},
+	}})
+
+	expected := map[string]int{
+		models.Labels{"app": "api", "json_status": "200"}.Hash():                            2,
+		models.Labels{"app": "api", "json_status": "500", "json_http_method": "GET"}.Hash(): 1,
+		models.Labels{"app": "api"}.Hash():                                                  2,
+		models.Labels{"app": "web"}.Hash():                                                  1,
+	}
+	if len(ing.buffers) != len(expected) {
+		t.Errorf("expected %d streams, got %d", len(expected), len(ing.buffers))
+	}
+	for hash, n := range expected {
+		if buf := ing.buffers[hash]; buf == nil || len(buf.entries) != n {
+			t.Errorf("expected %d entries in stream %s, got %+v", n, hash, buf)
+		}
+	}
+	if buf := ing.buffers[models.Labels{"app": "api", "json_status": "200"}.Hash()]; buf != nil && buf.entries[0].Line != `{"status":200,"msg":"ok"}` {
+		t.Errorf("expected the line to be kept intact, got %q", buf.entries[0].Line)
+	}
+	if got := ing.GetJSONLabelSkips(); got != 2 {
+		t.Errorf("expected 2 skipped labels, got %d", got)
+	}
+
+	if err := ing.SetJSONLabels([]JSONLabels{{Fields: []string{"status"}, Prefix: "json-"}}); err == nil {
+		t.Error("expected an error for a prefix making an invalid label name")
+	}
+}
+
+func TestIngest_LabelCardinalityLimits(t *testing.T) {
+	storeDir := t.TempDir()
+	idx := index.NewIndex()
+	idx.SetMaxLabelNames(3)
+	idx.SetMaxLabelValues(2)
+	ing := NewIngestor(idx, storage.NewWriter(storeDir, 1024*1024), 1000, nil)
+
+	dropped := func(limit string) float64 {
+		return testutil.ToFloat64(droppedLabels.WithLabelValues(limit))
+	}
+	beforeNames, beforeValues := dropped(LimitLabelNames), dropped(LimitLabelValues)
+	beforeRejected := testutil.ToFloat64(ingestRejected.WithLabelValues(RejectLabelLimit))
+
+	now := time.Now().UTC()
+	stream := func(labels map[string]string, line string) models.Stream {
+		return models.Stream{Labels: labels, Entries: []models.Entry{{Ts: now.Format(time.RFC3339), Line: line}}}
+	}
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		stream(map[string]string{"app": "api", "request_id": "r1"}, "first"),
+		stream(map[string]string{"app": "api", "request_id": "r2"}, "second"),
+		stream(map[string]string{"app": "api", "request_id": "r3"}, "third"),          // past the value limit
+		stream(map[string]string{"app": "api", "pod": "p1", "trace": "t1"}, "fourth"), // trace is past the name limit
+		stream(map[string]string{"trace": "t2"}, "no labels left"),
+	}})
+	ing.Flush()
+
+	stored := make(map[string]map[string]string)
+	for _, meta := range idx.FindChunkMetas(now.Add(-time.Hour), now.Add(time.Hour), func(map[string]string) bool { return true }) {
+		entries, err := storage.NewReader(storeDir).ReadChunk(meta.Labels, meta.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			stored[e.Line] = meta.Labels
+		}
+	}
+	want := map[string]models.Labels{
+		"first":  {"app": "api", "request_id": "r1"},
+		"second": {"app": "api", "request_id": "r2"},
+		"third":  {"app": "api"},
+		"fourth": {"app": "api", "pod": "p1"},
+	}
+	if len(stored) != len(want) {
+		t.Errorf("expected %d lines stored, got %v", len(want), stored)
+	}
+	for line, labels := range want {
+		if got, ok := stored[line]; !ok || models.Labels(got).Hash() != labels.Hash() {
+			t.Errorf("expected %q stored under %v, got %v", line, labels, got)
+		}
+	}
+
+	if got := dropped(LimitLabelNames) - beforeNames; got != 2 {
+		t.Errorf("expected 2 labels dropped by the name limit, got %v", got)
+	}
+	if got := dropped(LimitLabelValues) - beforeValues; got != 1 {
+		t.Errorf("expected 1 label dropped by the value limit, got %v", got)
+	}
+	if got := testutil.ToFloat64(ingestRejected.WithLabelValues(RejectLabelLimit)) - beforeRejected; got != 1 {
+		t.Errorf("expected the stream left without labels rejected, got %v", got)
+	}
+	if got := ing.GetDroppedLabels(); got != 3 {
+		t.Errorf("expected 3 dropped labels, got %d", got)
+	}
+	if len(ing.labelWarned) != 2 {
+		t.Errorf("expected one warning per dropped label name, got %v", ing.labelWarned)
+	}
+	if values := idx.GetLabelValues("request_id"); len(values) != 2 {
+		t.Errorf("expected the index to hold 2 request_id values, got %v", values)
+	}
+}
+
+func TestIngest_RejectedReasons(t *testing.T) {
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	ing.SetMissingTimestamp(MissingTimestampReject)
+	if err := ing.SetMaxLineLength(41, LongLineReject); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := func(reason string) float64 {
+		return testutil.ToFloat64(ingestRejected.WithLabelValues(reason))
+	}
+	before := map[string]float64{}
+	for _, reason := range rejectReasons {
+		before[reason] = rejected(reason)
+	}
+
+	ts := time.Now().UTC().Format(time.RFC3339)
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}, Entries: []models.Entry{
+			{Ts: ts, Line: "ok"},
+			{Line: "no timestamp"},
+			{Ts: ts, Line: strings.Repeat("x", 42)},
+		}},
+		{Labels: map[string]string{}, Entries: []models.Entry{{Ts: ts, Line: "a"}, {Ts: ts, Line: "b"}}},
+	}})
+	RecordRejectedRequest(RejectKeyScope, &models.IngestRequest{Streams: []models.Stream{
+		{Entries: []models.Entry{{Line: "x"}, {Line: "y"}, {Line: "z"}}},
+	}})
+
+	want := map[string]float64{
+		RejectInvalidTimestamp: 1,
+		RejectLineTooLong:      1,
+		RejectInvalidStream:    2,
+		RejectKeyScope:         3,
+	}
+	for _, reason := range rejectReasons {
+		if got := rejected(reason) - before[reason]; got != want[reason] {
+			t.Errorf("reason %s: expected %v rejected, got %v", reason, want[reason], got)
+		}
+	}
+}
+
+func TestIngest_DropsRecordedInIndex(t *testing.T) {
+	idx := index.NewIndex()
+	ing := NewIngestor(idx, storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	ing.SetMissingTimestamp(MissingTimestampReject)
+	if err := ing.SetMaxLineLength(41, LongLineTruncate); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+	long := strings.Repeat("x", 42)
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api"}, Entries: []models.Entry{
+			{Ts: at(-10 * time.Minute), Line: long},
+			{Ts: at(-time.Minute), Line: long},
+			{Ts: "bad", Line: "no timestamp"},
+			{Ts: at(-time.Minute), Line: "ok"},
+		}},
+		{Labels: map[string]string{"app": "web"}, Entries: []models.Entry{
+			{Ts: at(-time.Minute), Line: long},
+		}},
+	}})
+
+	all := func(map[string]string) bool { return true }
+	api := func(labels map[string]string) bool { return labels["app"] == "api" }
+	got := idx.Drops(api, now.Add(-5*time.Minute), now.Add(time.Minute))
+	if len(got) != 2 {
+		t.Fatalf("expected truncated and invalid timestamp counts for api, got %+v", got)
+	}
+	if got[0].Reason != RejectInvalidTimestamp || got[0].Count != 1 {
+		t.Errorf("expected 1 entry without a timestamp, got %+v", got[0])
+	}
+	if got[1].Reason != DropTruncated || got[1].Count != 1 || !got[1].Start.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expected 1 truncated entry in the window, got %+v", got[1])
+	}
+
+	if got := idx.Drops(all, now.Add(-15*time.Minute), now.Add(time.Minute)); len(got) != 3 || got[1].Count != 2 {
+		t.Errorf("expected both truncations of api over the wider window and web's, got %+v", got)
+	}
+}
+
+func TestIngest_WALReplay(t *testing.T) {
+	storeDir, walDir := t.TempDir(), t.TempDir()
+	now := time.Now().UTC()
+	a := map[string]string{"app": "a"}
+	b := map[string]string{"app": "b"}
+	request := func(labels map[string]string, lines ...string) *models.IngestRequest {
+		stream := models.Stream{Labels: labels}
+		for _, line := range lines {
+			ts := now.Add(-time.Minute)
+			if line == "late" {
+				ts = now.Add(-3 * time.Hour)
+			}
+			stream.Entries = append(stream.Entries, models.Entry{Ts: ts.Format(time.RFC3339Nano), Line: line})
+		}
+		return &models.IngestRequest{Streams: []models.Stream{stream}}
+	}
+	// One writer across restarts, as its chunk IDs are only unique within
+	// a second
+	writer := storage.NewWriter(storeDir, 1024*1024)
+	start := func(idx *index.Index) (*Ingestor, *wal.WAL) {
+		// Small segments so the records rotate across several
+		w, err := wal.Open(wal.Options{Dir: walDir, SegmentSize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ing := NewIngestor(idx, writer, 1000, nil)
+		if err := ing.SetLateWindow(time.Hour, LateLogsSeparate); err != nil {
+			t.Fatal(err)
+		}
+		ing.SetWAL(w)
+		return ing, w
+	}
+
+	ing, w := start(index.NewIndex())
+	if _, err := ing.Ingest(request(a, "a1", "a2", "a3")); err != nil {
+		t.Fatal(err)
+	}
+	ing.FlushStream(a)
+	if _, err := ing.Ingest(request(a, "a4", "a5")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ing.Ingest(request(b, "b1", "late")); err != nil {
+		t.Fatal(err)
+	}
+	// Crash with a4, a5, b1 and the late entry only in buffers
+	w.Close()
+
+	idx := index.NewIndex()
+	if _, err := idx.Recover("", storage.NewReader(storeDir)); err != nil {
+		t.Fatal(err)
+	}
+	ing, w = start(idx)
+	restored, err := ing.ReplayWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 4 {
+		t.Errorf("expected the 4 unflushed entries restored, got %d", restored)
+	}
+
+	lines := make(map[string]int)
+	for _, meta := range idx.FindChunkMetas(now.Add(-4*time.Hour), now, func(map[string]string) bool { return true }) {
+		entries, err := storage.NewReader(storeDir).ReadChunk(meta.Labels, meta.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			lines[e.Line]++
+		}
+	}
+	for _, line := range []string{"a1", "a2", "a3", "a4", "a5", "b1", "late"} {
+		if lines[line] != 1 {
+			t.Errorf("expected %q stored once, got %d", line, lines[line])
+		}
+	}
+
+	// Everything is in chunks, so only the current segment is kept and
+	// another restart restores nothing
+	files, err := os.ReadDir(walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected only the current segment to remain, got %d files", len(files))
+	}
+	w.Close()
+	ing, w = start(idx)
+	defer w.Close()
+	if restored, err := ing.ReplayWAL(); err != nil || restored != 0 {
+		t.Errorf("expected nothing to replay after a clean flush, got %d (%v)", restored, err)
+	}
+}
+
+func TestIngest_WALFailureLeavesNoTrace(t *testing.T) {
+	w, err := wal.Open(wal.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	ing.SetWAL(w)
+	request := func(lines ...string) *models.IngestRequest {
+		stream := models.Stream{Labels: map[string]string{"app": "api"}}
+		for _, line := range lines {
+			stream.Entries = append(stream.Entries, models.Entry{Line: line})
+		}
+		return &models.IngestRequest{Streams: []models.Stream{stream}}
+	}
+	if _, err := ing.Ingest(request("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A closed WAL fails every append
+	w.Close()
+	accepted, err := ing.Ingest(request("two", "three"))
+	if err == nil {
+		t.Fatal("expected the WAL error to be returned")
+	}
+	if accepted != 0 {
+		t.Errorf("expected nothing accepted, got %d", accepted)
+	}
+	if n := ing.BufferedEntries(); n != 1 {
+		t.Errorf("expected only the logged entry buffered, got %d", n)
+	}
+	if lines, _, _ := ing.GetMetrics(); lines != 1 {
+		t.Errorf("expected only the logged entry counted, got %d", lines)
+	}
+	if n := len(ing.broadcastQueue); n != 1 {
+		t.Errorf("expected only the logged entry queued for broadcast, got %d", n)
+	}
+	buf := ing.buffers[models.Labels(map[string]string{"app": "api"}).Hash()]
+	if len(buf.entries) != 1 || buf.walFirst != 1 || buf.walLast != 1 {
+		t.Errorf("expected the buffer to hold only the logged entry, got %d entries, WAL %d-%d", len(buf.entries), buf.walFirst, buf.walLast)
+	}
+}
+
+func TestIngest_StreamMetrics(t *testing.T) {
+	ing := NewIngestor(index.NewIndex(), storage.NewWriter(t.TempDir(), 1024*1024), 1000, nil)
+	if err := ing.SetStreamMetricLabels([]string{"app", "app"}); err == nil {
+		t.Error("expected a duplicate label to be refused")
+	}
+	if err := ing.SetStreamMetricLabels([]string{"__name__"}); err == nil {
+		t.Error("expected a reserved label to be refused")
+	}
+	if err := ing.SetStreamMetricLabels([]string{"app", "level"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// scrape returns the named counter's value per app/level series
+	scrape := func(name string) map[string]float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]float64)
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				var dims []string
+				for _, l := range m.GetLabel() {
+					dims = append(dims, l.GetName()+"="+l.GetValue())
+				}
+				values[strings.Join(dims, ",")] = m.GetCounter().GetValue()
+			}
+		}
+		return values
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "api", "level": "error", "pod": "p1"}, Entries: []models.Entry{{Ts: now, Line: "boom"}, {Ts: now, Line: "again"}}},
+		{Labels: map[string]string{"app": "api", "level": "error", "pod": "p2"}, Entries: []models.Entry{{Ts: now, Line: "x"}}},
+		{Labels: map[string]string{"app": "db"}, Entries: []models.Entry{{Ts: now, Line: "slow query"}}},
+	}})
+
+	lines, bytes := scrape("logpulse_ingested_lines_total"), scrape("logpulse_ingested_bytes_total")
+	if got := lines["app=api,level=error"]; got != 3 {
+		t.Errorf("expected 3 lines for app=api,level=error across pods, got %v (%v)", got, lines)
+	}
+	if got := bytes["app=api,level=error"]; got != float64(len("boom")+len("again")+len("x")) {
+		t.Errorf("expected the lines' bytes counted, got %v", got)
+	}
+	if got := lines["app=db,level="]; got != 1 {
+		t.Errorf("expected 1 line for app=db without a level, got %v (%v)", got, lines)
+	}
+	if len(lines) != 2 {
+		t.Errorf("expected a series per app and level only, got %v", lines)
+	}
+
+	// The counters advance with further lines
+	ing.Ingest(&models.IngestRequest{Streams: []models.Stream{
+		{Labels: map[string]string{"app": "db"}, Entries: []models.Entry{{Ts: now, Line: "another"}}},
+	}})
+	if got := scrape("logpulse_ingested_lines_total")["app=db,level="]; got != 2 {
+		t.Errorf("expected the counter to advance to 2, got %v", got)
+	}
+}
@@ -0,0 +1,232 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
+)
+
+// JSONLabels promotes fields of JSON lines to labels for streams matching
+// Selector. Each of Fields names a top-level key; an object value is
+// flattened into one label per leaf, its keys joined with "_". Label names
+// are Prefix followed by the flattened key. MaxValues caps the distinct
+// values each promoted label may take (0 = unlimited).
+type JSONLabels struct {
+	Selector  string
+	Fields    []string
+	Prefix    string
+	MaxValues int
+}
+
+var labelNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type jsonLabels struct {
+	selector  *query.ParsedQuery
+	fields    []string
+	prefix    string
+	maxValues int
+
+	mu     sync.Mutex
+	values map[string]map[string]struct{} // distinct values seen per label
+}
+
+// SetJSONLabels enables promoting JSON fields to labels. The first rule
+// whose selector matches a stream applies; the line is stored unchanged.
+// Labels the stream already carries are left alone, and a label is not
+// added to an entry when it would exceed its value cap or the index's label
+// name limit, so promotion cannot reject a stream or grow the index without
+// bound. Must be called before Ingest.
+func (ing *Ingestor) SetJSONLabels(rules []JSONLabels) error {
+	parsed := make([]*jsonLabels, 0, len(rules))
+	for _, r := range rules {
+		sel := r.Selector
+		if strings.TrimSpace(sel) == "{}" {
+			sel = ""
+		}
+		p, err := query.ParseAdvancedQuery(sel)
+		if err != nil {
+			return fmt.Errorf("invalid json labels selector %q: %w", r.Selector, err)
+		}
+		if len(r.Fields) == 0 {
+			return fmt.Errorf("json labels %q must list fields", r.Selector)
+		}
+		for _, f := range r.Fields {
+			if !labelNameRE.MatchString(r.Prefix + f) {
+				return fmt.Errorf("json labels %q: field %q with prefix %q is not a valid label name", r.Selector, f, r.Prefix)
+			}
+		}
+		if r.MaxValues < 0 {
+			return fmt.Errorf("json labels %q: max values must not be negative", r.Selector)
+		}
+		parsed = append(parsed, &jsonLabels{
+			selector:  p,
+			fields:    r.Fields,
+			prefix:    r.Prefix,
+			maxValues: r.MaxValues,
+			values:    make(map[string]map[string]struct{}),
+		})
+	}
+	ing.jsonLabels = parsed
+	return nil
+}
+
+// promoteJSONLabels splits streams matching a rule into one stream per set
+// of promoted labels, keeping entry order within each
+func (ing *Ingestor) promoteJSONLabels(streams []models.Stream) []models.Stream {
+	if len(ing.jsonLabels) == 0 {
+		return streams
+	}
+
+	out := make([]models.Stream, 0, len(streams))
+	for _, stream := range streams {
+		var rule *jsonLabels
+		for _, r := range ing.jsonLabels {
+			if r.selector.MatchLabels(stream.Labels) {
+				rule = r
+				break
+			}
+		}
+		// Reserve the stream's own label names first so promoted labels
+		// cannot crowd them out of the name limit
+		if rule == nil || len(ing.index.AdmitLabelNames(stream.Labels)) > 0 {
+			out = append(out, stream)
+			continue
+		}
+
+		// Position in out of the stream for each set of promoted labels
+		byLabels := make(map[string]int)
+		for _, entry := range stream.Entries {
+			promoted := ing.extractJSONLabels(rule, stream.Labels, entry.Line)
+			key := models.Labels(promoted).Hash()
+			i, ok := byLabels[key]
+			if !ok {
+				labels := stream.Labels
+				if len(promoted) > 0 {
+					labels = make(map[string]string, len(stream.Labels)+len(promoted))
+					for k, v := range stream.Labels {
+						labels[k] = v
+					}
+					for k, v := range promoted {
+						labels[k] = v
+					}
+				}
+				i = len(out)
+				byLabels[key] = i
+				out = append(out, models.Stream{Labels: labels})
+			}
+			out[i].Entries = append(out[i].Entries, entry)
+		}
+	}
+	return out
+}
+
+// extractJSONLabels returns the labels rule promotes from line, or nil when
+// the line is not a JSON object
+func (ing *Ingestor) extractJSONLabels(rule *jsonLabels, existing map[string]string, line string) map[string]string {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &obj); err != nil {
+		return nil
+	}
+
+	var promoted map[string]string
+	for _, field := range rule.fields {
+		v, ok := obj[field]
+		if !ok {
+			continue
+		}
+		flattenJSON(rule.prefix+field, v, func(name, value string) {
+			if _, ok := existing[name]; ok {
+				return
+			}
+			if !ing.admitJSONLabel(rule, name, value) {
+				return
+			}
+			if promoted == nil {
+				promoted = make(map[string]string)
+			}
+			promoted[name] = value
+		})
+	}
+	return promoted
+}
+
+// admitJSONLabel reports whether name=value may be added, reserving the
+// value against the label's cap and the name against the index's limit
+func (ing *Ingestor) admitJSONLabel(rule *jsonLabels, name, value string) bool {
+	rule.mu.Lock()
+	seen, ok := rule.values[name]
+	if !ok {
+		if rejected := ing.index.AdmitLabelNames(map[string]string{name: value}); len(rejected) > 0 {
+			rule.mu.Unlock()
+			ing.countJSONLabelSkip(name, "label name limit reached")
+			return false
+		}
+		seen = make(map[string]struct{})
+		// Values already indexed count towards the cap after a restart
+		for _, v := range ing.index.GetLabelValues(name) {
+			seen[v] = struct{}{}
+		}
+		rule.values[name] = seen
+	}
+	_, known := seen[value]
+	if !known && rule.maxValues > 0 && len(seen) >= rule.maxValues {
+		rule.mu.Unlock()
+		ing.countJSONLabelSkip(name, fmt.Sprintf("more than %d values", rule.maxValues))
+		return false
+	}
+	seen[value] = struct{}{}
+	rule.mu.Unlock()
+	return true
+}
+
+func (ing *Ingestor) countJSONLabelSkip(name, reason string) {
+	skips := atomic.AddInt64(&ing.jsonLabelSkips, 1)
+	if skips == 1 || skips%100 == 0 {
+		log.Printf("[Ingestor] WARNING: Not promoting JSON field %s to a label: %s. Total skipped: %d",
+			name, reason, skips)
+	}
+}
+
+// flattenJSON calls emit for each scalar under v, naming nested values by
+// their keys joined with "_". Nulls, arrays and keys that would not make a
+// valid label name are skipped.
+func flattenJSON(name string, v interface{}, emit func(name, value string)) {
+	switch val := v.(type) {
+	case string:
+		emit(name, val)
+	case float64:
+		emit(name, strconv.FormatFloat(val, 'f', -1, 64))
+	case bool:
+		emit(name, strconv.FormatBool(val))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if child := name + "_" + k; labelNameRE.MatchString(child) {
+				flattenJSON(child, val[k], emit)
+			}
+		}
+	}
+}
+
+// GetJSONLabelSkips returns the number of JSON fields not promoted to labels
+// because of a value cap or the label name limit
+func (ing *Ingestor) GetJSONLabelSkips() int64 {
+	return atomic.LoadInt64(&ing.jsonLabelSkips)
+}
@@ -0,0 +1,90 @@
+package ingest
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limits a label is dropped for, the values of the limit label on
+// logpulse_ingest_dropped_labels_total
+const (
+	LimitLabelNames  = "max_label_names"
+	LimitLabelValues = "max_label_values_per_name"
+)
+
+// maxWarnedLabels bounds the label names remembered as warned about, since
+// names past the name limit are themselves unbounded
+const maxWarnedLabels = 1000
+
+var (
+	labelLimitMetricsOnce sync.Once
+	droppedLabels         *prometheus.CounterVec
+)
+
+func registerLabelLimitMetrics() {
+	labelLimitMetricsOnce.Do(func() {
+		droppedLabels = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "logpulse_ingest_dropped_labels_total",
+				Help: "Total labels stripped from streams at ingest for passing a cardinality limit, by limit.",
+			},
+			[]string{"limit"},
+		)
+		for _, limit := range []string{LimitLabelNames, LimitLabelValues} {
+			droppedLabels.WithLabelValues(limit)
+		}
+		prometheus.MustRegister(droppedLabels)
+	})
+}
+
+// limitLabels admits a stream's labels against the index's cardinality
+// limits and returns them without the labels that pass a limit; the
+// stream's lines are kept under the remaining labels. labels is not
+// modified.
+func (ing *Ingestor) limitLabels(labels map[string]string) map[string]string {
+	overNames, overValues := ing.index.AdmitLabels(labels)
+	if len(overNames) == 0 && len(overValues) == 0 {
+		return labels
+	}
+
+	kept := make(map[string]string, len(labels))
+	for k, v := range labels {
+		kept[k] = v
+	}
+	for _, over := range []struct {
+		limit string
+		names []string
+	}{{LimitLabelNames, overNames}, {LimitLabelValues, overValues}} {
+		for _, name := range over.names {
+			delete(kept, name)
+			droppedLabels.WithLabelValues(over.limit).Inc()
+			atomic.AddInt64(&ing.droppedLabels, 1)
+			ing.warnLabelLimit(name, over.limit)
+		}
+	}
+	return kept
+}
+
+// warnLabelLimit logs the first time a label name is dropped
+func (ing *Ingestor) warnLabelLimit(name, limit string) {
+	ing.labelWarnMu.Lock()
+	defer ing.labelWarnMu.Unlock()
+	if _, warned := ing.labelWarned[name]; warned || len(ing.labelWarned) >= maxWarnedLabels {
+		return
+	}
+	if ing.labelWarned == nil {
+		ing.labelWarned = make(map[string]struct{})
+	}
+	ing.labelWarned[name] = struct{}{}
+	log.Printf("[Ingestor] WARNING: Dropping label %s from incoming streams: %s limit reached; lines are kept without it",
+		name, limit)
+}
+
+// GetDroppedLabels returns the count of labels stripped from streams by the
+// label cardinality limits
+func (ing *Ingestor) GetDroppedLabels() int64 {
+	return atomic.LoadInt64(&ing.droppedLabels)
+}
@@ -0,0 +1,110 @@
+package ingest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/logpulse/backend/internal/query"
+)
+
+// Actions for streams that violate a label schema
+const (
+	LabelSchemaReject = "reject"
+	LabelSchemaWarn   = "warn"
+)
+
+// LabelSchema declares the labels streams matching Selector must carry
+// (Required) and, when Allowed is set, the only other labels they may carry
+// besides those named in the selector
+type LabelSchema struct {
+	Selector string
+	Required []string
+	Allowed  []string
+}
+
+type labelSchema struct {
+	selector *query.ParsedQuery
+	raw      string
+	required []string
+	// permitted is nil when any extra label is allowed
+	permitted map[string]struct{}
+}
+
+// SetLabelSchemas configures the label schemas enforced at ingestion. Every
+// schema whose selector matches a stream applies. Violating streams are
+// dropped with the "reject" action or only counted and logged with "warn".
+// Must be called before Ingest.
+func (ing *Ingestor) SetLabelSchemas(schemas []LabelSchema, action string) error {
+	switch action {
+	case LabelSchemaReject, "":
+		ing.warnLabelSchema = false
+	case LabelSchemaWarn:
+		ing.warnLabelSchema = true
+	default:
+		return fmt.Errorf("unknown label schema action %q", action)
+	}
+
+	parsed := make([]labelSchema, 0, len(schemas))
+	for _, s := range schemas {
+		sel := s.Selector
+		if strings.TrimSpace(sel) == "{}" {
+			sel = ""
+		}
+		p, err := query.ParseAdvancedQuery(sel)
+		if err != nil {
+			return fmt.Errorf("invalid label schema selector %q: %w", s.Selector, err)
+		}
+		if len(s.Required) == 0 && len(s.Allowed) == 0 {
+			return fmt.Errorf("label schema %q must list required or allowed labels", s.Selector)
+		}
+
+		schema := labelSchema{selector: p, raw: s.Selector, required: s.Required}
+		if len(s.Allowed) > 0 {
+			schema.permitted = make(map[string]struct{})
+			for _, names := range [][]string{s.Required, s.Allowed} {
+				for _, name := range names {
+					schema.permitted[name] = struct{}{}
+				}
+			}
+			for _, m := range p.LabelMatchers {
+				schema.permitted[m.Name] = struct{}{}
+			}
+		}
+		parsed = append(parsed, schema)
+	}
+	ing.labelSchemas = parsed
+	return nil
+}
+
+// checkLabelSchemas describes how a stream's labels break the schemas that
+// match it, or returns "" when they conform
+func (ing *Ingestor) checkLabelSchemas(labels map[string]string) string {
+	var problems []string
+	for _, s := range ing.labelSchemas {
+		if !s.selector.MatchLabels(labels) {
+			continue
+		}
+		var missing, unexpected []string
+		for _, name := range s.required {
+			if labels[name] == "" {
+				missing = append(missing, name)
+			}
+		}
+		if s.permitted != nil {
+			for name := range labels {
+				if _, ok := s.permitted[name]; !ok {
+					unexpected = append(unexpected, name)
+				}
+			}
+			sort.Strings(unexpected)
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%s requires %s", s.raw, strings.Join(missing, ", ")))
+		}
+		if len(unexpected) > 0 {
+			problems = append(problems, fmt.Sprintf("%s does not allow %s", s.raw, strings.Join(unexpected, ", ")))
+		}
+	}
+	return strings.Join(problems, "; ")
+}
@@ -0,0 +1,75 @@
+package ingest
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Policies for entries older than the late window
+const (
+	LateLogsSeparate = "separate"
+	LateLogsReject   = "reject"
+)
+
+// lateBufferSuffix keys a stream's late buffer apart from its open buffer
+const lateBufferSuffix = "/late"
+
+// SetLateWindow sets how far behind their arrival entries may be timestamped
+// and still join their stream's open chunk. Chunks are not cut into time
+// buckets: each chunk's time range is the min and max of its entries, so an
+// entry inside the window is always found by queries covering its timestamp.
+// An older entry would stretch the open chunk's range back and make every
+// query over that span read the chunk, so it is instead written to a
+// separate late chunk of the same stream ("separate"), which queries find
+// the same way, or dropped ("reject"). window 0 accepts entries of any age
+// into the open chunk.
+func (ing *Ingestor) SetLateWindow(window time.Duration, policy string) error {
+	if window < 0 {
+		return fmt.Errorf("late window must not be negative, got %s", window)
+	}
+	switch policy {
+	case LateLogsSeparate, "":
+		ing.rejectLate = false
+	case LateLogsReject:
+		ing.rejectLate = true
+	default:
+		return fmt.Errorf("unknown late log policy %q", policy)
+	}
+	ing.lateWindow = window
+	return nil
+}
+
+// admitLate decides where an entry timestamped ts that arrived at arrival
+// goes. It returns the buffer for the entry, or nil when it is rejected.
+// bufferMu must be held.
+func (ing *Ingestor) admitLate(buf *logBuffer, hash string, ts, arrival time.Time) *logBuffer {
+	if ing.lateWindow <= 0 || arrival.Sub(ts) <= ing.lateWindow {
+		return buf
+	}
+
+	if ing.rejectLate {
+		rejects := atomic.AddInt64(&ing.rejectedLate, 1)
+		if rejects == 1 || rejects%100 == 0 {
+			log.Printf("[Ingestor] WARNING: Dropping entry %s behind arrival, beyond the %s late window. Total dropped: %d",
+				arrival.Sub(ts).Truncate(time.Second), ing.lateWindow, rejects)
+		}
+		ing.recordDropped(RejectTooLate, buf.labels, ts)
+		return nil
+	}
+
+	atomic.AddInt64(&ing.lateEntries, 1)
+	late, ok := ing.buffers[hash+lateBufferSuffix]
+	if !ok {
+		late = ing.newBuffer(buf.labels)
+		ing.buffers[hash+lateBufferSuffix] = late
+	}
+	return late
+}
+
+// GetLateCounts returns the entries written to late chunks and the entries
+// rejected for arriving beyond the late window
+func (ing *Ingestor) GetLateCounts() (separated, rejected int64) {
+	return atomic.LoadInt64(&ing.lateEntries), atomic.LoadInt64(&ing.rejectedLate)
+}
@@ -0,0 +1,174 @@
+package ingest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/query"
+)
+
+// LevelLabel is the label level detection fills in
+const LevelLabel = "level"
+
+// LevelRule infers Level for lines matching Pattern, a regular expression, or
+// containing one of Keywords as a whole word (case-insensitive)
+type LevelRule struct {
+	Level    string
+	Pattern  string
+	Keywords []string
+}
+
+// LevelDetection applies Rules, in order, to streams matching Selector; the
+// first matching rule sets the level. No rules means DefaultLevelRules.
+type LevelDetection struct {
+	Selector string
+	Rules    []LevelRule
+}
+
+// DefaultLevelRules recognize the usual severity words
+var DefaultLevelRules = []LevelRule{
+	{Level: "error", Keywords: []string{"error", "err", "fatal", "critical", "panic"}},
+	{Level: "warn", Keywords: []string{"warn", "warning"}},
+	{Level: "info", Keywords: []string{"info"}},
+	{Level: "debug", Keywords: []string{"debug"}},
+	{Level: "trace", Keywords: []string{"trace"}},
+}
+
+type levelRule struct {
+	level string
+	re    *regexp.Regexp
+}
+
+type levelDetection struct {
+	selector *query.ParsedQuery
+	rules    []levelRule
+}
+
+// SetLevelDetection enables inferring a level label from the line for
+// streams without one. The first detection whose selector matches a stream
+// applies; lines no rule matches are stored without a level. Must be called
+// before Ingest.
+func (ing *Ingestor) SetLevelDetection(detections []LevelDetection) error {
+	parsed := make([]levelDetection, 0, len(detections))
+	for _, d := range detections {
+		sel := d.Selector
+		if strings.TrimSpace(sel) == "{}" {
+			sel = ""
+		}
+		p, err := query.ParseAdvancedQuery(sel)
+		if err != nil {
+			return fmt.Errorf("invalid level detection selector %q: %w", d.Selector, err)
+		}
+
+		rules := d.Rules
+		if len(rules) == 0 {
+			rules = DefaultLevelRules
+		}
+		detection := levelDetection{selector: p}
+		for _, r := range rules {
+			rule, err := compileLevelRule(r)
+			if err != nil {
+				return fmt.Errorf("level detection %q: %w", d.Selector, err)
+			}
+			detection.rules = append(detection.rules, rule)
+		}
+		parsed = append(parsed, detection)
+	}
+	ing.levelDetections = parsed
+	return nil
+}
+
+func compileLevelRule(r LevelRule) (levelRule, error) {
+	if r.Level == "" {
+		return levelRule{}, fmt.Errorf("rule must name a level")
+	}
+	if (r.Pattern == "") == (len(r.Keywords) == 0) {
+		return levelRule{}, fmt.Errorf("rule for level %q must set either a pattern or keywords", r.Level)
+	}
+
+	pattern := r.Pattern
+	if pattern == "" {
+		words := make([]string, len(r.Keywords))
+		for i, k := range r.Keywords {
+			words[i] = regexp.QuoteMeta(k)
+		}
+		pattern = `(?i)\b(?:` + strings.Join(words, "|") + `)\b`
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return levelRule{}, fmt.Errorf("invalid pattern for level %q: %w", r.Level, err)
+	}
+	return levelRule{level: r.Level, re: re}, nil
+}
+
+// detectLevels splits streams without a level label that match a detection
+// into one stream per inferred level, keeping entry order within each
+func (ing *Ingestor) detectLevels(streams []models.Stream) []models.Stream {
+	if len(ing.levelDetections) == 0 {
+		return streams
+	}
+
+	out := make([]models.Stream, 0, len(streams))
+	for _, stream := range streams {
+		if _, ok := stream.Labels[LevelLabel]; ok {
+			out = append(out, stream)
+			continue
+		}
+		var detection *levelDetection
+		for i := range ing.levelDetections {
+			if ing.levelDetections[i].selector.MatchLabels(stream.Labels) {
+				detection = &ing.levelDetections[i]
+				break
+			}
+		}
+		if detection == nil {
+			out = append(out, stream)
+			continue
+		}
+
+		// Position in out of the stream for each level; "" keeps the
+		// original labels
+		byLevel := make(map[string]int)
+		for _, entry := range stream.Entries {
+			level := detection.detect(entry.Line)
+			i, ok := byLevel[level]
+			if !ok {
+				labels := stream.Labels
+				if level != "" {
+					labels = make(map[string]string, len(stream.Labels)+1)
+					for k, v := range stream.Labels {
+						labels[k] = v
+					}
+					labels[LevelLabel] = level
+				}
+				i = len(out)
+				byLevel[level] = i
+				out = append(out, models.Stream{Labels: labels})
+			}
+			if level != "" {
+				atomic.AddInt64(&ing.detectedLevels, 1)
+			}
+			out[i].Entries = append(out[i].Entries, entry)
+		}
+	}
+	return out
+}
+
+// detect returns the level of the first rule matching line, or ""
+func (d *levelDetection) detect(line string) string {
+	for _, r := range d.rules {
+		if r.re.MatchString(line) {
+			return r.level
+		}
+	}
+	return ""
+}
+
+// GetDetectedLevels returns the number of entries given a level inferred
+// from their line
+func (ing *Ingestor) GetDetectedLevels() int64 {
+	return atomic.LoadInt64(&ing.detectedLevels)
+}
@@ -0,0 +1,50 @@
+package ingest
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// TruncationMarker ends a line that was cut to the maximum line length
+const TruncationMarker = "…[truncated]"
+
+// Policies for lines longer than the maximum line length
+const (
+	LongLineTruncate = "truncate"
+	LongLineReject   = "reject"
+)
+
+// SetMaxLineLength caps the bytes of a stored line. Longer lines keep a
+// prefix ending in TruncationMarker, or are dropped with the "reject"
+// policy. maxBytes 0 disables the limit.
+func (ing *Ingestor) SetMaxLineLength(maxBytes int, policy string) error {
+	if maxBytes < 0 {
+		return fmt.Errorf("max line length must not be negative, got %d", maxBytes)
+	}
+	if maxBytes > 0 && maxBytes <= len(TruncationMarker) {
+		return fmt.Errorf("max line length must exceed the %d byte truncation marker", len(TruncationMarker))
+	}
+	switch policy {
+	case LongLineTruncate, "":
+		ing.rejectLongLines = false
+	case LongLineReject:
+		ing.rejectLongLines = true
+	default:
+		return fmt.Errorf("unknown long line policy %q", policy)
+	}
+	ing.maxLineBytes = maxBytes
+	return nil
+}
+
+// TruncateLine shortens line to at most maxBytes, keeping a prefix that ends
+// on a UTF-8 boundary followed by TruncationMarker
+func TruncateLine(line string, maxBytes int) string {
+	if len(line) <= maxBytes {
+		return line
+	}
+	cut := maxBytes - len(TruncationMarker)
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + TruncationMarker
+}
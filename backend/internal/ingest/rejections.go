@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// Reasons entries are rejected for, the values of the reason label on
+// logpulse_ingest_rejected_total. The set is fixed so the label stays
+// bounded; add a constant here for a new rejection point.
+const (
+	RejectInvalidRequest   = "invalid_request"   // request failed validation
+	RejectKeyScope         = "key_scope"         // labels outside the API key's scope
+	RejectInvalidStream    = "invalid_stream"    // stream failed validation
+	RejectLabelSchema      = "label_schema"      // labels violate a label schema
+	RejectLabelLimit       = "label_limit"       // no labels left within the label limits
+	RejectInvalidTimestamp = "invalid_timestamp" // missing or unparseable timestamp
+	RejectTooLate          = "too_late"          // older than the late window
+	RejectTooOld           = "too_old"           // pushed older than reject_old_samples_max_age
+	RejectLineTooLong      = "line_too_long"     // line over the length limit
+	RejectBackpressure     = "backpressure"      // refused while ingest buffers are full
+)
+
+// DropTruncated is the reason the index's drop counts give entries stored
+// with their line truncated, alongside the Reject* reasons
+const DropTruncated = "truncated"
+
+var rejectReasons = []string{
+	RejectInvalidRequest, RejectKeyScope, RejectInvalidStream, RejectLabelSchema,
+	RejectLabelLimit, RejectInvalidTimestamp, RejectTooLate, RejectTooOld, RejectLineTooLong,
+	RejectBackpressure,
+}
+
+var (
+	rejectMetricsOnce sync.Once
+	ingestRejected    *prometheus.CounterVec
+)
+
+func registerRejectMetrics() {
+	rejectMetricsOnce.Do(func() {
+		ingestRejected = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "logpulse_ingest_rejected_total",
+				Help: "Total log entries rejected during ingestion, by reason.",
+			},
+			[]string{"reason"},
+		)
+		// Export every reason from the start so rates work before the
+		// first rejection
+		for _, reason := range rejectReasons {
+			ingestRejected.WithLabelValues(reason)
+		}
+		prometheus.MustRegister(ingestRejected)
+	})
+}
+
+// RecordRejected counts n entries rejected for reason, one of the Reject*
+// constants
+func RecordRejected(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	registerRejectMetrics()
+	ingestRejected.WithLabelValues(reason).Add(float64(n))
+}
+
+// RecordRejectedRequest counts every entry of a request rejected as a whole
+func RecordRejectedRequest(reason string, req *models.IngestRequest) {
+	if req == nil {
+		return
+	}
+	n := 0
+	for _, stream := range req.Streams {
+		n += len(stream.Entries)
+	}
+	RecordRejected(reason, n)
+}
@@ -0,0 +1,118 @@
+package ingest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxStreamMetricSeries bounds the label value combinations exported by
+// the per-stream counters; lines of further combinations are counted under
+// OtherStreamsValue
+const maxStreamMetricSeries = 10000
+
+// OtherStreamsValue is every dimension of the series counting streams past
+// maxStreamMetricSeries
+const OtherStreamsValue = "__other__"
+
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var (
+	streamMetricsOnce sync.Once
+	ingestedStreams   = &streamMetrics{series: make(map[string]*streamSeries)}
+)
+
+// streamMetrics exports logpulse_ingested_lines_total and
+// logpulse_ingested_bytes_total with the allowlisted stream labels as
+// dimensions. The dimensions are set at startup, so it builds each scrape's
+// metrics itself rather than through a CounterVec of fixed labels.
+type streamMetrics struct {
+	mu        sync.Mutex
+	labels    []string
+	linesDesc *prometheus.Desc
+	bytesDesc *prometheus.Desc
+	series    map[string]*streamSeries
+}
+
+type streamSeries struct {
+	values       []string
+	lines, bytes float64
+}
+
+func registerStreamMetrics() {
+	streamMetricsOnce.Do(func() {
+		ingestedStreams.setLabels(nil)
+		prometheus.MustRegister(ingestedStreams)
+	})
+}
+
+// setLabels changes the dimensions, starting the counters over
+func (m *streamMetrics) setLabels(labels []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.labels = labels
+	m.linesDesc = prometheus.NewDesc("logpulse_ingested_lines_total",
+		"Total log lines accepted at ingest, by the stream labels allowlisted in ingest.metric_labels.", labels, nil)
+	m.bytesDesc = prometheus.NewDesc("logpulse_ingested_bytes_total",
+		"Total bytes of log lines accepted at ingest, by the stream labels allowlisted in ingest.metric_labels.", labels, nil)
+	m.series = make(map[string]*streamSeries)
+}
+
+// add counts a stream's accepted lines and their bytes
+func (m *streamMetrics) add(labels map[string]string, lines, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make([]string, len(m.labels))
+	for i, name := range m.labels {
+		values[i] = labels[name]
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok && len(m.series) >= maxStreamMetricSeries {
+		for i := range values {
+			values[i] = OtherStreamsValue
+		}
+		key = strings.Join(values, "\x00")
+		s, ok = m.series[key]
+	}
+	if !ok {
+		s = &streamSeries{values: values}
+		m.series[key] = s
+	}
+	s.lines += float64(lines)
+	s.bytes += float64(bytes)
+}
+
+// Describe sends nothing, leaving the collector unchecked, since its
+// dimensions are configured after registration
+func (m *streamMetrics) Describe(chan<- *prometheus.Desc) {}
+
+func (m *streamMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.series {
+		ch <- prometheus.MustNewConstMetric(m.linesDesc, prometheus.CounterValue, s.lines, s.values...)
+		ch <- prometheus.MustNewConstMetric(m.bytesDesc, prometheus.CounterValue, s.bytes, s.values...)
+	}
+}
+
+// SetStreamMetricLabels sets the stream labels, e.g. app and level, that
+// the ingested lines and bytes counters are broken down by. Each should have
+// few values, since every combination is a series; nil exports totals only.
+func (ing *Ingestor) SetStreamMetricLabels(labels []string) error {
+	seen := make(map[string]bool, len(labels))
+	for _, name := range labels {
+		if !metricLabelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid metric label %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate metric label %q", name)
+		}
+		seen[name] = true
+	}
+	ingestedStreams.setLabels(append([]string(nil), labels...))
+	return nil
+}
@@ -0,0 +1,197 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/wal"
+)
+
+// replayedSegment is the segment recorded for replayed entries. Segments
+// are numbered from 1, so until those entries are flushed no segment is
+// deleted.
+const replayedSegment = 1
+
+// walRecord is a write-ahead log record: the entries accepted for a stream
+// in one request, or a note that a buffer's entries reached a chunk
+type walRecord struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Entries []walEntry        `json:"entries,omitempty"`
+
+	// Flushed is the key of a buffer (the stream hash, with the late suffix
+	// for late chunks) whose entries numbered From to To are in a chunk
+	Flushed string `json:"flushed,omitempty"`
+	From    uint64 `json:"from,omitempty"`
+	To      uint64 `json:"to,omitempty"`
+}
+
+type walEntry struct {
+	Seq  uint64 `json:"seq"`
+	ID   string `json:"id"`
+	Ts   int64  `json:"ts"` // unix nanoseconds
+	Line string `json:"line"`
+	Late bool   `json:"late,omitempty"`
+}
+
+// SetWAL logs every accepted entry to w before Ingest returns. Each
+// request's entries for a stream are one record, and a record noting the
+// flush follows every chunk written, so segments are deleted once all the
+// entries in them are in chunks. Must be called before ReplayWAL and Start.
+func (ing *Ingestor) SetWAL(w *wal.WAL) {
+	ing.wal = w
+}
+
+// trackWAL adds an entry to the stream's pending record, numbered after
+// the entries before it; the numbers are taken by markWAL once the record
+// is appended. bufferMu must be held.
+func (ing *Ingestor) trackWAL(rec *walRecord, entry *models.LogEntry, late bool) {
+	rec.Entries = append(rec.Entries, walEntry{
+		Seq:  ing.walSeq + uint64(len(rec.Entries)) + 1,
+		ID:   entry.ID,
+		Ts:   entry.Timestamp.UnixNano(),
+		Line: entry.Line,
+		Late: late,
+	})
+}
+
+// markWAL notes that buf holds the entry logged under seq, in segment or
+// a later one; bufferMu must be held
+func (ing *Ingestor) markWAL(buf *logBuffer, segment, seq uint64) {
+	ing.walSeq = max(ing.walSeq, seq)
+	if buf.walSegment == 0 {
+		buf.walSegment = segment
+	}
+	if buf.walFirst == 0 {
+		buf.walFirst = seq
+	}
+	buf.walLast = seq
+}
+
+func (ing *Ingestor) appendWAL(rec *walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = ing.wal.Append(data)
+	return err
+}
+
+// commitWAL notes that buf's entries reached a chunk and deletes the
+// segments no pending entry needs anymore; bufferMu must be held
+func (ing *Ingestor) commitWAL(key string, buf *logBuffer) {
+	if ing.wal == nil || buf.walFirst == 0 {
+		return
+	}
+	if err := ing.appendWAL(&walRecord{Flushed: key, From: buf.walFirst, To: buf.walLast}); err != nil {
+		log.Printf("[Ingestor] WARNING: failed to log a flush to the WAL, its entries may be replayed twice: %v", err)
+	}
+	buf.walSegment, buf.walFirst, buf.walLast = 0, 0, 0
+
+	oldest := ing.wal.Segment()
+	if ing.walPinned != 0 && ing.walPinned < oldest {
+		oldest = ing.walPinned
+	}
+	for _, b := range ing.buffers {
+		if b.walSegment != 0 && b.walSegment < oldest {
+			oldest = b.walSegment
+		}
+	}
+	if err := ing.wal.Checkpoint(oldest); err != nil {
+		log.Printf("[Ingestor] WARNING: failed to delete flushed WAL segments: %v", err)
+	}
+}
+
+// pinWAL keeps the segments holding entries of buf, whose flush failed, so
+// a restart replays them; bufferMu must be held
+func (ing *Ingestor) pinWAL(buf *logBuffer) {
+	if buf.walSegment != 0 && (ing.walPinned == 0 || buf.walSegment < ing.walPinned) {
+		ing.walPinned = buf.walSegment
+	}
+	buf.walSegment, buf.walFirst, buf.walLast = 0, 0, 0
+}
+
+// ReplayWAL restores the logged entries that never reached a chunk, as a
+// crash leaves them, and flushes them to chunks, which deletes the replayed
+// segments. It returns the number of entries restored. Must be called after
+// SetWAL and before Start.
+func (ing *Ingestor) ReplayWAL() (int, error) {
+	if ing.wal == nil {
+		return 0, nil
+	}
+
+	var records []walRecord
+	flushed := make(map[string][][2]uint64)
+	_, err := ing.wal.Replay(func(data []byte) error {
+		var rec walRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("corrupt WAL record: %w", err)
+		}
+		if rec.Flushed != "" {
+			flushed[rec.Flushed] = append(flushed[rec.Flushed], [2]uint64{rec.From, rec.To})
+		} else {
+			records = append(records, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	ing.bufferMu.Lock()
+	for _, rec := range records {
+		hash := models.Labels(rec.Labels).Hash()
+		for _, e := range rec.Entries {
+			// Keep numbering after the replayed entries, so flushes noted
+			// from now on still match them if this run crashes too
+			ing.walSeq = max(ing.walSeq, e.Seq)
+
+			key := hash
+			if e.Late {
+				key += lateBufferSuffix
+			}
+			if walFlushed(flushed[key], e.Seq) {
+				continue
+			}
+			buf, ok := ing.buffers[key]
+			if !ok {
+				buf = ing.newBuffer(rec.Labels)
+				ing.buffers[key] = buf
+			}
+			if len(buf.entries) == 0 {
+				buf.openedAt = time.Now()
+			}
+			buf.entries = append(buf.entries, models.LogEntry{
+				ID:        e.ID,
+				Timestamp: time.Unix(0, e.Ts).UTC(),
+				Line:      e.Line,
+				Labels:    rec.Labels,
+			})
+			buf.size += len(e.Line)
+			ing.addBuffered(1)
+			buf.walSegment = replayedSegment
+			if buf.walFirst == 0 {
+				buf.walFirst = e.Seq
+			}
+			buf.walLast = e.Seq
+			restored++
+		}
+	}
+	ing.bufferMu.Unlock()
+
+	ing.flushAll()
+	return restored, nil
+}
+
+// walFlushed reports whether entry seq is within one of the flushed ranges
+func walFlushed(ranges [][2]uint64, seq uint64) bool {
+	for _, r := range ranges {
+		if seq >= r[0] && seq <= r[1] {
+			return true
+		}
+	}
+	return false
+}
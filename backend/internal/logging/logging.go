@@ -0,0 +1,51 @@
+// Package logging configures the server's own log output: slog records,
+// as text or JSON, each tagged with the component that wrote it.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New creates a logger writing records of level and above to w in format
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// Setup makes a logger writing to stderr the default, for slog and for the
+// log package, whose output is logged at info level
+func Setup(format, level string) error {
+	logger, err := New(os.Stderr, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Component returns the default logger with records tagged with the
+// component, e.g. StreamHub. Loggers taken before Setup keep the previous
+// default.
+func Component(name string) *slog.Logger {
+	return slog.Default().With("component", name)
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestNew_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger = logger.With("component", "StreamHub")
+	logger.Debug("Not logged")
+	logger.Info("Client connected", "clients", 3)
+	logger.Warn("Client buffer full", "drops", 1)
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected a JSON object per line, got %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records at info and above, got %d", len(records))
+	}
+	first := records[0]
+	for _, key := range []string{"time", "level", "msg", "component", "clients"} {
+		if _, ok := first[key]; !ok {
+			t.Errorf("expected key %q in %v", key, first)
+		}
+	}
+	if first["level"] != "INFO" || first["msg"] != "Client connected" || first["component"] != "StreamHub" || first["clients"] != float64(3) {
+		t.Errorf("unexpected record %v", first)
+	}
+	if records[1]["level"] != "WARN" {
+		t.Errorf("expected a WARN record, got %v", records[1])
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+	if _, err := New(&bytes.Buffer{}, FormatText, "verbose"); err == nil {
+		t.Error("expected an unknown level to be refused")
+	}
+}
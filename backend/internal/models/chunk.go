@@ -13,11 +13,35 @@ type Chunk struct {
 	FilePath   string            `json:"filePath"`
 }
 
-// ChunkMeta is stored alongside chunk data for quick lookups
+// ChunkMeta is stored alongside chunk data for quick lookups. Metadata
+// written before SchemaVersion existed (version 0) lacks the checksum and
+// nanosecond bounds; migration fills them in.
 type ChunkMeta struct {
 	ID         string            `json:"id"`
 	Labels     map[string]string `json:"labels"`
 	StartTime  int64             `json:"start_time"` // Unix timestamp
 	EndTime    int64             `json:"end_time"`
 	EntryCount int               `json:"entry_count"`
+	Encoding   string            `json:"encoding,omitempty"` // json (default) or msgpack
+	// Compression is the codec the data file is compressed with, gzip for
+	// .log.gz chunks; empty for plain .log chunks
+	Compression string `json:"compression,omitempty"`
+
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	StartTimeNano int64  `json:"start_time_ns,omitempty"` // Unix nanoseconds
+	EndTimeNano   int64  `json:"end_time_ns,omitempty"`
+	Checksum      string `json:"checksum,omitempty"` // CRC-32C of the data file as stored, hex
+
+	// Replaces lists the chunks compaction merged into this one until they
+	// are deleted; any still on disk are deleted when compaction resumes
+	Replaces []string `json:"replaces,omitempty"`
+}
+
+// Bounds returns the times of the chunk's first and last entries, to the
+// nanosecond when the metadata records them
+func (m *ChunkMeta) Bounds() (time.Time, time.Time) {
+	if m.StartTimeNano != 0 || m.EndTimeNano != 0 {
+		return time.Unix(0, m.StartTimeNano), time.Unix(0, m.EndTimeNano)
+	}
+	return time.Unix(m.StartTime, 0), time.Unix(m.EndTime, 0)
 }
@@ -1,8 +1,27 @@
 package plugin
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"text/template"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/logpulse/backend/internal/clock"
+)
+
+// notifyTimeout bounds a single notifier delivery
+const notifyTimeout = 10 * time.Second
+
+var (
+	alertMetricsOnce   sync.Once
+	alertQueryTimeouts *prometheus.CounterVec
+	alertMuted         *prometheus.CounterVec
 )
 
 type AlertRule struct {
@@ -12,18 +31,65 @@ type AlertRule struct {
 	Window    time.Duration     `json:"window"`
 	Channels  []string          `json:"channels"` // e.g. ["slack", "webhook"]
 	Labels    map[string]string `json:"labels"`
+	Severity  string            `json:"severity,omitempty"`
+	// Duration is how long the value must stay over the threshold before
+	// the rule fires; until then it is pending (0 = fire on the first
+	// crossing)
+	Duration time.Duration `json:"duration,omitempty"`
+	// Annotations carry free-form context such as summary or runbook_url.
+	// Values are Go templates rendered with .Value, .Threshold, .Name and .Labels.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// RepeatInterval overrides the manager default for this rule (0 = default)
+	RepeatInterval time.Duration `json:"repeat_interval,omitempty"`
 }
 
 type AlertManager struct {
 	Rules    []AlertRule
 	mu       sync.RWMutex
 	Notifier *WebhookNotifier
+
+	// Notifiers built from config, keyed by the name rules list in channels
+	notifiers map[string]Notifier
+
+	// RepeatInterval is the default minimum time between notifications
+	// for a rule that stays firing (0 = notify once per firing)
+	RepeatInterval time.Duration
+
+	// QuietHours mutes notifications on a recurring schedule (nil = never)
+	QuietHours *QuietHours
+
+	// Clock times evaluations; tests replace the real clock with a fake
+	Clock clock.Clock
+
+	// Per-rule state, keyed by rule name
+	states map[string]*ruleState
 }
 
 func NewAlertManager(notifier *WebhookNotifier) *AlertManager {
+	alertMetricsOnce.Do(func() {
+		alertQueryTimeouts = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "alert_evaluation_query_timeouts_total",
+				Help: "Total alert rule evaluations skipped because the query exceeded its deadline.",
+			},
+			[]string{"rule"},
+		)
+		alertMuted = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "alert_notifications_muted_total",
+				Help: "Total firing alert evaluations whose notification was muted by quiet hours.",
+			},
+			[]string{"rule"},
+		)
+		prometheus.MustRegister(alertQueryTimeouts, alertMuted)
+	})
+
 	return &AlertManager{
-		Rules:    []AlertRule{},
-		Notifier: notifier,
+		Rules:     []AlertRule{},
+		Notifier:  notifier,
+		notifiers: make(map[string]Notifier),
+		states:    make(map[string]*ruleState),
+		Clock:     clock.Real{},
 	}
 }
 
@@ -33,23 +99,186 @@ func (am *AlertManager) AddRule(rule AlertRule) {
 	am.Rules = append(am.Rules, rule)
 }
 
-// EvaluateRules should be called periodically (e.g. every minute)
+// ConfigureNotifiers instantiates notifiers from config through the
+// registry. Either all notifiers are created or none are.
+func (am *AlertManager) ConfigureNotifiers(cfgs []NotifierConfig) error {
+	notifiers := make(map[string]Notifier, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return fmt.Errorf("notifier of type %q has no name", cfg.Type)
+		}
+		if _, dup := notifiers[cfg.Name]; dup {
+			return fmt.Errorf("duplicate notifier name %q", cfg.Name)
+		}
+		n, err := NewNotifier(cfg)
+		if err != nil {
+			return err
+		}
+		notifiers[cfg.Name] = n
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for name, n := range notifiers {
+		am.notifiers[name] = n
+	}
+	return nil
+}
+
+// AddNotifier registers a notifier instance under a channel name
+func (am *AlertManager) AddNotifier(name string, n Notifier) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.notifiers[name] = n
+}
+
+// dispatch delivers an event to the notifiers named in its channels, or to
+// every notifier when the rule lists none. Callers hold am.mu.
+func (am *AlertManager) dispatch(event AlertEvent) {
+	targets := make(map[string]Notifier)
+	if len(event.Channels) == 0 {
+		for name, n := range am.notifiers {
+			targets[name] = n
+		}
+	}
+	for _, name := range event.Channels {
+		if n, ok := am.notifiers[name]; ok {
+			targets[name] = n
+		}
+	}
+
+	for name, n := range targets {
+		go func(name string, n Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Notify(ctx, event); err != nil {
+				log.Printf("[AlertManager] Notifier %q failed for rule %q: %v", name, event.Rule, err)
+			}
+		}(name, n)
+	}
+}
+
+// EvaluateRules should be called periodically (e.g. every minute). Each
+// rule's state advances with its value; notifiers hear once when a rule
+// starts firing, again every repeat interval while it stays firing, and once
+// when it resolves. Queries run without am.mu held, so a slow one does not
+// hold up rule changes or state lookups.
 func (am *AlertManager) EvaluateRules(queryFunc func(expr string) (float64, error)) {
 	am.mu.RLock()
-	defer am.mu.RUnlock()
-	for _, rule := range am.Rules {
+	rules := append([]AlertRule(nil), am.Rules...)
+	am.mu.RUnlock()
+
+	for _, rule := range rules {
 		value, err := queryFunc(rule.Expr)
-		if err == nil && value > rule.Threshold {
-			if am.Notifier != nil {
-				am.Notifier.Notify("alert", map[string]interface{}{
-					"rule":      rule.Name,
-					"expr":      rule.Expr,
-					"value":     value,
-					"labels":    rule.Labels,
-					"channels":  rule.Channels,
-					"timestamp": time.Now().Format(time.RFC3339),
-				})
-			}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("[AlertManager] WARN: query for rule %q timed out, skipping evaluation", rule.Name)
+			alertQueryTimeouts.WithLabelValues(rule.Name).Inc()
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		am.mu.Lock()
+		am.evaluate(rule, value)
+		am.mu.Unlock()
+	}
+}
+
+// evaluate advances rule's state with its value and sends the notification
+// due, if any. Callers hold am.mu.
+func (am *AlertManager) evaluate(rule AlertRule, value float64) {
+	now := am.Clock.Now()
+	st := am.state(rule.Name)
+	notified := !st.lastNotified.IsZero()
+	if am.transition(rule, value, now) {
+		// Resolves are sent through quiet hours: they close out a
+		// notification someone already received
+		if notified {
+			am.notify(rule, StateResolved, value, now)
+		}
+		return
+	}
+	if st.state != StateFiring {
+		return
+	}
+	if am.QuietHours.Mutes(rule.Severity, now) {
+		// Leave the firing unnotified, so it is sent once the quiet
+		// window ends
+		if st.firedAt.Equal(now) {
+			log.Printf("[AlertManager] Rule %q fired during quiet hours, notification muted", rule.Name)
+		}
+		alertMuted.WithLabelValues(rule.Name).Inc()
+		return
+	}
+	if am.shouldNotify(rule, now) {
+		am.notify(rule, StateFiring, value, now)
+	}
+}
+
+// notify sends a firing or resolved event for rule to the webhooks and the
+// rule's channels. Callers hold am.mu.
+func (am *AlertManager) notify(rule AlertRule, status AlertState, value float64, now time.Time) {
+	event := AlertEvent{
+		Rule:        rule.Name,
+		Status:      status,
+		Expr:        rule.Expr,
+		Value:       value,
+		Threshold:   rule.Threshold,
+		Severity:    rule.Severity,
+		Labels:      rule.Labels,
+		Annotations: renderAnnotations(rule, value),
+		Channels:    rule.Channels,
+		Timestamp:   now,
+	}
+	if am.Notifier != nil {
+		am.Notifier.Notify("alert", map[string]interface{}{
+			"rule":        event.Rule,
+			"status":      string(event.Status),
+			"expr":        event.Expr,
+			"value":       event.Value,
+			"labels":      event.Labels,
+			"annotations": event.Annotations,
+			"channels":    event.Channels,
+			"timestamp":   event.Timestamp.Format(time.RFC3339),
+		})
+	}
+	am.dispatch(event)
+}
+
+// annotationData is the template context for rule annotations
+type annotationData struct {
+	Name      string
+	Value     float64
+	Threshold float64
+	Labels    map[string]string
+}
+
+// renderAnnotations expands annotation templates with the triggering value.
+// An annotation that fails to parse or execute is passed through unchanged.
+func renderAnnotations(rule AlertRule, value float64) map[string]string {
+	if len(rule.Annotations) == 0 {
+		return nil
+	}
+	data := annotationData{
+		Name:      rule.Name,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Labels:    rule.Labels,
+	}
+	out := make(map[string]string, len(rule.Annotations))
+	for k, text := range rule.Annotations {
+		out[k] = text
+		tmpl, err := template.New(k).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			log.Printf("[AlertManager] Invalid annotation %q for rule %q: %v", k, rule.Name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			log.Printf("[AlertManager] Failed to render annotation %q for rule %q: %v", k, rule.Name, err)
+			continue
 		}
+		out[k] = buf.String()
 	}
+	return out
 }
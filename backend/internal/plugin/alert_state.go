@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"time"
+)
+
+// AlertState is where a rule is in its lifecycle. A rule is inactive until
+// its value crosses the threshold, pending while it stays over for less than
+// the rule's Duration, then firing, and resolved once the value falls back.
+// A crossing from resolved starts over at pending.
+type AlertState string
+
+const (
+	StateInactive AlertState = "inactive"
+	StatePending  AlertState = "pending"
+	StateFiring   AlertState = "firing"
+	StateResolved AlertState = "resolved"
+)
+
+// ruleState tracks one rule across evaluations
+type ruleState struct {
+	state          AlertState
+	value          float64
+	activeSince    time.Time // first evaluation over the threshold
+	firedAt        time.Time
+	resolvedAt     time.Time
+	lastEvaluation time.Time
+	// lastNotified is zero until the current firing is notified, so a
+	// muted firing is sent once quiet hours end and a resolve is only sent
+	// for a firing someone was told about
+	lastNotified time.Time
+}
+
+// AlertStatus is a snapshot of a rule's state
+type AlertStatus struct {
+	Rule           string     `json:"rule"`
+	State          AlertState `json:"state"`
+	Value          float64    `json:"value"`
+	Threshold      float64    `json:"threshold"`
+	ActiveSince    *time.Time `json:"active_since,omitempty"`
+	FiredAt        *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	LastEvaluation *time.Time `json:"last_evaluation,omitempty"`
+	LastNotified   *time.Time `json:"last_notified,omitempty"`
+}
+
+// state returns the tracked state of a rule, inactive if it was never
+// evaluated. Callers hold am.mu.
+func (am *AlertManager) state(name string) *ruleState {
+	st, ok := am.states[name]
+	if !ok {
+		st = &ruleState{state: StateInactive}
+		am.states[name] = st
+	}
+	return st
+}
+
+// RuleState reports the state of the named rule; false if no such rule
+func (am *AlertManager) RuleState(name string) (AlertStatus, bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	for _, rule := range am.Rules {
+		if rule.Name != name {
+			continue
+		}
+		status := AlertStatus{Rule: name, State: StateInactive, Threshold: rule.Threshold}
+		if st, ok := am.states[name]; ok {
+			status.State = st.state
+			status.Value = st.value
+			status.ActiveSince = timeOrNil(st.activeSince)
+			status.FiredAt = timeOrNil(st.firedAt)
+			status.ResolvedAt = timeOrNil(st.resolvedAt)
+			status.LastEvaluation = timeOrNil(st.lastEvaluation)
+			status.LastNotified = timeOrNil(st.lastNotified)
+		}
+		return status, true
+	}
+	return AlertStatus{}, false
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// transition moves a rule's state for an evaluation of value at now and
+// reports whether the rule just resolved. Callers hold am.mu.
+func (am *AlertManager) transition(rule AlertRule, value float64, now time.Time) (resolved bool) {
+	st := am.state(rule.Name)
+	st.value = value
+	st.lastEvaluation = now
+
+	if value <= rule.Threshold {
+		switch st.state {
+		case StateFiring:
+			st.state = StateResolved
+			st.resolvedAt = now
+			return true
+		case StatePending:
+			st.state = StateInactive
+		}
+		return false
+	}
+
+	if st.state == StateInactive || st.state == StateResolved {
+		st.state = StatePending
+		st.activeSince = now
+		st.firedAt = time.Time{}
+		st.lastNotified = time.Time{}
+	}
+	if st.state == StatePending && now.Sub(st.activeSince) >= rule.Duration {
+		st.state = StateFiring
+		st.firedAt = now
+	}
+	return false
+}
+
+// shouldNotify reports whether a firing evaluation warrants a notification:
+// the first since the rule began firing, or a repeat once the rule's repeat
+// interval has elapsed since the last one. Callers hold am.mu.
+func (am *AlertManager) shouldNotify(rule AlertRule, now time.Time) bool {
+	st := am.state(rule.Name)
+	if st.state != StateFiring {
+		return false
+	}
+	repeat := rule.RepeatInterval
+	if repeat <= 0 {
+		repeat = am.RepeatInterval
+	}
+	if !st.lastNotified.IsZero() && (repeat <= 0 || now.Sub(st.lastNotified) < repeat) {
+		return false
+	}
+	st.lastNotified = now
+	return true
+}
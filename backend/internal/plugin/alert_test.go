@@ -0,0 +1,279 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/clock"
+)
+
+func TestShouldNotify_RepeatInterval(t *testing.T) {
+	am := NewAlertManager(nil)
+	am.RepeatInterval = time.Hour
+	rule := AlertRule{Name: "errors", Threshold: 10}
+	start := time.Now()
+	fire := func(at time.Time) bool {
+		am.transition(rule, 20, at)
+		return am.shouldNotify(rule, at)
+	}
+
+	if !fire(start) {
+		t.Fatal("expected first firing to notify")
+	}
+	if fire(start.Add(30 * time.Minute)) {
+		t.Error("expected repeat within interval to be suppressed")
+	}
+	if !fire(start.Add(61 * time.Minute)) {
+		t.Error("expected notification once the interval elapsed")
+	}
+}
+
+func TestShouldNotify_RuleOverrideAndResolve(t *testing.T) {
+	am := NewAlertManager(nil)
+	am.RepeatInterval = time.Hour
+	rule := AlertRule{Name: "errors", RepeatInterval: 5 * time.Minute}
+	start := time.Now()
+	fire := func(at time.Time) bool {
+		am.transition(rule, 20, at)
+		return am.shouldNotify(rule, at)
+	}
+
+	fire(start)
+	if !fire(start.Add(6 * time.Minute)) {
+		t.Error("expected rule override to shorten the repeat interval")
+	}
+
+	// A resolve followed by a new firing notifies immediately
+	if !am.transition(rule, 0, start.Add(6*time.Minute+30*time.Second)) {
+		t.Fatal("expected the rule to resolve")
+	}
+	if !fire(start.Add(7 * time.Minute)) {
+		t.Error("expected resolve→fire transition to notify")
+	}
+}
+
+func TestEvaluateRules_SuppressesRepeats(t *testing.T) {
+	am := NewAlertManager(nil)
+	am.RepeatInterval = time.Hour
+	am.AddRule(AlertRule{Name: "errors", Expr: `{level="error"}`, Threshold: 10})
+
+	value := 20.0
+	query := func(string) (float64, error) { return value, nil }
+
+	am.EvaluateRules(query)
+	first := am.state("errors").lastNotified
+	am.EvaluateRules(query)
+	if !am.state("errors").lastNotified.Equal(first) {
+		t.Error("expected second evaluation within interval not to notify")
+	}
+
+	value = 0
+	am.EvaluateRules(query)
+	if st := am.state("errors").state; st != StateResolved {
+		t.Errorf("expected rule to be resolved, got %s", st)
+	}
+}
+
+func TestEvaluateRules_QueriesWithoutLock(t *testing.T) {
+	am := NewAlertManager(nil)
+	am.AddRule(AlertRule{Name: "errors", Expr: `{level="error"}`, Threshold: 10})
+
+	// A query that reads rule state, as the alerts API does meanwhile,
+	// would deadlock if the rules were evaluated under the lock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		am.EvaluateRules(func(string) (float64, error) {
+			am.RuleState("errors")
+			am.AddRule(AlertRule{Name: "added", Threshold: 1})
+			return 20, nil
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("EvaluateRules blocked on its own lock")
+	}
+	if status, _ := am.RuleState("errors"); status.State != StateFiring {
+		t.Errorf("expected the rule firing, got %s", status.State)
+	}
+}
+
+func TestRenderAnnotations(t *testing.T) {
+	rule := AlertRule{
+		Name:      "errors",
+		Threshold: 10,
+		Labels:    map[string]string{"service": "api"},
+		Annotations: map[string]string{
+			"summary":     "{{.Labels.service}} logged {{.Value}} errors (> {{.Threshold}})",
+			"runbook_url": "https://runbooks.example.com/errors",
+			"broken":      "{{.Value",
+		},
+	}
+	got := renderAnnotations(rule, 42)
+	if got["summary"] != "api logged 42 errors (> 10)" {
+		t.Errorf("unexpected summary: %q", got["summary"])
+	}
+	if got["runbook_url"] != "https://runbooks.example.com/errors" {
+		t.Errorf("unexpected runbook_url: %q", got["runbook_url"])
+	}
+	if got["broken"] != "{{.Value" {
+		t.Errorf("expected invalid template to pass through, got %q", got["broken"])
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	payload := map[string]interface{}{"labels": map[string]string{"env": "production", "service": "db"}}
+	if !matchLabels(nil, payload) {
+		t.Error("expected empty match to accept")
+	}
+	if !matchLabels(map[string]string{"env": "production"}, payload) {
+		t.Error("expected matching label to accept")
+	}
+	if matchLabels(map[string]string{"env": "staging"}, payload) {
+		t.Error("expected mismatched label to reject")
+	}
+}
+
+func TestEvaluateRules_SkipsTimedOutQuery(t *testing.T) {
+	am := NewAlertManager(nil)
+	am.AddRule(AlertRule{Name: "slow", Expr: `{level="error"}`, Threshold: 10})
+
+	am.EvaluateRules(func(string) (float64, error) { return 0, context.DeadlineExceeded })
+	if st := am.state("slow"); st.state != StateInactive || !st.lastNotified.IsZero() {
+		t.Error("expected timed-out rule to be skipped")
+	}
+}
+
+func TestQuietHours_Mutes(t *testing.T) {
+	q, err := NewQuietHours("UTC", []QuietWindow{
+		{Days: []string{"sat", "sun"}},
+		{Days: []string{"fri"}, Start: "22:00", End: "07:00"},
+	}, nil, []string{"critical"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		at       string
+		severity string
+		want     bool
+	}{
+		{"2024-01-13T12:00:00Z", "warning", true},   // Saturday
+		{"2024-01-13T12:00:00Z", "critical", false}, // exempt
+		{"2024-01-12T23:00:00Z", "warning", true},   // Friday night
+		{"2024-01-15T06:00:00Z", "warning", false},  // Monday: the weekend window ends at midnight
+		{"2024-01-16T06:00:00Z", "warning", false},  // Tuesday morning
+		{"2024-01-12T21:59:00Z", "warning", false},  // before the Friday window
+	}
+	for _, c := range cases {
+		at, _ := time.Parse(time.RFC3339, c.at)
+		if got := q.Mutes(c.severity, at); got != c.want {
+			t.Errorf("Mutes(%s, %s) = %v, want %v", c.severity, c.at, got, c.want)
+		}
+	}
+
+	if _, err := NewQuietHours("Mars/Olympus", nil, nil, nil); err == nil {
+		t.Error("expected error for unknown timezone")
+	}
+}
+
+func TestEvaluateRules_QuietHoursDefersNotification(t *testing.T) {
+	am := NewAlertManager(nil)
+	am.QuietHours, _ = NewQuietHours("", []QuietWindow{{}}, nil, nil) // always quiet
+	am.AddRule(AlertRule{Name: "errors", Threshold: 1, Severity: "warning"})
+
+	am.EvaluateRules(func(string) (float64, error) { return 5, nil })
+	if am.state("errors").state != StateFiring {
+		t.Error("expected the firing to be recorded during quiet hours")
+	}
+	if !am.state("errors").lastNotified.IsZero() {
+		t.Error("expected no notification during quiet hours")
+	}
+
+	am.QuietHours = nil
+	am.EvaluateRules(func(string) (float64, error) { return 5, nil })
+	if am.state("errors").lastNotified.IsZero() {
+		t.Error("expected the deferred notification once quiet hours end")
+	}
+}
+
+func TestEvaluateRules_RepeatsAfterInterval(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC))
+	am := NewAlertManager(nil)
+	am.Clock = clk
+	am.RepeatInterval = time.Hour
+	am.AddRule(AlertRule{Name: "errors", Threshold: 10})
+	query := func(string) (float64, error) { return 20, nil }
+
+	am.EvaluateRules(query)
+	clk.Advance(59 * time.Minute)
+	am.EvaluateRules(query)
+	if got := am.state("errors").lastNotified; !got.Equal(clk.Now().Add(-59 * time.Minute)) {
+		t.Errorf("expected the repeat within the interval to be suppressed, last notified %v", got)
+	}
+
+	clk.Advance(time.Minute)
+	am.EvaluateRules(query)
+	if got := am.state("errors").lastNotified; !got.Equal(clk.Now()) {
+		t.Errorf("expected a repeat once the interval elapsed, last notified %v", got)
+	}
+}
+
+func TestEvaluateRules_FiresOnceAndResolves(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC))
+	recorder := &recordingNotifier{events: make(chan AlertEvent, 10)}
+	am := NewAlertManager(nil)
+	am.Clock = clk
+	am.AddNotifier("oncall", recorder)
+	am.AddRule(AlertRule{Name: "errors", Threshold: 10, Duration: 2 * time.Minute, Channels: []string{"oncall"}})
+
+	// Over the threshold for 3 minutes, back under for 2
+	values := []float64{5, 20, 20, 20, 20, 3, 2}
+	wantStates := []AlertState{StateInactive, StatePending, StatePending, StateFiring, StateFiring, StateResolved, StateResolved}
+	for i, v := range values {
+		am.EvaluateRules(func(string) (float64, error) { return v, nil })
+		status, ok := am.RuleState("errors")
+		if !ok || status.State != wantStates[i] {
+			t.Fatalf("evaluation %d: expected %s, got %+v", i, wantStates[i], status)
+		}
+		clk.Advance(time.Minute)
+	}
+
+	var got []AlertState
+	deadline := time.After(time.Second)
+	for len(got) < 2 {
+		select {
+		case e := <-recorder.events:
+			got = append(got, e.Status)
+		case <-deadline:
+			t.Fatalf("expected a fire and a resolve, got %v", got)
+		}
+	}
+	select {
+	case e := <-recorder.events:
+		t.Fatalf("unexpected extra notification %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Deliveries run concurrently, so only the counts are certain
+	if got[0] == got[1] {
+		t.Errorf("expected one fire and one resolve, got %v", got)
+	}
+
+	// A pending rule that falls back never notifies
+	am.AddRule(AlertRule{Name: "blip", Threshold: 10, Duration: time.Hour, Channels: []string{"oncall"}})
+	am.EvaluateRules(func(expr string) (float64, error) { return 20, nil })
+	am.EvaluateRules(func(expr string) (float64, error) { return 0, nil })
+	if status, _ := am.RuleState("blip"); status.State != StateInactive {
+		t.Errorf("expected blip back to inactive, got %s", status.State)
+	}
+	select {
+	case e := <-recorder.events:
+		t.Errorf("unexpected notification for a pending rule %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := am.RuleState("missing"); ok {
+		t.Error("expected no state for an unknown rule")
+	}
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AlertEvent describes an alert that started firing, is still firing, or
+// resolved, delivered to notifiers
+type AlertEvent struct {
+	Rule        string            `json:"rule"`
+	Status      AlertState        `json:"status"` // firing or resolved
+	Expr        string            `json:"expr"`
+	Value       float64           `json:"value"`
+	Threshold   float64           `json:"threshold"`
+	Severity    string            `json:"severity,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Channels    []string          `json:"channels,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+}
+
+// Notifier delivers alert events to an external system
+type Notifier interface {
+	Notify(ctx context.Context, event AlertEvent) error
+}
+
+// NotifierConfig selects a registered notifier type and its settings.
+// Name is what alert rules list in their channels.
+type NotifierConfig struct {
+	Name     string
+	Type     string
+	Settings map[string]interface{}
+}
+
+// NotifierFactory builds a notifier from its settings
+type NotifierFactory func(settings map[string]interface{}) (Notifier, error)
+
+var (
+	notifierRegistryMu sync.RWMutex
+	notifierRegistry   = make(map[string]NotifierFactory)
+)
+
+// RegisterNotifier makes a notifier type available to NewNotifier. It is
+// meant to be called from init and panics on a duplicate type.
+func RegisterNotifier(typ string, factory NotifierFactory) {
+	notifierRegistryMu.Lock()
+	defer notifierRegistryMu.Unlock()
+	if _, exists := notifierRegistry[typ]; exists {
+		panic("plugin: notifier type registered twice: " + typ)
+	}
+	notifierRegistry[typ] = factory
+}
+
+// NotifierTypes lists the registered notifier types
+func NotifierTypes() []string {
+	notifierRegistryMu.RLock()
+	defer notifierRegistryMu.RUnlock()
+	types := make([]string, 0, len(notifierRegistry))
+	for typ := range notifierRegistry {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewNotifier instantiates a notifier of a registered type
+func NewNotifier(cfg NotifierConfig) (Notifier, error) {
+	notifierRegistryMu.RLock()
+	factory, ok := notifierRegistry[cfg.Type]
+	notifierRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown notifier type %q (available: %v)", cfg.Type, NotifierTypes())
+	}
+	n, err := factory(cfg.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("notifier %q: %w", cfg.Name, err)
+	}
+	return n, nil
+}
+
+// decodeSettings copies free-form notifier settings into a typed struct
+// using its json tags
+func decodeSettings(settings map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+func init() {
+	RegisterNotifier("pagerduty", newPagerDutyNotifier)
+}
+
+// pagerDutyNotifier triggers PagerDuty incidents through the Events API v2.
+// Every notification for a rule carries the same dedup key, so repeats while
+// it keeps firing update one incident instead of opening new ones, and the
+// resolve closes it.
+type pagerDutyNotifier struct {
+	url        string
+	routingKey string
+	source     string
+	client     *http.Client
+}
+
+func newPagerDutyNotifier(settings map[string]interface{}) (Notifier, error) {
+	var s struct {
+		RoutingKey string `json:"routing_key"`
+		URL        string `json:"url"`
+		Source     string `json:"source"`
+	}
+	if err := decodeSettings(settings, &s); err != nil {
+		return nil, err
+	}
+	if s.RoutingKey == "" {
+		return nil, errors.New("routing_key is required")
+	}
+	if s.URL == "" {
+		s.URL = pagerDutyEventsURL
+	}
+	if s.Source == "" {
+		s.Source = "logpulse"
+	}
+	return &pagerDutyNotifier{
+		url:        s.URL,
+		routingKey: s.RoutingKey,
+		source:     s.Source,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// pagerDutyEvent is an Events API v2 trigger or resolve event; resolves
+// carry no payload
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Links       []pagerDutyLink   `json:"links,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp"`
+	CustomDetails map[string]interface{} `json:"custom_details"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+func (n *pagerDutyNotifier) Notify(ctx context.Context, event AlertEvent) error {
+	b, err := json.Marshal(n.event(event))
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, n.client, n.url, nil, b)
+}
+
+func (n *pagerDutyNotifier) event(event AlertEvent) pagerDutyEvent {
+	dedupKey := n.source + "/" + event.Rule
+	if event.Status == StateResolved {
+		return pagerDutyEvent{RoutingKey: n.routingKey, EventAction: "resolve", DedupKey: dedupKey}
+	}
+
+	summary := fmt.Sprintf("%s is firing: value %g > threshold %g", event.Rule, event.Value, event.Threshold)
+	if s := event.Annotations["summary"]; s != "" {
+		summary = event.Rule + ": " + s
+	}
+	// PagerDuty rejects summaries over 1024 characters
+	if len(summary) > 1024 {
+		summary = summary[:1021] + "..."
+	}
+
+	details := map[string]interface{}{
+		"expr":      event.Expr,
+		"value":     event.Value,
+		"threshold": event.Threshold,
+	}
+	if len(event.Labels) > 0 {
+		details["labels"] = event.Labels
+	}
+	if len(event.Annotations) > 0 {
+		details["annotations"] = event.Annotations
+	}
+
+	pd := pagerDutyEvent{
+		RoutingKey:  n.routingKey,
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+		Payload: &pagerDutyPayload{
+			Summary:       summary,
+			Source:        n.source,
+			Severity:      pagerDutySeverity(event.Severity),
+			Timestamp:     event.Timestamp.UTC().Format(time.RFC3339),
+			CustomDetails: details,
+		},
+	}
+	if runbook := event.Annotations["runbook_url"]; runbook != "" {
+		pd.Links = []pagerDutyLink{{Href: runbook, Text: "Runbook"}}
+	}
+	return pd
+}
+
+// pagerDutySeverity maps a rule severity onto the four PagerDuty accepts,
+// defaulting to error
+func pagerDutySeverity(severity string) string {
+	switch severity {
+	case "critical", "error", "warning", "info":
+		return severity
+	case "warn":
+		return "warning"
+	}
+	return "error"
+}
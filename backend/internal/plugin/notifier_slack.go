@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+func init() {
+	RegisterNotifier("slack", newSlackNotifier)
+}
+
+// slackNotifier posts a Block Kit message to a Slack incoming webhook, with
+// the same content as plain text for notifications and older clients
+type slackNotifier struct {
+	url     string
+	channel string
+	client  *http.Client
+}
+
+func newSlackNotifier(settings map[string]interface{}) (Notifier, error) {
+	var s struct {
+		WebhookURL string `json:"webhook_url"`
+		Channel    string `json:"channel"`
+	}
+	if err := decodeSettings(settings, &s); err != nil {
+		return nil, err
+	}
+	if s.WebhookURL == "" {
+		return nil, errors.New("webhook_url is required")
+	}
+	return &slackNotifier{
+		url:     s.WebhookURL,
+		channel: s.Channel,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// slackText is a Block Kit text object
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackBlock is a Block Kit layout block; only the fields of the block types
+// used here are included
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Fields   []slackText `json:"fields,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackMessage struct {
+	Channel string       `json:"channel,omitempty"`
+	Text    string       `json:"text"`
+	Blocks  []slackBlock `json:"blocks"`
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, event AlertEvent) error {
+	b, err := json.Marshal(n.message(event))
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, n.client, n.url, nil, b)
+}
+
+// message lays out an event as a headline, the summary, one field per label
+// and a context line with the query and the links in the annotations
+func (n *slackNotifier) message(event AlertEvent) slackMessage {
+	headline := fmt.Sprintf(":rotating_light: *%s* is firing: value %g > threshold %g", event.Rule, event.Value, event.Threshold)
+	if event.Status == StateResolved {
+		headline = fmt.Sprintf(":white_check_mark: *%s* resolved: value %g <= threshold %g", event.Rule, event.Value, event.Threshold)
+	}
+	if event.Severity != "" {
+		headline += fmt.Sprintf(" (%s)", event.Severity)
+	}
+	text := headline
+	blocks := []slackBlock{{Type: "section", Text: &slackText{Type: "mrkdwn", Text: headline}}}
+
+	if summary := event.Annotations["summary"]; summary != "" {
+		text += "\n" + summary
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "plain_text", Text: summary}})
+	}
+
+	keys := make([]string, 0, len(event.Labels))
+	for k := range event.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fields []slackText
+	for _, k := range keys {
+		text += fmt.Sprintf("\n• %s: %s", k, event.Labels[k])
+		fields = append(fields, slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%s", k, event.Labels[k])})
+	}
+	// Slack allows at most 10 fields in a section
+	for len(fields) > 0 {
+		batch := fields[:min(len(fields), 10)]
+		fields = fields[len(batch):]
+		blocks = append(blocks, slackBlock{Type: "section", Fields: batch})
+	}
+
+	footer := []slackText{{Type: "mrkdwn", Text: fmt.Sprintf("`%s`", event.Expr)}}
+	if runbook := event.Annotations["runbook_url"]; runbook != "" {
+		footer = append(footer, slackText{Type: "mrkdwn", Text: fmt.Sprintf("<%s|Runbook>", runbook)})
+	}
+	blocks = append(blocks, slackBlock{Type: "context", Elements: footer})
+
+	return slackMessage{Channel: n.channel, Text: text, Blocks: blocks}
+}
@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	events chan AlertEvent
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, event AlertEvent) error {
+	n.events <- event
+	return nil
+}
+
+func TestConfigureNotifiers_Registry(t *testing.T) {
+	recorder := &recordingNotifier{events: make(chan AlertEvent, 1)}
+	RegisterNotifier("test_recorder", func(settings map[string]interface{}) (Notifier, error) {
+		return recorder, nil
+	})
+
+	am := NewAlertManager(nil)
+	if err := am.ConfigureNotifiers([]NotifierConfig{{Name: "oncall", Type: "missing"}}); err == nil {
+		t.Fatal("expected error for unknown notifier type")
+	}
+	if err := am.ConfigureNotifiers([]NotifierConfig{{Name: "webhook", Type: "webhook"}}); err == nil {
+		t.Fatal("expected error for webhook notifier without url")
+	}
+	if err := am.ConfigureNotifiers([]NotifierConfig{{Name: "oncall", Type: "test_recorder"}}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+
+	am.AddRule(AlertRule{Name: "quiet", Expr: `{app="a"}`, Threshold: 1, Channels: []string{"email"}})
+	am.AddRule(AlertRule{Name: "errors", Expr: `{app="b"}`, Threshold: 1, Channels: []string{"oncall"}})
+	am.EvaluateRules(func(string) (float64, error) { return 5, nil })
+
+	select {
+	case event := <-recorder.events:
+		if event.Rule != "errors" || event.Value != 5 {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the oncall notifier to receive the alert")
+	}
+	select {
+	case event := <-recorder.events:
+		t.Errorf("rule routed to another channel reached the notifier: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNotifiers_PayloadShape(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid JSON body: %v", err)
+		}
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	event := AlertEvent{
+		Rule:        "errors",
+		Expr:        `{app="api"}`,
+		Value:       12,
+		Threshold:   10,
+		Severity:    "critical",
+		Labels:      map[string]string{"env": "prod"},
+		Annotations: map[string]string{"summary": "12 errors", "runbook_url": "https://runbooks.example.com/errors"},
+		Channels:    []string{"oncall"},
+		Timestamp:   time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+	send := func(typ string, settings map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		n, err := NewNotifier(NotifierConfig{Name: typ, Type: typ, Settings: settings})
+		if err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		if err := n.Notify(context.Background(), event); err != nil {
+			t.Fatalf("%s notify: %v", typ, err)
+		}
+		return <-bodies
+	}
+
+	body := send("webhook", map[string]interface{}{"url": srv.URL})
+	if body["rule"] != "errors" || body["value"] != 12.0 || body["severity"] != "critical" {
+		t.Errorf("unexpected webhook payload %v", body)
+	}
+
+	body = send("slack", map[string]interface{}{"webhook_url": srv.URL, "channel": "#alerts"})
+	blocks, _ := body["blocks"].([]interface{})
+	if body["channel"] != "#alerts" || body["text"] == "" || len(blocks) != 4 {
+		t.Fatalf("unexpected slack payload %v", body)
+	}
+	for i, typ := range []string{"section", "section", "section", "context"} {
+		if b := blocks[i].(map[string]interface{}); b["type"] != typ {
+			t.Errorf("block %d: expected %s, got %v", i, typ, b)
+		}
+	}
+	fields, _ := blocks[2].(map[string]interface{})["fields"].([]interface{})
+	if len(fields) != 1 || fields[0].(map[string]interface{})["text"] != "*env*\nprod" {
+		t.Errorf("expected a field per label, got %v", blocks[2])
+	}
+
+	if _, err := NewNotifier(NotifierConfig{Name: "pd", Type: "pagerduty"}); err == nil {
+		t.Error("expected error for pagerduty notifier without routing_key")
+	}
+	body = send("pagerduty", map[string]interface{}{"url": srv.URL, "routing_key": "key123"})
+	if body["routing_key"] != "key123" || body["event_action"] != "trigger" || body["dedup_key"] != "logpulse/errors" {
+		t.Errorf("unexpected pagerduty envelope %v", body)
+	}
+	payload, _ := body["payload"].(map[string]interface{})
+	if payload["summary"] != "errors: 12 errors" || payload["severity"] != "critical" ||
+		payload["source"] != "logpulse" || payload["timestamp"] != "2026-01-01T12:00:00Z" {
+		t.Errorf("unexpected pagerduty payload %v", payload)
+	}
+	if details, _ := payload["custom_details"].(map[string]interface{}); details["expr"] != `{app="api"}` {
+		t.Errorf("expected the query in custom_details, got %v", payload["custom_details"])
+	}
+	if links, _ := body["links"].([]interface{}); len(links) != 1 {
+		t.Errorf("expected the runbook link, got %v", body["links"])
+	}
+
+	event.Status = StateResolved
+	body = send("pagerduty", map[string]interface{}{"url": srv.URL, "routing_key": "key123"})
+	if body["event_action"] != "resolve" || body["dedup_key"] != "logpulse/errors" || body["payload"] != nil {
+		t.Errorf("unexpected pagerduty resolve %v", body)
+	}
+}
+
+func TestWebhookQueue_RetryAndRestart(t *testing.T) {
+	var calls int32
+	delivered := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The receiver is down for the first attempt
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		delivered <- string(body)
+	}))
+	defer srv.Close()
+
+	cfg := WebhookQueueConfig{
+		Path:       filepath.Join(t.TempDir(), "queue.json"),
+		MaxSize:    2,
+		Workers:    2,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	q, err := NewWebhookQueue(cfg)
+	if err != nil {
+		t.Fatalf("open queue: %v", err)
+	}
+	notifier := NewWebhookNotifier([]WebhookConfig{{URL: srv.URL, Events: []string{"alert"}}})
+	notifier.SetQueue(q)
+	for _, rule := range []string{"a", "b", "c"} {
+		notifier.Notify("alert", map[string]interface{}{"rule": rule})
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected the full queue to drop the oldest, got %d pending", q.Len())
+	}
+
+	// Pending deliveries survive a restart
+	q, err = NewWebhookQueue(cfg)
+	if err != nil {
+		t.Fatalf("reopen queue: %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 deliveries after reopening, got %d", q.Len())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx)
+	defer func() {
+		cancel()
+		q.Wait()
+	}()
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case body := <-delivered:
+			got[body] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for deliveries, got %v", got)
+		}
+	}
+	if !got[`{"rule":"b"}`] || !got[`{"rule":"c"}`] {
+		t.Errorf("expected rules b and c to be delivered, got %v", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected an empty queue after delivery, got %d", q.Len())
+	}
+	if q.backoff(1) != 10*time.Millisecond || q.backoff(3) != 40*time.Millisecond || q.backoff(10) != 50*time.Millisecond {
+		t.Errorf("unexpected backoff: %v %v %v", q.backoff(1), q.backoff(3), q.backoff(10))
+	}
+}
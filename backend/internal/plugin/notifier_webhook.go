@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func init() {
+	RegisterNotifier("webhook", newHTTPNotifier)
+}
+
+// httpNotifier posts the alert event as JSON to a URL
+type httpNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPNotifier(settings map[string]interface{}) (Notifier, error) {
+	var s struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Timeout string            `json:"timeout"`
+	}
+	if err := decodeSettings(settings, &s); err != nil {
+		return nil, err
+	}
+	if s.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	timeout := 5 * time.Second
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %w", s.Timeout, err)
+		}
+		timeout = d
+	}
+	return &httpNotifier{
+		url:     s.URL,
+		headers: s.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (n *httpNotifier) Notify(ctx context.Context, event AlertEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, n.client, n.url, n.headers, b)
+}
+
+// postJSON sends body to url and treats any non-2xx response as an error
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QuietWindow is a recurring time range. An empty Days list means every
+// day; a window whose end is not after its start runs past midnight into
+// the next day.
+type QuietWindow struct {
+	Days  []string // mon, tue, ... sun
+	Start string   // HH:MM, empty = 00:00
+	End   string   // HH:MM, empty = 24:00
+}
+
+// QuietHours mutes alert notifications during recurring windows
+type QuietHours struct {
+	location   *time.Location
+	windows    []quietWindow
+	severities map[string]bool // muted severities; empty mutes all
+	exempt     map[string]bool // never muted
+}
+
+type quietWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// NewQuietHours validates a quiet hours schedule. timezone is an IANA name
+// (empty = UTC). Rules whose severity is in severities are muted during the
+// windows (all rules when severities is empty), except those in exempt.
+func NewQuietHours(timezone string, windows []QuietWindow, severities, exempt []string) (*QuietHours, error) {
+	loc := time.UTC
+	if timezone != "" {
+		l, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet hours timezone %q: %w", timezone, err)
+		}
+		loc = l
+	}
+
+	q := &QuietHours{location: loc, severities: toSet(severities), exempt: toSet(exempt)}
+	for i, w := range windows {
+		var qw quietWindow
+		if len(w.Days) == 0 {
+			for d := range qw.days {
+				qw.days[d] = true
+			}
+		}
+		for _, day := range w.Days {
+			wd, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+			if !ok {
+				return nil, fmt.Errorf("quiet hours window %d: invalid day %q", i, day)
+			}
+			qw.days[wd] = true
+		}
+
+		var err error
+		if qw.start, err = parseClock(w.Start, 0); err != nil {
+			return nil, fmt.Errorf("quiet hours window %d: %w", i, err)
+		}
+		if qw.end, err = parseClock(w.End, 24*60); err != nil {
+			return nil, fmt.Errorf("quiet hours window %d: %w", i, err)
+		}
+		q.windows = append(q.windows, qw)
+	}
+	return q, nil
+}
+
+func parseClock(s string, empty int) (int, error) {
+	if s == "" {
+		return empty, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
+
+// Mutes reports whether a notification for a rule of the given severity is
+// suppressed at t
+func (q *QuietHours) Mutes(severity string, t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	severity = strings.ToLower(severity)
+	if q.exempt[severity] || (len(q.severities) > 0 && !q.severities[severity]) {
+		return false
+	}
+
+	local := t.In(q.location)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, w := range q.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Overnight window: the evening part belongs to the start day and
+		// the morning part to the day before
+		if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"time"
 )
 
 // WebhookConfig holds configuration for a webhook
@@ -13,28 +12,51 @@ import (
 type WebhookConfig struct {
 	URL    string   `json:"url"`
 	Events []string `json:"events"`
+	// Match routes alerts by rule label; empty receives everything
+	Match map[string]string `json:"match,omitempty"`
 }
 
 // WebhookNotifier sends events to configured webhooks
 // Usage: notifier.Notify("alert", map[string]interface{}{...})
 type WebhookNotifier struct {
 	Webhooks []WebhookConfig
+
+	// queue holds deliveries until they succeed; nil sends each event
+	// once, without retries
+	queue *WebhookQueue
 }
 
 func NewWebhookNotifier(cfgs []WebhookConfig) *WebhookNotifier {
 	return &WebhookNotifier{Webhooks: cfgs}
 }
 
+// SetQueue routes deliveries through q, so failed ones are retried and
+// pending ones survive a restart
+func (w *WebhookNotifier) SetQueue(q *WebhookQueue) {
+	w.queue = q
+}
+
 func (w *WebhookNotifier) Notify(event string, payload map[string]interface{}) {
+	var body []byte
 	for _, wh := range w.Webhooks {
-		if !contains(wh.Events, event) {
+		if !contains(wh.Events, event) || !matchLabels(wh.Match, payload) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(payload); err != nil {
+				log.Printf("Webhook error: %v", err)
+				return
+			}
+		}
+		if w.queue != nil {
+			w.queue.Enqueue(wh.URL, body)
 			continue
 		}
 		go func(url string) {
-			b, _ := json.Marshal(payload)
-			req, _ := http.NewRequest("POST", url, bytes.NewBuffer(b))
+			req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
 			req.Header.Set("Content-Type", "application/json")
-			client := &http.Client{Timeout: 5 * time.Second}
+			client := &http.Client{Timeout: webhookTimeout}
 			resp, err := client.Do(req)
 			if err != nil {
 				log.Printf("Webhook error: %v", err)
@@ -45,6 +67,20 @@ func (w *WebhookNotifier) Notify(event string, payload map[string]interface{}) {
 	}
 }
 
+// matchLabels reports whether the payload's labels contain every match pair
+func matchLabels(match map[string]string, payload map[string]interface{}) bool {
+	if len(match) == 0 {
+		return true
+	}
+	labels, _ := payload["labels"].(map[string]string)
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
 func contains(arr []string, s string) bool {
 	for _, v := range arr {
 		if v == s {
@@ -0,0 +1,346 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Webhook queue defaults, used for unset WebhookQueueConfig fields
+const (
+	DefaultWebhookQueueSize       = 1000
+	DefaultWebhookQueueWorkers    = 4
+	DefaultWebhookQueueMinBackoff = time.Second
+	DefaultWebhookQueueMaxBackoff = 5 * time.Minute
+)
+
+// webhookTimeout bounds a single webhook POST
+const webhookTimeout = 5 * time.Second
+
+var (
+	webhookQueueMetricsOnce sync.Once
+	webhookQueueDropped     *prometheus.CounterVec
+	webhookQueuePending     prometheus.Gauge
+)
+
+// WebhookQueueConfig configures durable webhook delivery
+type WebhookQueueConfig struct {
+	// Path is the file pending deliveries are kept in
+	Path string
+	// MaxSize bounds the pending deliveries; the oldest is dropped when full
+	MaxSize int
+	// Workers is the number of concurrent deliveries
+	Workers int
+	// MinBackoff and MaxBackoff bound the delay before a retry, doubling
+	// from MinBackoff after each failed attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts drops a delivery after this many failures (0 = never)
+	MaxAttempts int
+}
+
+// webhookDelivery is a payload waiting to be POSTed to a webhook
+type webhookDelivery struct {
+	ID          uint64          `json:"id"`
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	Enqueued    time.Time       `json:"enqueued"`
+}
+
+// WebhookQueue delivers webhook payloads from a bounded queue that is
+// written to a file on every change, so deliveries pending at shutdown or
+// crash are retried once the process starts again
+type WebhookQueue struct {
+	cfg    WebhookQueueConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	pending  []*webhookDelivery // oldest first
+	inflight map[uint64]bool
+	nextID   uint64
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWebhookQueue opens the queue at cfg.Path, loading the deliveries left
+// pending by a previous run
+func NewWebhookQueue(cfg WebhookQueueConfig) (*WebhookQueue, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("webhook queue path must not be empty")
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultWebhookQueueSize
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultWebhookQueueWorkers
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultWebhookQueueMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(cfg.MinBackoff, DefaultWebhookQueueMaxBackoff)
+	}
+
+	webhookQueueMetricsOnce.Do(func() {
+		webhookQueueDropped = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "logpulse_webhook_queue_dropped_total",
+				Help: "Total webhook deliveries dropped from the queue, by reason (full, attempts).",
+			},
+			[]string{"reason"},
+		)
+		webhookQueuePending = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "logpulse_webhook_queue_pending",
+				Help: "Webhook deliveries waiting in the queue, including those being retried.",
+			},
+		)
+		prometheus.MustRegister(webhookQueueDropped, webhookQueuePending)
+	})
+
+	q := &WebhookQueue{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: webhookTimeout},
+		inflight: make(map[uint64]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if len(q.pending) > 0 {
+		log.Printf("[WebhookQueue] Loaded %d pending deliveries from %s", len(q.pending), cfg.Path)
+	}
+	return q, nil
+}
+
+// load reads the queue file; a missing file is an empty queue
+func (q *WebhookQueue) load() error {
+	data, err := os.ReadFile(q.cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read webhook queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.pending); err != nil {
+		return fmt.Errorf("decode webhook queue %s: %w", q.cfg.Path, err)
+	}
+	// Retry right away whatever was due before the restart
+	now := time.Now()
+	for _, d := range q.pending {
+		q.nextID = max(q.nextID, d.ID)
+		if d.NextAttempt.After(now) {
+			continue
+		}
+		d.NextAttempt = now
+	}
+	for len(q.pending) > q.cfg.MaxSize {
+		q.dropOldest()
+	}
+	webhookQueuePending.Set(float64(len(q.pending)))
+	return nil
+}
+
+// persist writes the queue to a temporary file and renames it over the
+// queue file, so a crash leaves either the old or the new queue. q.mu is held.
+func (q *WebhookQueue) persist() {
+	webhookQueuePending.Set(float64(len(q.pending)))
+
+	data, err := json.Marshal(q.pending)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(q.cfg.Path), 0755)
+	}
+	if err == nil {
+		tmp := q.cfg.Path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, q.cfg.Path)
+		}
+	}
+	if err != nil {
+		log.Printf("[WebhookQueue] WARN: failed to persist %d pending deliveries: %v", len(q.pending), err)
+	}
+}
+
+// Enqueue adds a delivery of body to url, dropping the oldest pending
+// delivery when the queue is full
+func (q *WebhookQueue) Enqueue(url string, body []byte) {
+	now := time.Now()
+	q.mu.Lock()
+	if len(q.pending) >= q.cfg.MaxSize {
+		q.dropOldest()
+	}
+	q.nextID++
+	q.pending = append(q.pending, &webhookDelivery{
+		ID:          q.nextID,
+		URL:         url,
+		Body:        body,
+		NextAttempt: now,
+		Enqueued:    now,
+	})
+	q.persist()
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// dropOldest removes the oldest delivery. One being sent is forgotten too;
+// its outcome is then ignored. q.mu is held.
+func (q *WebhookQueue) dropOldest() {
+	d := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	webhookQueueDropped.WithLabelValues("full").Inc()
+	log.Printf("[WebhookQueue] WARN: queue full (%d), dropped delivery %d to %s", q.cfg.MaxSize, d.ID, d.URL)
+}
+
+func (q *WebhookQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of pending deliveries
+func (q *WebhookQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Start runs the delivery workers until ctx is cancelled
+func (q *WebhookQueue) Start(ctx context.Context) {
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+}
+
+// Wait blocks until the workers started by Start have returned
+func (q *WebhookQueue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *WebhookQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		d, wait := q.next(time.Now())
+		if d == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		// Let another worker look for due deliveries
+		q.signal()
+
+		reqCtx, cancel := context.WithTimeout(ctx, webhookTimeout)
+		err := postJSON(reqCtx, q.client, d.URL, nil, d.Body)
+		cancel()
+		if ctx.Err() != nil {
+			// Shutting down; leave the delivery queued for the next start
+			q.release(d)
+			return
+		}
+		q.complete(d, err)
+	}
+}
+
+// next claims the oldest due delivery, or returns how long until the
+// earliest one is due
+func (q *WebhookQueue) next(now time.Time) (*webhookDelivery, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wait := q.cfg.MaxBackoff
+	for _, d := range q.pending {
+		if q.inflight[d.ID] {
+			continue
+		}
+		if !d.NextAttempt.After(now) {
+			q.inflight[d.ID] = true
+			return d, 0
+		}
+		wait = min(wait, d.NextAttempt.Sub(now))
+	}
+	return nil, wait
+}
+
+func (q *WebhookQueue) release(d *webhookDelivery) {
+	q.mu.Lock()
+	delete(q.inflight, d.ID)
+	q.mu.Unlock()
+}
+
+// complete removes a delivered payload from the queue, or schedules its
+// retry with exponential backoff
+func (q *WebhookQueue) complete(d *webhookDelivery, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, d.ID)
+
+	i := q.indexOf(d.ID)
+	if i < 0 {
+		// Dropped while being sent
+		return
+	}
+	if err == nil {
+		q.remove(i)
+		q.persist()
+		return
+	}
+
+	d.Attempts++
+	if q.cfg.MaxAttempts > 0 && d.Attempts >= q.cfg.MaxAttempts {
+		q.remove(i)
+		q.persist()
+		webhookQueueDropped.WithLabelValues("attempts").Inc()
+		log.Printf("[WebhookQueue] Giving up on delivery %d to %s after %d attempts: %v", d.ID, d.URL, d.Attempts, err)
+		return
+	}
+	backoff := q.backoff(d.Attempts)
+	d.NextAttempt = time.Now().Add(backoff)
+	q.persist()
+	log.Printf("[WebhookQueue] Delivery %d to %s failed (attempt %d), retrying in %v: %v", d.ID, d.URL, d.Attempts, backoff, err)
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (q *WebhookQueue) backoff(attempts int) time.Duration {
+	delay := q.cfg.MinBackoff
+	for i := 1; i < attempts && delay < q.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, q.cfg.MaxBackoff)
+}
+
+func (q *WebhookQueue) indexOf(id uint64) int {
+	for i, d := range q.pending {
+		if d.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *WebhookQueue) remove(i int) {
+	copy(q.pending[i:], q.pending[i+1:])
+	q.pending[len(q.pending)-1] = nil
+	q.pending = q.pending[:len(q.pending)-1]
+}
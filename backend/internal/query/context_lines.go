@@ -0,0 +1,103 @@
+package query
+
+import (
+	"github.com/logpulse/backend/internal/models"
+)
+
+// lineRef identifies a stored line by its chunk and position
+type lineRef struct {
+	chunkID string
+	line    int
+}
+
+// contextTracker collects up to n non-matching lines before and after each
+// match as the scan passes them. Each stream keeps only a ring of its last n
+// lines and the matches still waiting for lines after them, so memory grows
+// with the matches rather than with every line of the streams scanned.
+// Lines arrive in the scan's stream order, chunks by start time.
+type contextTracker struct {
+	n       int
+	parsed  *ParsedQuery
+	streams map[string]*streamContext
+	lines   map[lineRef][]models.LogEntry
+}
+
+type streamContext struct {
+	recent []models.LogEntry // ring of the stream's last n lines
+	next   int
+	// pending are the matches still owed lines after them, with how many
+	pending []pendingContext
+}
+
+type pendingContext struct {
+	ref  lineRef
+	left int
+}
+
+func newContextTracker(n int, parsed *ParsedQuery) *contextTracker {
+	return &contextTracker{
+		n:       n,
+		parsed:  parsed,
+		streams: make(map[string]*streamContext),
+		lines:   make(map[lineRef][]models.LogEntry),
+	}
+}
+
+// add passes the tracker the next label-matched line of its stream, and
+// whether it matched the line filters
+func (t *contextTracker) add(loc located, match bool) {
+	key := models.Labels(loc.entry.Labels).Hash()
+	s := t.streams[key]
+	if s == nil {
+		s = &streamContext{recent: make([]models.LogEntry, 0, t.n)}
+		t.streams[key] = s
+	}
+
+	// Lines after earlier matches, which may themselves match
+	kept := s.pending[:0]
+	for _, p := range s.pending {
+		if !match {
+			t.lines[p.ref] = append(t.lines[p.ref], loc.entry)
+		}
+		if p.left--; p.left > 0 {
+			kept = append(kept, p)
+		}
+	}
+	s.pending = kept
+
+	if match {
+		ref := lineRef{chunkID: loc.chunkID, line: loc.line}
+		// The ring holds the lines before this one, oldest at next
+		for i := 0; i < len(s.recent); i++ {
+			entry := s.recent[(s.next+i)%len(s.recent)]
+			if !t.parsed.MatchLine(entry.Line) {
+				t.lines[ref] = append(t.lines[ref], entry)
+			}
+		}
+		s.pending = append(s.pending, pendingContext{ref: ref, left: t.n})
+	}
+
+	if len(s.recent) < t.n {
+		s.recent = append(s.recent, loc.entry)
+	} else {
+		s.recent[s.next] = loc.entry
+		s.next = (s.next + 1) % t.n
+	}
+}
+
+// context returns the lines collected around the given matches. Lines
+// adjacent to several matches are returned once.
+func (t *contextTracker) context(matches []located) []models.LogEntry {
+	seen := make(map[string]bool)
+	var context []models.LogEntry
+	for _, loc := range matches {
+		for _, entry := range t.lines[lineRef{chunkID: loc.chunkID, line: loc.line}] {
+			if seen[entry.ID] {
+				continue
+			}
+			seen[entry.ID] = true
+			context = append(context, entry)
+		}
+	}
+	return context
+}
@@ -0,0 +1,66 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// Cursor marks the position of the last entry returned on a page. Results are
+// ordered newest first, with ties broken by chunk ID and then by line index
+// within the chunk, so a cursor resumes exactly even when many entries share
+// a timestamp. Compaction gives merged lines a new chunk ID and index, so
+// when it merges the cursor's chunk between pages, the lines sharing the
+// cursor's timestamp may be repeated or skipped; older lines are not
+// affected.
+type Cursor struct {
+	Timestamp int64  `json:"t"` // unix nanoseconds
+	ChunkID   string `json:"c"`
+	Line      int    `json:"l"`
+}
+
+// Encode returns the cursor as an opaque URL-safe token
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a token produced by Cursor.Encode
+func DecodeCursor(token string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, &QueryError{Type: "invalid_cursor", Message: "malformed cursor"}
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ChunkID == "" || c.Line < 0 {
+		return nil, &QueryError{Type: "invalid_cursor", Message: "malformed cursor"}
+	}
+	return &c, nil
+}
+
+// located is a log entry together with its storage position
+type located struct {
+	entry   models.LogEntry
+	chunkID string
+	line    int
+
+	// value is the numeric sample produced by a delta stage
+	value    float64
+	hasValue bool
+}
+
+func (l located) cursor() Cursor {
+	return Cursor{Timestamp: l.entry.Timestamp.UnixNano(), ChunkID: l.chunkID, Line: l.line}
+}
+
+// before reports whether a sorts ahead of b in result order
+func (c Cursor) before(b Cursor) bool {
+	if c.Timestamp != b.Timestamp {
+		return c.Timestamp > b.Timestamp
+	}
+	if c.ChunkID != b.ChunkID {
+		return c.ChunkID > b.ChunkID
+	}
+	return c.Line > b.Line
+}
@@ -0,0 +1,30 @@
+package query
+
+import (
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// dedupLocated drops entries repeating an earlier one's timestamp, line and
+// labels, as retried pushes leave across chunks. matched must be in result
+// order, which puts equal timestamps together; the first copy is kept. It
+// returns the entries kept and the number dropped.
+func dedupLocated(matched []located) ([]located, int) {
+	kept := matched[:0]
+	var seen map[string]bool
+	var ts time.Time
+	for i, loc := range matched {
+		if i == 0 || !loc.entry.Timestamp.Equal(ts) {
+			ts = loc.entry.Timestamp
+			seen = make(map[string]bool)
+		}
+		key := loc.entry.Line + "\x00" + models.Labels(loc.entry.Labels).Hash()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, loc)
+	}
+	return kept, len(matched) - len(kept)
+}
@@ -0,0 +1,93 @@
+package query
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// MaxDistinctValues bounds the distinct values tracked by DistinctValues.
+// Values first seen after the cap is reached are counted as Other.
+const MaxDistinctValues = 1000
+
+// DistinctValue is one value of a field with its number of matching lines
+type DistinctValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// DistinctResult lists the distinct values of a field over a query's matches
+type DistinctResult struct {
+	Field  string          `json:"field"`
+	Values []DistinctValue `json:"values"`
+	// Other counts matching lines whose value was not tracked because the
+	// distinct value cap was reached
+	Other     int        `json:"other"`
+	Truncated bool       `json:"truncated"`
+	Stats     QueryStats `json:"stats"`
+}
+
+// DistinctValues returns the distinct values of field, with counts, over the
+// lines matching queryStr. Lines without the field are not counted. At most
+// limit values are returned, most frequent first.
+func (e *Executor) DistinctValues(queryStr, field string, startTime, endTime time.Time, limit int) (*DistinctResult, error) {
+	return e.DistinctValuesWithOptions(queryStr, field, startTime, endTime, limit, ExecuteOptions{})
+}
+
+// DistinctValuesWithOptions is DistinctValues honoring opts.Scope
+func (e *Executor) DistinctValuesWithOptions(queryStr, field string, startTime, endTime time.Time, limit int, opts ExecuteOptions) (*DistinctResult, error) {
+	startExec := time.Now()
+
+	parsed, err := ParseAdvancedQuery(queryStr)
+	if err != nil {
+		return nil, err
+	}
+	parsed.restrict(opts.Scope)
+	if limit <= 0 || limit > MaxDistinctValues {
+		limit = MaxDistinctValues
+	}
+
+	result := &DistinctResult{Field: field}
+	counts := make(map[string]int)
+	err = e.scan(context.Background(), parsed, startTime, endTime, &result.Stats, func(loc located) {
+		if !parsed.MatchLine(loc.entry.Line) {
+			return
+		}
+		result.Stats.MatchedLines++
+
+		value, ok := loc.entry.Labels[field]
+		if !ok {
+			return
+		}
+		if _, tracked := counts[value]; !tracked && len(counts) >= MaxDistinctValues {
+			result.Other++
+			result.Truncated = true
+			return
+		}
+		counts[value]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Values = make([]DistinctValue, 0, len(counts))
+	for value, count := range counts {
+		result.Values = append(result.Values, DistinctValue{Value: value, Count: count})
+	}
+	sort.Slice(result.Values, func(i, j int) bool {
+		if result.Values[i].Count != result.Values[j].Count {
+			return result.Values[i].Count > result.Values[j].Count
+		}
+		return result.Values[i].Value < result.Values[j].Value
+	})
+	if len(result.Values) > limit {
+		for _, v := range result.Values[limit:] {
+			result.Other += v.Count
+		}
+		result.Values = result.Values[:limit]
+		result.Truncated = true
+	}
+
+	result.Stats.ExecutionTime = int(time.Since(startExec).Milliseconds())
+	return result, nil
+}
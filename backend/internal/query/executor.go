@@ -1,7 +1,13 @@
 package query
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/logpulse/backend/internal/index"
@@ -13,6 +19,13 @@ import (
 type Executor struct {
 	index  *index.Index
 	reader *storage.Reader
+
+	// strict fails queries that reference chunks missing from storage
+	// instead of skipping them
+	strict bool
+	// streamWarning is the stream count above which results carry a
+	// cardinality warning (0 = never)
+	streamWarning int
 }
 
 // NewExecutor creates a new query executor
@@ -23,11 +36,37 @@ func NewExecutor(idx *index.Index, reader *storage.Reader) *Executor {
 	}
 }
 
+// SetStrictConsistency makes queries fail when the index references a chunk
+// that no longer exists on disk. By default such chunks are logged, counted
+// in QueryStats.MissingChunks and skipped.
+func (e *Executor) SetStrictConsistency(strict bool) {
+	e.strict = strict
+}
+
+// SetStreamWarningThreshold makes results matching more than n streams
+// carry a warning naming the labels that split them most (0 = disabled).
+// Unlike a limit, the query still runs in full.
+func (e *Executor) SetStreamWarningThreshold(n int) error {
+	if n < 0 {
+		return fmt.Errorf("stream warning threshold must not be negative, got %d", n)
+	}
+	e.streamWarning = n
+	return nil
+}
+
 // QueryResult contains query results and stats
 type QueryResult struct {
-	Logs        []LogResponse        `json:"logs"`
-	Stats       QueryStats           `json:"stats"`
-	Aggregation *AggregationResult   `json:"aggregation,omitempty"`
+	Logs        []LogResponse      `json:"logs"`
+	Stats       QueryStats         `json:"stats"`
+	Aggregation *AggregationResult `json:"aggregation,omitempty"`
+	// Next is an opaque token for the following page, set when the limit
+	// cut the result short
+	Next string `json:"next,omitempty"`
+	// Dropped counts entries missing from, or truncated in, the result's
+	// streams because ingestion dropped them; set with IncludeDropped
+	Dropped []index.DroppedEntries `json:"dropped,omitempty"`
+	// Warnings are diagnostics about the query that did not stop it
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 type LogResponse struct {
@@ -36,13 +75,49 @@ type LogResponse struct {
 	Level     string            `json:"level"`
 	Message   string            `json:"message"`
 	Labels    map[string]string `json:"labels"`
+	Context   bool              `json:"context,omitempty"` // surrounding line, not a match
+	Value     *float64          `json:"value,omitempty"`   // sample from a delta stage
 }
 
+// ExecuteOptions tunes query execution beyond the basic range and limit
+type ExecuteOptions struct {
+	// Context is the number of lines before and after each match to include
+	// from the same stream (line-filter queries only)
+	Context int
+	// Cursor resumes after the last entry of a previous page
+	Cursor *Cursor
+	// Scope restricts the query to streams carrying these labels, on top of
+	// the query's own selector, e.g. the labels an API key is limited to
+	Scope map[string]string
+	// MinCount and MaxCount keep only streams (label sets, including
+	// extracted fields) whose number of matching lines in the whole time
+	// range is within the bounds. 0 leaves a bound open.
+	MinCount int
+	MaxCount int
+	// IncludeDropped reports the entries of matching streams that ingestion
+	// dropped or truncated within the time range
+	IncludeDropped bool
+	// Step evaluates count_over_time, rate, bytes_over_time and bytes_rate
+	// at every multiple of Step within the range, each point covering the
+	// aggregation's range window up to it, as Loki's query_range does. 0
+	// keeps consecutive range-wide buckets from the start of the range.
+	Step time.Duration
+	// Dedup drops entries with the same timestamp, line and labels as
+	// another, e.g. from retried pushes stored in several chunks, keeping
+	// one. They are counted once by aggregations too.
+	Dedup bool
+}
+
+// MaxStepPoints bounds the points of a stepped range aggregation
+const MaxStepPoints = 11000
+
 type QueryStats struct {
 	QueriedChunks int `json:"queriedChunks"`
 	ScannedLines  int `json:"scannedLines"`
 	MatchedLines  int `json:"matchedLines"`
-	ExecutionTime int `json:"executionTime"` // milliseconds
+	MissingChunks int `json:"missingChunks"`        // indexed but absent from storage
+	Duplicates    int `json:"duplicates,omitempty"` // dropped by Dedup
+	ExecutionTime int `json:"executionTime"`        // milliseconds
 }
 
 // AggregationResult contains aggregation computation results
@@ -65,6 +140,17 @@ type AggregationGroup struct {
 
 // Execute runs a query and returns matching logs
 func (e *Executor) Execute(queryStr string, startTime, endTime time.Time, limit int) (*QueryResult, error) {
+	return e.ExecuteWithOptions(queryStr, startTime, endTime, limit, ExecuteOptions{})
+}
+
+// ExecuteWithOptions runs a query with additional execution options
+func (e *Executor) ExecuteWithOptions(queryStr string, startTime, endTime time.Time, limit int, opts ExecuteOptions) (*QueryResult, error) {
+	return e.ExecuteContext(context.Background(), queryStr, startTime, endTime, limit, opts)
+}
+
+// ExecuteContext runs a query that is abandoned with ctx's error once ctx is
+// done. Cancellation is checked between chunks.
+func (e *Executor) ExecuteContext(ctx context.Context, queryStr string, startTime, endTime time.Time, limit int, opts ExecuteOptions) (*QueryResult, error) {
 	startExec := time.Now()
 
 	// Parse query with advanced features
@@ -72,70 +158,150 @@ func (e *Executor) Execute(queryStr string, startTime, endTime time.Time, limit
 	if err != nil {
 		return nil, err
 	}
+	parsed.restrict(opts.Scope)
 
-	// Get simple labels for chunk lookup (exact matches only)
-	simpleLabels := make(map[string]string)
-	for _, m := range parsed.LabelMatchers {
-		if m.Operator == MatchEqual {
-			simpleLabels[m.Name] = m.Value
+	var stats QueryStats
+	var matched []located
+
+	// Context lines are the non-matching neighbours of each match, so the
+	// tracker sees every label-matched entry
+	withContext := opts.Context > 0 && len(parsed.LineFilters) > 0 && parsed.Aggregation == nil
+	var tracker *contextTracker
+	if withContext {
+		tracker = newContextTracker(opts.Context, parsed)
+	}
+	countFilter := opts.MinCount > 0 || opts.MaxCount > 0
+	lateCursor := len(parsed.Pipeline) > 0 || countFilter
+
+	// The first point of a stepped aggregation looks back a whole window,
+	// which may start before the range
+	scanStart := startTime
+	var points []time.Time
+	if opts.Step > 0 && parsed.Aggregation.isRange() {
+		if points, err = stepPoints(startTime, endTime, opts.Step); err != nil {
+			return nil, err
+		}
+		if len(points) > 0 && points[0].Add(-parsed.Aggregation.window(opts.Step)).Before(startTime) {
+			scanStart = points[0].Add(-parsed.Aggregation.window(opts.Step))
 		}
 	}
 
-	// Find matching chunks
-	chunkIDs := e.index.FindChunks(simpleLabels, startTime, endTime)
-
-	stats := QueryStats{
-		QueriedChunks: len(chunkIDs),
+	// Results run newest first, so a page resumed by a cursor ends at the
+	// cursor's timestamp and newer chunks are not read again. Context lines
+	// may be newer than the match they surround, so those scans keep the
+	// whole range.
+	scanEnd := endTime
+	if opts.Cursor != nil && !lateCursor && !withContext {
+		if resume := time.Unix(0, opts.Cursor.Timestamp); resume.Before(scanEnd) {
+			scanEnd = resume
+		}
 	}
 
-	var allLogs []models.LogEntry
-
-	// Read logs from each chunk
-	for _, chunkID := range chunkIDs {
-		meta := e.index.GetChunkMeta(chunkID)
-		if meta == nil {
-			continue
+	err = e.scan(ctx, parsed, scanStart, scanEnd, &stats, func(loc located) {
+		// Check line filters
+		match := parsed.MatchLine(loc.entry.Line)
+		if withContext {
+			tracker.add(loc, match)
+		}
+		if !match {
+			return
 		}
 
-		entries, scanned, err := e.reader.ReadChunkFiltered(meta.Labels, chunkID, startTime, endTime)
-		if err != nil {
-			continue
+		// Stateful stages, stream counts and dedup need the entries before
+		// the cursor too, so they apply the cursor afterwards
+		if opts.Cursor != nil && !lateCursor && !opts.Dedup && !opts.Cursor.before(loc.cursor()) {
+			return
 		}
+		matched = append(matched, loc)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		stats.ScannedLines += scanned
+	if len(parsed.Pipeline) > 0 {
+		matched = runPipeline(parsed.Pipeline, matched)
+	}
+	if countFilter {
+		matched = filterStreamCounts(matched, opts.MinCount, opts.MaxCount)
+	}
 
-		// Apply advanced filters
-		for _, entry := range entries {
-			// Check label matchers (including regex)
-			if !parsed.MatchLabels(entry.Labels) {
-				continue
+	// Lines only in the first window count towards the points, not the
+	// range's own results
+	var lookback []models.LogEntry
+	if scanStart.Before(startTime) {
+		kept := matched[:0]
+		for _, loc := range matched {
+			if loc.entry.Timestamp.Before(startTime) {
+				lookback = append(lookback, loc.entry)
+			} else {
+				kept = append(kept, loc)
 			}
+		}
+		matched = kept
+	}
 
-			// Check line filters
-			if !parsed.MatchLine(entry.Line) {
-				continue
+	// Sort newest first; chunk and line break timestamp ties so that
+	// pagination cursors are deterministic
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].cursor().before(matched[j].cursor())
+	})
+	// Copies of the line a page ended on sort after the cursor, so dedup
+	// runs first and drops them as already seen
+	if opts.Dedup {
+		matched, stats.Duplicates = dedupLocated(matched)
+	}
+	if opts.Cursor != nil && (lateCursor || opts.Dedup) {
+		kept := matched[:0]
+		for _, loc := range matched {
+			if opts.Cursor.before(loc.cursor()) {
+				kept = append(kept, loc)
 			}
-
-			allLogs = append(allLogs, entry)
 		}
+		matched = kept
 	}
 
-	stats.MatchedLines = len(allLogs)
+	stats.MatchedLines = len(matched)
+	var warnings []string
+	if w := streamCardinalityWarning(matched, e.streamWarning); w != "" {
+		warnings = append(warnings, w)
+	}
 
-	// Sort by timestamp descending (newest first)
-	sort.Slice(allLogs, func(i, j int) bool {
-		return allLogs[i].Timestamp.After(allLogs[j].Timestamp)
-	})
+	// Apply limit (only for non-aggregation queries)
+	var next string
+	if limit > 0 && len(matched) > limit && parsed.Aggregation == nil {
+		matched = matched[:limit]
+		next = matched[limit-1].cursor().Encode()
+	}
+
+	allLogs := make([]models.LogEntry, len(matched))
+	values := make(map[string]float64)
+	for i, loc := range matched {
+		allLogs[i] = loc.entry
+		if loc.hasValue {
+			values[loc.entry.ID] = loc.value
+		}
+	}
 
 	// Handle aggregations
 	var aggResult *AggregationResult
 	if parsed.Aggregation != nil {
-		aggResult = e.computeAggregation(parsed.Aggregation, allLogs, startTime, endTime)
+		aggResult = e.computeAggregation(parsed.Aggregation, allLogs, values, startTime, endTime)
+		if points != nil {
+			aggResult.Series = stepSeries(parsed.Aggregation, append(lookback, allLogs...), points, opts.Step)
+		}
 	}
 
-	// Apply limit (only for non-aggregation queries)
-	if limit > 0 && len(allLogs) > limit && parsed.Aggregation == nil {
-		allLogs = allLogs[:limit]
+	// Attach surrounding lines for the matches that survived the limit
+	isContext := make(map[string]bool)
+	if withContext {
+		contextLogs := tracker.context(matched)
+		for _, entry := range contextLogs {
+			isContext[entry.ID] = true
+		}
+		allLogs = append(allLogs, contextLogs...)
+		sort.SliceStable(allLogs, func(i, j int) bool {
+			return allLogs[i].Timestamp.After(allLogs[j].Timestamp)
+		})
 	}
 
 	// Convert to response format
@@ -152,20 +318,189 @@ func (e *Executor) Execute(queryStr string, startTime, endTime time.Time, limit
 			Level:     level,
 			Message:   entry.Line,
 			Labels:    entry.Labels,
+			Context:   isContext[entry.ID],
+		}
+		if v, ok := values[entry.ID]; ok && !isContext[entry.ID] {
+			logs[i].Value = &v
 		}
 	}
 
+	var dropped []index.DroppedEntries
+	if opts.IncludeDropped {
+		dropped = e.index.Drops(parsed.MatchLabels, startTime, endTime)
+	}
+
 	stats.ExecutionTime = int(time.Since(startExec).Milliseconds())
 
 	return &QueryResult{
 		Logs:        logs,
 		Stats:       stats,
 		Aggregation: aggResult,
+		Next:        next,
+		Dropped:     dropped,
+		Warnings:    warnings,
 	}, nil
 }
 
-// computeAggregation computes the aggregation result
-func (e *Executor) computeAggregation(agg *Aggregation, logs []models.LogEntry, startTime, endTime time.Time) *AggregationResult {
+// maxWarningLabels bounds the labels a cardinality warning names
+const maxWarningLabels = 3
+
+// streamCardinalityWarning describes the matches spanning more than
+// threshold streams, naming the labels with the most distinct values among
+// them, or returns "" when they do not. Streams are counted before the
+// limit so a small page still shows how broad the selector is.
+func streamCardinalityWarning(matched []located, threshold int) string {
+	if threshold <= 0 {
+		return ""
+	}
+	streams := make(map[string]bool)
+	values := make(map[string]map[string]bool)
+	for _, loc := range matched {
+		key := models.Labels(loc.entry.Labels).Hash()
+		if streams[key] {
+			continue
+		}
+		streams[key] = true
+		for k, v := range loc.entry.Labels {
+			if values[k] == nil {
+				values[k] = make(map[string]bool)
+			}
+			values[k][v] = true
+		}
+	}
+	if len(streams) <= threshold {
+		return ""
+	}
+
+	type labelCount struct {
+		name  string
+		count int
+	}
+	var counts []labelCount
+	for name, vals := range values {
+		// A label with one value does not split the streams
+		if len(vals) > 1 {
+			counts = append(counts, labelCount{name, len(vals)})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].name < counts[j].name
+	})
+	if len(counts) > maxWarningLabels {
+		counts = counts[:maxWarningLabels]
+	}
+
+	names := make([]string, len(counts))
+	for i, c := range counts {
+		names[i] = fmt.Sprintf("%s (%d values)", c.name, c.count)
+	}
+	return fmt.Sprintf("query matched %d streams, over the warning threshold of %d; labels with the most distinct values: %s",
+		len(streams), threshold, strings.Join(names, ", "))
+}
+
+// filterStreamCounts drops the matches of streams with fewer than min or more
+// than max matches; a zero bound is not checked
+func filterStreamCounts(matched []located, min, max int) []located {
+	counts := make(map[string]int)
+	keys := make([]string, len(matched))
+	for i, loc := range matched {
+		keys[i] = models.Labels(loc.entry.Labels).Hash()
+		counts[keys[i]]++
+	}
+
+	kept := matched[:0]
+	for i, loc := range matched {
+		n := counts[keys[i]]
+		if (min > 0 && n < min) || (max > 0 && n > max) {
+			continue
+		}
+		kept = append(kept, loc)
+	}
+	return kept
+}
+
+// scan reads every chunk that may hold entries for the parsed query within
+// the time range and calls fn for each entry passing the label matchers.
+// Line filters are left to fn.
+func (e *Executor) scan(ctx context.Context, parsed *ParsedQuery, startTime, endTime time.Time, stats *QueryStats, fn func(loc located)) error {
+	// Get simple labels for chunk lookup (exact matches only), along with
+	// prefix and suffix matchers, which are as cheap to check per chunk
+	simpleLabels := make(map[string]string)
+	var affixes []LabelMatcher
+	for _, m := range parsed.LabelMatchers {
+		switch m.Operator {
+		case MatchEqual:
+			simpleLabels[m.Name] = m.Value
+		case MatchPrefix, MatchSuffix:
+			affixes = append(affixes, m)
+		}
+	}
+
+	// Find matching chunks in one snapshot of the index, so the scan
+	// neither blocks ingestion nor sees a half-applied update
+	metas := e.index.FindChunkMetas(startTime, endTime, func(labels map[string]string) bool {
+		for i := range affixes {
+			if !affixes[i].Match(labels) {
+				return false
+			}
+		}
+		return models.Labels(labels).Match(simpleLabels)
+	})
+	stats.QueriedChunks += len(metas)
+
+	// Read the chunks in order, with the reader fetching the next ones
+	// while each is scanned
+	refs := make([]storage.ChunkRef, 0, len(metas))
+	for _, meta := range metas {
+		refs = append(refs, storage.ChunkRef{Labels: meta.Labels, ID: meta.ID})
+	}
+	chunks := e.reader.Prefetch(refs)
+	defer chunks.Close()
+
+	// Read logs from each chunk
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunkID := ref.ID
+		entries, lines, scanned, err := chunks.ReadChunkLines(ref.Labels, chunkID, startTime, endTime)
+		if errors.Is(err, fs.ErrNotExist) {
+			if e.strict {
+				return &QueryError{
+					Type:    "storage_inconsistency",
+					Message: "Index references a missing chunk",
+					Details: fmt.Sprintf("chunk %s for stream %s", chunkID, models.Labels(ref.Labels).ToPath()),
+				}
+			}
+			log.Printf("[Executor] WARN: chunk %s is indexed but missing from storage, skipping", chunkID)
+			stats.MissingChunks++
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		stats.ScannedLines += scanned
+
+		for i, entry := range entries {
+			// Check label matchers (including regex)
+			if !parsed.MatchLabels(entry.Labels) {
+				continue
+			}
+			fn(located{entry: entry, chunkID: chunkID, line: lines[i]})
+		}
+	}
+	return nil
+}
+
+// computeAggregation computes the aggregation result. When a delta stage
+// produced samples, keyed by entry ID in values, sum/avg/min/max reduce
+// those samples instead of counting lines.
+func (e *Executor) computeAggregation(agg *Aggregation, logs []models.LogEntry, values map[string]float64, startTime, endTime time.Time) *AggregationResult {
 	result := &AggregationResult{}
 
 	switch agg.Type {
@@ -205,7 +540,13 @@ func (e *Executor) computeAggregation(agg *Aggregation, logs []models.LogEntry,
 
 	case AggSum, AggAvg, AggMin, AggMax:
 		result.Type = aggTypeToString(agg.Type)
-		if len(agg.GroupBy) > 0 {
+		if len(values) > 0 {
+			result.Value = reduceValues(agg.Type, logs, values)
+			result.Series = e.computeValueSeries(agg, logs, values, startTime, endTime)
+			if len(agg.GroupBy) > 0 {
+				result.Groups = e.computeGroupedValues(agg, logs, values)
+			}
+		} else if len(agg.GroupBy) > 0 {
 			result.Groups = e.computeGroupedAggregation(agg, logs)
 		} else {
 			result.Value = float64(len(logs))
@@ -315,6 +656,81 @@ func (e *Executor) computeBytesSeries(logs []models.LogEntry, stepSeconds int64,
 	return series
 }
 
+// isRange reports whether the aggregation is a range function over lines,
+// one that can be evaluated at steps
+func (a *Aggregation) isRange() bool {
+	if a == nil {
+		return false
+	}
+	switch a.Type {
+	case AggCountOverTime, AggRate, AggBytesOverTime, AggBytesRate:
+		return true
+	}
+	return false
+}
+
+// window returns the aggregation's range, or step when the query gives none
+func (a *Aggregation) window(step time.Duration) time.Duration {
+	if a.Duration > 0 {
+		return time.Duration(a.Duration) * time.Second
+	}
+	return step
+}
+
+// stepPoints returns the multiples of step from startTime to endTime
+// inclusive, so the points of a series line up across queries whatever
+// range each asks for
+func stepPoints(startTime, endTime time.Time, step time.Duration) ([]time.Time, error) {
+	step = step.Truncate(time.Second)
+	if step <= 0 {
+		return nil, &QueryError{Type: "step", Message: "Invalid step", Details: "step must be at least 1s"}
+	}
+	first := startTime.Truncate(step)
+	if first.Before(startTime) {
+		first = first.Add(step)
+	}
+	if first.After(endTime) {
+		return []time.Time{}, nil
+	}
+	n := int64(endTime.Sub(first)/step) + 1
+	if n > MaxStepPoints {
+		return nil, &QueryError{Type: "step", Message: "Too many points",
+			Details: fmt.Sprintf("range of %d points exceeds the maximum of %d, use a larger step", n, MaxStepPoints)}
+	}
+	points := make([]time.Time, n)
+	for i := range points {
+		points[i] = first.Add(time.Duration(i) * step)
+	}
+	return points, nil
+}
+
+// stepSeries evaluates a range aggregation at each point over the lines in
+// the window (point-range, point]. logs need not be sorted.
+func stepSeries(agg *Aggregation, logs []models.LogEntry, points []time.Time, step time.Duration) []AggregationSeriesPoint {
+	window := agg.window(step)
+	series := make([]AggregationSeriesPoint, len(points))
+	counts := make([]float64, len(points))
+	for _, entry := range logs {
+		v := 1.0
+		if agg.Type == AggBytesOverTime || agg.Type == AggBytesRate {
+			v = float64(len(entry.Line))
+		}
+		// Every point in [ts, ts+window) covers the line
+		i := sort.Search(len(points), func(i int) bool { return !points[i].Before(entry.Timestamp) })
+		for ; i < len(points) && points[i].Sub(entry.Timestamp) < window; i++ {
+			counts[i] += v
+		}
+	}
+	for i, t := range points {
+		value := counts[i]
+		if agg.Type == AggRate || agg.Type == AggBytesRate {
+			value /= window.Seconds()
+		}
+		series[i] = AggregationSeriesPoint{Timestamp: t.Format(time.RFC3339), Value: value}
+	}
+	return series
+}
+
 // computeGroupedAggregation computes aggregation grouped by labels
 func (e *Executor) computeGroupedAggregation(agg *Aggregation, logs []models.LogEntry) []AggregationGroup {
 	groups := make(map[string]*AggregationGroup)
@@ -355,3 +771,91 @@ func (e *Executor) computeGroupedAggregation(agg *Aggregation, logs []models.Log
 
 	return result
 }
+
+// reduceValues folds the samples of logs with the aggregation function
+func reduceValues(t AggregationType, logs []models.LogEntry, values map[string]float64) float64 {
+	var result float64
+	n := 0
+	for _, entry := range logs {
+		v, ok := values[entry.ID]
+		if !ok {
+			continue
+		}
+		switch {
+		case n == 0:
+			result = v
+		case t == AggMin && v < result:
+			result = v
+		case t == AggMax && v > result:
+			result = v
+		case t == AggSum || t == AggAvg:
+			result += v
+		}
+		n++
+	}
+	if t == AggAvg && n > 0 {
+		result /= float64(n)
+	}
+	return result
+}
+
+// computeValueSeries reduces the samples falling in each step of the range
+func (e *Executor) computeValueSeries(agg *Aggregation, logs []models.LogEntry, values map[string]float64, startTime, endTime time.Time) []AggregationSeriesPoint {
+	stepSeconds := agg.Duration
+	if stepSeconds <= 0 {
+		stepSeconds = 60
+	}
+
+	step := time.Duration(stepSeconds) * time.Second
+	var series []AggregationSeriesPoint
+
+	for t := startTime; t.Before(endTime); t = t.Add(step) {
+		bucketEnd := t.Add(step)
+		if bucketEnd.After(endTime) {
+			bucketEnd = endTime
+		}
+
+		var bucket []models.LogEntry
+		for _, log := range logs {
+			if !log.Timestamp.Before(t) && log.Timestamp.Before(bucketEnd) {
+				bucket = append(bucket, log)
+			}
+		}
+
+		series = append(series, AggregationSeriesPoint{
+			Timestamp: t.Format(time.RFC3339),
+			Value:     reduceValues(agg.Type, bucket, values),
+		})
+	}
+
+	return series
+}
+
+// computeGroupedValues reduces the samples of each group of labels
+func (e *Executor) computeGroupedValues(agg *Aggregation, logs []models.LogEntry, values map[string]float64) []AggregationGroup {
+	members := make(map[string][]models.LogEntry)
+	groupLabels := make(map[string]map[string]string)
+
+	for _, log := range logs {
+		key := ""
+		labels := make(map[string]string)
+		for _, label := range agg.GroupBy {
+			if val, ok := log.Labels[label]; ok {
+				key += label + "=" + val + ","
+				labels[label] = val
+			}
+		}
+		members[key] = append(members[key], log)
+		groupLabels[key] = labels
+	}
+
+	result := make([]AggregationGroup, 0, len(members))
+	for key, group := range members {
+		result = append(result, AggregationGroup{
+			Labels: groupLabels[key],
+			Value:  reduceValues(agg.Type, group, values),
+		})
+	}
+
+	return result
+}
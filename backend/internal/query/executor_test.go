@@ -0,0 +1,716 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+	"github.com/logpulse/backend/internal/storage"
+)
+
+// newTestExecutor writes each batch as a separate chunk and indexes it
+func newTestExecutor(t testing.TB, chunks ...[]models.LogEntry) *Executor {
+	dir := t.TempDir()
+	idx := index.NewIndex()
+	writer := storage.NewWriter(dir, 1024*1024)
+	for _, entries := range chunks {
+		id, start, end, err := writer.WriteChunk(entries[0].Labels, entries)
+		if err != nil {
+			t.Fatalf("write chunk: %v", err)
+		}
+		idx.AddChunk(id, entries[0].Labels, start, end, len(entries))
+	}
+	return NewExecutor(idx, storage.NewReader(dir))
+}
+
+// makeEntries builds one entry per line, one second apart from base
+func makeEntries(labels map[string]string, base time.Time, lines ...string) []models.LogEntry {
+	entries := make([]models.LogEntry, len(lines))
+	for i, line := range lines {
+		entries[i] = models.LogEntry{
+			ID:        fmt.Sprintf("%s-%d-%d", labels["app"], base.Unix(), i),
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+			Line:      line,
+			Labels:    labels,
+		}
+	}
+	return entries
+}
+
+func TestExecute_ContextLines(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	web := map[string]string{"app": "web"}
+
+	e := newTestExecutor(t,
+		makeEntries(api, base, "a1", "a2", "a3", "boom error", "a5", "a6", "a7"),
+		makeEntries(web, base, "w1", "w2", "w3", "w4"),
+	)
+
+	result, err := e.ExecuteWithOptions(`{app="api"} |= "error"`, base.Add(-time.Minute), time.Now(), 100, ExecuteOptions{Context: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Stats.MatchedLines != 1 {
+		t.Errorf("expected 1 matched line, got %d", result.Stats.MatchedLines)
+	}
+
+	var messages []string
+	for _, l := range result.Logs {
+		messages = append(messages, l.Message)
+		if l.Message == "boom error" && l.Context {
+			t.Error("match must not be marked as context")
+		}
+		if l.Message != "boom error" && !l.Context {
+			t.Errorf("expected %q to be marked as context", l.Message)
+		}
+	}
+
+	expected := []string{"a6", "a5", "boom error", "a3", "a2"}
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, messages)
+	}
+}
+
+func TestExecute_ContextSpansChunksAndDeduplicates(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+
+	first := makeEntries(api, base, "ok", "error one")
+	second := makeEntries(api, base.Add(2*time.Second), "between", "error two", "tail")
+	e := newTestExecutor(t, first, second)
+
+	result, err := e.ExecuteWithOptions(`{app="api"} |= "error"`, base.Add(-time.Minute), time.Now(), 100, ExecuteOptions{Context: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// "between" neighbours both matches but must only appear once
+	if len(result.Logs) != 5 {
+		t.Fatalf("expected 5 lines, got %d: %+v", len(result.Logs), result.Logs)
+	}
+}
+
+func TestExecute_ContextAroundAdjacentMatches(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	e := newTestExecutor(t, makeEntries(api, base, "a1", "a2", "error one", "error two", "a5", "a6", "a7", "a8", "error three"))
+
+	result, err := e.ExecuteWithOptions(`{app="api"} |= "error"`, base.Add(-time.Minute), time.Now(), 100, ExecuteOptions{Context: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Matches take up window positions but are not context themselves
+	var messages []string
+	for _, l := range result.Logs {
+		messages = append(messages, l.Message)
+	}
+	expected := []string{"error three", "a8", "a5", "error two", "error one", "a2"}
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, messages)
+	}
+}
+
+func TestExecute_CursorPaginatesTies(t *testing.T) {
+	ts := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+
+	// Two chunks whose entries all share one timestamp
+	var chunks [][]models.LogEntry
+	for c := 0; c < 2; c++ {
+		entries := make([]models.LogEntry, 7)
+		for i := range entries {
+			entries[i] = models.LogEntry{
+				ID:        fmt.Sprintf("c%d-%d", c, i),
+				Timestamp: ts,
+				Line:      fmt.Sprintf("line %d", i),
+				Labels:    api,
+			}
+		}
+		chunks = append(chunks, entries)
+	}
+	e := newTestExecutor(t, chunks...)
+
+	seen := make(map[string]bool)
+	var opts ExecuteOptions
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+		result, err := e.ExecuteWithOptions(`{app="api"}`, ts.Add(-time.Minute), time.Now(), 5, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, l := range result.Logs {
+			if seen[l.ID] {
+				t.Fatalf("entry %s returned twice", l.ID)
+			}
+			seen[l.ID] = true
+		}
+		if result.Next == "" {
+			break
+		}
+		opts.Cursor, err = DecodeCursor(result.Next)
+		if err != nil {
+			t.Fatalf("decode cursor: %v", err)
+		}
+	}
+
+	if len(seen) != 14 {
+		t.Errorf("expected 14 entries across pages, got %d", len(seen))
+	}
+}
+
+func TestExecute_CursorPagesSkipNewerChunks(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+
+	// 5000 lines in five chunks of 1000, one millisecond apart
+	var chunks [][]models.LogEntry
+	for c := 0; c < 5; c++ {
+		entries := make([]models.LogEntry, 1000)
+		for i := range entries {
+			n := c*1000 + i
+			entries[i] = models.LogEntry{
+				ID:        fmt.Sprintf("e%d", n),
+				Timestamp: base.Add(time.Duration(n) * time.Millisecond),
+				Line:      fmt.Sprintf("line %d", n),
+				Labels:    api,
+			}
+		}
+		chunks = append(chunks, entries)
+	}
+	e := newTestExecutor(t, chunks...)
+
+	var opts ExecuteOptions
+	next := 4999
+	for page := 0; page < 5; page++ {
+		result, err := e.ExecuteWithOptions(`{app="api"}`, base, time.Now(), 1000, opts)
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		for _, l := range result.Logs {
+			if l.ID != fmt.Sprintf("e%d", next) {
+				t.Fatalf("page %d: expected e%d, got %s", page, next, l.ID)
+			}
+			next--
+		}
+		// Each page reads from the cursor back, so only the chunk holding
+		// the cursor is read again
+		if want := min(5, 6-page); result.Stats.QueriedChunks != want {
+			t.Errorf("page %d: expected %d chunks queried, got %d", page, want, result.Stats.QueriedChunks)
+		}
+		if page == 4 {
+			if result.Next != "" {
+				t.Errorf("expected no cursor on the last page")
+			}
+			break
+		}
+		if opts.Cursor, err = DecodeCursor(result.Next); err != nil {
+			t.Fatalf("page %d: decode cursor: %v", page, err)
+		}
+	}
+	if next != -1 {
+		t.Errorf("expected all 5000 lines across the pages, stopped before e%d", next)
+	}
+}
+
+func TestDecodeCursor_Invalid(t *testing.T) {
+	for _, token := range []string{"!!!", "e30"} {
+		if _, err := DecodeCursor(token); err == nil {
+			t.Errorf("expected error for token %q", token)
+		}
+	}
+}
+
+func TestExecute_MissingChunk(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	e := newTestExecutor(t, makeEntries(api, base, "a1", "a2"))
+
+	// An indexed chunk whose file was deleted out-of-band
+	e.index.AddChunk("deleted", api, base, base.Add(time.Second), 2)
+
+	result, err := e.Execute(`{app="api"}`, base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("expected missing chunk to be skipped, got %v", err)
+	}
+	if result.Stats.MissingChunks != 1 || len(result.Logs) != 2 {
+		t.Errorf("expected 1 missing chunk and 2 logs, got %d and %d", result.Stats.MissingChunks, len(result.Logs))
+	}
+
+	e.SetStrictConsistency(true)
+	_, err = e.Execute(`{app="api"}`, base.Add(-time.Minute), time.Now(), 100)
+	if qe, ok := err.(*QueryError); !ok || qe.Type != "storage_inconsistency" {
+		t.Errorf("expected storage_inconsistency error in strict mode, got %v", err)
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	ok := map[string]string{"app": "api", "status": "200"}
+	bad := map[string]string{"app": "api", "status": "500"}
+	none := map[string]string{"app": "api"}
+
+	e := newTestExecutor(t,
+		makeEntries(ok, base, "GET /a", "GET /b", "GET /c"),
+		makeEntries(bad, base, "GET /d", "POST /e"),
+		makeEntries(none, base, "GET /f"),
+	)
+
+	result, err := e.DistinctValues(`{app="api"} |= "GET"`, "status", base.Add(-time.Minute), time.Now(), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []DistinctValue{{Value: "200", Count: 3}, {Value: "500", Count: 1}}
+	if fmt.Sprint(result.Values) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, result.Values)
+	}
+	if result.Stats.MatchedLines != 5 || result.Truncated {
+		t.Errorf("expected 5 matched lines and no truncation, got %d and %v", result.Stats.MatchedLines, result.Truncated)
+	}
+
+	result, err = e.DistinctValues(`{app="api"}`, "status", base.Add(-time.Minute), time.Now(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Values) != 1 || result.Other != 2 || !result.Truncated {
+		t.Errorf("expected 1 value with 2 others truncated, got %v other=%d", result.Values, result.Other)
+	}
+}
+
+func TestVolume(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	api := map[string]string{"app": "api"}
+	e := newTestExecutor(t,
+		makeEntries(api, base, "GET /a", "GET /b", "POST /c"),
+		makeEntries(api, base.Add(2*time.Minute), "GET /d"),
+		makeEntries(map[string]string{"app": "web"}, base, "GET /e"),
+	)
+
+	result, err := e.Volume(context.Background(), `{app="api"} |= "GET"`, base, base.Add(3*time.Minute), time.Minute, ExecuteOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][2]int64{{base.Unix(), 2}, {base.Unix() + 60, 0}, {base.Unix() + 120, 1}}
+	if fmt.Sprint(result.Values) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, result.Values)
+	}
+	if result.Step != 60 || result.Stats.MatchedLines != 3 {
+		t.Errorf("expected a 60s step and 3 matched lines, got %d and %d", result.Step, result.Stats.MatchedLines)
+	}
+
+	if _, err := e.Volume(context.Background(), `{app="api"}`, base, base.Add(time.Hour), time.Millisecond, ExecuteOptions{}); err == nil {
+		t.Error("expected a sub-second step to be rejected")
+	}
+	if _, err := e.Volume(context.Background(), `{app="api"}`, base.Add(-30*24*time.Hour), base, time.Second, ExecuteOptions{}); err == nil {
+		t.Error("expected too many buckets to be rejected")
+	}
+}
+
+func TestExecute_AffixMatchers(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	e := newTestExecutor(t,
+		makeEntries(map[string]string{"app": "api-gateway"}, base, "a1"),
+		makeEntries(map[string]string{"app": "api-auth"}, base, "a2"),
+		makeEntries(map[string]string{"app": "web"}, base, "w1"),
+	)
+
+	result, err := e.Execute(`{app=^"api-"}`, base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 2 || result.Stats.QueriedChunks != 2 {
+		t.Errorf("expected 2 lines from 2 chunks, got %d lines from %d chunks", len(result.Logs), result.Stats.QueriedChunks)
+	}
+
+	result, err = e.Execute(`{app=$"auth"}`, base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 1 || result.Logs[0].Message != "a2" || result.Stats.QueriedChunks != 1 {
+		t.Errorf("expected only a2 from 1 chunk, got %+v", result)
+	}
+}
+
+func TestExecuteContext_Cancelled(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	e := newTestExecutor(t, makeEntries(map[string]string{"app": "api"}, base, "a1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err := e.ExecuteContext(ctx, `{app="api"}`, base.Add(-time.Minute), time.Now(), 100, ExecuteOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestExecute_DeltaPipeline(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	web := map[string]string{"app": "web"}
+
+	// The later api chunk is indexed first; deltas must follow time order
+	e := newTestExecutor(t,
+		makeEntries(api, base.Add(3*time.Second), "tick served=5", "tick served=12"),
+		makeEntries(api, base, "tick served=10", "tick served=15", "tick served=25"),
+		makeEntries(web, base, "tick served=100", "noise", "tick served=130"),
+	)
+	pipeline := `{app=~"api|web"} | pattern "<_> served=<served>" | delta served`
+
+	result, err := e.Execute(pipeline, base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := make(map[string][]float64)
+	for i := len(result.Logs) - 1; i >= 0; i-- {
+		l := result.Logs[i]
+		if l.Value == nil {
+			t.Fatalf("expected a delta value on %q", l.Message)
+		}
+		got[l.Labels["app"]] = append(got[l.Labels["app"]], *l.Value)
+		if l.Labels["served"] == "" {
+			t.Errorf("expected extracted field on %q", l.Message)
+		}
+	}
+	// 10→15→25→5 (reset, raw value)→12
+	if fmt.Sprint(got["api"]) != "[5 10 5 7]" || fmt.Sprint(got["web"]) != "[30]" {
+		t.Errorf("unexpected deltas %v", got)
+	}
+
+	result, err = e.Execute(`sum(`+pipeline+` [1h])`, base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Aggregation == nil || result.Aggregation.Value != 57 {
+		t.Fatalf("expected sum of deltas 57, got %+v", result.Aggregation)
+	}
+
+	result, err = e.Execute(`max(`+pipeline+` [1h]) by (app)`, base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, g := range result.Aggregation.Groups {
+		want := map[string]float64{"api": 10, "web": 30}[g.Labels["app"]]
+		if g.Value != want {
+			t.Errorf("group %v: expected max %v, got %v", g.Labels, want, g.Value)
+		}
+	}
+}
+
+func TestExecuteWithOptions_Scope(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	payments := map[string]string{"app": "api", "team": "payments"}
+	search := map[string]string{"app": "api", "team": "search"}
+	e := newTestExecutor(t,
+		makeEntries(payments, base, "p1", "p2"),
+		makeEntries(search, base, "s1"),
+	)
+	scope := ExecuteOptions{Scope: map[string]string{"team": "payments"}}
+
+	result, err := e.ExecuteWithOptions(`{app="api"}`, base.Add(-time.Minute), time.Now(), 100, scope)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 2 {
+		t.Errorf("expected only the 2 in-scope lines, got %d", len(result.Logs))
+	}
+
+	// Naming another tenant in the selector cannot widen the scope
+	result, err = e.ExecuteWithOptions(`{team="search"}`, base.Add(-time.Minute), time.Now(), 100, scope)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 0 {
+		t.Errorf("expected no lines outside the scope, got %d", len(result.Logs))
+	}
+}
+
+func TestExecute_FormatPipeline(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	e := newTestExecutor(t, makeEntries(api, base,
+		"\x1b[32mGET\x1b[0m /users 200",
+		"\x1b[31mPOST\x1b[0m /login 500",
+	))
+
+	// The line filter sees the stored, still colored line
+	result, err := e.Execute("{app=\"api\"} |= \"/login\" | decolorize | pattern `<method> <path> <status>` | line_format `{{.status}} {{upper .app}} {{__line__}}`",
+		base.Add(-time.Minute), time.Now(), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Logs) != 1 || result.Logs[0].Message != "500 API POST /login 500" {
+		t.Fatalf("unexpected result %+v", result.Logs)
+	}
+
+	// Stored lines are untouched
+	result, _ = e.Execute(`{app="api"} |= "/login"`, base.Add(-time.Minute), time.Now(), 100)
+	if len(result.Logs) != 1 || !strings.Contains(result.Logs[0].Message, "\x1b[31m") {
+		t.Errorf("expected the raw line to be returned without stages, got %+v", result.Logs)
+	}
+}
+
+func TestExecute_ParserStages(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	e := newTestExecutor(t,
+		makeEntries(api, base,
+			`{"level":"error","req":{"method":"GET","status":500},"tags":["a","b"]}`,
+			`{"level":"info","req":{"method":"GET","status":200}}`,
+			`{"level":"error","req":`, // truncated
+			`plain text`,
+		),
+		makeEntries(map[string]string{"app": "web"}, base,
+			`level=error msg="upstream timed out" duration=1.5 path=/login`,
+			`level=info msg="ok" duration=0.2 path=/`,
+			`level=warn msg="unterminated`,
+		),
+	)
+	messages := func(q string) []string {
+		t.Helper()
+		result, err := e.Execute(q, base.Add(-time.Minute), time.Now(), 100)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", q, err)
+		}
+		var out []string
+		for _, l := range result.Logs {
+			out = append(out, l.Message)
+		}
+		return out
+	}
+
+	// Nested fields are flattened into dotted names
+	got := messages("{app=\"api\"} | json | req.status=\"500\" | line_format `{{.level}} {{index . \"req.method\"}} {{.tags}}`")
+	if fmt.Sprint(got) != `[error GET ["a","b"]]` {
+		t.Errorf("expected the 500 line formatted from its fields, got %q", got)
+	}
+	// Lines that are not JSON pass through without fields
+	if got := messages(`{app="api"} | json | level=""`); len(got) != 2 {
+		t.Errorf("expected the malformed and plain lines kept without fields, got %q", got)
+	}
+	if got := messages(`{app="api"} | json | req.status >= 400`); len(got) != 1 {
+		t.Errorf("expected one line with status >= 400, got %q", got)
+	}
+
+	if got := messages(`{app="web"} | logfmt | duration > 1 | line_format "{{.msg}} on {{.path}}"`); fmt.Sprint(got) != "[upstream timed out on /login]" {
+		t.Errorf("expected the slow request, got %q", got)
+	}
+	if got := messages(`{app="web"} | logfmt | level=~"warn|error"`); fmt.Sprint(got) != "[level=error msg=\"upstream timed out\" duration=1.5 path=/login]" {
+		t.Errorf("expected only the valid error line, got %q", got)
+	}
+	// Label filters apply to stream labels too
+	if got := messages(`{app=~"api|web"} | app!="api" | logfmt | level="info"`); len(got) != 1 {
+		t.Errorf("expected one info line from web, got %q", got)
+	}
+}
+
+func TestExecuteWithOptions_StreamCounts(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	e := newTestExecutor(t,
+		makeEntries(map[string]string{"app": "noisy"}, base, "error 1", "error 2", "error 3", "error 4"),
+		makeEntries(map[string]string{"app": "normal"}, base, "error 1", "error 2"),
+		makeEntries(map[string]string{"app": "quiet"}, base, "error 1", "ok"),
+	)
+	apps := func(opts ExecuteOptions, limit int) map[string]int {
+		result, err := e.ExecuteWithOptions(`{app=~".+"} |= "error"`, base.Add(-time.Minute), time.Now(), limit, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := make(map[string]int)
+		for _, l := range result.Logs {
+			got[l.Labels["app"]]++
+		}
+		return got
+	}
+
+	if got := apps(ExecuteOptions{MinCount: 3}, 100); fmt.Sprint(got) != "map[noisy:4]" {
+		t.Errorf("min_count: unexpected streams %v", got)
+	}
+	if got := apps(ExecuteOptions{MaxCount: 1}, 100); fmt.Sprint(got) != "map[quiet:1]" {
+		t.Errorf("max_count: unexpected streams %v", got)
+	}
+	if got := apps(ExecuteOptions{MinCount: 2, MaxCount: 2}, 100); fmt.Sprint(got) != "map[normal:2]" {
+		t.Errorf("range: unexpected streams %v", got)
+	}
+	// Counts cover the whole range, not just the page the limit returns
+	if got := apps(ExecuteOptions{MinCount: 3}, 2); fmt.Sprint(got) != "map[noisy:2]" {
+		t.Errorf("limit: unexpected streams %v", got)
+	}
+}
+
+func TestExecute_StreamCardinalityWarning(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var chunks [][]models.LogEntry
+	for i := 0; i < 4; i++ {
+		labels := map[string]string{"app": "api", "env": "prod", "pod": fmt.Sprintf("api-%d", i), "zone": fmt.Sprintf("z%d", i%2)}
+		chunks = append(chunks, makeEntries(labels, base, "request"))
+	}
+	exec := newTestExecutor(t, chunks...)
+	if err := exec.SetStreamWarningThreshold(-1); err == nil {
+		t.Error("expected a negative threshold to be refused")
+	}
+
+	exec.SetStreamWarningThreshold(4)
+	result, err := exec.Execute(`{app="api"}`, base.Add(-time.Minute), base.Add(time.Minute), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("expected no warning at the threshold, got %v", result.Warnings)
+	}
+
+	// Streams are counted before the limit cuts the page to one line
+	exec.SetStreamWarningThreshold(3)
+	result, err = exec.Execute(`{app="api"}`, base.Add(-time.Minute), base.Add(time.Minute), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "query matched 4 streams, over the warning threshold of 3; labels with the most distinct values: pod (4 values), zone (2 values)"
+	if len(result.Warnings) != 1 || result.Warnings[0] != want {
+		t.Errorf("expected warning %q, got %v", want, result.Warnings)
+	}
+}
+
+func TestExecute_StepAlignedSeries(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = "request"
+	}
+	// One line a second from 25s to 34s
+	exec := newTestExecutor(t, makeEntries(map[string]string{"app": "api"}, base.Add(25*time.Second), lines...))
+
+	series := func(q string, start, end time.Duration) (*QueryResult, []AggregationSeriesPoint) {
+		t.Helper()
+		result, err := exec.ExecuteWithOptions(q, base.Add(start), base.Add(end), 100, ExecuteOptions{Step: 10 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, result.Aggregation.Series
+	}
+
+	// Points fall on multiples of the step, not on the start, and each
+	// covers the window (point-10s, point]
+	_, points := series(`count_over_time({app="api"}[10s])`, 7*time.Second, 60*time.Second)
+	want := []struct {
+		ts    string
+		value float64
+	}{
+		{"2024-01-01T00:00:10Z", 0}, {"2024-01-01T00:00:20Z", 0}, {"2024-01-01T00:00:30Z", 6},
+		{"2024-01-01T00:00:40Z", 4}, {"2024-01-01T00:00:50Z", 0}, {"2024-01-01T00:01:00Z", 0},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("expected %d points, got %+v", len(want), points)
+	}
+	for i, w := range want {
+		if points[i].Timestamp != w.ts || points[i].Value != w.value {
+			t.Errorf("point %d: expected %s=%v, got %s=%v", i, w.ts, w.value, points[i].Timestamp, points[i].Value)
+		}
+	}
+
+	_, points = series(`rate({app="api"}[10s])`, 7*time.Second, 60*time.Second)
+	if points[2].Value != 0.6 || points[3].Value != 0.4 {
+		t.Errorf("expected rates 0.6 and 0.4 at 30s and 40s, got %+v", points)
+	}
+	_, points = series(`bytes_over_time({app="api"}[10s])`, 7*time.Second, 60*time.Second)
+	if points[2].Value != 42 || points[3].Value != 28 {
+		t.Errorf("expected 42 and 28 bytes at 30s and 40s, got %+v", points)
+	}
+
+	// The first point's window reaches back before the range, without those
+	// lines being counted as matches of the range itself
+	result, points := series(`count_over_time({app="api"}[10s])`, 32*time.Second, 40*time.Second)
+	if len(points) != 1 || points[0].Value != 4 {
+		t.Errorf("expected one point of 4 at 40s, got %+v", points)
+	}
+	if result.Stats.MatchedLines != 3 || result.Aggregation.Value != 3 {
+		t.Errorf("expected 3 lines matched in the range, got %d (value %v)", result.Stats.MatchedLines, result.Aggregation.Value)
+	}
+
+	_, err := exec.ExecuteWithOptions(`count_over_time({app="api"}[1m])`, base, base.Add(24*time.Hour), 100, ExecuteOptions{Step: time.Second})
+	if err == nil {
+		t.Error("expected a step giving too many points to be refused")
+	}
+}
+
+func TestExecuteWithOptions_Dedup(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	db := map[string]string{"app": "db"}
+
+	// A retried push stored "started" and "ready" again in a second chunk
+	first := makeEntries(api, base, "started", "ready")
+	retried := makeEntries(api, base, "started", "ready", "serving")
+	// Same timestamp and line, other stream: not a duplicate
+	other := makeEntries(db, base, "started")
+	// Same timestamp and stream, other line: not a duplicate
+	sameTime := makeEntries(api, base, "warming up")
+	e := newTestExecutor(t, first, retried, other, sameTime)
+
+	run := func(dedup bool) *QueryResult {
+		result, err := e.ExecuteWithOptions(`{app=~"api|db"}`, base.Add(-time.Minute), time.Now(), 100, ExecuteOptions{Dedup: dedup})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result
+	}
+
+	if got := run(false); len(got.Logs) != 7 {
+		t.Fatalf("expected all 7 lines without dedup, got %d", len(got.Logs))
+	}
+	result := run(true)
+	var lines []string
+	for _, log := range result.Logs {
+		lines = append(lines, log.Labels["app"]+":"+log.Message)
+	}
+	sort.Strings(lines)
+	if got, want := strings.Join(lines, ", "), "api:ready, api:serving, api:started, api:warming up, db:started"; got != want {
+		t.Errorf("expected one copy of each line, got %q", got)
+	}
+	if result.Stats.Duplicates != 2 {
+		t.Errorf("expected 2 duplicates counted, got %d", result.Stats.Duplicates)
+	}
+}
+
+func TestExecuteWithOptions_DedupAcrossPages(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	api := map[string]string{"app": "api"}
+	e := newTestExecutor(t, makeEntries(api, base, "started", "ready"), makeEntries(api, base, "started", "ready"))
+
+	// Each page ends on a line whose copy sorts right after the cursor
+	var lines []string
+	opts := ExecuteOptions{Dedup: true}
+	for page := 0; ; page++ {
+		if page > 4 {
+			t.Fatal("pagination did not terminate")
+		}
+		result, err := e.ExecuteWithOptions(`{app="api"}`, base.Add(-time.Minute), time.Now(), 1, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, log := range result.Logs {
+			lines = append(lines, log.Message)
+		}
+		if result.Stats.MatchedLines != 2-page {
+			t.Errorf("page %d: expected %d matched lines after dedup, got %d", page, 2-page, result.Stats.MatchedLines)
+		}
+		if result.Next == "" {
+			break
+		}
+		if opts.Cursor, err = DecodeCursor(result.Next); err != nil {
+			t.Fatalf("decode cursor: %v", err)
+		}
+	}
+	if got := strings.Join(lines, ", "); got != "ready, started" {
+		t.Errorf("expected one copy of each line across pages, got %q", got)
+	}
+}
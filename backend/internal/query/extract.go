@@ -0,0 +1,125 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// jsonStage extracts the fields of a JSON object line. Nested objects are
+// flattened into dotted names, so {"req":{"status":500}} gives req.status;
+// arrays keep their JSON text. Lines that are not a JSON object pass through
+// without fields.
+type jsonStage struct{}
+
+func (jsonStage) Name() string      { return "json" }
+func (jsonStage) phase() stagePhase { return phaseParse }
+
+func (jsonStage) apply(_ *pipelineRun, p *pipelineEntry) bool {
+	dec := json.NewDecoder(strings.NewReader(p.line))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil || dec.More() {
+		return true
+	}
+	flattenJSON(p, "", fields)
+	return true
+}
+
+// flattenJSON sets a label for every scalar under prefix
+func flattenJSON(p *pipelineEntry, prefix string, fields map[string]interface{}) {
+	for k, v := range fields {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenJSON(p, name, v)
+		case string:
+			p.setLabel(name, v)
+		case json.Number:
+			p.setLabel(name, v.String())
+		case bool:
+			p.setLabel(name, strconv.FormatBool(v))
+		case nil:
+			p.setLabel(name, "")
+		default:
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if enc.Encode(v) == nil {
+				p.setLabel(name, strings.TrimSuffix(buf.String(), "\n"))
+			}
+		}
+	}
+}
+
+// logfmtStage extracts the key=value pairs of a logfmt line such as
+// `level=error msg="request failed" status=500`. A key without a value is
+// extracted empty. Lines that are not valid logfmt, e.g. with an
+// unterminated quote, pass through without fields.
+type logfmtStage struct{}
+
+func (logfmtStage) Name() string      { return "logfmt" }
+func (logfmtStage) phase() stagePhase { return phaseParse }
+
+func (logfmtStage) apply(_ *pipelineRun, p *pipelineEntry) bool {
+	pairs, ok := parseLogfmt(p.line)
+	if !ok {
+		return true
+	}
+	for _, kv := range pairs {
+		p.setLabel(kv[0], kv[1])
+	}
+	return true
+}
+
+// parseLogfmt splits a line into its key and value pairs, in order
+func parseLogfmt(line string) ([][2]string, bool) {
+	var pairs [][2]string
+	i := 0
+	for {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i == len(line) {
+			return pairs, true
+		}
+
+		start := i
+		for i < len(line) && line[i] != ' ' && line[i] != '=' {
+			if line[i] == '"' {
+				return nil, false
+			}
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil, false
+		}
+		if i == len(line) || line[i] == ' ' {
+			pairs = append(pairs, [2]string{key, ""})
+			continue
+		}
+
+		i++ // '='
+		var value string
+		if i < len(line) && line[i] == '"' {
+			quoted, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				return nil, false
+			}
+			value, _ = strconv.Unquote(quoted)
+			i += len(quoted)
+		} else {
+			start = i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			value = line[start:i]
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+}
@@ -0,0 +1,76 @@
+package query
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// ansiEscapeRegex matches CSI sequences (colors, cursor movement), OSC
+// sequences terminated by BEL or ST, and two-byte escapes
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// StripANSI removes ANSI escape sequences from a log line
+func StripANSI(line string) string {
+	if strings.IndexByte(line, 0x1b) < 0 {
+		return line
+	}
+	return ansiEscapeRegex.ReplaceAllString(line, "")
+}
+
+// lineFormatStage rewrites the line with a text/template such as
+// `{{.method}} {{.path}} -> {{.status}}`. Labels and extracted fields are
+// the template's fields; {{__line__}} is the current line. Missing fields
+// render empty.
+type lineFormatStage struct {
+	tmpl *template.Template
+	line string // line being formatted, read by __line__
+	sb   strings.Builder
+}
+
+func newLineFormatStage(arg string) (Stage, error) {
+	text, err := unquoteStageArg(arg)
+	if err != nil || text == "" {
+		return nil, &QueryError{Type: "syntax", Message: "line_format stage requires a quoted template"}
+	}
+
+	s := &lineFormatStage{}
+	tmpl, err := template.New("line_format").
+		Option("missingkey=zero").
+		Funcs(template.FuncMap{
+			"__line__": func() string { return s.line },
+			"upper":    strings.ToUpper,
+			"lower":    strings.ToLower,
+			"trim":     strings.TrimSpace,
+		}).
+		Parse(text)
+	if err != nil {
+		return nil, &QueryError{Type: "syntax", Message: "Invalid line_format template", Details: err.Error()}
+	}
+	s.tmpl = tmpl
+	return s, nil
+}
+
+func (s *lineFormatStage) Name() string      { return "line_format" }
+func (s *lineFormatStage) phase() stagePhase { return phaseFormat }
+
+// apply keeps the original line when the template fails to execute
+func (s *lineFormatStage) apply(_ *pipelineRun, p *pipelineEntry) bool {
+	s.line = p.line
+	s.sb.Reset()
+	if err := s.tmpl.Execute(&s.sb, p.labels); err == nil {
+		p.line = s.sb.String()
+	}
+	return true
+}
+
+// decolorizeStage removes ANSI escape sequences from the line
+type decolorizeStage struct{}
+
+func (decolorizeStage) Name() string      { return "decolorize" }
+func (decolorizeStage) phase() stagePhase { return phaseAny }
+
+func (decolorizeStage) apply(_ *pipelineRun, p *pipelineEntry) bool {
+	p.line = StripANSI(p.line)
+	return true
+}
@@ -0,0 +1,191 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxMacroDepth bounds macros expanding to other macros, which also stops
+// a macro that refers to itself
+const maxMacroDepth = 8
+
+// Query macros, referenced as $name or $name(arg, ...) and expanded before
+// parsing. Macro bodies refer to their arguments as $1, $2, ...
+var (
+	macrosMu sync.RWMutex
+	macros   = make(map[string]Macro)
+
+	macroNameRE  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	macroParamRE = regexp.MustCompile(`\$(\d+)`)
+)
+
+// Macro is a named query fragment
+type Macro struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// Params is the number of positional arguments the macro takes
+	Params int `json:"params"`
+}
+
+// SetMacro registers (or replaces) a query macro. The body may use $1..$N
+// for positional arguments, which calls must then all supply.
+func SetMacro(name, body string) error {
+	if !macroNameRE.MatchString(name) {
+		return fmt.Errorf("invalid macro name %q", name)
+	}
+	if strings.TrimSpace(body) == "" {
+		return fmt.Errorf("macro %q has an empty body", name)
+	}
+	params := 0
+	for _, m := range macroParamRE.FindAllStringSubmatch(body, -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n == 0 {
+			return fmt.Errorf("macro %q: arguments are numbered from $1", name)
+		}
+		params = max(params, n)
+	}
+
+	macrosMu.Lock()
+	macros[name] = Macro{Name: name, Query: body, Params: params}
+	macrosMu.Unlock()
+	return nil
+}
+
+// Macros returns the registered macros sorted by name
+func Macros() []Macro {
+	macrosMu.RLock()
+	list := make([]Macro, 0, len(macros))
+	for _, m := range macros {
+		list = append(list, m)
+	}
+	macrosMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// expandMacros replaces macro references outside quoted strings with their
+// bodies, so `$` in regexes and label values is left alone
+func expandMacros(query string, depth int) (string, error) {
+	if !strings.Contains(query, "$") {
+		return query, nil
+	}
+
+	var out strings.Builder
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' && i+1 < len(query) {
+				out.WriteByte(c)
+				i++
+				c = query[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`':
+			quote = c
+		case c == '$' && i+1 < len(query) && isMacroNameStart(query[i+1]):
+			end := i + 1
+			for end < len(query) && isMacroNameChar(query[end]) {
+				end++
+			}
+			name := query[i+1 : end]
+
+			var args []string
+			if end < len(query) && query[end] == '(' {
+				var err error
+				if args, end, err = parseMacroArgs(query, end); err != nil {
+					return "", err
+				}
+			}
+			expanded, err := expandMacro(name, args, depth)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expanded)
+			i = end - 1
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return out.String(), nil
+}
+
+// expandMacro substitutes args into the named macro and expands any macros
+// its body uses in turn
+func expandMacro(name string, args []string, depth int) (string, error) {
+	if depth >= maxMacroDepth {
+		return "", &QueryError{Type: "syntax", Message: "Macro expansion too deep", Details: "$" + name}
+	}
+	macrosMu.RLock()
+	m, ok := macros[name]
+	macrosMu.RUnlock()
+	if !ok {
+		return "", &QueryError{Type: "syntax", Message: "Unknown macro", Details: "$" + name}
+	}
+	if len(args) != m.Params {
+		return "", &QueryError{Type: "syntax", Message: "Wrong number of macro arguments",
+			Details: fmt.Sprintf("$%s takes %d, got %d", name, m.Params, len(args))}
+	}
+
+	body := macroParamRE.ReplaceAllStringFunc(m.Query, func(p string) string {
+		n, _ := strconv.Atoi(p[1:])
+		return args[n-1]
+	})
+	return expandMacros(body, depth+1)
+}
+
+// parseMacroArgs reads the comma-separated arguments of a call whose "("
+// is at open, returning them and the index just past the closing ")".
+// Commas inside quotes or nested parentheses do not split arguments, and
+// an argument given as a quoted string is substituted without its quotes.
+func parseMacroArgs(query string, open int) ([]string, int, error) {
+	var args []string
+	var quote byte
+	nested := 0
+	start := open + 1
+	for i := start; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			nested++
+		case c == ')' && nested > 0:
+			nested--
+		case c == ',' || c == ')':
+			arg := strings.TrimSpace(query[start:i])
+			if n := len(arg); n >= 2 && (arg[0] == '"' || arg[0] == '`') && arg[n-1] == arg[0] {
+				arg = arg[1 : n-1]
+			}
+			if c == ')' && arg == "" && len(args) == 0 {
+				return nil, i + 1, nil
+			}
+			args = append(args, arg)
+			if c == ')' {
+				return args, i + 1, nil
+			}
+			start = i + 1
+		}
+	}
+	return nil, 0, &QueryError{Type: "syntax", Message: "Unterminated macro arguments", Details: query[open:]}
+}
+
+func isMacroNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isMacroNameChar(c byte) bool {
+	return isMacroNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -3,6 +3,7 @@ package query
 import (
 	"errors"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,6 +14,20 @@ var (
 	ErrInvalidTimeRange = errors.New("invalid time range in aggregation")
 )
 
+// QueryError is a detailed query error carrying a category for API responses
+type QueryError struct {
+	Type    string // syntax, regex, ...
+	Message string
+	Details string
+}
+
+func (e *QueryError) Error() string {
+	if e.Details != "" {
+		return e.Message + ": " + e.Details
+	}
+	return e.Message
+}
+
 // MatchOperator defines the type of label matching
 type MatchOperator int
 
@@ -21,6 +36,10 @@ const (
 	MatchNotEqual                      // !=
 	MatchRegex                         // =~
 	MatchNotRegex                      // !~
+	MatchIn                            // in ["a","b"] or in @set
+	MatchNotIn                         // not in ["a","b"] or not in @set
+	MatchPrefix                        // =^ (value starts with)
+	MatchSuffix                        // =$ (value ends with)
 )
 
 // LabelMatcher represents a single label match condition
@@ -28,17 +47,20 @@ type LabelMatcher struct {
 	Name     string
 	Value    string
 	Operator MatchOperator
-	Regex    *regexp.Regexp // Compiled regex for =~ and !~
+	Regex    *regexp.Regexp      // Compiled regex for =~ and !~
+	Set      map[string]struct{} // Values for in and not in
 }
 
 // LineFilterOperator defines the type of line filtering
 type LineFilterOperator int
 
 const (
-	LineContains    LineFilterOperator = iota // |=
-	LineNotContains                           // !=
-	LineRegex                                 // |~
-	LineNotRegex                              // !~
+	LineContains        LineFilterOperator = iota // |=
+	LineNotContains                               // !=
+	LineRegex                                     // |~
+	LineNotRegex                                  // !~
+	LineContainsFold                              // |=i (case-insensitive literal)
+	LineNotContainsFold                           // !=i (case-insensitive literal)
 )
 
 // LineFilter represents a filter on log content
@@ -73,18 +95,25 @@ type Aggregation struct {
 // ParsedQuery represents a fully parsed LogQL query
 type ParsedQuery struct {
 	LabelMatchers []LabelMatcher
-	LineFilters   []LineFilter
-	Aggregation   *Aggregation
-	RawQuery      string
+	// LineFilters are held in the order they are checked, cheapest first
+	LineFilters []LineFilter
+	Aggregation *Aggregation
+	// Pipeline holds the stages after the line filters, e.g. json, pattern,
+	// label filters and delta
+	Pipeline []Stage
+	RawQuery string
 }
 
 var (
 	// Matches {key="value", key2=~"regex.*"}
 	queryRegex = regexp.MustCompile(`\{([^}]*)\}`)
-	// Matches different operators: =, !=, =~, !~
-	labelRegex = regexp.MustCompile(`(\w+)\s*(=~|!~|!=|=)\s*"([^"]*)"`)
-	// Matches line filters: |= "text", != "text", |~ "regex", !~ "regex"
-	lineFilterRegex = regexp.MustCompile(`(\|=|\|~|!=|!~)\s*"([^"]*)"`)
+	// Matches different operators: =, !=, =~, !~, =^ (prefix), =$ (suffix)
+	labelRegex = regexp.MustCompile(`(\w+)\s*(=~|!~|!=|=\^|=\$|=)\s*"([^"]*)"`)
+	// Matches set membership: app in ["a","b"], app not in @allowlist
+	labelSetRegex = regexp.MustCompile(`(\w+)\s+(in|not\s+in)\s+(\[[^\]]*\]|@[\w.-]+)`)
+	// Matches line filters: |= "text", != "text", |~ "regex", !~ "regex",
+	// and the case-insensitive literals |=i "text", !=i "text"
+	lineFilterRegex = regexp.MustCompile(`(\|=i|!=i|\|=|\|~|!=|!~)\s*"([^"]*)"`)
 	// Matches aggregation functions: count_over_time({...}[5m])
 	aggFuncRegex = regexp.MustCompile(`^(count_over_time|rate|bytes_over_time|bytes_rate|sum|avg|min|max)\s*\(`)
 	// Matches time range: [5m], [1h], [30s]
@@ -108,6 +137,13 @@ func ParseAdvancedQuery(query string) (*ParsedQuery, error) {
 		RawQuery: query,
 	}
 
+	// Expand macros such as $prod_api before anything else is parsed
+	query, err := expandMacros(query, 0)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.TrimSpace(query)
+
 	// Check for aggregation function
 	aggMatch := aggFuncRegex.FindStringSubmatch(query)
 	if len(aggMatch) > 0 {
@@ -127,11 +163,12 @@ func ParseAdvancedQuery(query string) (*ParsedQuery, error) {
 	parsed.LabelMatchers = labelMatchers
 
 	// Extract line filters (after the label selector)
-	lineFilters, err := parseLineFilters(query)
+	lineFilters, stages, err := parseLineFilters(query)
 	if err != nil {
 		return nil, err
 	}
 	parsed.LineFilters = lineFilters
+	parsed.Pipeline = stages
 
 	return parsed, nil
 }
@@ -150,6 +187,27 @@ func parseLabelMatchers(query string) ([]LabelMatcher, error) {
 	}
 
 	var matchers []LabelMatcher
+
+	// Set matchers first, removing them so their quoted values are not
+	// mistaken for ordinary matchers
+	for _, match := range labelSetRegex.FindAllStringSubmatch(labelContent, -1) {
+		op := MatchIn
+		if strings.HasPrefix(match[2], "not") {
+			op = MatchNotIn
+		}
+		set, err := parseValueSet(match[3])
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, LabelMatcher{
+			Name:     match[1],
+			Value:    match[3],
+			Operator: op,
+			Set:      set,
+		})
+	}
+	labelContent = labelSetRegex.ReplaceAllString(labelContent, "")
+
 	labelMatches := labelRegex.FindAllStringSubmatch(labelContent, -1)
 
 	for _, match := range labelMatches {
@@ -182,6 +240,10 @@ func parseLabelMatchers(query string) ([]LabelMatcher, error) {
 			if err != nil {
 				return nil, ErrInvalidRegex
 			}
+		case "=^":
+			op = MatchPrefix
+		case "=$":
+			op = MatchSuffix
 		}
 
 		matchers = append(matchers, LabelMatcher{
@@ -195,27 +257,34 @@ func parseLabelMatchers(query string) ([]LabelMatcher, error) {
 	return matchers, nil
 }
 
-// parseLineFilters extracts line filters from query
-func parseLineFilters(query string) ([]LineFilter, error) {
+// parseLineFilters extracts line filters and pipeline stages from query.
+// Line filters only look at the raw line, so they are applied before the
+// stages wherever they are written. A line must pass them all, so they are
+// also reordered by cost: literals, then case-insensitive literals, then
+// regexes, letting a cheap filter reject a line before a regex runs on it.
+func parseLineFilters(query string) ([]LineFilter, []Stage, error) {
 	// Find everything after the label selector
-	braceEnd := strings.LastIndex(query, "}")
+	braceEnd := selectorEnd(query)
 	if braceEnd == -1 {
-		return []LineFilter{}, nil
+		return []LineFilter{}, nil, nil
 	}
 
 	filterPart := query[braceEnd+1:]
-	
-	// Remove time range if present (for aggregations)
-	if idx := strings.Index(filterPart, "["); idx != -1 {
-		endIdx := strings.Index(filterPart, "]")
-		if endIdx > idx {
-			filterPart = filterPart[:idx] + filterPart[endIdx+1:]
-		}
+
+	// Remove time range if present (for aggregations). Only a well-formed
+	// range like [5m] is stripped so literal brackets in filters survive.
+	if loc := timeRangeRegex.FindStringIndex(filterPart); loc != nil {
+		filterPart = filterPart[:loc[0]] + filterPart[loc[1]:]
 	}
 
 	// Remove closing paren from aggregation if present
 	filterPart = strings.TrimSuffix(strings.TrimSpace(filterPart), ")")
 
+	stages, filterPart, err := parseStages(filterPart)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	var filters []LineFilter
 	filterMatches := lineFilterRegex.FindAllStringSubmatch(filterPart, -1)
 
@@ -229,24 +298,27 @@ func parseLineFilters(query string) ([]LineFilter, error) {
 
 		var op LineFilterOperator
 		var regex *regexp.Regexp
-		var err error
 
 		switch opStr {
 		case "|=":
 			op = LineContains
 		case "!=":
 			op = LineNotContains
+		case "|=i":
+			op = LineContainsFold
+		case "!=i":
+			op = LineNotContainsFold
 		case "|~":
 			op = LineRegex
 			regex, err = regexp.Compile(pattern)
 			if err != nil {
-				return nil, ErrInvalidRegex
+				return nil, nil, ErrInvalidRegex
 			}
 		case "!~":
 			op = LineNotRegex
 			regex, err = regexp.Compile(pattern)
 			if err != nil {
-				return nil, ErrInvalidRegex
+				return nil, nil, ErrInvalidRegex
 			}
 		}
 
@@ -256,8 +328,45 @@ func parseLineFilters(query string) ([]LineFilter, error) {
 			Regex:    regex,
 		})
 	}
+	sort.SliceStable(filters, func(i, j int) bool {
+		return filters[i].cost() < filters[j].cost()
+	})
+
+	return filters, stages, nil
+}
 
-	return filters, nil
+// cost ranks a filter by how expensive it is to check per line
+func (f *LineFilter) cost() int {
+	switch f.Operator {
+	case LineContains, LineNotContains:
+		return 0
+	case LineContainsFold, LineNotContainsFold:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// selectorEnd returns the index of the brace closing the label selector, or
+// -1. Quoted values are skipped, so braces in later stage arguments such as
+// line_format templates are not mistaken for the selector's.
+func selectorEnd(query string) int {
+	start := strings.Index(query, "{")
+	if start == -1 {
+		return -1
+	}
+	inQuote := false
+	for i := start + 1; i < len(query); i++ {
+		switch c := query[i]; {
+		case inQuote && c == '\\':
+			i++
+		case c == '"':
+			inQuote = !inQuote
+		case !inQuote && c == '}':
+			return i
+		}
+	}
+	return -1
 }
 
 // parseAggregation extracts aggregation function and returns inner query
@@ -329,7 +438,7 @@ func parseAggregation(query string, funcName string) (*Aggregation, string, erro
 			}
 		}
 		innerQuery = query[idx : endIdx+1]
-		
+
 		// Also capture line filters if present
 		afterBrace := query[endIdx+1:]
 		if filterIdx := strings.Index(afterBrace, "|"); filterIdx != -1 {
@@ -392,6 +501,16 @@ func (m *LabelMatcher) Match(labels map[string]string) bool {
 		return exists && m.Regex != nil && m.Regex.MatchString(value)
 	case MatchNotRegex:
 		return !exists || (m.Regex != nil && !m.Regex.MatchString(value))
+	case MatchIn:
+		_, ok := m.Set[value]
+		return exists && ok
+	case MatchNotIn:
+		_, ok := m.Set[value]
+		return !exists || !ok
+	case MatchPrefix:
+		return exists && strings.HasPrefix(value, m.Value)
+	case MatchSuffix:
+		return exists && strings.HasSuffix(value, m.Value)
 	}
 
 	return false
@@ -408,11 +527,33 @@ func (f *LineFilter) Match(line string) bool {
 		return f.Regex != nil && f.Regex.MatchString(line)
 	case LineNotRegex:
 		return f.Regex == nil || !f.Regex.MatchString(line)
+	case LineContainsFold:
+		return containsFold(line, f.Pattern)
+	case LineNotContainsFold:
+		return !containsFold(line, f.Pattern)
 	}
 
 	return true
 }
 
+// containsFold reports whether substr is within s ignoring case, without
+// allocating lowercased copies of the line
+//
+// Folding is done over equal-width byte windows, which covers ASCII and most
+// Unicode but not characters whose folded form has a different UTF-8 length.
+func containsFold(s, substr string) bool {
+	n := len(substr)
+	if n == 0 {
+		return true
+	}
+	for i := 0; i+n <= len(s); i++ {
+		if strings.EqualFold(s[i:i+n], substr) {
+			return true
+		}
+	}
+	return false
+}
+
 // MatchLabels checks if all matchers match the given labels
 func (p *ParsedQuery) MatchLabels(labels map[string]string) bool {
 	for _, m := range p.LabelMatchers {
@@ -423,6 +564,14 @@ func (p *ParsedQuery) MatchLabels(labels map[string]string) bool {
 	return true
 }
 
+// restrict adds an equality matcher for each scope label, so only streams
+// carrying all of them match regardless of the selector
+func (p *ParsedQuery) restrict(scope map[string]string) {
+	for name, value := range scope {
+		p.LabelMatchers = append(p.LabelMatchers, LabelMatcher{Name: name, Value: value, Operator: MatchEqual})
+	}
+}
+
 // MatchLine checks if all line filters match the given line
 func (p *ParsedQuery) MatchLine(line string) bool {
 	for _, f := range p.LineFilters {
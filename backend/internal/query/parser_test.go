@@ -1,7 +1,13 @@
 package query
 
 import (
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
 )
 
 func TestParseAdvancedQuery_ExactMatch(t *testing.T) {
@@ -146,6 +152,24 @@ func TestLabelMatcher_Match(t *testing.T) {
 			labels:   map[string]string{"level": "debug"},
 			expected: false,
 		},
+		{
+			name:     "prefix match",
+			matcher:  LabelMatcher{Name: "app", Value: "api-", Operator: MatchPrefix},
+			labels:   map[string]string{"app": "api-gateway"},
+			expected: true,
+		},
+		{
+			name:     "prefix on missing label",
+			matcher:  LabelMatcher{Name: "app", Value: "", Operator: MatchPrefix},
+			labels:   map[string]string{},
+			expected: false,
+		},
+		{
+			name:     "suffix match failure",
+			matcher:  LabelMatcher{Name: "env", Value: "-prod", Operator: MatchSuffix},
+			labels:   map[string]string{"env": "eu-staging"},
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -158,6 +182,30 @@ func TestLabelMatcher_Match(t *testing.T) {
 	}
 }
 
+func TestParseAdvancedQuery_AffixMatch(t *testing.T) {
+	parsed, err := ParseAdvancedQuery(`{app=^"api-", env =$ "-prod", level="error"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.LabelMatchers) != 3 {
+		t.Fatalf("expected 3 matchers, got %d", len(parsed.LabelMatchers))
+	}
+	ops := map[string]MatchOperator{}
+	for _, m := range parsed.LabelMatchers {
+		ops[m.Name+"="+m.Value] = m.Operator
+	}
+	if ops["app=api-"] != MatchPrefix || ops["env=-prod"] != MatchSuffix || ops["level=error"] != MatchEqual {
+		t.Errorf("unexpected operators %v", ops)
+	}
+
+	if !parsed.MatchLabels(map[string]string{"app": "api-gw", "env": "eu-prod", "level": "error"}) {
+		t.Error("expected labels to match")
+	}
+	if parsed.MatchLabels(map[string]string{"app": "web-api-", "env": "eu-prod", "level": "error"}) {
+		t.Error("expected the prefix matcher to reject the labels")
+	}
+}
+
 func TestLineFilter_Match(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -228,3 +276,301 @@ func TestParseAdvancedQuery_EmptyQuery(t *testing.T) {
 		t.Error("expected empty matchers for empty query")
 	}
 }
+
+func TestParseAdvancedQuery_CaseInsensitiveLineFilters(t *testing.T) {
+	query := `{app="nginx"} |=i "Timeout" !=i "HEALTHCHECK"`
+	parsed, err := ParseAdvancedQuery(query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(parsed.LineFilters) != 2 {
+		t.Fatalf("expected 2 line filters, got %d", len(parsed.LineFilters))
+	}
+	if parsed.LineFilters[0].Operator != LineContainsFold {
+		t.Errorf("expected LineContainsFold, got %v", parsed.LineFilters[0].Operator)
+	}
+	if parsed.LineFilters[1].Operator != LineNotContainsFold {
+		t.Errorf("expected LineNotContainsFold, got %v", parsed.LineFilters[1].Operator)
+	}
+
+	if !parsed.MatchLine("upstream TIMEOUT after 30s") {
+		t.Error("expected case-insensitive match")
+	}
+	if parsed.MatchLine("healthcheck timeout") {
+		t.Error("expected case-insensitive exclusion")
+	}
+}
+
+func TestLineFilter_LiteralMetacharacters(t *testing.T) {
+	parsed, err := ParseAdvancedQuery(`{app="api"} |= "GET /v1/users?id=[0-9]+"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if parsed.LineFilters[0].Regex != nil {
+		t.Error("literal filter should not compile a regex")
+	}
+	if !parsed.MatchLine("request GET /v1/users?id=[0-9]+ failed") {
+		t.Error("expected literal match of regex metacharacters")
+	}
+	if parsed.MatchLine("request GET /v1/users?id=42 failed") {
+		t.Error("literal filter must not be interpreted as a regex")
+	}
+}
+
+var benchLine = `2024-01-15T10:30:00Z level=info msg="request completed" method=GET path=/api/v1/users status=200 duration=12ms upstream=timeout-guard`
+
+func BenchmarkLineFilter_Contains(b *testing.B) {
+	f := LineFilter{Pattern: "upstream=timeout", Operator: LineContains}
+	for i := 0; i < b.N; i++ {
+		f.Match(benchLine)
+	}
+}
+
+func BenchmarkLineFilter_Regex(b *testing.B) {
+	parsed, _ := ParseAdvancedQuery(`{app="api"} |~ "upstream=timeout"`)
+	f := parsed.LineFilters[0]
+	for i := 0; i < b.N; i++ {
+		f.Match(benchLine)
+	}
+}
+
+func BenchmarkLineFilter_ContainsFold(b *testing.B) {
+	f := LineFilter{Pattern: "UPSTREAM=TIMEOUT", Operator: LineContainsFold}
+	for i := 0; i < b.N; i++ {
+		f.Match(benchLine)
+	}
+}
+
+func BenchmarkLineFilter_RegexCaseInsensitive(b *testing.B) {
+	parsed, _ := ParseAdvancedQuery(`{app="api"} |~ "(?i)UPSTREAM=TIMEOUT"`)
+	f := parsed.LineFilters[0]
+	for i := 0; i < b.N; i++ {
+		f.Match(benchLine)
+	}
+}
+
+func TestParseAdvancedQuery_LineFilterCostOrder(t *testing.T) {
+	parsed, err := ParseAdvancedQuery(`{app="api"} |~ "time.*out" | pattern "<_> status=<status> <_>" !=i "health" |= "error"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var ops []LineFilterOperator
+	for _, f := range parsed.LineFilters {
+		ops = append(ops, f.Operator)
+	}
+	if len(ops) != 3 || ops[0] != LineContains || ops[1] != LineNotContainsFold || ops[2] != LineRegex {
+		t.Errorf("expected literal, case-insensitive, then regex filters, got %v", ops)
+	}
+	if len(parsed.Pipeline) != 1 {
+		t.Errorf("expected the pattern stage to follow the filters, got %d stages", len(parsed.Pipeline))
+	}
+}
+
+// benchFilterLines alternates lines a literal filter keeps and rejects
+func benchFilterLines(n int) []located {
+	lines := make([]located, n)
+	for i := range lines {
+		line := benchLine
+		if i%10 == 0 {
+			line = strings.Replace(benchLine, "level=info", "level=error", 1)
+		}
+		lines[i] = located{entry: models.LogEntry{
+			ID:        strconv.Itoa(i),
+			Timestamp: time.Unix(int64(i), 0),
+			Line:      line,
+			Labels:    map[string]string{"app": "api"},
+		}}
+	}
+	return lines
+}
+
+// BenchmarkLineFilter_Order compares checking a selective literal after a
+// regex, as written, with the cost order the parser uses
+func BenchmarkLineFilter_Order(b *testing.B) {
+	parsed, _ := ParseAdvancedQuery(`{app="api"} |~ "status=[45][0-9]{2}|upstream=timeout" |= "level=error"`)
+	lines := benchFilterLines(1000)
+	orders := map[string][]LineFilter{
+		"written": {parsed.LineFilters[1], parsed.LineFilters[0]},
+		"cost":    parsed.LineFilters,
+	}
+	for _, name := range []string{"written", "cost"} {
+		q := &ParsedQuery{LineFilters: orders[name]}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, loc := range lines {
+					q.MatchLine(loc.entry.Line)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPipeline_FilterBeforeParse compares parsing every line and then
+// filtering, as written order would, with filtering before the pattern stage
+func BenchmarkPipeline_FilterBeforeParse(b *testing.B) {
+	parsed, err := ParseAdvancedQuery(`{app="api"} | pattern "<_> level=<level> msg=<msg> method=<method> path=<path> status=<status> <_>" |= "level=error"`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := benchFilterLines(1000)
+	work := make([]located, len(lines))
+
+	b.Run("parse_first", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			copy(work, lines)
+			for _, loc := range runPipeline(parsed.Pipeline, work) {
+				parsed.MatchLine(loc.entry.Line)
+			}
+		}
+	})
+	b.Run("filter_first", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			kept := work[:0]
+			for _, loc := range lines {
+				if parsed.MatchLine(loc.entry.Line) {
+					kept = append(kept, loc)
+				}
+			}
+			runPipeline(parsed.Pipeline, kept)
+		}
+	})
+}
+
+func TestParseAdvancedQuery_SetMembership(t *testing.T) {
+	SetNamedSet("prod_apps", []string{"api", "web"})
+
+	parsed, err := ParseAdvancedQuery(`{app in ["api", "worker"], env not in @prod_apps, level="error"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.LabelMatchers) != 3 {
+		t.Fatalf("expected 3 matchers, got %d", len(parsed.LabelMatchers))
+	}
+
+	cases := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"app": "api", "env": "staging", "level": "error"}, true},
+		{map[string]string{"app": "worker", "level": "error"}, true},
+		{map[string]string{"app": "cron", "env": "staging", "level": "error"}, false},
+		{map[string]string{"app": "api", "env": "web", "level": "error"}, false},
+	}
+	for _, c := range cases {
+		if got := parsed.MatchLabels(c.labels); got != c.want {
+			t.Errorf("MatchLabels(%v) = %v, want %v", c.labels, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{`{app in @missing}`, `{app in ["a", 1]}`} {
+		if _, err := ParseAdvancedQuery(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestParseAdvancedQuery_Macros(t *testing.T) {
+	for name, body := range map[string]string{
+		"prod_api": `{app="api", env="prod"}`,
+		"svc":      `{app="$1", env="$2"}`,
+		"errors":   `$svc("$1", "prod") |= "error"`,
+		"loop":     `$loop`,
+	} {
+		if err := SetMacro(name, body); err != nil {
+			t.Fatalf("SetMacro(%s): %v", name, err)
+		}
+	}
+	if err := SetMacro("bad name", `{app="x"}`); err == nil {
+		t.Error("expected an error for an invalid macro name")
+	}
+
+	parsed, err := ParseAdvancedQuery(`count_over_time($errors("web, mobile")[5m])`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.Aggregation == nil || len(parsed.LineFilters) != 1 {
+		t.Fatalf("expected the expanded aggregation and line filter, got %+v", parsed)
+	}
+	if !parsed.MatchLabels(map[string]string{"app": "web, mobile", "env": "prod"}) {
+		t.Errorf("expected the quoted argument to be substituted whole, got %+v", parsed.LabelMatchers)
+	}
+
+	// $ inside strings is not a macro reference
+	parsed, err = ParseAdvancedQuery(`$prod_api |~ "done$prod_api"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.LabelMatchers) != 2 || parsed.LineFilters[0].Pattern != "done$prod_api" {
+		t.Errorf("unexpected expansion: %+v %+v", parsed.LabelMatchers, parsed.LineFilters)
+	}
+
+	for _, bad := range []string{`$missing`, `$svc("api")`, `$prod_api("x")`, `$loop`, `$svc("a", "b"`} {
+		if _, err := ParseAdvancedQuery(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+
+	var names []string
+	for _, m := range Macros() {
+		names = append(names, m.Name)
+		if m.Name == "svc" && m.Params != 2 {
+			t.Errorf("expected svc to take 2 params, got %d", m.Params)
+		}
+	}
+	if len(names) < 4 || !sort.StringsAreSorted(names) {
+		t.Errorf("expected the macros sorted by name, got %v", names)
+	}
+}
+
+func TestParseAdvancedQuery_PipelineStages(t *testing.T) {
+	parsed, err := ParseAdvancedQuery("{app=\"api\"} |= \"tick\" | pattern `<_> served=<served>` | delta served")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.LineFilters) != 1 || parsed.LineFilters[0].Pattern != "tick" {
+		t.Errorf("expected the line filter to survive stage parsing, got %+v", parsed.LineFilters)
+	}
+	if len(parsed.Pipeline) != 2 || parsed.Pipeline[0].Name() != "pattern" || parsed.Pipeline[1].Name() != "delta" {
+		t.Fatalf("unexpected pipeline %+v", parsed.Pipeline)
+	}
+
+	for _, bad := range []string{`{app="api"} | delta`, `{app="api"} | pattern "<_> only"`} {
+		if _, err := ParseAdvancedQuery(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestParseAdvancedQuery_FormatStages(t *testing.T) {
+	parsed, err := ParseAdvancedQuery("{app=\"api\"} | pattern `<method> <path>` | decolorize | line_format `{{.method}} {{.path}}` |= \"GET\"")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.LabelMatchers) != 1 || parsed.LabelMatchers[0].Value != "api" {
+		t.Errorf("expected the template braces not to disturb the selector, got %+v", parsed.LabelMatchers)
+	}
+	if len(parsed.LineFilters) != 1 || parsed.LineFilters[0].Pattern != "GET" {
+		t.Errorf("expected the line filter to be kept, got %+v", parsed.LineFilters)
+	}
+	if len(parsed.Pipeline) != 3 || parsed.Pipeline[2].Name() != "line_format" {
+		t.Fatalf("unexpected pipeline %+v", parsed.Pipeline)
+	}
+
+	for _, bad := range []string{
+		"{app=\"api\"} | line_format `{{.a}}` | pattern `<a> <b>`",
+		"{app=\"api\"} | line_format `{{.a}}` | decolorize | delta served",
+		"{app=\"api\"} | line_format `{{.a`",
+		`{app="api"} | decolorize "x"`,
+		`{app="api"} | json "x"`,
+		`{app="api"} | line_format "{{.a}}" | logfmt`,
+		`{app="api"} | json | status > high`,
+		`{app="api"} | json | path=~"("`,
+	} {
+		if _, err := ParseAdvancedQuery(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
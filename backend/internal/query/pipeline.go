@@ -0,0 +1,369 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// Stage is a pipeline step such as `| pattern "..."` or `| delta field`.
+//
+// A query is evaluated as filter → parse → format:
+//   - label matchers and line filters (|=, !=, |~, !~) run first, always on
+//     the stored line, wherever they are written, so a line a filter rejects
+//     is never parsed;
+//   - parse stages (json, logfmt, pattern, delta) then extract fields;
+//   - format stages (line_format) finally rewrite the line that is returned.
+//
+// Stages run in written order over each stream's entries oldest first, and a
+// parse stage written after a format stage is rejected. decolorize may go
+// anywhere: before parsing to match uncolored text, or last to clean the
+// output. So may label filters such as `| status="500"`, which see the
+// fields extracted before them. Stored lines are never modified.
+type Stage interface {
+	// Name is the stage keyword as written in the query
+	Name() string
+	phase() stagePhase
+	// apply updates the entry in place and reports whether it is kept
+	apply(run *pipelineRun, p *pipelineEntry) bool
+}
+
+// stagePhase orders stage kinds: parse stages must precede format stages
+type stagePhase int
+
+const (
+	phaseAny stagePhase = iota // allowed anywhere in the pipeline
+	phaseParse
+	phaseFormat
+)
+
+// pipelineEntry is the entry a stage sees: the stream's labels extended by
+// fields extracted so far, and the numeric sample produced by delta
+type pipelineEntry struct {
+	stream   string // hash of the original stream labels
+	labels   map[string]string
+	owned    bool // labels is a private copy that stages may modify
+	line     string
+	value    float64
+	hasValue bool
+}
+
+// setLabel adds an extracted field, copying the shared stream labels first
+func (p *pipelineEntry) setLabel(name, value string) {
+	if !p.owned {
+		labels := make(map[string]string, len(p.labels)+1)
+		for k, v := range p.labels {
+			labels[k] = v
+		}
+		p.labels = labels
+		p.owned = true
+	}
+	p.labels[name] = value
+}
+
+// pipelineRun holds per-query stage state, such as the previous value of
+// each stream for delta
+type pipelineRun struct {
+	previous map[string]float64
+}
+
+// stageRegex matches a pipeline stage and its argument, or a label filter
+// on a stream label or extracted field: | name op value
+var stageRegex = regexp.MustCompile("\\|\\s*(?:(pattern|delta|line_format|decolorize|json|logfmt)\\b\\s*(\"[^\"]*\"|`[^`]*`|[\\w.]+)?" +
+	"|([A-Za-z_][\\w.]*)\\s*(=~|!~|!=|==|>=|<=|=|>|<)\\s*(\"[^\"]*\"|`[^`]*`|[\\w.+-]+))")
+
+// parseStages extracts pipeline stages from the text after the selector and
+// returns the text with the stages removed, leaving the line filters
+func parseStages(part string) ([]Stage, string, error) {
+	matches := stageRegex.FindAllStringSubmatchIndex(part, -1)
+	if len(matches) == 0 {
+		return nil, part, nil
+	}
+
+	var stages []Stage
+	var last Stage // latest stage with a phase, for the ordering check
+	var rest strings.Builder
+	prev := 0
+	for _, m := range matches {
+		rest.WriteString(part[prev:m[0]])
+		prev = m[1]
+
+		var stage Stage
+		var err error
+		if m[2] < 0 {
+			stage, err = newLabelFilterStage(part[m[6]:m[7]], part[m[8]:m[9]], part[m[10]:m[11]])
+			if err != nil {
+				return nil, "", err
+			}
+			stages = append(stages, stage)
+			continue
+		}
+
+		keyword := part[m[2]:m[3]]
+		arg := ""
+		if m[4] >= 0 {
+			arg = part[m[4]:m[5]]
+		}
+
+		switch keyword {
+		case "pattern":
+			stage, err = newPatternStage(arg)
+		case "delta":
+			stage, err = newDeltaStage(arg)
+		case "line_format":
+			stage, err = newLineFormatStage(arg)
+		case "decolorize":
+			if arg != "" {
+				err = &QueryError{Type: "syntax", Message: "decolorize stage takes no argument", Details: arg}
+			}
+			stage = decolorizeStage{}
+		case "json", "logfmt":
+			if arg != "" {
+				err = &QueryError{Type: "syntax", Message: keyword + " stage takes no argument", Details: arg}
+			}
+			stage = jsonStage{}
+			if keyword == "logfmt" {
+				stage = logfmtStage{}
+			}
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if last != nil && stage.phase() != phaseAny && stage.phase() < last.phase() {
+			return nil, "", &QueryError{
+				Type:    "syntax",
+				Message: fmt.Sprintf("%s stage must come before %s", keyword, last.Name()),
+				Details: "stages run filter, then parse (json, logfmt, pattern, delta), then format (line_format)",
+			}
+		}
+		if stage.phase() != phaseAny {
+			last = stage
+		}
+		stages = append(stages, stage)
+	}
+	rest.WriteString(part[prev:])
+	return stages, rest.String(), nil
+}
+
+// runPipeline applies the stages to the matched entries. Entries are
+// processed oldest first so stateful stages see each stream in time order;
+// the returned entries keep that order.
+func runPipeline(stages []Stage, matched []located) []located {
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[j].cursor().before(matched[i].cursor())
+	})
+
+	run := &pipelineRun{previous: make(map[string]float64)}
+	out := matched[:0]
+	for _, loc := range matched {
+		p := &pipelineEntry{
+			stream: models.Labels(loc.entry.Labels).Hash(),
+			labels: loc.entry.Labels,
+			line:   loc.entry.Line,
+		}
+		kept := true
+		for _, stage := range stages {
+			if !stage.apply(run, p) {
+				kept = false
+				break
+			}
+		}
+		if !kept {
+			continue
+		}
+
+		loc.entry.Labels = p.labels
+		loc.entry.Line = p.line
+		loc.value, loc.hasValue = p.value, p.hasValue
+		out = append(out, loc)
+	}
+	return out
+}
+
+// patternStage extracts fields with a Loki-style pattern such as
+// `<ip> - <_> "<method> <path> <_>" <status>`. <_> skips text.
+type patternStage struct {
+	regex *regexp.Regexp
+	names []string
+}
+
+var patternCaptureRegex = regexp.MustCompile(`<(_|[A-Za-z_]\w*)>`)
+
+func newPatternStage(arg string) (Stage, error) {
+	expr, err := unquoteStageArg(arg)
+	if err != nil || expr == "" {
+		return nil, &QueryError{Type: "syntax", Message: "pattern stage requires a quoted pattern"}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	var names []string
+	locs := patternCaptureRegex.FindAllStringSubmatchIndex(expr, -1)
+	prev := 0
+	for i, loc := range locs {
+		sb.WriteString(regexp.QuoteMeta(expr[prev:loc[0]]))
+		prev = loc[1]
+
+		// A capture runs up to the next literal; the last one takes the rest
+		group := "(.*?)"
+		if i == len(locs)-1 && loc[1] == len(expr) {
+			group = "(.*)"
+		}
+		name := expr[loc[2]:loc[3]]
+		if name == "_" {
+			sb.WriteString(strings.Replace(group, "(", "(?:", 1))
+			continue
+		}
+		sb.WriteString(group)
+		names = append(names, name)
+	}
+	sb.WriteString(regexp.QuoteMeta(expr[prev:]))
+
+	if len(names) == 0 {
+		return nil, &QueryError{Type: "syntax", Message: "pattern stage needs at least one named capture", Details: expr}
+	}
+	regex, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, &QueryError{Type: "syntax", Message: "Invalid pattern", Details: err.Error()}
+	}
+	return &patternStage{regex: regex, names: names}, nil
+}
+
+func (s *patternStage) Name() string      { return "pattern" }
+func (s *patternStage) phase() stagePhase { return phaseParse }
+
+// apply keeps lines that do not match the pattern, without extracted fields
+func (s *patternStage) apply(_ *pipelineRun, p *pipelineEntry) bool {
+	m := s.regex.FindStringSubmatch(p.line)
+	if m == nil {
+		return true
+	}
+	for i, name := range s.names {
+		p.setLabel(name, m[i+1])
+	}
+	return true
+}
+
+// deltaStage turns a numeric field into the difference from the previous
+// entry of the same stream. A decrease is treated as a counter reset and
+// yields the raw value. The first entry of each stream only sets the
+// baseline, and entries without a numeric field are dropped.
+type deltaStage struct {
+	field string
+}
+
+func newDeltaStage(arg string) (Stage, error) {
+	if arg == "" || strings.HasPrefix(arg, `"`) || strings.HasPrefix(arg, "`") {
+		return nil, &QueryError{Type: "syntax", Message: "delta stage requires a field name"}
+	}
+	return &deltaStage{field: arg}, nil
+}
+
+func (s *deltaStage) Name() string      { return "delta" }
+func (s *deltaStage) phase() stagePhase { return phaseParse }
+
+func (s *deltaStage) apply(run *pipelineRun, p *pipelineEntry) bool {
+	raw, ok := p.labels[s.field]
+	if !ok {
+		return false
+	}
+	current, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return false
+	}
+
+	previous, seen := run.previous[p.stream]
+	run.previous[p.stream] = current
+	if !seen {
+		return false
+	}
+
+	delta := current - previous
+	if delta < 0 {
+		delta = current
+	}
+	p.value, p.hasValue = delta, true
+	return true
+}
+
+// labelFilterStage keeps entries whose label or extracted field compares to
+// a value: =, == and != compare text, =~ and !~ match a regex against the
+// whole value, and >, >=, < and <= compare numbers. A missing field is the
+// empty string; entries whose field is not a number fail numeric filters.
+type labelFilterStage struct {
+	name   string
+	op     string
+	value  string
+	number float64
+	regex  *regexp.Regexp
+}
+
+func newLabelFilterStage(name, op, arg string) (Stage, error) {
+	value := arg
+	if strings.HasPrefix(arg, `"`) || strings.HasPrefix(arg, "`") {
+		var err error
+		if value, err = unquoteStageArg(arg); err != nil {
+			return nil, &QueryError{Type: "syntax", Message: "Invalid label filter value", Details: arg}
+		}
+	}
+
+	s := &labelFilterStage{name: name, op: op, value: value}
+	switch op {
+	case "=~", "!~":
+		regex, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, ErrInvalidRegex
+		}
+		s.regex = regex
+	case ">", ">=", "<", "<=":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, &QueryError{Type: "syntax", Message: fmt.Sprintf("label filter %s %s needs a number", name, op), Details: arg}
+		}
+		s.number = number
+	}
+	return s, nil
+}
+
+func (s *labelFilterStage) Name() string      { return s.name + s.op }
+func (s *labelFilterStage) phase() stagePhase { return phaseAny }
+
+func (s *labelFilterStage) apply(_ *pipelineRun, p *pipelineEntry) bool {
+	v := p.labels[s.name]
+	switch s.op {
+	case "=", "==":
+		return v == s.value
+	case "!=":
+		return v != s.value
+	case "=~":
+		return s.regex.MatchString(v)
+	case "!~":
+		return !s.regex.MatchString(v)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return false
+	}
+	switch s.op {
+	case ">":
+		return n > s.number
+	case ">=":
+		return n >= s.number
+	case "<":
+		return n < s.number
+	default:
+		return n <= s.number
+	}
+}
+
+func unquoteStageArg(arg string) (string, error) {
+	if strings.HasPrefix(arg, "`") {
+		return strings.Trim(arg, "`"), nil
+	}
+	return strconv.Unquote(arg)
+}
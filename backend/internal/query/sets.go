@@ -0,0 +1,79 @@
+package query
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Named value sets referenced from queries as `label in @name`
+var (
+	namedSetsMu sync.RWMutex
+	namedSets   = make(map[string]map[string]struct{})
+)
+
+// SetNamedSet registers (or replaces) a server-side value set
+func SetNamedSet(name string, values []string) {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	namedSetsMu.Lock()
+	namedSets[name] = set
+	namedSetsMu.Unlock()
+}
+
+// LoadNamedSetFile reads a value set from a file holding either a JSON array
+// of strings or one value per line. Blank lines and lines starting with #
+// are ignored in the line format.
+func LoadNamedSetFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		var values []string
+		if err := json.Unmarshal([]byte(trimmed), &values); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+
+	var values []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	return values, scanner.Err()
+}
+
+// parseValueSet resolves the operand of an in/not in matcher: an inline JSON
+// array or a reference to a named set
+func parseValueSet(operand string) (map[string]struct{}, error) {
+	if strings.HasPrefix(operand, "@") {
+		name := operand[1:]
+		namedSetsMu.RLock()
+		set, ok := namedSets[name]
+		namedSetsMu.RUnlock()
+		if !ok {
+			return nil, &QueryError{Type: "syntax", Message: "Unknown value set", Details: name}
+		}
+		return set, nil
+	}
+
+	var values []string
+	if err := json.Unmarshal([]byte(operand), &values); err != nil {
+		return nil, &QueryError{Type: "syntax", Message: "Invalid value set", Details: "expected a JSON array of strings"}
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set, nil
+}
@@ -1,6 +1,7 @@
 package ratelimiter
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -12,39 +13,110 @@ import (
 	"github.com/gorilla/mux"
 	"golang.org/x/time/rate"
 
+	"github.com/logpulse/backend/internal/clock"
 	"github.com/logpulse/backend/internal/config"
 )
 
-type ipLimiterEntry struct {
+type limiterEntry struct {
 	limiter    *rate.Limiter
 	lastAccess time.Time
 }
 
-type IPRateLimiter struct {
-	ips            map[string]*ipLimiterEntry
-	mu             *sync.RWMutex
-	r              rate.Limit
-	b              int
-	cleanupTicker  *time.Ticker
-	ttl            time.Duration
-	done           chan struct{}
-	trustedProxies map[string]bool
+// KeyedRateLimiter keeps a token bucket per key, a client IP or an API key,
+// and drops buckets left idle past the TTL
+type KeyedRateLimiter struct {
+	limiters      map[string]*limiterEntry
+	mu            *sync.RWMutex
+	r             rate.Limit
+	b             int
+	cleanupTicker *time.Ticker
+	ttl           time.Duration
+	done          chan struct{}
+	clock         clock.Clock
 }
 
-func NewIPRateLimiter(r rate.Limit, b int, trustedProxies []string) *IPRateLimiter {
-	limiter := &IPRateLimiter{
-		ips:            make(map[string]*ipLimiterEntry),
-		mu:             &sync.RWMutex{},
-		r:              r,
-		b:              b,
-		cleanupTicker:  time.NewTicker(5 * time.Minute),
-		ttl:            10 * time.Minute,
-		done:           make(chan struct{}),
-		trustedProxies: make(map[string]bool),
+// ipSet holds exact IPs and CIDR blocks, for trusted proxies and the
+// whitelist and blacklist
+type ipSet struct {
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+// newIPSet parses entries such as "10.0.0.5", "10.0.0.0/8" or "fd00::/8".
+// Entries that are neither are logged, naming the list they came from, and
+// ignored.
+func newIPSet(list string, entries []string) *ipSet {
+	s := &ipSet{ips: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				log.Printf("[Rate Limit] Ignoring invalid %s CIDR %q: %v", list, entry, err)
+				continue
+			}
+			s.nets = append(s.nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			log.Printf("[Rate Limit] Ignoring invalid %s IP %q", list, entry)
+			continue
+		}
+		s.ips[ip.String()] = true
+	}
+	return s
+}
+
+func (s *ipSet) empty() bool {
+	return s == nil || (len(s.ips) == 0 && len(s.nets) == 0)
+}
+
+// contains reports whether ip is in the set
+func (s *ipSet) contains(ip string) bool {
+	if s.empty() {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if s.ips[parsed.String()] {
+		return true
+	}
+	for _, n := range s.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipLists are the parsed IP lists of a RateLimitConfig
+type ipLists struct {
+	trustedProxies *ipSet
+	whitelist      *ipSet
+	blacklist      *ipSet
+}
+
+func newIPLists(cfg config.RateLimitConfig) *ipLists {
+	return &ipLists{
+		trustedProxies: newIPSet("trusted proxy", cfg.TrustedProxies),
+		whitelist:      newIPSet("whitelist", cfg.WhitelistIPs),
+		blacklist:      newIPSet("blacklist", cfg.BlacklistIPs),
 	}
+}
 
-	for _, proxy := range trustedProxies {
-		limiter.trustedProxies[proxy] = true
+func NewKeyedRateLimiter(r rate.Limit, b int) *KeyedRateLimiter {
+	limiter := &KeyedRateLimiter{
+		limiters:      make(map[string]*limiterEntry),
+		mu:            &sync.RWMutex{},
+		r:             r,
+		b:             b,
+		cleanupTicker: time.NewTicker(5 * time.Minute),
+		ttl:           10 * time.Minute,
+		done:          make(chan struct{}),
+		clock:         clock.Real{},
 	}
 
 	go limiter.cleanupLoop()
@@ -52,25 +124,44 @@ func NewIPRateLimiter(r rate.Limit, b int, trustedProxies []string) *IPRateLimit
 	return limiter
 }
 
-func (i *IPRateLimiter) GetLimiter(ip string) *rate.Limiter {
+// SetClock replaces the clock that idle entries are aged by
+func (i *KeyedRateLimiter) SetClock(c clock.Clock) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.clock = c
+}
+
+func (i *KeyedRateLimiter) GetLimiter(key string) *rate.Limiter {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	entry, exists := i.ips[ip]
+	entry, exists := i.limiters[key]
 	if !exists {
-		entry = &ipLimiterEntry{
+		entry = &limiterEntry{
 			limiter:    rate.NewLimiter(i.r, i.b),
-			lastAccess: time.Now(),
+			lastAccess: i.clock.Now(),
 		}
-		i.ips[ip] = entry
+		i.limiters[key] = entry
 	} else {
-		entry.lastAccess = time.Now()
+		entry.lastAccess = i.clock.Now()
 	}
 
 	return entry.limiter
 }
 
-func (i *IPRateLimiter) cleanupLoop() {
+// SetLimit changes the rate and burst of every bucket, existing and new
+func (i *KeyedRateLimiter) SetLimit(r rate.Limit, b int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.r, i.b = r, b
+	now := i.clock.Now()
+	for _, entry := range i.limiters {
+		entry.limiter.SetLimitAt(now, r)
+		entry.limiter.SetBurstAt(now, b)
+	}
+}
+
+func (i *KeyedRateLimiter) cleanupLoop() {
 	for {
 		select {
 		case <-i.cleanupTicker.C:
@@ -82,79 +173,126 @@ func (i *IPRateLimiter) cleanupLoop() {
 	}
 }
 
-func (i *IPRateLimiter) cleanup() {
+func (i *KeyedRateLimiter) cleanup() {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	now := time.Now()
-	for ip, entry := range i.ips {
+	now := i.clock.Now()
+	for key, entry := range i.limiters {
 		if now.Sub(entry.lastAccess) > i.ttl {
-			delete(i.ips, ip)
+			delete(i.limiters, key)
 		}
 	}
 }
 
-func (i *IPRateLimiter) Stop() {
+func (i *KeyedRateLimiter) Stop() {
 	close(i.done)
 }
 
-func Middleware(cfg *config.RateLimitConfig) mux.MiddlewareFunc {
-	if !cfg.Enabled {
-		return func(next http.Handler) http.Handler {
-			return next
-		}
+// Limiter enforces a RateLimitConfig. Requests carrying an API key get a
+// bucket per key, so agents behind one NAT gateway don't share a budget;
+// the rest get one per IP. Update swaps the settings while it serves
+// requests, keeping the buckets.
+type Limiter struct {
+	mu    sync.RWMutex
+	cfg   config.RateLimitConfig
+	lists *ipLists
+
+	ipLimiter  *KeyedRateLimiter
+	keyLimiter *KeyedRateLimiter
+}
+
+// New creates a limiter enforcing cfg
+func New(cfg config.RateLimitConfig) *Limiter {
+	keyRPM, keyBurst := cfg.KeyLimits()
+	return &Limiter{
+		cfg:        cfg,
+		lists:      newIPLists(cfg),
+		ipLimiter:  NewKeyedRateLimiter(rate.Limit(float64(cfg.RequestsPerMinute)/60.0), cfg.Burst),
+		keyLimiter: NewKeyedRateLimiter(rate.Limit(float64(keyRPM)/60.0), keyBurst),
 	}
+}
 
-	requestsPerSecond := float64(cfg.RequestsPerMinute) / 60.0
-	limiter := NewIPRateLimiter(rate.Limit(requestsPerSecond), cfg.Burst, cfg.TrustedProxies)
+// Update applies new settings to requests from now on. Buckets keep their
+// tokens, capped at the new burst.
+func (l *Limiter) Update(cfg config.RateLimitConfig) {
+	keyRPM, keyBurst := cfg.KeyLimits()
+	l.ipLimiter.SetLimit(rate.Limit(float64(cfg.RequestsPerMinute)/60.0), cfg.Burst)
+	l.keyLimiter.SetLimit(rate.Limit(float64(keyRPM)/60.0), keyBurst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.lists = newIPLists(cfg)
+}
 
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == "OPTIONS" {
-				next.ServeHTTP(w, r)
-				return
-			}
+func (l *Limiter) settings() (config.RateLimitConfig, *ipLists) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg, l.lists
+}
 
-			ip := extractIP(r, limiter.trustedProxies)
+// Middleware limits requests by cfg, copied as it is now
+func Middleware(cfg *config.RateLimitConfig) mux.MiddlewareFunc {
+	return New(*cfg).Middleware
+}
 
-			if isWhitelisted(ip, cfg.WhitelistIPs) {
-				log.Printf("[Rate Limit] Bypassed for whitelisted IP: %s", maskIP(ip))
-				next.ServeHTTP(w, r)
-				return
-			}
+// Middleware wraps next with the limiter; it passes every request through
+// while rate limiting is disabled
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg, lists := l.settings()
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == "OPTIONS" && !cfg.CountPreflight {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			if isBlacklisted(ip, cfg.BlacklistIPs) {
-				log.Printf("[Rate Limit] Access denied for blacklisted IP: %s", maskIP(ip))
-				http.Error(w, "Access denied", http.StatusForbidden)
-				return
-			}
+		ip := extractIP(r, lists.trustedProxies)
 
-			lim := limiter.GetLimiter(ip)
-			if !lim.Allow() {
-				log.Printf("[Rate Limit] Exceeded for IP: %s (limit: %d req/min, burst: %d)",
-					maskIP(ip), cfg.RequestsPerMinute, cfg.Burst)
+		if lists.whitelist.contains(ip) {
+			log.Printf("[Rate Limit] Bypassed for whitelisted IP: %s", maskIP(ip))
+			next.ServeHTTP(w, r)
+			return
+		}
 
-				w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", cfg.RequestsPerMinute))
-				w.Header().Set("X-RateLimit-Remaining", "0")
-				w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix()))
-				w.Header().Set("Retry-After", "60")
+		if lists.blacklist.contains(ip) {
+			log.Printf("[Rate Limit] Access denied for blacklisted IP: %s", maskIP(ip))
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
 
-				http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
-				return
-			}
+		lim, rpm, burst, client := l.ipLimiter.GetLimiter(ip), cfg.RequestsPerMinute, cfg.Burst, "IP: "+maskIP(ip)
+		if key := acceptedAPIKey(r.Context()); key != "" {
+			keyRPM, keyBurst := cfg.KeyLimits()
+			lim, rpm, burst, client = l.keyLimiter.GetLimiter(key), keyRPM, keyBurst, "API key: "+maskKey(key)
+		}
+		if !lim.Allow() {
+			log.Printf("[Rate Limit] Exceeded for %s (limit: %d req/min, burst: %d)", client, rpm, burst)
 
-			next.ServeHTTP(w, r)
-		})
-	}
+			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", rpm))
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix()))
+			w.Header().Set("Retry-After", "60")
+
+			http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
-func extractIP(r *http.Request, trustedProxies map[string]bool) string {
+func extractIP(r *http.Request, trustedProxies *ipSet) string {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		ip = r.RemoteAddr
 	}
 
-	if len(trustedProxies) > 0 && trustedProxies[ip] {
+	if trustedProxies.contains(ip) {
 		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
 			parts := strings.Split(forwarded, ",")
 			if len(parts) > 0 {
@@ -175,6 +313,34 @@ func extractIP(r *http.Request, trustedProxies map[string]bool) string {
 	return ip
 }
 
+type apiKeyContextKey struct{}
+
+// WithAPIKey records the API key the auth middleware accepted for a
+// request. Only such keys get a bucket of their own: a key taken straight
+// from the headers would let a client dodge its IP's limit by sending a
+// new made-up key with every request.
+func WithAPIKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// acceptedAPIKey returns the key recorded by WithAPIKey, or "" for requests
+// limited by IP
+func acceptedAPIKey(ctx context.Context) string {
+	key, _ := ctx.Value(apiKeyContextKey{}).(string)
+	return key
+}
+
+// maskKey keeps only the start of an API key for logs
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "xxxx"
+	}
+	return key[:4] + "xxxx"
+}
+
 func maskIP(ip string) string {
 	if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.To4() != nil {
 		parts := strings.Split(ip, ".")
@@ -192,21 +358,3 @@ func maskIP(ip string) string {
 
 	return ip
 }
-
-func isWhitelisted(ip string, whitelist []string) bool {
-	for _, whitelistIP := range whitelist {
-		if ip == whitelistIP {
-			return true
-		}
-	}
-	return false
-}
-
-func isBlacklisted(ip string, blacklist []string) bool {
-	for _, blacklistIP := range blacklist {
-		if ip == blacklistIP {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,174 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/config"
+)
+
+func TestExtractIP_TrustedProxies(t *testing.T) {
+	proxies := newIPSet("trusted proxy", []string{"192.168.1.10", "10.244.0.0/16", "not-a-cidr/99"})
+
+	cases := []struct {
+		remote string
+		want   string
+	}{
+		{"192.168.1.10:5000", "203.0.113.7"}, // exact IP
+		{"10.244.3.17:5000", "203.0.113.7"},  // inside CIDR
+		{"10.245.0.1:5000", "10.245.0.1"},    // outside CIDR
+		{"192.168.1.11:5000", "192.168.1.11"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/ingest", nil)
+		r.RemoteAddr = c.remote
+		r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.244.3.17")
+		if got := extractIP(r, proxies); got != c.want {
+			t.Errorf("remote %s: expected %s, got %s", c.remote, c.want, got)
+		}
+	}
+
+	if len(proxies.nets) != 1 {
+		t.Errorf("expected invalid CIDR to be ignored, got %d nets", len(proxies.nets))
+	}
+}
+
+func TestKeyedRateLimiter_CleanupIdle(t *testing.T) {
+	limiter := NewKeyedRateLimiter(1, 1)
+	defer limiter.Stop()
+	clk := clock.NewFake(time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC))
+	limiter.SetClock(clk)
+
+	limiter.GetLimiter("10.0.0.1")
+	clk.Advance(6 * time.Minute)
+	limiter.GetLimiter("10.0.0.2")
+	clk.Advance(5 * time.Minute)
+	limiter.cleanup()
+
+	if _, ok := limiter.limiters["10.0.0.1"]; ok {
+		t.Error("expected the entry idle past the TTL to be removed")
+	}
+	if _, ok := limiter.limiters["10.0.0.2"]; !ok {
+		t.Error("expected the recently used entry to be kept")
+	}
+}
+
+func TestMiddleware_PerAPIKey(t *testing.T) {
+	cfg := &config.RateLimitConfig{Enabled: true, RequestsPerMinute: 60, Burst: 1, KeyRequestsPerMinute: 60, KeyBurst: 2}
+	handler := Middleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(key string) int {
+		r := httptest.NewRequest("POST", "/ingest", nil)
+		r.RemoteAddr = "203.0.113.7:5000" // one NAT gateway
+		r = r.WithContext(WithAPIKey(r.Context(), key))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Each key has its own bucket of the keyed burst
+	for _, key := range []string{"agent-key-one", "agent-key-two"} {
+		for i := 0; i < 2; i++ {
+			if code := send(key); code != http.StatusOK {
+				t.Fatalf("%s request %d: expected 200, got %d", key, i+1, code)
+			}
+		}
+		if code := send(key); code != http.StatusTooManyRequests {
+			t.Errorf("%s: expected 429 past the burst, got %d", key, code)
+		}
+	}
+
+	// Anonymous requests from the same IP are limited apart from the keys
+	if code := send(""); code != http.StatusOK {
+		t.Errorf("anonymous: expected 200, got %d", code)
+	}
+	if code := send(""); code != http.StatusTooManyRequests {
+		t.Errorf("anonymous: expected 429 past the burst, got %d", code)
+	}
+}
+
+func TestMiddleware_UnacceptedKeysShareIPBucket(t *testing.T) {
+	cfg := &config.RateLimitConfig{Enabled: true, RequestsPerMinute: 60, Burst: 2, KeyRequestsPerMinute: 60, KeyBurst: 100}
+	handler := Middleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Keys only in the headers, not accepted by auth, get no buckets
+	codes := make([]int, 3)
+	for i := range codes {
+		r := httptest.NewRequest("POST", "/ingest", nil)
+		r.RemoteAddr = "203.0.113.7:5000"
+		r.Header.Set("X-API-Key", fmt.Sprintf("made-up-%d", i))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes[i] = w.Code
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("expected the IP's burst of 2 to apply across keys, got %v", codes)
+	}
+}
+
+func TestIPSet_Contains(t *testing.T) {
+	set := newIPSet("whitelist", []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8", "2001:db8::1", "not-an-ip", "10.0.0.0/99"})
+
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},        // IPv4 CIDR
+		{"11.0.0.1", false},       // outside it
+		{"192.168.1.10", true},    // exact IPv4
+		{"192.168.1.11", false},   // next to it
+		{"fd12:3456::1", true},    // IPv6 CIDR
+		{"fe80::1", false},        // outside it
+		{"2001:db8:0::1", true},   // exact IPv6, written differently
+		{"2001:db8::2", false},    // next to it
+		{"::ffff:10.1.2.3", true}, // IPv4-mapped IPv6
+		{"not-an-ip", false},      // invalid entries are never matched
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := set.contains(c.ip); got != c.want {
+			t.Errorf("%q: expected %v, got %v", c.ip, c.want, got)
+		}
+	}
+	if len(set.ips) != 2 || len(set.nets) != 2 {
+		t.Errorf("expected invalid entries skipped, got %d IPs and %d nets", len(set.ips), len(set.nets))
+	}
+}
+
+func TestMiddleware_CIDRLists(t *testing.T) {
+	cfg := &config.RateLimitConfig{
+		Enabled:           true,
+		RequestsPerMinute: 60,
+		Burst:             1,
+		WhitelistIPs:      []string{"10.0.0.0/8", "2001:db8::/32"},
+		BlacklistIPs:      []string{"203.0.113.0/24", "198.51.100.7"},
+	}
+	handler := Middleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(remote string) int {
+		r := httptest.NewRequest("POST", "/ingest", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Whitelisted subnets are never limited
+	for _, remote := range []string{"10.20.30.40:5000", "[2001:db8::5]:5000"} {
+		for i := 0; i < 3; i++ {
+			if code := send(remote); code != http.StatusOK {
+				t.Fatalf("%s request %d: expected 200, got %d", remote, i+1, code)
+			}
+		}
+	}
+	for _, remote := range []string{"203.0.113.99:5000", "198.51.100.7:5000"} {
+		if code := send(remote); code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", remote, code)
+		}
+	}
+	if code := send("198.51.100.8:5000"); code != http.StatusOK {
+		t.Errorf("expected an unlisted IP to be allowed, got %d", code)
+	}
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StorageBackend stores the objects chunks are made of, their data and
+// metadata files, under slash-separated keys relative to the storage root:
+// a stream directory and a file name, such as "app=api/chunk_1_2.log".
+// Writer and Reader keep chunks in one; LocalBackend is the filesystem,
+// S3Backend an S3-compatible bucket.
+type StorageBackend interface {
+	// PutChunk stores data under key, replacing any object there. Readers
+	// see the whole object or none of it, and it is durable once PutChunk
+	// returns.
+	PutChunk(key string, data []byte) error
+	// GetChunk opens the object under key. A missing object is an error
+	// matching fs.ErrNotExist.
+	GetChunk(key string) (io.ReadCloser, error)
+	// ListChunks returns the objects whose keys start with prefix, sorted
+	// by key
+	ListChunks(prefix string) ([]ChunkObject, error)
+	// DeleteChunk removes the object under key; a missing object is not an
+	// error
+	DeleteChunk(key string) error
+}
+
+// ChunkObject describes an object in a StorageBackend
+type ChunkObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// modTimeSetter is implemented by backends that can backdate an object, as
+// LocalBackend can. Retention ages objects by modification time, so objects
+// rewritten in place keep theirs where the backend allows.
+type modTimeSetter interface {
+	SetModTime(key string, t time.Time) error
+}
+
+// chunkKey joins a stream directory and a file name into an object key
+func chunkKey(dir, name string) string {
+	return path.Join(dir, name)
+}
+
+// splitKey returns the stream directory and file name of an object key
+func splitKey(key string) (dir, name string) {
+	dir, name = path.Split(key)
+	return strings.TrimSuffix(dir, "/"), name
+}
+
+// readObject reads the object under key whole
+func readObject(b StorageBackend, key string) ([]byte, error) {
+	rc, err := b.GetChunk(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// partialSuffix marks a file LocalBackend is still writing. A crash leaves
+// it behind as an ordinary object, which retention ages out.
+const partialSuffix = ".partial"
+
+// LocalBackend keeps objects as files under a base directory, one
+// subdirectory per stream
+type LocalBackend struct {
+	basePath string
+}
+
+// NewLocalBackend creates a backend storing objects under basePath
+func NewLocalBackend(basePath string) *LocalBackend {
+	return &LocalBackend{basePath: basePath}
+}
+
+func (b *LocalBackend) path(key string) string {
+	return filepath.Join(b.basePath, filepath.FromSlash(key))
+}
+
+// PutChunk writes data to a temporary file, syncs it and renames it into
+// place, then syncs the directory
+func (b *LocalBackend) PutChunk(key string, data []byte) error {
+	p := b.path(key)
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := p + partialSuffix
+	err := writeFileSynced(tmp, func(f io.Writer) error {
+		_, err := f.Write(data)
+		return err
+	})
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// GetChunk opens the file under key
+func (b *LocalBackend) GetChunk(key string) (io.ReadCloser, error) {
+	return os.Open(b.path(key))
+}
+
+// ListChunks reads the directories prefix can match files in
+func (b *LocalBackend) ListChunks(prefix string) ([]ChunkObject, error) {
+	// Only the directory holding the prefix's last segment needs walking
+	root := b.basePath
+	if dir, _ := splitKey(prefix); dir != "" {
+		root = b.path(dir)
+	}
+
+	var objects []ChunkObject
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed meanwhile, or never created
+			}
+			return err
+		}
+		rel, err := filepath.Rel(b.basePath, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			// Skip directories the prefix cannot reach into
+			if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed meanwhile
+		}
+		objects = append(objects, ChunkObject{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// DeleteChunk removes the file under key, and its directory once empty,
+// syncing the removal to disk
+func (b *LocalBackend) DeleteChunk(key string) error {
+	p := b.path(key)
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if dir == filepath.Clean(b.basePath) {
+		return syncDir(dir)
+	}
+	// Fails harmlessly while other files remain
+	if os.Remove(dir) == nil {
+		return syncDir(b.basePath)
+	}
+	if err := syncDir(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SetModTime sets the modification time of the file under key
+func (b *LocalBackend) SetModTime(key string, t time.Time) error {
+	return os.Chtimes(b.path(key), t, t)
+}
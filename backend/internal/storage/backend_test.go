@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/models"
+)
+
+// backends returns every backend the contract tests run against, each
+// empty: the local filesystem, memory, and S3 against a fake server that
+// keeps objects in memory
+func backends(t *testing.T) map[string]StorageBackend {
+	t.Helper()
+	s3, err := NewS3Backend(S3Config{
+		Endpoint:        newFakeS3(t, "logs").URL,
+		Bucket:          "logs",
+		Prefix:          "chunks/",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]StorageBackend{
+		"local":  NewLocalBackend(t.TempDir()),
+		"memory": NewMemoryBackend(),
+		"s3":     s3,
+	}
+}
+
+func TestStorageBackend_Contract(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			get := func(key string) (string, error) {
+				rc, err := b.GetChunk(key)
+				if err != nil {
+					return "", err
+				}
+				defer rc.Close()
+				data, err := io.ReadAll(rc)
+				return string(data), err
+			}
+
+			for key, data := range map[string]string{
+				"app=api/chunk_1_1.log":          "first\n",
+				"app=api/chunk_1_1.meta":         "{}\n",
+				"app=api_env=prod/chunk_1_2.log": "other stream\n",
+				"app=db/chunk_1_3.log.gz":        "",
+				"SCHEMA_VERSION":                 "{}\n",
+			} {
+				if err := b.PutChunk(key, []byte(data)); err != nil {
+					t.Fatalf("put %s: %v", key, err)
+				}
+			}
+
+			if data, err := get("app=api/chunk_1_1.log"); err != nil || data != "first\n" {
+				t.Errorf("expected the stored data, got %q (%v)", data, err)
+			}
+			if data, err := get("app=db/chunk_1_3.log.gz"); err != nil || data != "" {
+				t.Errorf("expected an empty object, got %q (%v)", data, err)
+			}
+			if _, err := get("app=api/missing.log"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected a missing object to be fs.ErrNotExist, got %v", err)
+			}
+
+			b.PutChunk("app=api/chunk_1_1.log", []byte("replaced\n"))
+			if data, _ := get("app=api/chunk_1_1.log"); data != "replaced\n" {
+				t.Errorf("expected the object replaced, got %q", data)
+			}
+
+			keys := func(prefix string) string {
+				objects, err := b.ListChunks(prefix)
+				if err != nil {
+					t.Fatalf("list %q: %v", prefix, err)
+				}
+				var ks []string
+				for _, obj := range objects {
+					ks = append(ks, obj.Key)
+					if obj.ModTime.IsZero() {
+						t.Errorf("expected a modification time for %s", obj.Key)
+					}
+				}
+				return strings.Join(ks, " ")
+			}
+			if got, want := keys("app=api/"), "app=api/chunk_1_1.log app=api/chunk_1_1.meta"; got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+			if got, want := keys("app=api/chunk_1_1.l"), "app=api/chunk_1_1.log"; got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+			if got := keys(""); len(strings.Fields(got)) != 5 {
+				t.Errorf("expected all 5 objects listed, got %q", got)
+			}
+			objects, _ := b.ListChunks("app=api_env=prod/")
+			if len(objects) != 1 || objects[0].Size != int64(len("other stream\n")) {
+				t.Errorf("expected one object with its size, got %+v", objects)
+			}
+
+			if err := b.DeleteChunk("app=api/chunk_1_1.log"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if err := b.DeleteChunk("app=api/chunk_1_1.log"); err != nil {
+				t.Errorf("expected deleting a missing object to succeed, got %v", err)
+			}
+			if got, want := keys("app=api/"), "app=api/chunk_1_1.meta"; got != want {
+				t.Errorf("expected %q after delete, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestStorageBackend_WriterAndReader(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			w := NewWriterWithBackend(b, 1024*1024)
+			r := NewReaderWithBackend(b)
+			labels := map[string]string{"app": "api"}
+			now := time.Now()
+
+			var ids []string
+			for i := 0; i < 3; i++ {
+				entries := []models.LogEntry{{ID: strconv.Itoa(i), Timestamp: now.Add(time.Duration(i) * time.Second), Line: "line " + strconv.Itoa(i), Labels: labels}}
+				id, _, _, err := w.WriteChunk(labels, entries)
+				if err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				ids = append(ids, id)
+			}
+
+			if got, _ := r.ListChunks(labels); len(got) != 3 {
+				t.Fatalf("expected 3 chunks, got %v", got)
+			}
+			entries, err := r.ReadChunk(labels, ids[1])
+			if err != nil || len(entries) != 1 || entries[0].Line != "line 1" {
+				t.Fatalf("expected the written entry, got %+v (%v)", entries, err)
+			}
+			if meta, err := r.GetChunkMeta(labels, ids[1]); err != nil || meta.EntryCount != 1 {
+				t.Errorf("expected the written metadata, got %+v (%v)", meta, err)
+			}
+			if count, err := w.GetChunkCount(); r.ChunkSize(labels, ids[1]) == 0 || err != nil || count != 3 {
+				t.Errorf("expected sizes and counts of the written chunks, got %d (%v)", count, err)
+			}
+			dirs, _ := r.StreamDirs()
+			if metas, _ := r.ReadStreamMetas(models.Labels(labels).ToPath()); len(dirs) != 1 || len(metas) != 3 {
+				t.Errorf("expected one stream of 3 chunks, got %d streams and %d chunks", len(dirs), len(metas))
+			}
+
+			if err := w.DeleteChunk(labels, ids[0]); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := r.ListChunks(labels); len(got) != 2 {
+				t.Errorf("expected 2 chunks after delete, got %v", got)
+			}
+
+			// Compaction merges the rest through the backend alone
+			stats := Compact(context.Background(), w, noIndex{}, CompactionOptions{TargetBytes: 1024 * 1024}, clock.Real{})
+			if stats.Merged != 2 || stats.Written != 1 {
+				t.Fatalf("expected 2 chunks merged into 1, got %+v", stats)
+			}
+			got, _ := r.ListChunks(labels)
+			if entries, _ := r.ReadChunk(labels, got[0]); len(got) != 1 || len(entries) != 2 {
+				t.Errorf("expected one chunk of 2 entries, got %v", got)
+			}
+
+			// The running totals match a fresh listing after the deletes
+			// and the merge
+			size, err := w.GetStorageSize()
+			count, _ := w.GetChunkCount()
+			fresh, _ := NewWriterWithBackend(b, 0).GetStorageSize()
+			if err != nil || size != fresh || count != 1 {
+				t.Errorf("expected %d bytes in 1 chunk, got %d bytes in %d (%v)", fresh, size, count, err)
+			}
+		})
+	}
+}
+
+func TestCleanupOldChunks_MemoryBackend(t *testing.T) {
+	b := NewMemoryBackend()
+	w := NewWriterWithBackend(b, 1024*1024)
+	audit := map[string]string{"job": "audit"}
+	app := map[string]string{"job": "app"}
+	for _, labels := range []map[string]string{audit, app} {
+		if _, _, _, err := w.WriteChunk(labels, []models.LogEntry{{ID: "1", Timestamp: time.Now(), Line: "x"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, _ := b.ListChunks("")
+	old := time.Now().AddDate(0, 0, -30)
+	for _, obj := range objects {
+		b.SetModTime(obj.Key, old)
+	}
+
+	CleanupOldChunks(b, noIndex{}, 7, clock.Real{}, jobMatcher("audit"))
+
+	r := NewReaderWithBackend(b)
+	if ids, _ := r.ListChunks(audit); len(ids) != 1 {
+		t.Errorf("expected the protected chunk kept, got %v", ids)
+	}
+	if objects, _ := b.ListChunks(models.Labels(app).ToPath() + "/"); len(objects) != 0 {
+		t.Errorf("expected the expired chunk deleted, got %+v", objects)
+	}
+}
+
+// noIndex is a ChunkIndex for compactions whose index is not checked
+type noIndex struct{}
+
+func (noIndex) ReplaceChunks([]string, string, map[string]string, time.Time, time.Time, int) {}
+func (noIndex) RemoveChunk(string)                                                           {}
+
+// newFakeS3 serves the S3 calls S3Backend makes for one bucket, path-style,
+// keeping objects in memory. Listings are paged two objects at a time to
+// exercise continuation.
+func newFakeS3(t *testing.T, bucket string) *httptest.Server {
+	objects := NewMemoryBackend()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		key, ok := strings.CutPrefix(r.URL.Path, "/"+bucket)
+		key = strings.TrimPrefix(key, "/")
+		if !ok {
+			http.Error(w, "NoSuchBucket", http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+			all, _ := objects.ListChunks(r.URL.Query().Get("prefix"))
+			from, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+			type content struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			result := struct {
+				XMLName               xml.Name `xml:"ListBucketResult"`
+				Contents              []content
+				IsTruncated           bool
+				NextContinuationToken string `xml:",omitempty"`
+			}{}
+			for i := from; i < len(all) && i < from+2; i++ {
+				result.Contents = append(result.Contents, content{all[i].Key, all[i].Size, all[i].ModTime})
+			}
+			if from+2 < len(all) {
+				result.IsTruncated = true
+				result.NextContinuationToken = strconv.Itoa(from + 2)
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects.PutChunk(key, data)
+		case r.Method == http.MethodGet:
+			rc, err := objects.GetChunk(key)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+				return
+			}
+			io.Copy(w, rc)
+		case r.Method == http.MethodDelete:
+			objects.DeleteChunk(key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "NotImplemented", http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// Chunk encodings. The encoding is recorded in ChunkMeta, and each encoding
+// is also self-identifying from its first byte so chunks written before the
+// field existed (always JSON) stay readable.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+var errUnsupportedMsgpack = errors.New("unsupported msgpack type")
+
+// ValidEncoding reports whether name is a known chunk encoding
+func ValidEncoding(name string) bool {
+	return name == EncodingJSON || name == EncodingMsgpack
+}
+
+// chunkEncoder writes log entries in a specific encoding
+type chunkEncoder func(w *bufio.Writer, entry *models.LogEntry) error
+
+// chunkDecoder reads log entries until io.EOF
+type chunkDecoder interface {
+	Next() (models.LogEntry, error)
+}
+
+func encoderFor(encoding string) chunkEncoder {
+	if encoding == EncodingMsgpack {
+		return encodeMsgpackEntry
+	}
+	return encodeJSONEntry
+}
+
+// newChunkDecoder sniffs the encoding from the first byte: JSON lines start
+// with '{', msgpack records start with a map header.
+func newChunkDecoder(r io.Reader, strict bool) chunkDecoder {
+	br := bufio.NewReaderSize(r, 64*1024)
+	if b, err := br.Peek(1); err == nil && b[0] != '{' && b[0] != '\n' {
+		return &msgpackDecoder{r: br}
+	}
+
+	scanner := bufio.NewScanner(br)
+	// Increase buffer size for large lines
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 1024*1024)
+	return &jsonDecoder{scanner: scanner, strict: strict}
+}
+
+func encodeJSONEntry(w *bufio.Writer, entry *models.LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.Write(line)
+	return w.WriteByte('\n')
+}
+
+// jsonDecoder reads newline-delimited JSON entries. In lenient mode lines
+// that fail to decode are skipped.
+type jsonDecoder struct {
+	scanner *bufio.Scanner
+	strict  bool
+	line    int
+}
+
+func (d *jsonDecoder) Next() (models.LogEntry, error) {
+	for d.scanner.Scan() {
+		d.line++
+		var entry models.LogEntry
+		if err := json.Unmarshal(d.scanner.Bytes(), &entry); err != nil {
+			if d.strict {
+				return entry, fmt.Errorf("line %d: %w", d.line, err)
+			}
+			continue
+		}
+		return entry, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return models.LogEntry{}, err
+	}
+	return models.LogEntry{}, io.EOF
+}
+
+// encodeMsgpackEntry writes an entry as a msgpack map with the same field
+// names as the JSON encoding; the timestamp is stored as Unix nanoseconds.
+func encodeMsgpackEntry(w *bufio.Writer, entry *models.LogEntry) error {
+	buf := make([]byte, 0, 64+len(entry.Line))
+	buf = appendMsgpackMapHeader(buf, 4)
+	buf = appendMsgpackString(buf, "id")
+	buf = appendMsgpackString(buf, entry.ID)
+	buf = appendMsgpackString(buf, "timestamp")
+	buf = appendMsgpackInt64(buf, entry.Timestamp.UnixNano())
+	buf = appendMsgpackString(buf, "message")
+	buf = appendMsgpackString(buf, entry.Line)
+	buf = appendMsgpackString(buf, "labels")
+	buf = appendMsgpackMapHeader(buf, len(entry.Labels))
+	for k, v := range entry.Labels {
+		buf = appendMsgpackString(buf, k)
+		buf = appendMsgpackString(buf, v)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendMsgpackMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(buf, 0xde, byte(n>>8), byte(n))
+	default:
+		return append(buf, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xda, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackInt64(buf []byte, v int64) []byte {
+	buf = append(buf, 0xd3)
+	return binary.BigEndian.AppendUint64(buf, uint64(v))
+}
+
+// msgpackDecoder reads the subset of msgpack produced by encodeMsgpackEntry
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *msgpackDecoder) Next() (models.LogEntry, error) {
+	var entry models.LogEntry
+
+	n, err := d.readMapHeader()
+	if err != nil {
+		return entry, err // io.EOF at a record boundary ends the chunk
+	}
+
+	for i := 0; i < n; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return entry, unexpectedEOF(err)
+		}
+		switch key {
+		case "id":
+			entry.ID, err = d.readString()
+		case "message":
+			entry.Line, err = d.readString()
+		case "timestamp":
+			var ns int64
+			ns, err = d.readInt()
+			entry.Timestamp = time.Unix(0, ns)
+		case "labels":
+			entry.Labels, err = d.readStringMap()
+		default:
+			err = fmt.Errorf("unknown field %q", key)
+		}
+		if err != nil {
+			return entry, unexpectedEOF(err)
+		}
+	}
+
+	return entry, nil
+}
+
+func (d *msgpackDecoder) readMapHeader() (int, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b&0xf0 == 0x80:
+		return int(b & 0x0f), nil
+	case b == 0xde:
+		v, err := d.readUint(2)
+		return int(v), unexpectedEOF(err)
+	case b == 0xdf:
+		v, err := d.readUint(4)
+		return int(v), unexpectedEOF(err)
+	}
+	return 0, errUnsupportedMsgpack
+}
+
+func (d *msgpackDecoder) readString() (string, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	var n uint64
+	switch {
+	case b&0xe0 == 0xa0:
+		n = uint64(b & 0x1f)
+	case b == 0xd9:
+		n, err = d.readUint(1)
+	case b == 0xda:
+		n, err = d.readUint(2)
+	case b == 0xdb:
+		n, err = d.readUint(4)
+	default:
+		return "", errUnsupportedMsgpack
+	}
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (d *msgpackDecoder) readInt() (int64, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b == 0xd3, b == 0xcf:
+		v, err := d.readUint(8)
+		return int64(v), err
+	}
+	return 0, errUnsupportedMsgpack
+}
+
+func (d *msgpackDecoder) readStringMap() (map[string]string, error) {
+	n, err := d.readMapHeader()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		k, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[:size]); err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range buf[:size] {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// unexpectedEOF converts an EOF inside a record into io.ErrUnexpectedEOF so
+// truncated chunks are reported rather than silently ending
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
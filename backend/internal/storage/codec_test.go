@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+func sampleEntries(n int) []models.LogEntry {
+	labels := map[string]string{"app": "api", "env": "prod", "level": "info"}
+	base := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	entries := make([]models.LogEntry, n)
+	for i := range entries {
+		entries[i] = models.LogEntry{
+			ID:        fmt.Sprintf("20240115100000.%09d_%d", i, i),
+			Timestamp: base.Add(time.Duration(i) * time.Millisecond),
+			Line:      fmt.Sprintf(`method=GET path=/api/v1/users/%d status=200 duration=%dms`, i, i%250),
+			Labels:    labels,
+		}
+	}
+	return entries
+}
+
+func encodeEntries(t testing.TB, encoding string, entries []models.LogEntry) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	encode := encoderFor(encoding)
+	for i := range entries {
+		if err := encode(w, &entries[i]); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func decodeAll(t testing.TB, data []byte) []models.LogEntry {
+	var out []models.LogEntry
+	dec := newChunkDecoder(bytes.NewReader(data), true)
+	for {
+		entry, err := dec.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		out = append(out, entry)
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	entries := sampleEntries(50)
+	entries[7].Line = strings.Repeat("x", 70000) // exercise str32
+
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		t.Run(encoding, func(t *testing.T) {
+			got := decodeAll(t, encodeEntries(t, encoding, entries))
+			if len(got) != len(entries) {
+				t.Fatalf("expected %d entries, got %d", len(entries), len(got))
+			}
+			for i := range entries {
+				if got[i].ID != entries[i].ID || got[i].Line != entries[i].Line ||
+					!got[i].Timestamp.Equal(entries[i].Timestamp) ||
+					got[i].Labels["app"] != "api" || len(got[i].Labels) != 3 {
+					t.Fatalf("entry %d mismatch: %+v", i, got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCodec_TruncatedMsgpackIsReported(t *testing.T) {
+	data := encodeEntries(t, EncodingMsgpack, sampleEntries(2))
+	dec := newChunkDecoder(bytes.NewReader(data[:len(data)-5]), true)
+	if _, err := dec.Next(); err != nil {
+		t.Fatalf("first entry should decode: %v", err)
+	}
+	if _, err := dec.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestWriter_SwitchingEncodingKeepsOldChunksReadable(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	r := NewReader(dir)
+	labels := map[string]string{"app": "api"}
+
+	jsonID, _, _, err := w.WriteChunk(labels, sampleEntries(10))
+	if err != nil {
+		t.Fatalf("write json chunk: %v", err)
+	}
+	if err := w.SetEncoding(EncodingMsgpack); err != nil {
+		t.Fatalf("set encoding: %v", err)
+	}
+	packID, _, _, err := w.WriteChunk(labels, sampleEntries(10))
+	if err != nil {
+		t.Fatalf("write msgpack chunk: %v", err)
+	}
+
+	for _, id := range []string{jsonID, packID} {
+		entries, err := r.ReadChunk(labels, id)
+		if err != nil || len(entries) != 10 {
+			t.Errorf("chunk %s: expected 10 entries, got %d (err %v)", id, len(entries), err)
+		}
+	}
+
+	meta, err := r.GetChunkMeta(labels, packID)
+	if err != nil || meta.Encoding != EncodingMsgpack {
+		t.Errorf("expected msgpack encoding in meta, got %+v (err %v)", meta, err)
+	}
+
+	if err := w.SetEncoding("cbor"); err == nil {
+		t.Error("expected unknown encoding to be rejected")
+	}
+}
+
+func BenchmarkChunkEncoding(b *testing.B) {
+	entries := sampleEntries(10000)
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		data := encodeEntries(b, encoding, entries)
+
+		b.Run("write/"+encoding, func(b *testing.B) {
+			b.ReportMetric(float64(len(data))/float64(len(entries)), "bytes/entry")
+			for i := 0; i < b.N; i++ {
+				encodeEntries(b, encoding, entries)
+			}
+		})
+
+		b.Run("scan/"+encoding, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				decodeAll(b, data)
+			}
+		})
+	}
+}
+
+func TestWriteChunk_Compression(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	r := NewReader(dir)
+	labels := map[string]string{"app": "api"}
+	entries := sampleEntries(100)
+
+	plainID, _, _, err := w.WriteChunk(labels, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetCompression(true)
+	gzID, _, _, err := w.WriteChunk(labels, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, models.Labels(labels).ToPath(), gzID+LegacyChunkExt)); err != nil {
+		t.Fatalf("expected a .log.gz chunk: %v", err)
+	}
+	meta, err := r.GetChunkMeta(labels, gzID)
+	if err != nil || meta.Compression != CompressionGzip {
+		t.Errorf("expected gzip compression in meta, got %+v (err %v)", meta, err)
+	}
+	if plainSize, gzSize := r.ChunkSize(labels, plainID), r.ChunkSize(labels, gzID); gzSize >= plainSize/2 {
+		t.Errorf("expected the compressed chunk well under %d bytes, got %d", plainSize, gzSize)
+	}
+
+	// Both formats read back the same
+	for _, id := range []string{plainID, gzID} {
+		got, err := r.ReadChunk(labels, id)
+		if err != nil || len(got) != len(entries) || got[99].Line != entries[99].Line {
+			t.Errorf("chunk %s: expected %d entries back, got %d (err %v)", id, len(entries), len(got), err)
+		}
+	}
+}
+
+// BenchmarkChunkCompression writes a 100k-line chunk plain and compressed,
+// reporting the bytes each takes on disk
+func BenchmarkChunkCompression(b *testing.B) {
+	entries := sampleEntries(100000)
+	labels := map[string]string{"app": "api"}
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "gzip"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			w := NewWriter(dir, 1024*1024)
+			w.SetCompression(compress)
+			r := NewReader(dir)
+			var size int64
+			for i := 0; i < b.N; i++ {
+				id, _, _, err := w.WriteChunk(labels, entries)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = r.ChunkSize(labels, id)
+			}
+			b.ReportMetric(float64(size), "disk-bytes")
+			b.ReportMetric(float64(size)/float64(len(entries)), "bytes/entry")
+		})
+	}
+}
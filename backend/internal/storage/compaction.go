@@ -0,0 +1,584 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/logging"
+	"github.com/logpulse/backend/internal/models"
+)
+
+// compactionLog returns the logger of the compaction worker
+func compactionLog() *slog.Logger {
+	return logging.Component("Compactor")
+}
+
+// ChunkIndex is kept in step with the chunks compaction merges and
+// retention deletes, as index.Index is
+type ChunkIndex interface {
+	ReplaceChunks(oldIDs []string, chunkID string, labels map[string]string, startTime, endTime time.Time, entryCount int)
+	RemoveChunk(chunkID string)
+}
+
+// CompactionOptions configures the compaction worker
+type CompactionOptions struct {
+	// Interval is the time between compaction passes
+	Interval time.Duration
+	// TargetBytes bounds merged chunks: a run of chunks is merged while
+	// their combined size stays under it, normally chunk_size_bytes
+	TargetBytes int64
+	// MaxMergeBytes caps the chunk data one merge reads into memory
+	// (0 = TargetBytes)
+	MaxMergeBytes int64
+	// Workers is the number of streams compacted concurrently
+	Workers int
+	// Window restricts compaction to a daily window (nil = any time)
+	Window *CompactionWindow
+	// Paused reports ingestion pressure compaction yields to; the pass
+	// stops and the next one resumes (nil = never pause)
+	Paused func() bool
+}
+
+// CompactionStats describes a compaction pass
+type CompactionStats struct {
+	Streams        int   // stream directories examined
+	Merged         int   // chunks merged into others and deleted
+	Written        int   // merged chunks written
+	BytesReclaimed int64 // disk space freed, net of the merged chunks
+}
+
+var (
+	compactionMetricsOnce    sync.Once
+	compactionPendingStreams prometheus.Gauge
+	compactionChunksMerged   prometheus.Counter
+	compactionBytesReclaimed prometheus.Counter
+)
+
+func registerCompactionMetrics() {
+	compactionMetricsOnce.Do(func() {
+		compactionPendingStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "logpulse_compaction_pending_streams",
+			Help: "Streams left to examine in the running compaction pass.",
+		})
+		compactionChunksMerged = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "logpulse_compaction_chunks_merged_total",
+			Help: "Total chunks merged into larger chunks and deleted by compaction.",
+		})
+		compactionBytesReclaimed = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "logpulse_compaction_bytes_reclaimed_total",
+			Help: "Total disk bytes freed by compaction, net of the merged chunks written.",
+		})
+		prometheus.MustRegister(compactionPendingStreams, compactionChunksMerged, compactionBytesReclaimed)
+	})
+}
+
+// StartCompactionWorker merges runs of small chunks within each stream
+// every opts.Interval, so streams flushed often at low volume do not leave
+// thousands of tiny files for queries to open. Chunks of different label
+// sets are never merged. The window is checked against clk.
+func StartCompactionWorker(ctx context.Context, w *Writer, idx ChunkIndex, opts CompactionOptions, clk clock.Clock) {
+	compactionLog().Info("Starting", "target_bytes", opts.TargetBytes, "interval", opts.Interval, "workers", max(opts.Workers, 1))
+
+	// Finish merges a crash interrupted before the first interval, so no
+	// stream is queried with duplicated chunks for long
+	Compact(ctx, w, idx, opts, clk)
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			compactionLog().Info("Shutting down")
+			return
+		case <-ticker.C:
+			Compact(ctx, w, idx, opts, clk)
+		}
+	}
+}
+
+// Compact runs one compaction pass over every stream directory: it first
+// finishes merges a crash interrupted, then merges each stream's runs of
+// chunks, in time order, whose combined size stays under opts.TargetBytes.
+// A merged chunk's entries are sorted by timestamp. It is stored in full
+// before the chunks it replaces are deleted, and its metadata lists them
+// until then, so a crash at any point loses nothing. The pass stops early
+// when ctx ends, the window closes or compaction is paused.
+func Compact(ctx context.Context, w *Writer, idx ChunkIndex, opts CompactionOptions, clk clock.Clock) CompactionStats {
+	registerCompactionMetrics()
+
+	var stats CompactionStats
+	reader := &Reader{backend: w.backend, basePath: w.basePath}
+	streamDirs, err := reader.StreamDirs()
+	if err != nil {
+		compactionLog().Error("Failed to list streams", "error", err)
+		return stats
+	}
+	dirs := make([]string, 0, len(streamDirs))
+	for dir := range streamDirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	compactionPendingStreams.Set(float64(len(dirs)))
+	defer compactionPendingStreams.Set(0)
+
+	stop := func() bool {
+		return ctx.Err() != nil || !opts.Window.Contains(clk.Now()) || (opts.Paused != nil && opts.Paused())
+	}
+
+	c := &compactor{w: w, idx: idx, opts: opts, reader: reader}
+	var mu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(opts.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range jobs {
+				s := c.compactStream(dir, stop)
+				compactionPendingStreams.Dec()
+				mu.Lock()
+				stats.Streams++
+				stats.Merged += s.Merged
+				stats.Written += s.Written
+				stats.BytesReclaimed += s.BytesReclaimed
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, dir := range dirs {
+		if stop() {
+			break
+		}
+		jobs <- dir
+	}
+	close(jobs)
+	wg.Wait()
+
+	if stats.Written > 0 {
+		compactionLog().Info("Merged chunks",
+			"merged", stats.Merged, "written", stats.Written, "streams", stats.Streams, "bytes_reclaimed", stats.BytesReclaimed)
+	}
+	return stats
+}
+
+type compactor struct {
+	w      *Writer
+	idx    ChunkIndex
+	opts   CompactionOptions
+	reader *Reader
+}
+
+// compactChunk is a chunk considered for merging
+type compactChunk struct {
+	meta     models.ChunkMeta
+	size     int64 // data and metadata objects
+	modified time.Time
+}
+
+func (c *compactor) compactStream(dir string, stop func() bool) CompactionStats {
+	var stats CompactionStats
+	b := c.w.backend
+
+	c.removeOrphans(dir)
+
+	metas, err := c.reader.ReadStreamMetas(dir)
+	if err != nil {
+		return stats
+	}
+	replaced := make(map[string]bool)
+	for _, meta := range metas {
+		if len(meta.Replaces) > 0 {
+			stats.Merged += c.finishMerge(dir, meta)
+			for _, id := range meta.Replaces {
+				replaced[id] = true
+			}
+		}
+	}
+
+	objects, err := b.ListChunks(dir + "/")
+	if err != nil {
+		return stats
+	}
+	sizes := make(map[string]compactChunk) // by chunk ID
+	for _, obj := range objects {
+		_, name := splitKey(obj.Key)
+		id := chunkBase(name)
+		chunk := sizes[id]
+		chunk.size += obj.Size
+		if obj.ModTime.After(chunk.modified) {
+			chunk.modified = obj.ModTime
+		}
+		sizes[id] = chunk
+	}
+
+	// Distinct label sets can share a directory name, so chunks are
+	// grouped by their own labels
+	streams := make(map[string][]compactChunk)
+	for _, meta := range metas {
+		if replaced[meta.ID] {
+			continue
+		}
+		meta.Replaces = nil
+		chunk := sizes[meta.ID]
+		chunk.meta = meta
+		hash := models.Labels(meta.Labels).Hash()
+		streams[hash] = append(streams[hash], chunk)
+	}
+
+	var runs [][]compactChunk
+	for _, chunks := range streams {
+		runs = append(runs, c.planMerges(chunks)...)
+	}
+	for _, run := range runs {
+		if stop() {
+			break
+		}
+		reclaimed, err := c.merge(dir, run)
+		if err != nil {
+			compactionLog().Error("Failed to merge chunks", "chunks", len(run), "stream", dir, "error", err)
+			continue
+		}
+		stats.Merged += len(run)
+		stats.Written++
+		stats.BytesReclaimed += reclaimed
+		compactionChunksMerged.Add(float64(len(run)))
+		compactionBytesReclaimed.Add(float64(max(reclaimed, 0)))
+	}
+	return stats
+}
+
+// removeOrphans deletes what a crash mid-write leaves in a stream
+// directory: partial files and chunk data whose metadata was never
+// written. Chunks are written under the writer's lock, so none is caught
+// half written.
+func (c *compactor) removeOrphans(dir string) {
+	b := c.w.backend
+	c.w.mu.Lock()
+	defer c.w.mu.Unlock()
+
+	objects, err := b.ListChunks(dir + "/")
+	if err != nil {
+		return
+	}
+	keys := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keys[obj.Key] = true
+	}
+	for _, obj := range objects {
+		orphan := strings.HasSuffix(obj.Key, partialSuffix) ||
+			isChunkData(obj.Key) && !keys[chunkBase(obj.Key)+".meta"]
+		if orphan {
+			b.DeleteChunk(obj.Key)
+		}
+	}
+}
+
+// planMerges groups a stream's chunks, in order of start time, into runs
+// of two or more consecutive chunks whose combined size stays under the
+// target and the merge budget
+func (c *compactor) planMerges(chunks []compactChunk) [][]compactChunk {
+	limit := c.opts.TargetBytes
+	if c.opts.MaxMergeBytes > 0 && (limit <= 0 || c.opts.MaxMergeBytes < limit) {
+		limit = c.opts.MaxMergeBytes
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		si, _ := chunks[i].meta.Bounds()
+		sj, _ := chunks[j].meta.Bounds()
+		if !si.Equal(sj) {
+			return si.Before(sj)
+		}
+		return chunks[i].meta.ID < chunks[j].meta.ID
+	})
+
+	var runs [][]compactChunk
+	var run []compactChunk
+	var runSize int64
+	for _, chunk := range chunks {
+		if runSize+chunk.size >= limit {
+			if len(run) > 1 {
+				runs = append(runs, run)
+			}
+			run, runSize = nil, 0
+			if chunk.size >= limit {
+				continue
+			}
+		}
+		run = append(run, chunk)
+		runSize += chunk.size
+	}
+	if len(run) > 1 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// merge writes the entries of run as one chunk, then deletes the run's
+// chunks. It returns the bytes reclaimed.
+func (c *compactor) merge(dir string, run []compactChunk) (int64, error) {
+	labels := run[0].meta.Labels
+	var entries []models.LogEntry
+	var oldIDs []string
+	var oldSize int64
+	var modified time.Time
+	for _, chunk := range run {
+		chunkEntries, err := readChunkStrict(c.w.backend, dir, chunk.meta.ID)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, chunkEntries...)
+		oldIDs = append(oldIDs, chunk.meta.ID)
+		oldSize += chunk.size
+		if chunk.modified.After(modified) {
+			modified = chunk.modified
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+
+	c.w.mu.Lock()
+	encoding, compress := c.w.encoding, c.w.compress
+	c.w.mu.Unlock()
+
+	chunkID := c.w.nextChunkID()
+	dataKey := chunkKey(dir, chunkID+".log")
+	var compression string
+	if compress {
+		dataKey = chunkKey(dir, chunkID+LegacyChunkExt)
+		compression = CompressionGzip
+	}
+
+	var data bytes.Buffer
+	checksum, err := encodeChunk(&data, entries, encoding, compress)
+	if err != nil {
+		return 0, err
+	}
+
+	var start, end time.Time
+	if len(entries) > 0 {
+		start, end = entries[0].Timestamp, entries[len(entries)-1].Timestamp
+	}
+	meta := &models.ChunkMeta{
+		ID:            chunkID,
+		Labels:        labels,
+		StartTime:     start.Unix(),
+		EndTime:       end.Unix(),
+		EntryCount:    len(entries),
+		Encoding:      encoding,
+		Compression:   compression,
+		SchemaVersion: SchemaVersion,
+		StartTimeNano: start.UnixNano(),
+		EndTimeNano:   end.UnixNano(),
+		Checksum:      checksum,
+		Replaces:      oldIDs,
+	}
+	metaSize, err := c.commit(dir, oldIDs, dataKey, data.Bytes(), meta, modified)
+	if err != nil {
+		return 0, err
+	}
+	c.idx.ReplaceChunks(oldIDs, chunkID, labels, start, end, len(entries))
+
+	c.finishMerge(dir, *meta)
+	return oldSize - int64(data.Len()) - metaSize, nil
+}
+
+// commit stores a merged chunk, data first, so the chunk exists once its
+// metadata does, and returns the metadata's size. It fails, leaving the
+// stream as it was, if retention deleted one of the merged chunks
+// meanwhile, which the merged chunk would bring back. Retention ages
+// chunks by modification time; where the backend allows, the merged chunk
+// is as old as the newest chunk in it.
+func (c *compactor) commit(dir string, oldIDs []string, dataKey string, data []byte, meta *models.ChunkMeta, modified time.Time) (int64, error) {
+	b := c.w.backend
+	c.w.mu.Lock()
+	defer c.w.mu.Unlock()
+
+	objects, err := b.ListChunks(dir + "/")
+	if err != nil {
+		return 0, err
+	}
+	keys := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keys[obj.Key] = true
+	}
+	for _, id := range oldIDs {
+		if !keys[chunkKey(dir, id+".meta")] {
+			return 0, fmt.Errorf("chunk %s is gone", id)
+		}
+	}
+
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return 0, err
+	}
+	metaData = append(metaData, '\n')
+	metaKey := chunkKey(dir, meta.ID+".meta")
+	if err := b.PutChunk(dataKey, data); err != nil {
+		b.DeleteChunk(dataKey)
+		return 0, err
+	}
+	if err := b.PutChunk(metaKey, metaData); err != nil {
+		b.DeleteChunk(dataKey)
+		return 0, err
+	}
+	if setter, ok := b.(modTimeSetter); ok && !modified.IsZero() {
+		setter.SetModTime(dataKey, modified)
+		setter.SetModTime(metaKey, modified)
+	}
+	return int64(len(metaData)), nil
+}
+
+// finishMerge deletes the chunks a merged chunk replaces and clears the
+// list from its metadata. It returns the number of chunks deleted.
+func (c *compactor) finishMerge(dir string, meta models.ChunkMeta) int {
+	b := c.w.backend
+	objects, err := b.ListChunks(dir + "/")
+	if err != nil {
+		return 0
+	}
+	modTimes := make(map[string]time.Time, len(objects))
+	for _, obj := range objects {
+		modTimes[obj.Key] = obj.ModTime
+	}
+
+	deleted := 0
+	for _, id := range meta.Replaces {
+		if _, ok := modTimes[chunkKey(dir, id+".meta")]; ok {
+			deleted++
+		}
+		if err := c.w.DeleteChunk(meta.Labels, id); err != nil {
+			compactionLog().Error("Failed to delete merged chunk", "chunk", id, "error", err)
+			return deleted
+		}
+		c.idx.RemoveChunk(id)
+	}
+
+	metaKey := chunkKey(dir, meta.ID+".meta")
+	modified, ok := modTimes[metaKey]
+	if !ok {
+		return deleted
+	}
+	meta.Replaces = nil
+	if err := putChunkMeta(b, dir, &meta); err != nil {
+		compactionLog().Error("Failed to update merged chunk", "chunk", meta.ID, "error", err)
+		return deleted
+	}
+	if setter, ok := b.(modTimeSetter); ok {
+		setter.SetModTime(metaKey, modified)
+	}
+	return deleted
+}
+
+// readChunkStrict reads every entry of a chunk, failing on any that does
+// not decode, so a damaged chunk is left alone rather than merged short
+func readChunkStrict(b StorageBackend, dir, chunkID string) ([]models.LogEntry, error) {
+	file, err := openChunk(b, dir, chunkID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []models.LogEntry
+	dec := newChunkDecoder(file, true)
+	for {
+		entry, err := dec.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s entry %d: %w", chunkID, len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// writeFileSynced creates path, fills it with write and syncs it to disk
+func writeFileSynced(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs a directory, making renames and deletions in it durable
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// CompactionWindow is a daily time range compaction runs in; one whose end
+// is not after its start runs past midnight
+type CompactionWindow struct {
+	start, end int // minutes after midnight
+	loc        *time.Location
+}
+
+// ParseCompactionWindow parses a window from HH:MM times in an IANA
+// timezone (default UTC). Both times empty is no window: nil, which
+// contains every time.
+func ParseCompactionWindow(start, end, timezone string) (*CompactionWindow, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+	cw := &CompactionWindow{loc: loc}
+	for _, f := range []struct {
+		s   string
+		dst *int
+	}{{start, &cw.start}, {end, &cw.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(f.s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q, expected HH:MM", f.s)
+		}
+		*f.dst = t.Hour()*60 + t.Minute()
+	}
+	return cw, nil
+}
+
+// Contains reports whether t falls within the window
+func (cw *CompactionWindow) Contains(t time.Time) bool {
+	if cw == nil {
+		return true
+	}
+	t = t.In(cw.loc)
+	m := t.Hour()*60 + t.Minute()
+	if cw.start < cw.end {
+		return m >= cw.start && m < cw.end
+	}
+	return m >= cw.start || m < cw.end
+}
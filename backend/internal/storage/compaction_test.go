@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+)
+
+func TestCompact_MergesInTimestampOrder(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	r := NewReader(dir)
+	idx := index.NewIndex()
+	base := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	write := func(labels map[string]string, secs ...int) string {
+		t.Helper()
+		var entries []models.LogEntry
+		for _, s := range secs {
+			entries = append(entries, models.LogEntry{
+				ID:        labels["app"],
+				Timestamp: base.Add(time.Duration(s) * time.Second),
+				Line:      labels["app"] + " line " + time.Duration(s*int(time.Second)).String(),
+				Labels:    labels,
+			})
+		}
+		id, start, end, err := w.WriteChunk(labels, entries)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		idx.AddChunk(id, labels, start, end, len(entries))
+		return id
+	}
+
+	api := map[string]string{"app": "api"}
+	db := map[string]string{"app": "db"}
+	// These two label sets share a directory name
+	collideA := map[string]string{"app": "x_env=prod"}
+	collideB := map[string]string{"app": "x", "env": "prod"}
+
+	// Flushes of a stream overlap in time, as late entries do
+	write(api, 0, 4)
+	write(api, 1, 5)
+	write(api, 2)
+	write(api, 3, 6)
+	dbID := write(db, 0)
+	write(collideA, 0)
+	write(collideB, 1)
+	write(collideA, 2)
+	write(collideB, 3)
+
+	stats := Compact(context.Background(), w, idx, CompactionOptions{TargetBytes: 1024 * 1024}, clock.Real{})
+	if stats.Merged != 8 || stats.Written != 3 {
+		t.Fatalf("expected 8 chunks merged into 3, got %+v", stats)
+	}
+
+	ids, _ := r.ListChunks(api)
+	if len(ids) != 1 {
+		t.Fatalf("expected one api chunk, got %v", ids)
+	}
+	entries, err := r.ReadChunk(api, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Fatalf("expected 7 merged entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if want := base.Add(time.Duration(i) * time.Second); !e.Timestamp.Equal(want) {
+			t.Errorf("entry %d: expected %v, got %v", i, want, e.Timestamp)
+		}
+	}
+	meta, err := r.GetChunkMeta(api, ids[0])
+	if err != nil || meta.EntryCount != 7 || len(meta.Replaces) != 0 || meta.Checksum == "" {
+		t.Errorf("unexpected merged meta %+v (%v)", meta, err)
+	}
+
+	if ids, _ := r.ListChunks(db); len(ids) != 1 || ids[0] != dbID {
+		t.Errorf("expected the lone db chunk untouched, got %v", ids)
+	}
+
+	for _, labels := range []map[string]string{collideA, collideB} {
+		found := idx.FindChunkMetas(base, base.Add(time.Hour), func(l map[string]string) bool {
+			return models.Labels(l).Hash() == models.Labels(labels).Hash()
+		})
+		if len(found) != 1 {
+			t.Fatalf("expected one indexed chunk for %v, got %d", labels, len(found))
+		}
+		entries, err := r.ReadChunk(labels, found[0].ID)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("expected 2 entries for %v, got %d (%v)", labels, len(entries), err)
+		}
+		for _, e := range entries {
+			if e.Labels["app"] != labels["app"] {
+				t.Errorf("chunk of %v holds an entry of %v", labels, e.Labels)
+			}
+		}
+	}
+	if chunks, _ := idx.Stats(); chunks != 4 {
+		t.Errorf("expected 4 indexed chunks after compaction, got %d", chunks)
+	}
+}
+
+func TestCompact_FinishesInterruptedMerge(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	r := NewReader(dir)
+	idx := index.NewIndex()
+	labels := map[string]string{"app": "api"}
+	now := time.Now()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, start, end, err := w.WriteChunk(labels, []models.LogEntry{{ID: "1", Timestamp: now.Add(time.Duration(i) * time.Second), Line: "x"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.AddChunk(id, labels, start, end, 1)
+		ids = append(ids, id)
+	}
+
+	// A crash after the merged chunk was committed, before the chunks it
+	// replaces were deleted, and another between a chunk's data and
+	// metadata
+	streamDir := filepath.Join(dir, models.Labels(labels).ToPath())
+	meta, _ := r.GetChunkMeta(labels, ids[2])
+	meta.Replaces = ids[:2]
+	if err := writeChunkMeta(filepath.Join(streamDir, ids[2]+".meta"), meta); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(streamDir, "chunk_1_99.log")
+	os.WriteFile(stray, []byte("{}\n"), 0644)
+
+	// A target too small to merge anything leaves only the recovery
+	Compact(context.Background(), w, idx, CompactionOptions{TargetBytes: 1}, clock.Real{})
+
+	if got, _ := r.ListChunks(labels); len(got) != 1 || got[0] != ids[2] {
+		t.Fatalf("expected only the merged chunk to remain, got %v", got)
+	}
+	if meta, _ := r.GetChunkMeta(labels, ids[2]); len(meta.Replaces) != 0 {
+		t.Errorf("expected the replaced list cleared, got %v", meta.Replaces)
+	}
+	if chunks, _ := idx.Stats(); chunks != 1 {
+		t.Errorf("expected the replaced chunks dropped from the index, got %d chunks", chunks)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("expected the chunk data without metadata deleted")
+	}
+}
+
+func TestCompactionWindow(t *testing.T) {
+	cw, err := ParseCompactionWindow("22:00", "05:00", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for at, want := range map[string]bool{"23:30": true, "04:59": true, "05:00": false, "12:00": false, "22:00": true} {
+		ts, _ := time.Parse("15:04", at)
+		if got := cw.Contains(ts); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", at, got, want)
+		}
+	}
+	if cw, _ := ParseCompactionWindow("", "", ""); !cw.Contains(time.Now()) {
+		t.Error("expected no window to contain every time")
+	}
+}
+
+func TestCompact_YieldsOutsideWindowAndWhilePaused(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	r := NewReader(dir)
+	labels := map[string]string{"app": "api"}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := w.WriteChunk(labels, []models.LogEntry{{ID: "1", Timestamp: now.Add(time.Duration(i) * time.Second), Line: "x"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	window, err := ParseCompactionWindow("01:00", "05:00", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC))
+	paused := true
+	opts := CompactionOptions{TargetBytes: 1024 * 1024, Window: window, Paused: func() bool { return paused }}
+
+	if stats := Compact(context.Background(), w, noIndex{}, opts, clk); stats.Merged != 0 {
+		t.Fatalf("expected nothing merged outside the window, got %+v", stats)
+	}
+	clk.Set(time.Date(2024, 1, 15, 2, 0, 0, 0, time.UTC))
+	if stats := Compact(context.Background(), w, noIndex{}, opts, clk); stats.Merged != 0 {
+		t.Fatalf("expected nothing merged while paused, got %+v", stats)
+	}
+	if ids, _ := r.ListChunks(labels); len(ids) != 3 {
+		t.Fatalf("expected the chunks untouched, got %v", ids)
+	}
+
+	// The next pass in the window, once ingestion eases, picks up the work
+	paused = false
+	if stats := Compact(context.Background(), w, noIndex{}, opts, clk); stats.Merged != 3 || stats.Written != 1 {
+		t.Fatalf("expected 3 chunks merged into 1, got %+v", stats)
+	}
+}
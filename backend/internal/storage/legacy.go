@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// LegacyChunkExt is the extension of gzip-compressed chunks, written by the
+// writer when compression is enabled and by other tools as NDJSON. They are
+// read like .log chunks once a .meta exists for them.
+const LegacyChunkExt = ".log.gz"
+
+// CompressionGzip is the ChunkMeta.Compression of .log.gz chunks
+const CompressionGzip = "gzip"
+
+// chunkBase strips the data or metadata extension from a chunk file path
+func chunkBase(path string) string {
+	if strings.HasSuffix(path, LegacyChunkExt) {
+		return strings.TrimSuffix(path, LegacyChunkExt)
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// gzipChunk closes both the gzip stream and the underlying object
+type gzipChunk struct {
+	*gzip.Reader
+	file io.ReadCloser
+}
+
+func (g *gzipChunk) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// openChunk opens the data of a chunk in stream directory dir, falling back
+// to a gzip-compressed legacy chunk when no .log object exists
+func openChunk(b StorageBackend, dir, chunkID string) (io.ReadCloser, error) {
+	file, err := b.GetChunk(chunkKey(dir, chunkID+".log"))
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+
+	file, gzErr := b.GetChunk(chunkKey(dir, chunkID+LegacyChunkExt))
+	if gzErr != nil {
+		return nil, err // report the missing .log
+	}
+	zr, gzErr := gzip.NewReader(file)
+	if gzErr != nil {
+		file.Close()
+		return nil, fmt.Errorf("chunk %s: %w", chunkID, gzErr)
+	}
+	return &gzipChunk{Reader: zr, file: file}, nil
+}
+
+// LegacyImport reports the outcome of ImportLegacyChunks
+type LegacyImport struct {
+	Imported []models.ChunkMeta `json:"imported"`
+	Existing []models.ChunkMeta `json:"existing"`
+	Errors   []string           `json:"errors,omitempty"`
+}
+
+// ImportLegacyChunks adopts every .log.gz file in srcDir as a chunk of the
+// stream identified by labels. Each file is hard-linked (or copied when
+// linking fails) into the stream directory and a .meta is synthesized from
+// its entries. Files already imported are reported as existing, so the
+// import can be re-run after a restart to register them again. Only local
+// storage can import.
+func (w *Writer) ImportLegacyChunks(srcDir string, labels map[string]string) (*LegacyImport, error) {
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("labels are required")
+	}
+	if w.basePath == "" {
+		return nil, fmt.Errorf("legacy chunks can only be imported into local storage")
+	}
+	files, err := filepath.Glob(filepath.Join(srcDir, "*"+LegacyChunkExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	dirPath := filepath.Join(w.basePath, models.Labels(labels).ToPath())
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, err
+	}
+
+	// Chunk IDs are global in the index, so the stream hash keeps files with
+	// the same name in different streams apart
+	prefix := "legacy_" + models.Labels(labels).Hash() + "_"
+	result := &LegacyImport{Imported: []models.ChunkMeta{}, Existing: []models.ChunkMeta{}}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, src := range files {
+		chunkID := prefix + strings.TrimSuffix(filepath.Base(src), LegacyChunkExt)
+		metaPath := filepath.Join(dirPath, chunkID+".meta")
+
+		if data, err := os.ReadFile(metaPath); err == nil {
+			var meta models.ChunkMeta
+			if err := json.Unmarshal(data, &meta); err == nil {
+				result.Existing = append(result.Existing, meta)
+				continue
+			}
+		}
+
+		meta, err := importLegacyChunk(src, filepath.Join(dirPath, chunkID+LegacyChunkExt), metaPath)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filepath.Base(src), err))
+			continue
+		}
+		meta.ID = chunkID
+		meta.Labels = labels
+		if err := writeChunkMeta(metaPath, meta); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filepath.Base(src), err))
+			continue
+		}
+		result.Imported = append(result.Imported, *meta)
+	}
+
+	return result, nil
+}
+
+// importLegacyChunk scans src for its time range and entry count, then places
+// it at dst. The whole file is decompressed since gzip cannot seek to the
+// last line, and entries are not assumed to be sorted.
+func importLegacyChunk(src, dst, metaPath string) (*models.ChunkMeta, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var start, end time.Time
+	count := 0
+	dec := newChunkDecoder(zr, false)
+	for {
+		entry, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 || entry.Timestamp.Before(start) {
+			start = entry.Timestamp
+		}
+		if count == 0 || entry.Timestamp.After(end) {
+			end = entry.Timestamp
+		}
+		count++
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no readable entries")
+	}
+
+	if err := linkOrCopy(src, dst); err != nil {
+		return nil, err
+	}
+
+	return &models.ChunkMeta{
+		StartTime:   start.Unix(),
+		EndTime:     end.Unix(),
+		EntryCount:  count,
+		Encoding:    EncodingJSON,
+		Compression: CompressionGzip,
+	}, nil
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func writeChunkMeta(path string, meta *models.ChunkMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
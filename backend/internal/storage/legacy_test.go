@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeGzipFile(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte(content))
+	zw.Close()
+	f.Close()
+}
+
+func TestImportLegacyChunks(t *testing.T) {
+	src := t.TempDir()
+	base := t.TempDir()
+	labels := map[string]string{"job": "legacy"}
+
+	// Entries deliberately out of order; the range must not rely on first/last
+	writeGzipFile(t, filepath.Join(src, "day1.log.gz"),
+		`{"id":"b","timestamp":"2024-01-01T12:00:00Z","message":"second"}`+"\n"+
+			`{"id":"a","timestamp":"2024-01-01T10:00:00Z","message":"first"}`+"\n"+
+			`{"id":"c","timestamp":"2024-01-01T11:00:00Z","message":"middle"}`+"\n")
+	writeGzipFile(t, filepath.Join(src, "empty.log.gz"), "")
+	os.WriteFile(filepath.Join(src, "ignored.log"), []byte("{}\n"), 0644)
+
+	w := NewWriter(base, 1024)
+	result, err := w.ImportLegacyChunks(src, labels)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if len(result.Imported) != 1 || len(result.Errors) != 1 {
+		t.Fatalf("expected 1 imported and 1 error, got %+v", result)
+	}
+
+	meta := result.Imported[0]
+	if meta.EntryCount != 3 {
+		t.Errorf("expected 3 entries, got %d", meta.EntryCount)
+	}
+	wantStart := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).Unix()
+	wantEnd := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+	if meta.StartTime != wantStart || meta.EndTime != wantEnd {
+		t.Errorf("expected range [%d, %d], got [%d, %d]", wantStart, wantEnd, meta.StartTime, meta.EndTime)
+	}
+
+	r := NewReader(base)
+	ids, _ := r.ListChunks(labels)
+	if len(ids) != 1 || ids[0] != meta.ID {
+		t.Fatalf("expected chunk %s to be listed, got %v", meta.ID, ids)
+	}
+	entries, err := r.ReadChunk(labels, meta.ID)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected 3 readable entries, got %d (%v)", len(entries), err)
+	}
+	if _, err := r.GetChunkMeta(labels, meta.ID); err != nil {
+		t.Errorf("expected a synthesized .meta: %v", err)
+	}
+
+	// Re-running reports the chunk as existing instead of importing it twice
+	again, err := w.ImportLegacyChunks(src, labels)
+	if err != nil {
+		t.Fatalf("re-import: %v", err)
+	}
+	if len(again.Imported) != 0 || len(again.Existing) != 1 {
+		t.Errorf("expected the chunk to be reported as existing, got %+v", again)
+	}
+
+	if err := w.DeleteChunk(labels, meta.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if ids, _ := r.ListChunks(labels); len(ids) != 0 {
+		t.Errorf("expected no chunks after delete, got %v", ids)
+	}
+	if _, err := os.Stat(filepath.Join(src, "day1.log.gz")); err != nil {
+		t.Errorf("expected the source file to be left in place: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps objects in memory, for tests and throwaway instances
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryBackend creates an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]memoryObject)}
+}
+
+// PutChunk stores a copy of data under key
+func (b *MemoryBackend) PutChunk(key string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = memoryObject{data: bytes.Clone(data), modTime: time.Now()}
+	return nil
+}
+
+// GetChunk returns a reader over the object under key
+func (b *MemoryBackend) GetChunk(key string) (io.ReadCloser, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", key, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+// ListChunks returns the objects under prefix in key order
+func (b *MemoryBackend) ListChunks(prefix string) ([]ChunkObject, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var objects []ChunkObject
+	for key, obj := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ChunkObject{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// DeleteChunk removes the object under key
+func (b *MemoryBackend) DeleteChunk(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+// SetModTime sets the modification time of the object under key
+func (b *MemoryBackend) SetModTime(key string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	obj, ok := b.objects[key]
+	if !ok {
+		return fmt.Errorf("object %s: %w", key, fs.ErrNotExist)
+	}
+	obj.modTime = t
+	b.objects[key] = obj
+	return nil
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// SchemaVersion is the current chunk metadata schema. Version 1 records the
+// data file's checksum, nanosecond time bounds and, always, the encoding.
+// WriteChunk writes it; Migration upgrades older metadata.
+const SchemaVersion = 1
+
+// SchemaFile, in the storage base path, records the schema version every
+// chunk's metadata was last migrated to
+const SchemaFile = "SCHEMA_VERSION"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func newChecksum() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
+func formatChecksum(h hash.Hash32) string {
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// StorageSchema is the content of SchemaFile
+type StorageSchema struct {
+	Version    int       `json:"version"`
+	MigratedAt time.Time `json:"migrated_at"`
+}
+
+// ReadSchemaVersion returns the version recorded in basePath's SchemaFile,
+// or 0 when none is
+func ReadSchemaVersion(basePath string) int {
+	data, err := os.ReadFile(filepath.Join(basePath, SchemaFile))
+	if err != nil {
+		return 0
+	}
+	var schema StorageSchema
+	if json.Unmarshal(data, &schema) != nil {
+		return 0
+	}
+	return schema.Version
+}
+
+// EnsureSchema returns the schema version recorded for basePath, first
+// recording the current one when the storage holds no streams yet, since
+// every chunk it gets will be written current
+func EnsureSchema(basePath string) (int, error) {
+	if v := ReadSchemaVersion(basePath); v > 0 {
+		return v, nil
+	}
+	dirs, err := (&Reader{basePath: basePath}).StreamDirs()
+	if err != nil {
+		return 0, err
+	}
+	if len(dirs) > 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return 0, err
+	}
+	return SchemaVersion, writeSchemaFile(basePath)
+}
+
+// MigrationStatus reports the progress of a migration
+type MigrationStatus struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Streams    int       `json:"streams"`
+	Scanned    int       `json:"scanned_streams"`
+	Upgraded   int       `json:"upgraded_chunks"`
+	Current    int       `json:"current_chunks"`
+	Errors     []string  `json:"errors,omitempty"`
+	Version    int       `json:"version"`
+}
+
+// Migration upgrades the metadata of every chunk under a writer's base path
+// to SchemaVersion, reading each chunk to fill in what older metadata lacks.
+// Chunks already current are skipped, so a migration that was interrupted
+// resumes where it stopped when run again. SchemaFile is written once every
+// chunk is current.
+type Migration struct {
+	writer *Writer
+
+	mu     sync.Mutex
+	status MigrationStatus
+}
+
+// NewMigration creates a migration of the chunks w writes
+func NewMigration(w *Writer) *Migration {
+	return &Migration{writer: w}
+}
+
+// Status returns a copy of the migration's progress
+func (m *Migration) Status() MigrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	status.Errors = append([]string(nil), m.status.Errors...)
+	return status
+}
+
+// Start marks the migration running, failing if it already is or the
+// chunks are not on local disk. Run must follow.
+func (m *Migration) Start() error {
+	if m.writer.basePath == "" {
+		return fmt.Errorf("migration is only supported for local storage")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.Running {
+		return fmt.Errorf("migration already running")
+	}
+	m.status = MigrationStatus{Running: true, StartedAt: time.Now().UTC(), Version: SchemaVersion}
+	return nil
+}
+
+// Run migrates every stream directory, stopping early when ctx is done.
+// Chunks that fail to migrate are reported in the status and left as they
+// were.
+func (m *Migration) Run(ctx context.Context) error {
+	defer func() {
+		m.mu.Lock()
+		m.status.Running = false
+		m.status.FinishedAt = time.Now().UTC()
+		m.mu.Unlock()
+	}()
+
+	basePath := m.writer.basePath
+	dirs, err := (&Reader{basePath: basePath}).StreamDirs()
+	if err != nil {
+		m.fail(err.Error())
+		return err
+	}
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	m.update(func(s *MigrationStatus) { s.Streams = len(names) })
+
+	for _, dir := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		metas, err := filepath.Glob(filepath.Join(basePath, dir, "*.meta"))
+		if err != nil {
+			m.fail(err.Error())
+			continue
+		}
+		for _, metaPath := range metas {
+			upgraded, err := m.writer.migrateChunk(metaPath)
+			m.update(func(s *MigrationStatus) {
+				switch {
+				case err != nil:
+					s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", filepath.Join(dir, filepath.Base(metaPath)), err))
+				case upgraded:
+					s.Upgraded++
+				default:
+					s.Current++
+				}
+			})
+		}
+		m.update(func(s *MigrationStatus) { s.Scanned++ })
+	}
+
+	if status := m.Status(); len(status.Errors) > 0 {
+		return fmt.Errorf("%d chunks failed to migrate", len(status.Errors))
+	}
+	if err := writeSchemaFile(basePath); err != nil {
+		return err
+	}
+	log.Printf("[Storage] Chunk metadata migrated to schema version %d", SchemaVersion)
+	return nil
+}
+
+func (m *Migration) update(fn func(*MigrationStatus)) {
+	m.mu.Lock()
+	fn(&m.status)
+	m.mu.Unlock()
+}
+
+func (m *Migration) fail(msg string) {
+	m.update(func(s *MigrationStatus) { s.Errors = append(s.Errors, msg) })
+}
+
+// migrateChunk upgrades one chunk's metadata, reporting whether it needed
+// to be. The data file is read without the writer's lock; the new metadata
+// replaces the old under it, and only while the data file still exists, so
+// a chunk deleted meanwhile is not resurrected. The metadata keeps its
+// modification time, which retention ages chunks by.
+func (w *Writer) migrateChunk(metaPath string) (bool, error) {
+	w.mu.Lock()
+	info, err := os.Stat(metaPath)
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(metaPath)
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	var meta models.ChunkMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return false, err
+	}
+	if meta.SchemaVersion >= SchemaVersion {
+		return false, nil
+	}
+
+	dirPath := filepath.Dir(metaPath)
+	chunkID := strings.TrimSuffix(filepath.Base(metaPath), ".meta")
+	if meta.ID == "" {
+		meta.ID = chunkID
+	}
+	dataPath := filepath.Join(dirPath, chunkID+".log")
+	if _, err := os.Stat(dataPath); os.IsNotExist(err) {
+		dataPath = filepath.Join(dirPath, chunkID+LegacyChunkExt)
+	}
+
+	// Checksum the file as stored
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return false, err
+	}
+	checksum := newChecksum()
+	_, err = io.Copy(checksum, file)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+
+	// Bounds and encoding come from the entries themselves
+	chunk, err := openChunk(w.backend, filepath.Base(dirPath), chunkID)
+	if err != nil {
+		return false, err
+	}
+	dec := newChunkDecoder(chunk, false)
+	encoding := EncodingJSON
+	if _, ok := dec.(*msgpackDecoder); ok {
+		encoding = EncodingMsgpack
+	}
+	var start, end time.Time
+	count := 0
+	for {
+		entry, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			chunk.Close()
+			return false, err
+		}
+		if count == 0 || entry.Timestamp.Before(start) {
+			start = entry.Timestamp
+		}
+		if count == 0 || entry.Timestamp.After(end) {
+			end = entry.Timestamp
+		}
+		count++
+	}
+	chunk.Close()
+
+	meta.Encoding = encoding
+	meta.Compression = ""
+	if strings.HasSuffix(dataPath, LegacyChunkExt) {
+		meta.Compression = CompressionGzip
+	}
+	meta.EntryCount = count
+	if count > 0 {
+		meta.StartTime, meta.EndTime = start.Unix(), end.Unix()
+		meta.StartTimeNano, meta.EndTimeNano = start.UnixNano(), end.UnixNano()
+	}
+	meta.Checksum = formatChecksum(checksum)
+	meta.SchemaVersion = SchemaVersion
+
+	upgraded, err := json.Marshal(meta)
+	if err != nil {
+		return false, err
+	}
+	tmpPath := metaPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(upgraded, '\n'), 0644); err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := os.Stat(dataPath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err := os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err := os.Rename(tmpPath, metaPath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	return true, nil
+}
+
+func writeSchemaFile(basePath string) error {
+	data, err := json.Marshal(StorageSchema{Version: SchemaVersion, MigratedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(basePath, SchemaFile)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
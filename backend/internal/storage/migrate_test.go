@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+func TestMigration_UpgradesMetas(t *testing.T) {
+	base := t.TempDir()
+	w := NewWriter(base, 1024*1024)
+	labels := map[string]string{"app": "api"}
+	first := time.Date(2024, 1, 1, 0, 0, 0, 250, time.UTC)
+	id, _, _, err := w.WriteChunk(labels, []models.LogEntry{
+		{ID: "2", Timestamp: first.Add(time.Second), Line: "b"},
+		{ID: "1", Timestamp: first, Line: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath := filepath.Join(base, models.Labels(labels).ToPath(), id+".meta")
+	readMeta := func() models.ChunkMeta {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta models.ChunkMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	written := readMeta()
+	if written.SchemaVersion != SchemaVersion || written.Checksum == "" || written.StartTimeNano != first.UnixNano() {
+		t.Fatalf("expected new chunks to be written current, got %+v", written)
+	}
+
+	// Rewrite the metadata as an old server would have, and age it
+	old := models.ChunkMeta{ID: id, Labels: labels, StartTime: first.Unix(), EndTime: first.Unix() + 1, EntryCount: 2}
+	data, _ := json.Marshal(old)
+	os.WriteFile(metaPath, data, 0644)
+	aged := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	os.Chtimes(metaPath, aged, aged)
+
+	// A .meta whose data file is gone fails without stopping the rest
+	orphan := filepath.Join(base, "orphan")
+	os.MkdirAll(orphan, 0755)
+	os.WriteFile(filepath.Join(orphan, "chunk_1_1.meta"), []byte(`{"id":"chunk_1_1"}`), 0644)
+
+	m := NewMigration(w)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(); err == nil {
+		t.Error("expected a second start to fail while running")
+	}
+	if err := m.Run(context.Background()); err == nil {
+		t.Error("expected the orphaned metadata to fail the run")
+	}
+	if status := m.Status(); status.Upgraded != 1 || len(status.Errors) != 1 || status.Running {
+		t.Errorf("expected one upgraded chunk and one error, got %+v", status)
+	}
+	if ReadSchemaVersion(base) != 0 {
+		t.Error("expected no schema version recorded while chunks fail")
+	}
+
+	upgraded := readMeta()
+	if upgraded.Checksum != written.Checksum || upgraded.StartTimeNano != written.StartTimeNano ||
+		upgraded.EndTimeNano != written.EndTimeNano || upgraded.Encoding != EncodingJSON || upgraded.SchemaVersion != SchemaVersion {
+		t.Errorf("expected the upgrade to match what the writer records, got %+v want %+v", upgraded, written)
+	}
+	if info, _ := os.Stat(metaPath); !info.ModTime().Equal(aged) {
+		t.Errorf("expected the metadata to keep its age for retention, got %v", info.ModTime())
+	}
+
+	// Rerunning after fixing the failure skips current chunks
+	os.RemoveAll(orphan)
+	m.Start()
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := m.Status(); status.Upgraded != 0 || status.Current != 1 {
+		t.Errorf("expected the chunk to be skipped as current, got %+v", status)
+	}
+	if v := ReadSchemaVersion(base); v != SchemaVersion {
+		t.Errorf("expected schema version %d recorded, got %d", SchemaVersion, v)
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// ChunkRef identifies a chunk of a stream
+type ChunkRef struct {
+	Labels map[string]string
+	ID     string
+}
+
+// SetPrefetchBytes bounds the chunk data read ahead of each scan; 0
+// disables read-ahead so every chunk is read when it is scanned
+func (r *Reader) SetPrefetchBytes(n int64) {
+	r.prefetchBytes = max(0, n)
+}
+
+// prefetched is a chunk's data read ahead of the scan
+type prefetched struct {
+	data []byte
+	size int64 // bytes reserved from the budget
+	err  error
+}
+
+// ChunkPrefetcher reads the chunks of a scan in order in the background,
+// ahead of the chunk being scanned, so disk or network latency overlaps
+// decoding instead of adding to it. Data read ahead and not yet scanned is
+// bounded by the reader's prefetch budget, counted in on-disk bytes; a
+// chunk larger than the budget is read once nothing else is held.
+type ChunkPrefetcher struct {
+	reader *Reader
+	refs   []ChunkRef
+	slots  []chan prefetched
+	next   int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	held   int64
+	closed bool
+}
+
+// Prefetch starts reading refs ahead of a scan that will read them in this
+// order through the returned prefetcher's ReadChunkLines. Close must be
+// called once the scan ends.
+func (r *Reader) Prefetch(refs []ChunkRef) *ChunkPrefetcher {
+	p := &ChunkPrefetcher{reader: r, refs: refs}
+	p.cond = sync.NewCond(&p.mu)
+	if r.prefetchBytes > 0 && len(refs) > 1 {
+		p.slots = make([]chan prefetched, len(refs))
+		for i := range p.slots {
+			p.slots[i] = make(chan prefetched, 1)
+		}
+		go p.run(r.prefetchBytes)
+	}
+	return p
+}
+
+func (p *ChunkPrefetcher) run(budget int64) {
+	for i, ref := range p.refs {
+		size := p.reader.ChunkSize(ref.Labels, ref.ID)
+
+		p.mu.Lock()
+		for !p.closed && p.held > 0 && p.held+size > budget {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		p.held += size
+		p.mu.Unlock()
+
+		data, err := p.reader.readChunkData(ref.Labels, ref.ID)
+		p.slots[i] <- prefetched{data: data, size: size, err: err}
+	}
+}
+
+// ReadChunkLines reads a chunk like Reader.ReadChunkLines, from the data
+// read ahead when it is the scan's next chunk. Chunks skipped by the scan
+// are discarded.
+func (p *ChunkPrefetcher) ReadChunkLines(labels map[string]string, chunkID string, startTime, endTime time.Time) ([]models.LogEntry, []int, int, error) {
+	if p.slots == nil {
+		return p.reader.ReadChunkLines(labels, chunkID, startTime, endTime)
+	}
+
+	i := p.next
+	for i < len(p.refs) && p.refs[i].ID != chunkID {
+		i++
+	}
+	if i == len(p.refs) {
+		return p.reader.ReadChunkLines(labels, chunkID, startTime, endTime)
+	}
+	for ; p.next < i; p.next++ {
+		p.release(<-p.slots[p.next])
+	}
+	chunk := <-p.slots[p.next]
+	p.next++
+	p.release(chunk)
+
+	if chunk.err != nil {
+		return nil, nil, 0, chunk.err
+	}
+	entries, err := decodeChunk(bytes.NewReader(chunk.data))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	filtered, lines, scanned := filterChunkLines(entries, startTime, endTime)
+	return filtered, lines, scanned, nil
+}
+
+// release returns a consumed chunk's bytes to the budget
+func (p *ChunkPrefetcher) release(chunk prefetched) {
+	p.mu.Lock()
+	p.held -= chunk.size
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// Close stops reading ahead
+func (p *ChunkPrefetcher) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// readChunkData reads a chunk's entry data whole, decompressing legacy
+// chunks
+func (r *Reader) readChunkData(labels map[string]string, chunkID string) ([]byte, error) {
+	file, err := openChunk(r.backend, models.Labels(labels).ToPath(), chunkID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// writeChunks writes n chunks of entries each to a stream under dir
+func writeChunks(tb testing.TB, dir string, n, entries int) []ChunkRef {
+	tb.Helper()
+	w := NewWriter(dir, 1024*1024)
+	labels := map[string]string{"app": "api"}
+	refs := make([]ChunkRef, n)
+	for i := range refs {
+		id, _, _, err := w.WriteChunk(labels, sampleEntries(entries))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		refs[i] = ChunkRef{Labels: labels, ID: id}
+	}
+	return refs
+}
+
+func TestPrefetch_ReadsAhead(t *testing.T) {
+	dir := t.TempDir()
+	refs := writeChunks(t, dir, 5, 50)
+	refs = append(refs[:2], append([]ChunkRef{{Labels: refs[0].Labels, ID: "missing"}}, refs[2:]...)...)
+	start, end := time.Time{}, time.Now().Add(time.Hour)
+
+	r := NewReader(dir)
+	want := make(map[string]int)
+	for _, ref := range refs {
+		entries, _, _, _ := r.ReadChunkLines(ref.Labels, ref.ID, start, end)
+		want[ref.ID] = len(entries)
+	}
+
+	// A budget below one chunk still reads one chunk ahead at a time
+	for _, budget := range []int64{1, 1 << 20} {
+		r.SetPrefetchBytes(budget)
+		p := r.Prefetch(refs)
+		for i, ref := range refs {
+			if i == 3 {
+				continue // skipped chunks are discarded
+			}
+			entries, lines, scanned, err := p.ReadChunkLines(ref.Labels, ref.ID, start, end)
+			if ref.ID == "missing" {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("budget %d: expected a not-exist error for the missing chunk, got %v", budget, err)
+				}
+				continue
+			}
+			if err != nil || len(entries) != want[ref.ID] || len(lines) != len(entries) || scanned != 50 {
+				t.Errorf("budget %d: chunk %d: got %d entries, %d scanned, err %v; want %d",
+					budget, i, len(entries), scanned, err, want[ref.ID])
+			}
+		}
+		p.Close()
+	}
+}
+
+// BenchmarkChunkScan compares reading each chunk when it is scanned with
+// reading ahead. Latency is what read-ahead hides, so point
+// LOGPULSE_BENCH_DIR at the storage to measure (spinning disk, NFS, ...);
+// the default temp dir is usually served from the page cache.
+func BenchmarkChunkScan(b *testing.B) {
+	dir := os.Getenv("LOGPULSE_BENCH_DIR")
+	if dir == "" {
+		dir = b.TempDir()
+	} else {
+		var err error
+		if dir, err = os.MkdirTemp(dir, "chunkscan"); err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+	}
+	refs := writeChunks(b, dir, 50, 2000)
+	start, end := time.Time{}, time.Now().Add(time.Hour)
+
+	for _, c := range []struct {
+		name   string
+		budget int64
+	}{{"sequential", 0}, {"prefetch", 32 << 20}} {
+		b.Run(c.name, func(b *testing.B) {
+			r := NewReader(dir)
+			r.SetPrefetchBytes(c.budget)
+			for i := 0; i < b.N; i++ {
+				p := r.Prefetch(refs)
+				for _, ref := range refs {
+					entries, _, _, err := p.ReadChunkLines(ref.Labels, ref.ID, start, end)
+					if err != nil {
+						b.Fatal(err)
+					}
+					// Stand in for the executor's matching work
+					for _, e := range entries {
+						models.Labels(e.Labels).Hash()
+					}
+				}
+				p.Close()
+			}
+		})
+	}
+}
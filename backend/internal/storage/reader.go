@@ -1,8 +1,9 @@
 package storage
 
 import (
-	"bufio"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
@@ -10,102 +11,162 @@ import (
 	"github.com/logpulse/backend/internal/models"
 )
 
-// Reader handles reading log chunks from disk
+// Reader handles reading log chunks from a storage backend
 type Reader struct {
+	backend StorageBackend
+	// basePath is the directory of a LocalBackend, which stream
+	// directory times are read from (empty for other backends)
 	basePath string
+
+	// prefetchBytes bounds the chunk data a Prefetch reads ahead of a
+	// scan (0 = no read-ahead)
+	prefetchBytes int64
 }
 
-// NewReader creates a new storage reader
+// NewReader creates a new storage reader for chunks on local disk
 func NewReader(basePath string) *Reader {
-	return &Reader{basePath: basePath}
+	return &Reader{backend: NewLocalBackend(basePath), basePath: basePath}
 }
 
-// ReadChunk reads all entries from a chunk file
-func (r *Reader) ReadChunk(labels map[string]string, chunkID string) ([]models.LogEntry, error) {
-	labelPath := models.Labels(labels).ToPath()
-	chunkPath := filepath.Join(r.basePath, labelPath, chunkID+".log")
+// NewReaderWithBackend creates a storage reader for the chunks in b
+func NewReaderWithBackend(b StorageBackend) *Reader {
+	return &Reader{backend: b}
+}
 
-	file, err := os.Open(chunkPath)
+// ReadChunk reads all entries from a chunk file, skipping entries that fail
+// to decode. Gzip-compressed legacy chunks are read transparently.
+func (r *Reader) ReadChunk(labels map[string]string, chunkID string) ([]models.LogEntry, error) {
+	file, err := openChunk(r.backend, models.Labels(labels).ToPath(), chunkID)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return decodeChunk(file)
+}
 
+// decodeChunk reads every entry of chunk data, skipping entries that fail
+// to decode
+func decodeChunk(data io.Reader) ([]models.LogEntry, error) {
 	var entries []models.LogEntry
-	scanner := bufio.NewScanner(file)
-	
-	// Increase buffer size for large lines
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024)
-
-	for scanner.Scan() {
-		var entry models.LogEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			continue
+	dec := newChunkDecoder(data, false)
+	for {
+		entry, err := dec.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
 		}
 		entries = append(entries, entry)
 	}
+}
 
-	return entries, scanner.Err()
+// VerifyChunk strictly reads a chunk, failing on the first entry that does not
+// decode. It returns the number of entries read.
+func (r *Reader) VerifyChunk(labels map[string]string, chunkID string) (int, error) {
+	file, err := openChunk(r.backend, models.Labels(labels).ToPath(), chunkID)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	dec := newChunkDecoder(file, true)
+	for {
+		if _, err := dec.Next(); err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, fmt.Errorf("chunk %s entry %d: %w", chunkID, count+1, err)
+		}
+		count++
+	}
 }
 
 // ReadChunkFiltered reads entries from a chunk with time filtering
 func (r *Reader) ReadChunkFiltered(labels map[string]string, chunkID string, startTime, endTime time.Time) ([]models.LogEntry, int, error) {
+	filtered, _, scannedLines, err := r.ReadChunkLines(labels, chunkID, startTime, endTime)
+	return filtered, scannedLines, err
+}
+
+// ReadChunkLines is ReadChunkFiltered that also returns, for each entry, its
+// line index within the chunk file
+func (r *Reader) ReadChunkLines(labels map[string]string, chunkID string, startTime, endTime time.Time) ([]models.LogEntry, []int, int, error) {
 	entries, err := r.ReadChunk(labels, chunkID)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
+	filtered, lines, scannedLines := filterChunkLines(entries, startTime, endTime)
+	return filtered, lines, scannedLines, nil
+}
 
+// filterChunkLines keeps the entries within [startTime, endTime] along with
+// their line index in the chunk
+func filterChunkLines(entries []models.LogEntry, startTime, endTime time.Time) ([]models.LogEntry, []int, int) {
 	scannedLines := len(entries)
 	filtered := make([]models.LogEntry, 0)
+	lines := make([]int, 0)
 
-	for _, entry := range entries {
+	for i, entry := range entries {
 		if entry.Timestamp.Before(startTime) || entry.Timestamp.After(endTime) {
 			continue
 		}
 		filtered = append(filtered, entry)
+		lines = append(lines, i)
 	}
 
-	return filtered, scannedLines, nil
+	return filtered, lines, scannedLines
 }
 
 // GetChunkMeta reads chunk metadata
 func (r *Reader) GetChunkMeta(labels map[string]string, chunkID string) (*models.ChunkMeta, error) {
-	labelPath := models.Labels(labels).ToPath()
-	metaPath := filepath.Join(r.basePath, labelPath, chunkID+".meta")
-
-	file, err := os.Open(metaPath)
+	data, err := readObject(r.backend, chunkKey(models.Labels(labels).ToPath(), chunkID+".meta"))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
 	var meta models.ChunkMeta
-	if err := json.NewDecoder(file).Decode(&meta); err != nil {
+	if err := json.Unmarshal(data, &meta); err != nil {
 		return nil, err
 	}
 
 	return &meta, nil
 }
 
+// ChunkSize returns the size in bytes of a chunk's data file, or 0 if it
+// cannot be found
+func (r *Reader) ChunkSize(labels map[string]string, chunkID string) int64 {
+	dir := models.Labels(labels).ToPath()
+	if r.basePath != "" {
+		// A stat beats listing the stream directory
+		for _, ext := range []string{".log", LegacyChunkExt} {
+			if info, err := os.Stat(filepath.Join(r.basePath, dir, chunkID+ext)); err == nil {
+				return info.Size()
+			}
+		}
+		return 0
+	}
+
+	objects, _ := r.backend.ListChunks(chunkKey(dir, chunkID+"."))
+	for _, obj := range objects {
+		if _, name := splitKey(obj.Key); name == chunkID+".log" || name == chunkID+LegacyChunkExt {
+			return obj.Size
+		}
+	}
+	return 0
+}
+
 // ListChunks returns all chunk IDs for a label set
 func (r *Reader) ListChunks(labels map[string]string) ([]string, error) {
-	labelPath := models.Labels(labels).ToPath()
-	dirPath := filepath.Join(r.basePath, labelPath)
-
-	entries, err := os.ReadDir(dirPath)
+	objects, err := r.backend.ListChunks(models.Labels(labels).ToPath() + "/")
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []string{}, nil
-		}
 		return nil, err
 	}
 
 	chunks := make([]string, 0)
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".log" {
-			chunkID := entry.Name()[:len(entry.Name())-4] // Remove .log extension
-			chunks = append(chunks, chunkID)
+	for _, obj := range objects {
+		if _, name := splitKey(obj.Key); isChunkData(name) {
+			chunks = append(chunks, chunkBase(name))
 		}
 	}
 
@@ -2,99 +2,262 @@ package storage
 
 import (
 	"context"
-	"log"
-	"os"
-	"path/filepath"
+	"encoding/json"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/logging"
+	"github.com/logpulse/backend/internal/models"
 )
 
-// StartRetentionWorker starts a background worker to clean up old logs with context support
-func StartRetentionWorker(ctx context.Context, basePath string, retentionDays int) {
+// retentionLog returns the logger of the retention worker
+func retentionLog() *slog.Logger {
+	return logging.Component("RetentionWorker")
+}
+
+// LabelMatcher selects streams by their labels, e.g. a parsed query selector
+type LabelMatcher interface {
+	MatchLabels(labels map[string]string) bool
+}
+
+// StorageLimit caps the disk space chunks take. Once usage exceeds MaxBytes,
+// the oldest chunks are deleted until it is at most LowWaterBytes.
+type StorageLimit struct {
+	MaxBytes      int64 // 0 = unlimited
+	LowWaterBytes int64
+}
+
+// storageCheckInterval is how often usage is checked against the storage
+// limit, more often than ages so a burst cannot fill the disk in between
+const storageCheckInterval = time.Minute
+
+// RetentionWorker deletes chunks older than the retention period every
+// hour, and the oldest chunks whenever storage exceeds its limit. Chunks of
+// streams matching any exclude matcher are never deleted. Ages are measured
+// against clk. Deleted chunks are removed from idx.
+type RetentionWorker struct {
+	w       *Writer
+	idx     ChunkIndex
+	days    atomic.Int64
+	limit   StorageLimit
+	clk     clock.Clock
+	exclude []LabelMatcher
+}
+
+// NewRetentionWorker creates a worker keeping retentionDays of chunks
+func NewRetentionWorker(w *Writer, idx ChunkIndex, retentionDays int, limit StorageLimit, clk clock.Clock, exclude ...LabelMatcher) *RetentionWorker {
+	rw := &RetentionWorker{w: w, idx: idx, limit: limit, clk: clk, exclude: exclude}
+	rw.days.Store(int64(retentionDays))
+	return rw
+}
+
+// SetRetentionDays changes the retention period from the next hourly
+// cleanup on
+func (rw *RetentionWorker) SetRetentionDays(days int) {
+	rw.days.Store(int64(days))
+}
+
+// RetentionDays returns the retention period in days
+func (rw *RetentionWorker) RetentionDays() int {
+	return int(rw.days.Load())
+}
+
+// Run cleans up until ctx is cancelled
+func (rw *RetentionWorker) Run(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
-	log.Printf("[RetentionWorker] Starting with %d days retention", retentionDays)
+	var sizeTicks <-chan time.Time
+	if rw.limit.MaxBytes > 0 {
+		sizeTicker := time.NewTicker(storageCheckInterval)
+		defer sizeTicker.Stop()
+		sizeTicks = sizeTicker.C
+		retentionLog().Info("Starting", "retention_days", rw.RetentionDays(), "max_bytes", rw.limit.MaxBytes)
+	} else {
+		retentionLog().Info("Starting", "retention_days", rw.RetentionDays())
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("[RetentionWorker] Shutting down")
+			retentionLog().Info("Shutting down")
 			return
 		case <-ticker.C:
-			CleanupOldChunks(basePath, retentionDays)
+			CleanupOldChunks(rw.w.backend, rw.idx, rw.RetentionDays(), rw.clk, rw.exclude...)
+		case <-sizeTicks:
+			CleanupOverLimit(rw.w, rw.idx, rw.limit, rw.exclude...)
 		}
 	}
 }
 
-// CleanupOldChunks removes chunk files older than retention period
-func CleanupOldChunks(basePath string, retentionDays int) {
-	cutoff := time.Now().AddDate(0, 0, -retentionDays)
-	deletedCount := 0
-	deletedBytes := int64(0)
+// StartRetentionWorker runs a RetentionWorker until ctx is cancelled
+func StartRetentionWorker(ctx context.Context, w *Writer, idx ChunkIndex, retentionDays int, limit StorageLimit, clk clock.Clock, exclude ...LabelMatcher) {
+	NewRetentionWorker(w, idx, retentionDays, limit, clk, exclude...).Run(ctx)
+}
 
-	log.Printf("[RetentionWorker] Starting cleanup, cutoff: %s", cutoff.Format(time.RFC3339))
+// CleanupOverLimit deletes chunks, those that end earliest per their .meta
+// files first, while storage usage is above limit.LowWaterBytes, provided
+// it was above limit.MaxBytes to begin with. Chunks of streams matching an
+// exclude matcher are kept. Usage is checked against the writer's running
+// total, so the backend is only listed once it is over the limit. Deleted
+// chunks are removed from idx. It returns the bytes reclaimed.
+func CleanupOverLimit(w *Writer, idx ChunkIndex, limit StorageLimit, exclude ...LabelMatcher) int64 {
+	if limit.MaxBytes <= 0 {
+		return 0
+	}
+	usage, err := w.GetStorageSize()
+	if err != nil {
+		retentionLog().Error("Failed to get storage usage", "error", err)
+		return 0
+	}
+	if usage <= limit.MaxBytes {
+		return 0
+	}
+	objects, err := w.backend.ListChunks("")
+	if err != nil {
+		retentionLog().Error("Failed to list chunks", "error", err)
+		return 0
+	}
 
-	err := filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
+	type sizedChunk struct {
+		base string // key without extension
+		end  time.Time
+		keys []string
+		size int64
+	}
+	// A chunk's data and metadata share a base key
+	byBase := make(map[string]*sizedChunk)
+	for _, obj := range objects {
+		base := chunkBase(obj.Key)
+		c, ok := byBase[base]
+		if !ok {
+			c = &sizedChunk{base: base}
+			byBase[base] = c
+		}
+		c.keys = append(c.keys, obj.Key)
+		c.size += obj.Size
+	}
+	var chunks []*sizedChunk
+	protected := make(map[string]bool)
+	for base, c := range byBase {
+		data, err := readObject(w.backend, base+".meta")
 		if err != nil {
-			return nil // Continue walking on error
+			continue
 		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
+		var meta models.ChunkMeta
+		if json.Unmarshal(data, &meta) != nil || isProtectedChunk(w.backend, base, exclude, protected) {
+			continue
 		}
-
-		// Check if file is older than cutoff
-		if info.ModTime().Before(cutoff) {
-			size := info.Size()
-			if err := os.Remove(path); err != nil {
-				log.Printf("[RetentionWorker] Failed to delete %s: %v", path, err)
-				return nil
-			}
-			deletedCount++
-			deletedBytes += size
-			log.Printf("[RetentionWorker] Deleted old file: %s (age: %v)", 
-				filepath.Base(path), time.Since(info.ModTime()).Hours()/24)
+		_, c.end = meta.Bounds()
+		chunks = append(chunks, c)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		if !chunks[i].end.Equal(chunks[j].end) {
+			return chunks[i].end.Before(chunks[j].end)
 		}
-
-		return nil
+		return chunks[i].base < chunks[j].base
 	})
 
-	if err != nil {
-		log.Printf("[RetentionWorker] Cleanup error: %v", err)
+	deletedCount := 0
+	reclaimed := int64(0)
+	for _, c := range chunks {
+		if usage-reclaimed <= limit.LowWaterBytes {
+			break
+		}
+		// The metadata goes first, so a failure leaves no chunk behind
+		// whose data is gone
+		sort.SliceStable(c.keys, func(i, j int) bool {
+			return strings.HasSuffix(c.keys[i], ".meta") && !strings.HasSuffix(c.keys[j], ".meta")
+		})
+		for _, key := range c.keys {
+			if err := w.backend.DeleteChunk(key); err != nil {
+				retentionLog().Error("Failed to delete chunk object", "key", key, "error", err)
+			}
+		}
+		idx.RemoveChunk(path.Base(c.base))
+		deletedCount++
+		reclaimed += c.size
 	}
 
-	if deletedCount > 0 {
-		log.Printf("[RetentionWorker] Cleanup complete: deleted %d files (%.2f MB)", 
-			deletedCount, float64(deletedBytes)/1024/1024)
-	} else {
-		log.Printf("[RetentionWorker] Cleanup complete: no old files to delete")
+	retentionLog().Info("Storage exceeded its limit, deleted the oldest chunks",
+		"usage_bytes", usage, "max_bytes", limit.MaxBytes, "deleted_chunks", deletedCount, "reclaimed_bytes", reclaimed)
+	if usage-reclaimed > limit.LowWaterBytes {
+		retentionLog().Warn("Storage still above the low-water mark with no more chunks to delete",
+			"usage_bytes", usage-reclaimed, "low_water_bytes", limit.LowWaterBytes)
 	}
-
-	// Remove empty directories
-	cleanupEmptyDirs(basePath)
+	return reclaimed
 }
 
-// cleanupEmptyDirs removes empty directories recursively
-func cleanupEmptyDirs(basePath string) {
-	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || !info.IsDir() || path == basePath {
-			return nil
-		}
+// CleanupOldChunks removes the objects of b older than retention period as
+// of clk's current time, except chunks whose .meta labels match one of the
+// exclude matchers. Chunks whose data is deleted are removed from idx.
+func CleanupOldChunks(b StorageBackend, idx ChunkIndex, retentionDays int, clk clock.Clock, exclude ...LabelMatcher) {
+	cutoff := clk.Now().AddDate(0, 0, -retentionDays)
+	deletedCount := 0
+	deletedBytes := int64(0)
+	protected := make(map[string]bool) // chunk key without extension -> protected
 
-		entries, err := os.ReadDir(path)
-		if err != nil {
-			return nil
-		}
+	logger := retentionLog()
+	logger.Info("Starting cleanup", "cutoff", cutoff.Format(time.RFC3339))
 
-		if len(entries) == 0 {
-			if err := os.Remove(path); err == nil {
-				log.Printf("[RetentionWorker] Removed empty directory: %s", path)
-			}
+	objects, err := b.ListChunks("")
+	if err != nil {
+		logger.Error("Cleanup failed", "error", err)
+		return
+	}
+	for _, obj := range objects {
+		// Skip the schema version record
+		if obj.Key == SchemaFile || !obj.ModTime.Before(cutoff) {
+			continue
 		}
+		if isProtectedChunk(b, chunkBase(obj.Key), exclude, protected) {
+			continue
+		}
+		if err := b.DeleteChunk(obj.Key); err != nil {
+			logger.Error("Failed to delete chunk object", "key", obj.Key, "error", err)
+			continue
+		}
+		if isChunkData(obj.Key) {
+			idx.RemoveChunk(path.Base(chunkBase(obj.Key)))
+		}
+		deletedCount++
+		deletedBytes += obj.Size
+		logger.Info("Deleted old file",
+			"file", path.Base(obj.Key), "age_days", clk.Now().Sub(obj.ModTime).Hours()/24)
+	}
 
-		return nil
-	})
+	logger.Info("Cleanup complete", "deleted_files", deletedCount, "deleted_bytes", deletedBytes)
 }
 
+// isProtectedChunk reports whether the chunk with base key base belongs to
+// an excluded stream. The decision is cached per chunk so the .log and
+// .meta objects of a chunk are treated alike and logged once.
+func isProtectedChunk(b StorageBackend, base string, exclude []LabelMatcher, cache map[string]bool) bool {
+	if len(exclude) == 0 {
+		return false
+	}
+	if p, ok := cache[base]; ok {
+		return p
+	}
 
+	p := false
+	if data, err := readObject(b, base+".meta"); err == nil {
+		var meta models.ChunkMeta
+		if json.Unmarshal(data, &meta) == nil {
+			for _, m := range exclude {
+				if m.MatchLabels(meta.Labels) {
+					p = true
+					retentionLog().Info("Protected chunk of excluded stream", "chunk", path.Base(base), "labels", meta.Labels)
+					break
+				}
+			}
+		}
+	}
+	cache[base] = p
+	return p
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logpulse/backend/internal/clock"
+	"github.com/logpulse/backend/internal/index"
+	"github.com/logpulse/backend/internal/models"
+)
+
+type jobMatcher string
+
+func (j jobMatcher) MatchLabels(labels map[string]string) bool {
+	return labels["job"] == string(j)
+}
+
+func TestCleanupOldChunks_RetentionExclude(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	idx := index.NewIndex()
+
+	audit := map[string]string{"job": "audit"}
+	app := map[string]string{"job": "app"}
+	entry := func(labels map[string]string) []models.LogEntry {
+		return []models.LogEntry{{ID: "1", Timestamp: time.Now(), Line: "x", Labels: labels}}
+	}
+	write := func(labels map[string]string) string {
+		id, start, end, err := w.WriteChunk(labels, entry(labels))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		idx.AddChunk(id, labels, start, end, 1)
+		return id
+	}
+	auditID := write(audit)
+	appID := write(app)
+
+	old := time.Now().AddDate(0, 0, -30)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			os.Chtimes(path, old, old)
+		}
+		return nil
+	})
+
+	CleanupOldChunks(NewLocalBackend(dir), idx, 7, clock.Real{}, jobMatcher("audit"))
+
+	for _, ext := range []string{".log", ".meta"} {
+		if _, err := os.Stat(filepath.Join(dir, models.Labels(audit).ToPath(), auditID+ext)); err != nil {
+			t.Errorf("expected protected audit chunk %s to survive: %v", ext, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, models.Labels(app).ToPath(), appID+ext)); !os.IsNotExist(err) {
+			t.Errorf("expected expired app chunk %s to be deleted", ext)
+		}
+	}
+
+	metas := idx.FindChunkMetas(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), func(map[string]string) bool { return true })
+	if len(metas) != 1 || metas[0].ID != auditID {
+		t.Errorf("expected only the audit chunk left in the index, got %+v", metas)
+	}
+}
+
+func TestCleanupOverLimit_OldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, 1024*1024)
+	idx := index.NewIndex()
+	app := map[string]string{"job": "app"}
+	audit := map[string]string{"job": "audit"}
+	base := time.Now().Add(-time.Hour)
+
+	// Ten chunks written out of time order, each ending a minute after the
+	// one before it in time
+	write := func(labels map[string]string, minute int) string {
+		entries := []models.LogEntry{{ID: "1", Timestamp: base.Add(time.Duration(minute) * time.Minute), Line: strings.Repeat("x", 1000), Labels: labels}}
+		id, start, end, err := w.WriteChunk(labels, entries)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		idx.AddChunk(id, labels, start, end, len(entries))
+		return id
+	}
+	ids := make(map[int]string)
+	for _, minute := range []int{5, 2, 8, 0, 9, 3, 6, 1, 7, 4} {
+		ids[minute] = write(app, minute)
+	}
+	auditID := write(audit, -10) // oldest of all, but excluded
+
+	storageSize := func() int64 {
+		t.Helper()
+		size, err := w.GetStorageSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+	usage := storageSize()
+	limit := StorageLimit{MaxBytes: usage - 1, LowWaterBytes: usage / 2}
+	reclaimed := CleanupOverLimit(w, idx, limit, jobMatcher("audit"))
+	if reclaimed == 0 || storageSize() > limit.LowWaterBytes {
+		t.Fatalf("expected usage at most %d after reclaiming, got %d (reclaimed %d)", limit.LowWaterBytes, storageSize(), reclaimed)
+	}
+	if got := usage - storageSize(); got != reclaimed {
+		t.Errorf("expected %d bytes reported reclaimed, freed %d", reclaimed, got)
+	}
+
+	exists := func(labels map[string]string, id string) bool {
+		_, err := os.Stat(filepath.Join(dir, models.Labels(labels).ToPath(), id+".meta"))
+		return err == nil
+	}
+	// Deleted chunks are a prefix of the chunks in end time order
+	kept := false
+	for minute := 0; minute < 10; minute++ {
+		switch e := exists(app, ids[minute]); {
+		case e:
+			kept = true
+		case kept:
+			t.Errorf("chunk ending at minute %d deleted while an older one was kept", minute)
+		}
+	}
+	if !exists(app, ids[9]) {
+		t.Error("expected the newest chunk to be kept")
+	}
+	if exists(app, ids[0]) {
+		t.Error("expected the oldest chunk to be deleted")
+	}
+	if !exists(audit, auditID) {
+		t.Error("expected the excluded chunk to be kept")
+	}
+
+	// The index returns exactly the chunks left on disk
+	metas := idx.FindChunkMetas(base.Add(-time.Hour), base.Add(time.Hour), func(map[string]string) bool { return true })
+	indexed := make(map[string]bool)
+	for _, meta := range metas {
+		indexed[meta.ID] = true
+	}
+	for minute, id := range ids {
+		if indexed[id] != exists(app, id) {
+			t.Errorf("chunk ending at minute %d: indexed %v, on disk %v", minute, indexed[id], exists(app, id))
+		}
+	}
+
+	// Under the cap nothing is deleted
+	if reclaimed := CleanupOverLimit(w, idx, StorageLimit{MaxBytes: storageSize(), LowWaterBytes: 0}); reclaimed != 0 {
+		t.Errorf("expected nothing reclaimed under the cap, got %d", reclaimed)
+	}
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3Config locates an S3-compatible bucket, AWS S3 or a MinIO or similar
+// server
+type S3Config struct {
+	// Endpoint is the server's base URL, e.g. http://minio:9000 (empty =
+	// AWS S3 in Region). Custom endpoints are addressed path-style.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every key, so one bucket can hold several
+	// instances' chunks
+	Prefix string
+	// Credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN environment variables
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Timeout bounds each request (default 30s)
+	Timeout time.Duration
+}
+
+// S3Backend keeps objects in an S3 bucket through the AWS SDK
+type S3Backend struct {
+	cfg    S3Config
+	client *s3.Client
+}
+
+// NewS3Backend creates a backend storing objects in cfg.Bucket
+func NewS3Backend(cfg S3Config) (*S3Backend, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.AccessKeyID == "" && cfg.SecretAccessKey == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	opts := s3.Options{
+		Region:     cfg.Region,
+		HTTPClient: &http.Client{Timeout: cfg.Timeout},
+	}
+	if cfg.Endpoint != "" {
+		if u, err := url.Parse(cfg.Endpoint); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+		}
+		opts.BaseEndpoint = aws.String(strings.TrimSuffix(cfg.Endpoint, "/"))
+		opts.UsePathStyle = true
+	}
+	if cfg.AccessKeyID == "" && cfg.SecretAccessKey == "" {
+		opts.Credentials = aws.AnonymousCredentials{}
+	} else {
+		creds := aws.Credentials{
+			AccessKeyID:     cfg.AccessKeyID,
+			SecretAccessKey: cfg.SecretAccessKey,
+			SessionToken:    cfg.SessionToken,
+			Source:          "LogPulse storage.s3 config",
+		}
+		opts.Credentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return creds, nil
+		})
+	}
+	return &S3Backend{cfg: cfg, client: s3.New(opts)}, nil
+}
+
+// key returns the bucket key of the object under key
+func (b *S3Backend) key(key string) *string {
+	return aws.String(b.cfg.Prefix + key)
+}
+
+// s3Error wraps an SDK error with the operation and key, matching
+// fs.ErrNotExist when S3 answered 404
+func s3Error(op, key string, err error) error {
+	var resp *awshttp.ResponseError
+	if errors.As(err, &resp) && resp.HTTPStatusCode() == http.StatusNotFound {
+		return fmt.Errorf("s3 %s %s: %w (%w)", op, key, err, fs.ErrNotExist)
+	}
+	return fmt.Errorf("s3 %s %s: %w", op, key, err)
+}
+
+// PutChunk uploads data under key with a single PUT, which S3 applies
+// atomically
+func (b *S3Backend) PutChunk(key string, data []byte) error {
+	_, err := b.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(b.cfg.Bucket),
+		Key:           b.key(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	})
+	if err != nil {
+		return s3Error("put", key, err)
+	}
+	return nil
+}
+
+// GetChunk streams the object under key
+func (b *S3Backend) GetChunk(key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(b.cfg.Bucket),
+		Key:    b.key(key),
+	})
+	if err != nil {
+		return nil, s3Error("get", key, err)
+	}
+	return out.Body, nil
+}
+
+// DeleteChunk deletes the object under key
+func (b *S3Backend) DeleteChunk(key string) error {
+	_, err := b.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.cfg.Bucket),
+		Key:    b.key(key),
+	})
+	if err != nil {
+		if err := s3Error("delete", key, err); !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListChunks pages through ListObjectsV2 for the keys under prefix
+func (b *S3Backend) ListChunks(prefix string) ([]ChunkObject, error) {
+	var objects []ChunkObject
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.cfg.Bucket),
+		Prefix: b.key(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return nil, s3Error("list", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ChunkObject{
+				Key:     strings.TrimPrefix(aws.ToString(obj.Key), b.cfg.Prefix),
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
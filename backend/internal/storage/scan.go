@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/logpulse/backend/internal/models"
+)
+
+// StreamDirs returns every stream directory with its modification time,
+// which changes whenever a chunk is written into or deleted from it. Object
+// stores have no directory times, so there every directory is reported as
+// modified now.
+func (r *Reader) StreamDirs() (map[string]time.Time, error) {
+	if r.basePath == "" {
+		objects, err := r.backend.ListChunks("")
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		dirs := make(map[string]time.Time)
+		for _, obj := range objects {
+			if dir, _ := splitKey(obj.Key); dir != "" {
+				dirs[dir] = now
+			}
+		}
+		return dirs, nil
+	}
+
+	entries, err := os.ReadDir(r.basePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]time.Time{}, nil
+		}
+		return nil, err
+	}
+
+	dirs := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+		dirs[entry.Name()] = info.ModTime()
+	}
+	return dirs, nil
+}
+
+// ReadStreamMetas reads the .meta file of every chunk in a stream directory.
+// Unreadable metadata files are skipped.
+func (r *Reader) ReadStreamMetas(dir string) ([]models.ChunkMeta, error) {
+	objects, err := r.backend.ListChunks(dir + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var metas []models.ChunkMeta
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, ".meta") {
+			continue
+		}
+		data, err := readObject(r.backend, obj.Key)
+		if err != nil {
+			continue
+		}
+		var meta models.ChunkMeta
+		if err := json.Unmarshal(data, &meta); err != nil || meta.ID == "" {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
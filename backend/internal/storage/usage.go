@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// usageBackend keeps a running total of the size and chunk count of the
+// objects written through it, so reporting storage usage does not list the
+// whole backend, which on object storage is a paged request per thousand
+// keys. The totals start from one listing on first use; objects written or
+// deleted by another process sharing the storage are not seen until then.
+type usageBackend struct {
+	StorageBackend
+
+	mu     sync.Mutex
+	loaded bool
+	sizes  map[string]int64 // by key, once loaded
+	bytes  int64
+	chunks int
+}
+
+func newUsageBackend(b StorageBackend) *usageBackend {
+	return &usageBackend{StorageBackend: b}
+}
+
+// PutChunk stores the object and counts it, replacing the size of any
+// object it overwrites
+func (b *usageBackend) PutChunk(key string, data []byte) error {
+	if err := b.StorageBackend.PutChunk(key, data); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.set(key, int64(len(data)))
+	return nil
+}
+
+// DeleteChunk removes the object and its size from the totals
+func (b *usageBackend) DeleteChunk(key string) error {
+	if err := b.StorageBackend.DeleteChunk(key); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.set(key, -1)
+	return nil
+}
+
+// SetModTime backdates the object where the wrapped backend can, and is a
+// no-op elsewhere
+func (b *usageBackend) SetModTime(key string, t time.Time) error {
+	if setter, ok := b.StorageBackend.(modTimeSetter); ok {
+		return setter.SetModTime(key, t)
+	}
+	return nil
+}
+
+// set records the size of the object under key, or its removal for a
+// negative size; b.mu must be held. Before the first listing there is
+// nothing to update, as the listing will see the object as it is.
+func (b *usageBackend) set(key string, size int64) {
+	if !b.loaded {
+		return
+	}
+	if old, ok := b.sizes[key]; ok {
+		b.bytes -= old
+		if isChunkData(key) {
+			b.chunks--
+		}
+		delete(b.sizes, key)
+	}
+	if size < 0 {
+		return
+	}
+	b.sizes[key] = size
+	b.bytes += size
+	if isChunkData(key) {
+		b.chunks++
+	}
+}
+
+// usage returns the bytes stored and the number of chunks, listing the
+// backend the first time; a failed listing is retried on the next call
+func (b *usageBackend) usage() (int64, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.loaded {
+		objects, err := b.StorageBackend.ListChunks("")
+		if err != nil {
+			return 0, 0, err
+		}
+		b.sizes = make(map[string]int64, len(objects))
+		b.loaded = true
+		for _, obj := range objects {
+			b.set(obj.Key, obj.Size)
+		}
+	}
+	return b.bytes, b.chunks, nil
+}
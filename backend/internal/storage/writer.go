@@ -2,10 +2,13 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,39 +16,72 @@ import (
 	"github.com/logpulse/backend/internal/models"
 )
 
-// Writer handles writing log chunks to disk
+// Writer handles writing log chunks to a storage backend
 type Writer struct {
+	backend StorageBackend
+	// usage wraps the backend every write and delete goes through
+	usage *usageBackend
+	// basePath is the directory of a LocalBackend, for the tasks only
+	// local storage supports (empty for other backends)
 	basePath  string
 	chunkSize int
 	chunkSeq  int64
-	mu        sync.Mutex
+	encoding  string
+	// compress writes new chunks gzip-compressed as .log.gz
+	compress bool
+	mu       sync.Mutex
 }
 
-// NewWriter creates a new storage writer
+// NewWriter creates a new storage writer for chunks on local disk
 func NewWriter(basePath string, chunkSize int) *Writer {
 	os.MkdirAll(basePath, 0755)
+	w := NewWriterWithBackend(NewLocalBackend(basePath), chunkSize)
+	w.basePath = basePath
+	return w
+}
+
+// NewWriterWithBackend creates a storage writer keeping chunks in b
+func NewWriterWithBackend(b StorageBackend, chunkSize int) *Writer {
+	usage := newUsageBackend(b)
 	return &Writer{
-		basePath:  basePath,
+		backend:   usage,
+		usage:     usage,
 		chunkSize: chunkSize,
+		encoding:  EncodingJSON,
 	}
 }
 
-// WriteChunk writes a batch of logs to a new chunk file
-func (w *Writer) WriteChunk(labels map[string]string, entries []models.LogEntry) (string, time.Time, time.Time, error) {
-	// Generate chunk ID and prepare paths outside of lock
-	seq := atomic.AddInt64(&w.chunkSeq, 1)
-	chunkID := fmt.Sprintf("chunk_%d_%d", time.Now().Unix(), seq)
-	labelPath := models.Labels(labels).ToPath()
-	dirPath := filepath.Join(w.basePath, labelPath)
+// Backend returns the backend chunks are written to
+func (w *Writer) Backend() StorageBackend {
+	return w.backend
+}
 
-	// Create directory (can be done without lock)
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return "", time.Time{}, time.Time{}, err
+// SetEncoding selects the encoding for newly written chunks. Existing chunks
+// keep their encoding and remain readable.
+func (w *Writer) SetEncoding(encoding string) error {
+	if !ValidEncoding(encoding) {
+		return fmt.Errorf("unknown chunk encoding %q", encoding)
 	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.encoding = encoding
+	return nil
+}
 
-	// Prepare file paths
-	chunkPath := filepath.Join(dirPath, chunkID+".log")
-	metaPath := filepath.Join(dirPath, chunkID+".meta")
+// SetCompression makes newly written chunks gzip-compressed .log.gz files.
+// Existing chunks keep their format; the reader tells them apart by
+// extension.
+func (w *Writer) SetCompression(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.compress = enabled
+}
+
+// WriteChunk writes a batch of logs to a new chunk file
+func (w *Writer) WriteChunk(labels map[string]string, entries []models.LogEntry) (string, time.Time, time.Time, error) {
+	// Generate chunk ID and prepare keys outside of lock
+	chunkID := w.nextChunkID()
+	dir := models.Labels(labels).ToPath()
 
 	// Calculate time range by finding min/max timestamps
 	// Don't assume entries are sorted
@@ -63,74 +99,127 @@ func (w *Writer) WriteChunk(labels map[string]string, entries []models.LogEntry)
 		}
 	}
 
-	// Only lock for the actual file creation and writing
+	// Only lock for the actual encoding and writing
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Create and write chunk file
-	file, err := os.Create(chunkPath)
-	if err != nil {
-		return "", time.Time{}, time.Time{}, err
+	dataKey := chunkKey(dir, chunkID+".log")
+	var compression string
+	if w.compress {
+		dataKey = chunkKey(dir, chunkID+LegacyChunkExt)
+		compression = CompressionGzip
 	}
-	defer file.Close()
 
-	writer := bufio.NewWriter(file)
-	for _, entry := range entries {
-		line, _ := json.Marshal(entry)
-		writer.Write(line)
-		writer.WriteByte('\n')
+	var data bytes.Buffer
+	checksum, err := encodeChunk(&data, entries, w.encoding, w.compress)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
 	}
-
-	if err := writer.Flush(); err != nil {
+	if err := w.backend.PutChunk(dataKey, data.Bytes()); err != nil {
 		return "", time.Time{}, time.Time{}, err
 	}
 
 	// Write metadata file
 	meta := models.ChunkMeta{
-		ID:         chunkID,
-		Labels:     labels,
-		StartTime:  startTime.Unix(),
-		EndTime:    endTime.Unix(),
-		EntryCount: len(entries),
+		ID:            chunkID,
+		Labels:        labels,
+		StartTime:     startTime.Unix(),
+		EndTime:       endTime.Unix(),
+		EntryCount:    len(entries),
+		Encoding:      w.encoding,
+		Compression:   compression,
+		SchemaVersion: SchemaVersion,
+		StartTimeNano: startTime.UnixNano(),
+		EndTimeNano:   endTime.UnixNano(),
+		Checksum:      checksum,
 	}
 
-	metaFile, err := os.Create(metaPath)
-	if err != nil {
+	// The metadata goes last: a chunk exists once it does
+	if err := putChunkMeta(w.backend, dir, &meta); err != nil {
 		return "", time.Time{}, time.Time{}, err
 	}
-	defer metaFile.Close()
-
-	json.NewEncoder(metaFile).Encode(meta)
 
 	return chunkID, startTime, endTime, nil
 }
 
-// GetStorageSize returns total storage used in bytes
-func (w *Writer) GetStorageSize() int64 {
-	var size int64
-	filepath.Walk(w.basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
+// nextChunkID returns a new chunk ID, unique within this writer
+func (w *Writer) nextChunkID() string {
+	seq := atomic.AddInt64(&w.chunkSeq, 1)
+	return fmt.Sprintf("chunk_%d_%d", time.Now().Unix(), seq)
+}
+
+// encodeChunk writes entries to out as chunk data in the given encoding,
+// gzip-compressed if compress is set, and returns the checksum of the bytes
+// written, which covers the data as stored, after compression
+func encodeChunk(out io.Writer, entries []models.LogEntry, encoding string, compress bool) (string, error) {
+	checksum := newChecksum()
+	out = io.MultiWriter(out, checksum)
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(out)
+		out = zw
+	}
+	writer := bufio.NewWriter(out)
+	encode := encoderFor(encoding)
+	for i := range entries {
+		if err := encode(writer, &entries[i]); err != nil {
+			return "", err
 		}
-		if !info.IsDir() {
-			size += info.Size()
+	}
+
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return "", err
 		}
-		return nil
-	})
-	return size
+	}
+	return formatChecksum(checksum), nil
 }
 
-// GetChunkCount returns total number of chunks
-func (w *Writer) GetChunkCount() int {
-	count := 0
-	filepath.Walk(w.basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		if !info.IsDir() && filepath.Ext(path) == ".log" {
-			count++
+// DeleteChunk removes a chunk's data and metadata, the data last so a
+// chunk never has metadata without data
+func (w *Writer) DeleteChunk(labels map[string]string, chunkID string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return deleteChunk(w.backend, models.Labels(labels).ToPath(), chunkID)
+}
+
+// deleteChunk removes the objects of a chunk in stream directory dir
+func deleteChunk(b StorageBackend, dir, chunkID string) error {
+	for _, ext := range []string{".meta", ".log", LegacyChunkExt} {
+		if err := b.DeleteChunk(chunkKey(dir, chunkID+ext)); err != nil {
+			return err
 		}
-		return nil
-	})
-	return count
+	}
+	return nil
+}
+
+// putChunkMeta stores a chunk's metadata in stream directory dir
+func putChunkMeta(b StorageBackend, dir string, meta *models.ChunkMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return b.PutChunk(chunkKey(dir, meta.ID+".meta"), append(data, '\n'))
+}
+
+// GetStorageSize returns total storage used in bytes. It lists the backend
+// on the first call only, and counts the writer's own writes and deletes
+// from then on.
+func (w *Writer) GetStorageSize() (int64, error) {
+	size, _, err := w.usage.usage()
+	return size, err
+}
+
+// GetChunkCount returns total number of chunks, kept like GetStorageSize
+func (w *Writer) GetChunkCount() (int, error) {
+	_, count, err := w.usage.usage()
+	return count, err
+}
+
+// isChunkData reports whether an object key names a chunk's data
+func isChunkData(key string) bool {
+	return strings.HasSuffix(key, ".log") || strings.HasSuffix(key, LegacyChunkExt)
 }
@@ -0,0 +1,42 @@
+package wal
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	walMetricsOnce      sync.Once
+	walSizeBytes        prometheus.Gauge
+	walSegments         prometheus.Gauge
+	walRotations        prometheus.Counter
+	walReplayedRecords  prometheus.Counter
+	walReplayedSegments prometheus.Counter
+)
+
+func registerMetrics() {
+	walMetricsOnce.Do(func() {
+		walSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "wal_size_bytes",
+			Help: "Bytes on disk across all write-ahead log segments.",
+		})
+		walSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "wal_segments",
+			Help: "Number of write-ahead log segments on disk.",
+		})
+		walRotations = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wal_segment_rotations_total",
+			Help: "Total write-ahead log segments sealed after reaching the size limit.",
+		})
+		walReplayedRecords = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wal_replayed_records_total",
+			Help: "Total records replayed from the write-ahead log at startup.",
+		})
+		walReplayedSegments = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wal_replayed_segments_total",
+			Help: "Total write-ahead log segments replayed at startup.",
+		})
+		prometheus.MustRegister(walSizeBytes, walSegments, walRotations, walReplayedRecords, walReplayedSegments)
+	})
+}
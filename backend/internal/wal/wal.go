@@ -0,0 +1,440 @@
+// Package wal implements a segmented write-ahead log. Records are appended
+// to the current segment as length- and checksum-framed payloads; segments
+// rotate once they reach a size limit, sealed segments can be gzip
+// compressed, and segments whose records are durable elsewhere are deleted
+// with Checkpoint.
+package wal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt    = ".wal"
+	compressedExt = ".wal.gz"
+	tmpExt        = ".tmp"
+
+	// frameHeaderSize is the record length and CRC32 preceding each payload
+	frameHeaderSize = 8
+
+	// DefaultSegmentSize is used when Options.SegmentSize is not set
+	DefaultSegmentSize = 64 << 20
+
+	// maxRecordSize guards replay against a corrupt length prefix
+	maxRecordSize = 256 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrClosed is returned by Append after Close
+var ErrClosed = errors.New("wal: closed")
+
+// Options configures a WAL
+type Options struct {
+	Dir string
+	// SegmentSize is the size at which the current segment is sealed and a
+	// new one started
+	SegmentSize int64
+	// Compress gzips sealed segments in the background
+	Compress bool
+	// Sync fsyncs the segment after every append
+	Sync bool
+}
+
+// WAL is a segmented write-ahead log, safe for concurrent use
+type WAL struct {
+	opts Options
+
+	mu       sync.Mutex
+	cur      *os.File
+	curIndex uint64
+	curSize  int64
+	sizes    map[uint64]int64 // bytes on disk per segment, including cur
+	replay   []uint64         // segments found at Open, oldest first
+	closed   bool
+
+	compressWg sync.WaitGroup
+}
+
+// Open opens the WAL in opts.Dir, creating it if needed. Segments left by a
+// previous run are kept for Replay and a fresh segment is started for new
+// records.
+func Open(opts Options) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	registerMetrics()
+
+	w := &WAL{opts: opts, sizes: make(map[uint64]int64)}
+	segments, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	w.replay = segments
+
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	w.updateMetrics()
+	return w, nil
+}
+
+// scan lists the existing segments, removing leftovers of interrupted
+// compressions. Where both a plain and a compressed copy exist the plain
+// one is complete and wins.
+func (w *WAL) scan() ([]uint64, error) {
+	entries, err := os.ReadDir(w.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[uint64]bool)
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(w.opts.Dir, name)
+		if strings.HasSuffix(name, tmpExt) {
+			os.Remove(path)
+			continue
+		}
+		index, ok := parseSegmentName(name)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(name, compressedExt) {
+			if _, err := os.Stat(w.segmentPath(index, false)); err == nil {
+				os.Remove(path)
+				continue
+			}
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		seen[index] = true
+		w.sizes[index] = info.Size()
+	}
+
+	segments := make([]uint64, 0, len(seen))
+	for index := range seen {
+		segments = append(segments, index)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), segmentExt)
+	if base == name || len(base) == 0 {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(base, 10, 64)
+	return index, err == nil
+}
+
+func (w *WAL) segmentPath(index uint64, compressed bool) string {
+	ext := segmentExt
+	if compressed {
+		ext = compressedExt
+	}
+	return filepath.Join(w.opts.Dir, fmt.Sprintf("%016d%s", index, ext))
+}
+
+// openSegment starts a new current segment. Callers hold w.mu or own w.
+func (w *WAL) openSegment(index uint64) error {
+	f, err := os.OpenFile(w.segmentPath(index, false), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.cur = f
+	w.curIndex = index
+	w.curSize = 0
+	w.sizes[index] = 0
+	return nil
+}
+
+// Append writes a record and returns the segment it landed in. The caller
+// passes that segment to Checkpoint once the record is durable elsewhere.
+func (w *WAL) Append(record []byte) (uint64, error) {
+	frame := make([]byte, frameHeaderSize+len(record))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(record, crcTable))
+	copy(frame[frameHeaderSize:], record)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.curSize > 0 && w.curSize+int64(len(frame)) > w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := w.cur.Write(frame); err != nil {
+		return 0, err
+	}
+	if w.opts.Sync {
+		if err := w.cur.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	w.curSize += int64(len(frame))
+	w.sizes[w.curIndex] = w.curSize
+	w.updateMetrics()
+	return w.curIndex, nil
+}
+
+// rotate seals the current segment and starts the next. Callers hold w.mu.
+func (w *WAL) rotate() error {
+	if err := w.cur.Sync(); err != nil {
+		return err
+	}
+	if err := w.cur.Close(); err != nil {
+		return err
+	}
+	sealed := w.curIndex
+	if err := w.openSegment(sealed + 1); err != nil {
+		return err
+	}
+	walRotations.Inc()
+
+	if w.opts.Compress {
+		w.compressWg.Add(1)
+		go w.compress(sealed)
+	}
+	return nil
+}
+
+// compress gzips a sealed segment. The plain file is only removed once the
+// compressed copy is complete, so a crash leaves one readable version.
+func (w *WAL) compress(index uint64) {
+	defer w.compressWg.Done()
+
+	src := w.segmentPath(index, false)
+	dst := w.segmentPath(index, true)
+	tmp := dst + tmpExt
+	if err := gzipFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		if errors.Is(err, fs.ErrNotExist) {
+			return // checkpointed before compression started
+		}
+		log.Printf("[WAL] Failed to compress segment %d: %v", index, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The segment may have been checkpointed away meanwhile
+	if _, ok := w.sizes[index]; !ok {
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		log.Printf("[WAL] Failed to compress segment %d: %v", index, err)
+		return
+	}
+	os.Remove(src)
+	if info, err := os.Stat(dst); err == nil {
+		w.sizes[index] = info.Size()
+	}
+	w.updateMetrics()
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Segment returns the index of the segment currently appended to
+func (w *WAL) Segment() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.curIndex
+}
+
+// Checkpoint deletes every sealed segment older than segment, i.e. whose
+// records are all durable elsewhere. The current segment is never deleted.
+func (w *WAL) Checkpoint(segment uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var firstErr error
+	for index := range w.sizes {
+		if index >= segment || index == w.curIndex {
+			continue
+		}
+		for _, compressed := range []bool{false, true} {
+			if err := os.Remove(w.segmentPath(index, compressed)); err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(w.sizes, index)
+	}
+	w.updateMetrics()
+	return firstErr
+}
+
+// Replay calls fn for every record of the segments that existed when the
+// WAL was opened, oldest first. A torn or corrupt record ends the replay of
+// its segment, since nothing after it can be trusted.
+func (w *WAL) Replay(fn func(record []byte) error) (int, error) {
+	w.mu.Lock()
+	segments := make([]uint64, 0, len(w.replay))
+	for _, index := range w.replay {
+		if _, ok := w.sizes[index]; ok {
+			segments = append(segments, index)
+		}
+	}
+	w.mu.Unlock()
+
+	total := 0
+	for _, index := range segments {
+		n, err := w.replaySegment(index, fn)
+		total += n
+		walReplayedRecords.Add(float64(n))
+		walReplayedSegments.Inc()
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (w *WAL) replaySegment(index uint64, fn func(record []byte) error) (int, error) {
+	var r io.Reader
+	f, err := os.Open(w.segmentPath(index, false))
+	if os.IsNotExist(err) {
+		f, err = os.Open(w.segmentPath(index, true))
+		if err != nil {
+			return 0, err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	} else if err != nil {
+		return 0, err
+	} else {
+		r = f
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(r)
+	header := make([]byte, frameHeaderSize)
+	n := 0
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err != io.EOF {
+				log.Printf("[WAL] Segment %d ends with a torn record header, stopping its replay", index)
+			}
+			return n, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			log.Printf("[WAL] Segment %d has a corrupt record length %d, stopping its replay", index, size)
+			return n, nil
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(br, record); err != nil {
+			log.Printf("[WAL] Segment %d ends with a torn record, stopping its replay", index)
+			return n, nil
+		}
+		if crc32.Checksum(record, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("[WAL] Segment %d has a record with a bad checksum, stopping its replay", index)
+			return n, nil
+		}
+		if err := fn(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Size returns the bytes on disk across all segments
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.totalSize()
+}
+
+func (w *WAL) totalSize() int64 {
+	var total int64
+	for _, size := range w.sizes {
+		total += size
+	}
+	return total
+}
+
+// updateMetrics publishes size and segment gauges. Callers hold w.mu.
+func (w *WAL) updateMetrics() {
+	walSizeBytes.Set(float64(w.totalSize()))
+	walSegments.Set(float64(len(w.sizes)))
+}
+
+// Close syncs and closes the current segment after pending compressions
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.cur.Sync()
+	if cerr := w.cur.Close(); err == nil {
+		err = cerr
+	}
+	w.mu.Unlock()
+
+	w.compressWg.Wait()
+	return err
+}